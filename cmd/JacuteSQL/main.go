@@ -17,6 +17,12 @@ func main() {
 
 	cfg := config.MustLoad()
 	log := logger.SetupPrettyLogger(cfg)
+	// the admin tool can't change files of the database while the server is running
+	lock, err := storage.LockDatabase(cfg.StoragePath, cfg.LoadedSchema.Name)
+	if err != nil {
+		panic(err)
+	}
+	defer lock.Close()
 	st := storage.New(cfg.StoragePath, cfg.LoadedSchema, log.Log)
 
 	log.Log.Info(
@@ -32,7 +38,7 @@ func main() {
 		slog.Int("port", cfg.Port),
 		slog.String("env", cfg.Env),
 	)
-	application := app.New(log.Log, st, cfg.ConnTL, cfg.Port)
+	application := app.New(log.Log, st, cfg.ConnTL, cfg.WriteTL, cfg.Port)
 	go application.MustRun()
 
 	stop := make(chan os.Signal, 1)
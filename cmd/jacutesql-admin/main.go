@@ -0,0 +1,173 @@
+package main
+
+import (
+	"JacuteSQL/internal/config"
+	"JacuteSQL/internal/storage"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+
+	"github.com/jacute/prettylogger"
+)
+
+const usage = `Usage: jacutesql-admin --config <config.yaml> [--rename-columns] <command>
+
+Works with the storage_path of the stopped server, the tool exits if the server holds the database.
+check, stats and migrate status don't change files, other commands replay the wal first.
+
+Commands:
+  check    find wrong headers of sheets, duplicate pks, pk sequences behind pks, stray and damaged files
+  repair   fix what check finds, damaged sheets are only reported, columns of sheets with unknown names
+           are renamed by position only with --rename-columns or consistency.rename_columns
+  stats    print rows, sheets and size of each table
+  compact  pack sheets of all tables like VACUUM
+  migrate up [version]    apply pending migrations up to the version, all by default
+  migrate down <version>  revert applied migrations above the version
+  migrate status          print migrations and whether they are applied
+`
+
+func main() {
+	renameColumns := flag.Bool("rename-columns", false, "rename columns of sheets by position on repair")
+	cfg := config.MustLoad()
+	command := flag.Arg(0)
+	if command == "" {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	// the output of commands is written to stdout, so warnings are written to stderr
+	log := slog.New(
+		prettylogger.NewColoredHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelWarn}),
+	)
+	// problems are found and repaired by the command, not at startup
+	cfg.LoadedSchema.Consistency.Policy = storage.ConsistencyOff
+	// migrations are applied only by the migrate command
+	cfg.LoadedSchema.Migrations.Auto = false
+	if *renameColumns {
+		cfg.LoadedSchema.Consistency.RenameColumns = true
+	}
+	// the lock is released when the tool exits
+	lock, err := storage.LockDatabase(cfg.StoragePath, cfg.LoadedSchema.Name)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error: "+err.Error())
+		os.Exit(1)
+	}
+	defer lock.Close()
+
+	st := storage.New(cfg.StoragePath, cfg.LoadedSchema, log)
+	if readOnly(command, flag.Args()[1:]) {
+		err = st.OpenReadOnly()
+	} else {
+		st.Create()
+	}
+	if err == nil {
+		err = run(st, command, flag.Args()[1:])
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error: "+err.Error())
+		os.Exit(1)
+	}
+}
+
+// readOnly reports whether the command only reads files of the database
+func readOnly(command string, args []string) bool {
+	switch command {
+	case "check", "stats":
+		return true
+	case "migrate":
+		return len(args) > 0 && args[0] == "status"
+	}
+	return false
+}
+
+// run executes the command, the error is returned if check finds problems
+func run(st *storage.Storage, command string, args []string) error {
+	switch command {
+	case "check", "repair":
+		problems, err := st.Inspect(command == "repair")
+		if err != nil {
+			return err
+		}
+		fmt.Println("table,file,kind,status,detail")
+		unrepaired := 0
+		for _, problem := range problems {
+			fmt.Println(problem.String())
+			if !problem.Repaired {
+				unrepaired++
+			}
+		}
+		if unrepaired > 0 {
+			return fmt.Errorf("problems aren't repaired: %d", unrepaired)
+		}
+	case "stats":
+		stats, err := st.Stats()
+		if err != nil {
+			return err
+		}
+		fmt.Println("table,engine,rows,sheets,bytes,next_pk")
+		for _, table := range stats {
+			fmt.Printf("%s,%s,%d,%d,%d,%d\n", table.Table, table.Engine, table.Rows, table.Sheets, table.Bytes, table.NextPk)
+		}
+	case "compact":
+		output, err := st.VacuumTables("")
+		if err != nil {
+			return err
+		}
+		fmt.Print(output)
+	case "migrate":
+		return migrate(st, args)
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		return fmt.Errorf("unknown command %s", command)
+	}
+	return nil
+}
+
+// migrate executes migrate up, down or status, the database is restored if a migration fails
+func migrate(st *storage.Storage, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("migrate needs up, down or status")
+	}
+	switch args[0] {
+	case "status":
+		migrations, err := st.LoadMigrations()
+		if err != nil {
+			return err
+		}
+		fmt.Println("version,name,status")
+		for _, migration := range migrations {
+			status := "pending"
+			if migration.Applied {
+				status = "applied"
+			}
+			fmt.Printf("%d,%s,%s\n", migration.Version, migration.Name, status)
+		}
+		return nil
+	case storage.MigrationUp, storage.MigrationDown:
+		var target int
+		var err error
+		if len(args) > 1 {
+			target, err = strconv.Atoi(args[1])
+			if err != nil {
+				return fmt.Errorf("invalid version %s", args[1])
+			}
+		} else if args[0] == storage.MigrationUp {
+			target, err = st.LatestMigration()
+			if err != nil {
+				return err
+			}
+		} else {
+			return fmt.Errorf("migrate down needs a version")
+		}
+		output, err := st.Migrate(args[0], target)
+		if err != nil {
+			return err
+		}
+		fmt.Print(output)
+		return nil
+	default:
+		return fmt.Errorf("unknown migrate command %s", args[0])
+	}
+}
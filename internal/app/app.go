@@ -2,7 +2,9 @@ package app
 
 import (
 	"JacuteSQL/internal/storage"
+	"bufio"
 	"fmt"
+	"io"
 	"log/slog"
 	"net"
 	"sync"
@@ -11,11 +13,16 @@ import (
 	"github.com/jacute/prettylogger"
 )
 
+// inputBufferSize is the max size of the script received from the client at once
+const inputBufferSize = 64 * 1024
+
 type App struct {
 	log     *slog.Logger
 	storage *storage.Storage
 	port    int
 	connTL  time.Duration
+	// writeTL limits each write to the client, tables read by SELECT are locked while rows are written
+	writeTL time.Duration
 	ln      net.Listener
 }
 
@@ -23,12 +30,14 @@ func New(
 	log *slog.Logger,
 	storage *storage.Storage,
 	connTL time.Duration,
+	writeTL time.Duration,
 	port int,
 ) *App {
 	return &App{
 		log:     log,
 		storage: storage,
 		connTL:  connTL,
+		writeTL: writeTL,
 		port:    port,
 	}
 }
@@ -89,9 +98,21 @@ func (a *App) handleConnection(conn net.Conn, wg *sync.WaitGroup) error {
 
 	const op = "app.handleConnection"
 
-	inputBuffer := make([]byte, 1024)
+	session := a.storage.NewSession()
+	inputBuffer := make([]byte, inputBufferSize)
+	output := bufio.NewWriter(&deadlineWriter{conn: conn, timeout: a.writeTL})
 	for {
-		conn.Write([]byte(">> "))
+		output.WriteString(">> ")
+		if err := output.Flush(); err != nil {
+			// the client doesn't read the output, the statement is already stopped by the error
+			a.log.Info(
+				"connection close",
+				slog.String("op", op),
+				prettylogger.Err(err),
+				slog.String("addr", conn.RemoteAddr().String()),
+			)
+			return fmt.Errorf("%s: %w", op, err)
+		}
 
 		n, err := conn.Read(inputBuffer)
 		if err != nil {
@@ -114,16 +135,71 @@ func (a *App) handleConnection(conn net.Conn, wg *sync.WaitGroup) error {
 			break
 		}
 
-		cmdOutput, err := a.storage.Exec(received)
-		if err != nil {
-			conn.Write([]byte(err.Error() + "\n"))
-			continue
-		}
-		conn.Write([]byte("command executed successfully\n"))
-		if cmdOutput != "" {
-			conn.Write([]byte("output:\n" + cmdOutput + "\n"))
+		// rows are written to the connection while they are read, so the result isn't kept in memory
+		var result *resultWriter
+		err = session.ExecScriptTo(received, func(i int, count int) io.Writer {
+			if result != nil {
+				result.finish()
+			}
+			result = &resultWriter{output: output}
+			// several statements are numbered to show which result belongs to which statement
+			if count > 1 {
+				result.prefix = fmt.Sprintf("[%d] ", i+1)
+			}
+			return result
+		})
+		if err == nil {
+			result.finish()
+		} else {
+			if result != nil && result.started {
+				output.WriteString("\n")
+			}
+			output.WriteString(err.Error() + "\n")
 		}
 	}
 
 	return nil
 }
+
+// deadlineWriter writes to the connection with the deadline for each write, so a client which doesn't read
+// stops the statement by the error instead of holding locks of its tables
+type deadlineWriter struct {
+	conn    net.Conn
+	timeout time.Duration
+}
+
+func (w *deadlineWriter) Write(p []byte) (int, error) {
+	if w.timeout > 0 {
+		w.conn.SetWriteDeadline(time.Now().Add(w.timeout))
+	}
+	return w.conn.Write(p)
+}
+
+// resultWriter writes the output of the statement to the client after the success line
+//
+// The success line is written before the first byte of the output or by finish if the statement has no output.
+type resultWriter struct {
+	output  *bufio.Writer
+	prefix  string
+	started bool
+}
+
+func (w *resultWriter) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if !w.started {
+		w.started = true
+		w.output.WriteString(w.prefix + "command executed successfully\noutput:\n")
+	}
+	return w.output.Write(p)
+}
+
+// finish completes the output of the successful statement
+func (w *resultWriter) finish() {
+	if w.started {
+		w.output.WriteString("\n")
+		return
+	}
+	w.output.WriteString(w.prefix + "command executed successfully\n")
+}
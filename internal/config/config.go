@@ -11,9 +11,79 @@ import (
 )
 
 type Schema struct {
-	Name        string           `json:"name"`
-	TuplesLimit int              `json:"tuples_limit"`
-	Tables      *mymap.CustomMap `json:"structure"`
+	Name        string            `json:"name"`
+	TuplesLimit int               `json:"tuples_limit"`
+	Tables      *mymap.CustomMap  `json:"structure"`
+	Constraints []Constraint      `json:"constraints,omitempty"`
+	WAL         WALConfig         `json:"wal"`
+	Cache       CacheConfig       `json:"cache"`
+	Vacuum      VacuumConfig      `json:"vacuum"`
+	Consistency ConsistencyConfig `json:"consistency"`
+	Migrations  MigrationsConfig  `json:"migrations"`
+	// Engines are engines of tables, e.g. {"cache": "memory"}, tables are stored in csv sheets by default
+	Engines map[string]string `json:"engines,omitempty"`
+}
+
+// WALConfig sets up the write-ahead log of the database
+//
+// Sync is "always" (fsync after each record, by default), "interval" (fsync at most once per SyncInterval ms) or "off".
+// The log is truncated after CheckpointSize bytes when no statement is being applied.
+type WALConfig struct {
+	Sync           string `json:"sync,omitempty"`
+	SyncInterval   int    `json:"sync_interval_ms,omitempty"`
+	CheckpointSize int64  `json:"checkpoint_size,omitempty"`
+}
+
+// CacheConfig sets up the cache of parsed sheets shared by all connections
+//
+// Sheets is the maximum number of cached sheets and pages, 64 by default, a negative number turns the cache off.
+type CacheConfig struct {
+	Sheets int `json:"sheets,omitempty"`
+}
+
+// VacuumConfig sets up automatic compaction of tables
+//
+// A table is compacted in the background after UPDATE or DELETE if VACUUM frees at least Threshold of its sheets,
+// e.g. 0.5 is a half of sheets. The automatic compaction is off if Threshold is 0.
+type VacuumConfig struct {
+	Threshold float64 `json:"threshold,omitempty"`
+}
+
+// ConsistencyConfig sets up the check of files of tables at startup
+//
+// Policy is "report" (by default: problems are logged and files aren't changed), "repair" (problems are fixed and
+// the storage starts), "refuse" (the storage doesn't start if a problem is found) or "off". Problems which can't be
+// repaired, e.g. damaged sheets, are only reported. Columns of a sheet with unknown names are renamed by position
+// only if RenameColumns is set.
+type ConsistencyConfig struct {
+	Policy        string `json:"policy,omitempty"`
+	RenameColumns bool   `json:"rename_columns,omitempty"`
+}
+
+// MigrationsConfig sets up schema migrations
+//
+// Path is the directory with scripts <version>_<name>.up.sql and <version>_<name>.down.sql. Pending migrations
+// are applied at startup if Auto is set.
+type MigrationsConfig struct {
+	Path string `json:"path,omitempty"`
+	Auto bool   `json:"auto,omitempty"`
+}
+
+// Constraint is a table constraint, e.g. {"table": "user", "type": "UNIQUE", "columns": ["username"]}
+//
+// FOREIGN KEY also has the referenced table, its columns and the action on delete of referenced rows.
+// DEFAULT has the expression of the value, CHECK has the condition, GENERATED has the expression of the column.
+type Constraint struct {
+	Name       string   `json:"name,omitempty"`
+	Table      string   `json:"table"`
+	Type       string   `json:"type"`
+	Columns    []string `json:"columns,omitempty"`
+	References string   `json:"references,omitempty"`
+	RefColumns []string `json:"ref_columns,omitempty"`
+	OnDelete   string   `json:"on_delete,omitempty"`
+	Default    string   `json:"default,omitempty"`
+	Check      string   `json:"check,omitempty"`
+	Expression string   `json:"expression,omitempty"`
 }
 
 type Config struct {
@@ -23,6 +93,7 @@ type Config struct {
 	LogPath      string        `yaml:"log_path" env-required:"true"`
 	Port         int           `yaml:"port" env-default:"7432"`
 	ConnTL       time.Duration `yaml:"connTL" env-default:"0s"`
+	WriteTL      time.Duration `yaml:"writeTL" env-default:"30s"`
 	LoadedSchema *Schema
 }
 
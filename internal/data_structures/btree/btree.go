@@ -0,0 +1,522 @@
+package btree
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+)
+
+var (
+	DefaultOrder = 32
+)
+
+var (
+	ErrKeyNotFound  = errors.New("key not found")
+	ErrUnsortedKeys = errors.New("keys are not sorted or not unique")
+	ErrNoCompare    = errors.New("tree has no compare function")
+)
+
+// BTree is a custom realisation of B+tree, keys are kept in order of the compare function
+//
+// Values are stored only in leaves, leaves are linked to iterate keys in both directions.
+type BTree[K any, V any] struct {
+	root    *node[K, V]
+	length  int
+	compare func(a, b K) int
+	// Maximum number of children of the internal node, the leaf has at most order-1 keys
+	order int
+}
+
+type node[K any, V any] struct {
+	leaf     bool
+	keys     []K
+	values   []V
+	children []*node[K, V]
+	// neighbour leaves
+	prev *node[K, V]
+	next *node[K, V]
+}
+
+// Iterator points to the key of the tree, it's moved by Next and Prev
+//
+// The iterator is invalid after the tree is changed.
+type Iterator[K any, V any] struct {
+	leaf *node[K, V]
+	pos  int
+}
+
+// item is the key-value pair of the tree in json
+type item[K any, V any] struct {
+	Key   K `json:"key"`
+	Value V `json:"value"`
+}
+
+// New creates a new BTree, compare returns a negative number if a < b, zero if a == b and a positive number if a > b
+//
+// New(compare, order int)
+//
+// default order = 32, minimal order = 3.
+func New[K any, V any](compare func(a, b K) int, params ...int) *BTree[K, V] {
+	order := DefaultOrder
+	if len(params) > 0 {
+		order = max(params[0], 3)
+	}
+	return &BTree[K, V]{
+		root:    &node[K, V]{leaf: true},
+		compare: compare,
+		order:   order,
+	}
+}
+
+// Len returns the number of keys in the BTree
+func (t *BTree[K, V]) Len() int {
+	return t.length
+}
+
+// Height returns the number of levels of the BTree
+func (t *BTree[K, V]) Height() int {
+	height := 1
+	for n := t.root; !n.leaf; n = n.children[0] {
+		height++
+	}
+	return height
+}
+
+// Get returns the value of the key
+func (t *BTree[K, V]) Get(key K) (V, bool) {
+	leaf := t.findLeaf(key)
+	pos, found := t.search(leaf.keys, key)
+	if !found {
+		var zero V
+		return zero, false
+	}
+	return leaf.values[pos], true
+}
+
+// Put adds the key with the value or replaces the value of the existing key
+func (t *BTree[K, V]) Put(key K, value V) {
+	separator, right := t.put(t.root, key, value)
+	if right != nil {
+		t.root = &node[K, V]{
+			keys:     []K{separator},
+			children: []*node[K, V]{t.root, right},
+		}
+	}
+}
+
+// Delete removes the key from the BTree
+func (t *BTree[K, V]) Delete(key K) error {
+	if !t.delete(t.root, key) {
+		return ErrKeyNotFound
+	}
+	if !t.root.leaf && len(t.root.keys) == 0 {
+		t.root = t.root.children[0]
+	}
+	return nil
+}
+
+// Clear removes all keys
+func (t *BTree[K, V]) Clear() {
+	t.root = &node[K, V]{leaf: true}
+	t.length = 0
+}
+
+// BulkLoad replaces keys of the BTree by sorted unique keys, nodes are built from leaves to the root
+func (t *BTree[K, V]) BulkLoad(keys []K, values []V) error {
+	if t.compare == nil {
+		return ErrNoCompare
+	}
+	if len(keys) != len(values) {
+		return fmt.Errorf("%d keys and %d values", len(keys), len(values))
+	}
+	for i := 1; i < len(keys); i++ {
+		if t.compare(keys[i-1], keys[i]) >= 0 {
+			return ErrUnsortedKeys
+		}
+	}
+	if len(keys) == 0 {
+		t.Clear()
+		return nil
+	}
+
+	// level of nodes with their smallest keys
+	level := make([]*node[K, V], 0)
+	firstKeys := make([]K, 0)
+	start := 0
+	var prev *node[K, V]
+	for _, size := range chunkSizes(len(keys), t.order-1) {
+		leaf := &node[K, V]{
+			leaf:   true,
+			keys:   append([]K(nil), keys[start:start+size]...),
+			values: append([]V(nil), values[start:start+size]...),
+			prev:   prev,
+		}
+		if prev != nil {
+			prev.next = leaf
+		}
+		prev = leaf
+		level = append(level, leaf)
+		firstKeys = append(firstKeys, keys[start])
+		start += size
+	}
+	for len(level) > 1 {
+		parents := make([]*node[K, V], 0)
+		parentKeys := make([]K, 0)
+		start := 0
+		for _, size := range chunkSizes(len(level), t.order) {
+			parent := &node[K, V]{
+				keys:     append([]K(nil), firstKeys[start+1:start+size]...),
+				children: append([]*node[K, V](nil), level[start:start+size]...),
+			}
+			parents = append(parents, parent)
+			parentKeys = append(parentKeys, firstKeys[start])
+			start += size
+		}
+		level, firstKeys = parents, parentKeys
+	}
+	t.root = level[0]
+	t.length = len(keys)
+	return nil
+}
+
+// First returns the iterator at the smallest key
+func (t *BTree[K, V]) First() *Iterator[K, V] {
+	n := t.root
+	for !n.leaf {
+		n = n.children[0]
+	}
+	return newIterator(n, 0)
+}
+
+// Last returns the iterator at the largest key
+func (t *BTree[K, V]) Last() *Iterator[K, V] {
+	n := t.root
+	for !n.leaf {
+		n = n.children[len(n.children)-1]
+	}
+	it := &Iterator[K, V]{leaf: n, pos: len(n.keys) - 1}
+	if it.pos < 0 {
+		it.leaf = nil
+	}
+	return it
+}
+
+// Seek returns the iterator at the smallest key which is greater than or equal to the key
+func (t *BTree[K, V]) Seek(key K) *Iterator[K, V] {
+	return t.Search(func(k K) bool {
+		return t.compare(k, key) >= 0
+	})
+}
+
+// Search returns the iterator at the smallest key for which fn is true
+//
+// fn must be false for keys before some key and true for it and all keys after it, like in sort.Search.
+func (t *BTree[K, V]) Search(fn func(key K) bool) *Iterator[K, V] {
+	n := t.root
+	for !n.leaf {
+		n = n.children[sort.Search(len(n.keys), func(i int) bool { return fn(n.keys[i]) })]
+	}
+	return newIterator(n, sort.Search(len(n.keys), func(i int) bool { return fn(n.keys[i]) }))
+}
+
+// Ascend calls fn for keys from the smallest one which is greater than or equal to from, until fn returns false
+func (t *BTree[K, V]) Ascend(from K, fn func(key K, value V) bool) {
+	for it := t.Seek(from); it.Valid(); it.Next() {
+		if !fn(it.Key(), it.Value()) {
+			return
+		}
+	}
+}
+
+// Keys returns all keys in order
+func (t *BTree[K, V]) Keys() []K {
+	keys := make([]K, 0, t.length)
+	for it := t.First(); it.Valid(); it.Next() {
+		keys = append(keys, it.Key())
+	}
+	return keys
+}
+
+// MarshalJSON writes keys and values in order, so they are read back by bulk load
+func (t *BTree[K, V]) MarshalJSON() ([]byte, error) {
+	items := make([]item[K, V], 0, t.length)
+	for it := t.First(); it.Valid(); it.Next() {
+		items = append(items, item[K, V]{Key: it.Key(), Value: it.Value()})
+	}
+	return json.Marshal(items)
+}
+
+// UnmarshalJSON replaces keys of the tree created by New with keys from json
+func (t *BTree[K, V]) UnmarshalJSON(data []byte) error {
+	var items []item[K, V]
+	if err := json.Unmarshal(data, &items); err != nil {
+		return err
+	}
+	keys := make([]K, len(items))
+	values := make([]V, len(items))
+	for i, item := range items {
+		keys[i], values[i] = item.Key, item.Value
+	}
+	return t.BulkLoad(keys, values)
+}
+
+// WriteTo writes the tree to w in json
+func (t *BTree[K, V]) WriteTo(w io.Writer) (int64, error) {
+	data, err := t.MarshalJSON()
+	if err != nil {
+		return 0, err
+	}
+	n, err := w.Write(data)
+	return int64(n), err
+}
+
+// ReadFrom replaces keys of the tree by keys written by WriteTo
+func (t *BTree[K, V]) ReadFrom(r io.Reader) (int64, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return int64(len(data)), err
+	}
+	return int64(len(data)), t.UnmarshalJSON(data)
+}
+
+func (t *BTree[K, V]) String() string {
+	output := "["
+	for it := t.First(); it.Valid(); it.Next() {
+		if output != "[" {
+			output += " "
+		}
+		output += fmt.Sprintf("%v:%v", it.Key(), it.Value())
+	}
+	output += "]"
+	return output
+}
+
+// Valid checks that the iterator points to a key
+func (it *Iterator[K, V]) Valid() bool {
+	return it.leaf != nil
+}
+
+// Key returns the key of the iterator
+func (it *Iterator[K, V]) Key() K {
+	return it.leaf.keys[it.pos]
+}
+
+// Value returns the value of the key of the iterator
+func (it *Iterator[K, V]) Value() V {
+	return it.leaf.values[it.pos]
+}
+
+// Next moves the iterator to the next key, the iterator is invalid after the largest key
+func (it *Iterator[K, V]) Next() {
+	it.pos++
+	for it.leaf != nil && it.pos >= len(it.leaf.keys) {
+		it.leaf = it.leaf.next
+		it.pos = 0
+	}
+}
+
+// Prev moves the iterator to the previous key, the iterator is invalid before the smallest key
+func (it *Iterator[K, V]) Prev() {
+	it.pos--
+	for it.leaf != nil && it.pos < 0 {
+		it.leaf = it.leaf.prev
+		if it.leaf != nil {
+			it.pos = len(it.leaf.keys) - 1
+		}
+	}
+}
+
+// newIterator returns the iterator at the position of the leaf or at the next key if the position is after the last key
+func newIterator[K any, V any](leaf *node[K, V], pos int) *Iterator[K, V] {
+	it := &Iterator[K, V]{leaf: leaf, pos: pos - 1}
+	it.Next()
+	return it
+}
+
+// search returns the position of the key in sorted keys, or the position to insert it
+func (t *BTree[K, V]) search(keys []K, key K) (int, bool) {
+	pos := sort.Search(len(keys), func(i int) bool { return t.compare(keys[i], key) >= 0 })
+	return pos, pos < len(keys) && t.compare(keys[pos], key) == 0
+}
+
+// childIndex returns the child of the internal node which can contain the key, keys equal to the separator are in the right child
+func (t *BTree[K, V]) childIndex(n *node[K, V], key K) int {
+	return sort.Search(len(n.keys), func(i int) bool { return t.compare(n.keys[i], key) > 0 })
+}
+
+func (t *BTree[K, V]) findLeaf(key K) *node[K, V] {
+	n := t.root
+	for !n.leaf {
+		n = n.children[t.childIndex(n, key)]
+	}
+	return n
+}
+
+// put adds the key to the subtree, returns the separator and the new right node if the node is split
+func (t *BTree[K, V]) put(n *node[K, V], key K, value V) (K, *node[K, V]) {
+	var separator K
+	if n.leaf {
+		pos, found := t.search(n.keys, key)
+		if found {
+			n.values[pos] = value
+			return separator, nil
+		}
+		n.keys = insertAt(n.keys, pos, key)
+		n.values = insertAt(n.values, pos, value)
+		t.length++
+		if len(n.keys) < t.order {
+			return separator, nil
+		}
+		mid := len(n.keys) / 2
+		right := &node[K, V]{
+			leaf:   true,
+			keys:   append([]K(nil), n.keys[mid:]...),
+			values: append([]V(nil), n.values[mid:]...),
+			prev:   n,
+			next:   n.next,
+		}
+		if n.next != nil {
+			n.next.prev = right
+		}
+		n.next = right
+		n.keys = n.keys[:mid:mid]
+		n.values = n.values[:mid:mid]
+		return right.keys[0], right
+	}
+
+	i := t.childIndex(n, key)
+	childSeparator, child := t.put(n.children[i], key, value)
+	if child == nil {
+		return separator, nil
+	}
+	n.keys = insertAt(n.keys, i, childSeparator)
+	n.children = insertAt(n.children, i+1, child)
+	if len(n.children) <= t.order {
+		return separator, nil
+	}
+	mid := len(n.keys) / 2
+	separator = n.keys[mid]
+	right := &node[K, V]{
+		keys:     append([]K(nil), n.keys[mid+1:]...),
+		children: append([]*node[K, V](nil), n.children[mid+1:]...),
+	}
+	n.keys = n.keys[:mid:mid]
+	n.children = n.children[: mid+1 : mid+1]
+	return separator, right
+}
+
+// delete removes the key from the subtree and rebalances children with too few keys
+func (t *BTree[K, V]) delete(n *node[K, V], key K) bool {
+	if n.leaf {
+		pos, found := t.search(n.keys, key)
+		if !found {
+			return false
+		}
+		n.keys = removeAt(n.keys, pos)
+		n.values = removeAt(n.values, pos)
+		t.length--
+		return true
+	}
+
+	i := t.childIndex(n, key)
+	if !t.delete(n.children[i], key) {
+		return false
+	}
+	if len(n.children[i].keys) < t.minKeys() {
+		t.rebalance(n, i)
+	}
+	return true
+}
+
+// minKeys returns the minimal number of keys of the node except the root
+func (t *BTree[K, V]) minKeys() int {
+	return (t.order - 1) / 2
+}
+
+// rebalance takes a key from a sibling of the child or merges the child with it
+func (t *BTree[K, V]) rebalance(parent *node[K, V], i int) {
+	child := parent.children[i]
+	if i > 0 && len(parent.children[i-1].keys) > t.minKeys() {
+		left := parent.children[i-1]
+		last := len(left.keys) - 1
+		if child.leaf {
+			child.keys = insertAt(child.keys, 0, left.keys[last])
+			child.values = insertAt(child.values, 0, left.values[last])
+			left.values = left.values[:last]
+			parent.keys[i-1] = child.keys[0]
+		} else {
+			child.keys = insertAt(child.keys, 0, parent.keys[i-1])
+			child.children = insertAt(child.children, 0, left.children[last+1])
+			left.children = left.children[:last+1]
+			parent.keys[i-1] = left.keys[last]
+		}
+		left.keys = left.keys[:last]
+		return
+	}
+	if i < len(parent.children)-1 && len(parent.children[i+1].keys) > t.minKeys() {
+		right := parent.children[i+1]
+		if child.leaf {
+			child.keys = append(child.keys, right.keys[0])
+			child.values = append(child.values, right.values[0])
+			right.values = removeAt(right.values, 0)
+			right.keys = removeAt(right.keys, 0)
+			parent.keys[i] = right.keys[0]
+		} else {
+			child.keys = append(child.keys, parent.keys[i])
+			child.children = append(child.children, right.children[0])
+			parent.keys[i] = right.keys[0]
+			right.keys = removeAt(right.keys, 0)
+			right.children = removeAt(right.children, 0)
+		}
+		return
+	}
+
+	// merge the child with its sibling, the right node of the pair is removed
+	if i == len(parent.children)-1 {
+		i--
+	}
+	left, right := parent.children[i], parent.children[i+1]
+	if left.leaf {
+		left.keys = append(left.keys, right.keys...)
+		left.values = append(left.values, right.values...)
+		left.next = right.next
+		if right.next != nil {
+			right.next.prev = left
+		}
+	} else {
+		left.keys = append(append(left.keys, parent.keys[i]), right.keys...)
+		left.children = append(left.children, right.children...)
+	}
+	parent.keys = removeAt(parent.keys, i)
+	parent.children = removeAt(parent.children, i+1)
+}
+
+// chunkSizes splits n items into the least number of chunks with at most size items, chunks differ by one item at most
+func chunkSizes(n int, size int) []int {
+	count := (n + size - 1) / size
+	sizes := make([]int, count)
+	for i := range sizes {
+		sizes[i] = n / count
+		if i < n%count {
+			sizes[i]++
+		}
+	}
+	return sizes
+}
+
+func insertAt[T any](items []T, i int, item T) []T {
+	var zero T
+	items = append(items, zero)
+	copy(items[i+1:], items[i:])
+	items[i] = item
+	return items
+}
+
+func removeAt[T any](items []T, i int) []T {
+	copy(items[i:], items[i+1:])
+	var zero T
+	items[len(items)-1] = zero
+	return items[:len(items)-1]
+}
@@ -0,0 +1,246 @@
+package btree
+
+import (
+	"bytes"
+	"cmp"
+	"math/rand"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBTreeHappyPath(t *testing.T) {
+	tree := New[int, string](cmp.Compare[int], 4)
+
+	for _, key := range []int{5, 1, 9, 3, 7, 2, 8, 4, 6} {
+		tree.Put(key, strings.Repeat("v", key))
+	}
+	tree.Put(3, "three")
+
+	assert.Equal(t, 9, tree.Len())
+	assert.Equal(t, []int{1, 2, 3, 4, 5, 6, 7, 8, 9}, tree.Keys())
+	assert.Greater(t, tree.Height(), 1)
+
+	value, ok := tree.Get(3)
+	assert.True(t, ok)
+	assert.Equal(t, "three", value)
+	value, ok = tree.Get(9)
+	assert.True(t, ok)
+	assert.Equal(t, "vvvvvvvvv", value)
+	_, ok = tree.Get(10)
+	assert.False(t, ok)
+	checkTree(t, tree)
+}
+
+func TestBTreeDelete(t *testing.T) {
+	tree := New[int, int](cmp.Compare[int], 3)
+	for i := 0; i < 100; i++ {
+		tree.Put(i, i*10)
+	}
+
+	for i := 0; i < 100; i += 2 {
+		assert.Nil(t, tree.Delete(i))
+		checkTree(t, tree)
+	}
+	assert.ErrorIs(t, tree.Delete(0), ErrKeyNotFound)
+	assert.Equal(t, 50, tree.Len())
+	_, ok := tree.Get(10)
+	assert.False(t, ok)
+	value, ok := tree.Get(11)
+	assert.True(t, ok)
+	assert.Equal(t, 110, value)
+
+	for i := 1; i < 100; i += 2 {
+		assert.Nil(t, tree.Delete(i))
+	}
+	assert.Equal(t, 0, tree.Len())
+	assert.Equal(t, 1, tree.Height())
+	assert.False(t, tree.First().Valid())
+	assert.False(t, tree.Last().Valid())
+}
+
+func TestBTreeIterators(t *testing.T) {
+	tree := New[int, int](cmp.Compare[int], 4)
+	for i := 0; i < 50; i += 5 {
+		tree.Put(i, i)
+	}
+
+	keys := make([]int, 0)
+	for it := tree.Seek(12); it.Valid() && it.Key() <= 30; it.Next() {
+		keys = append(keys, it.Key())
+	}
+	assert.Equal(t, []int{15, 20, 25, 30}, keys)
+
+	keys = keys[:0]
+	for it := tree.Last(); it.Valid(); it.Prev() {
+		keys = append(keys, it.Key())
+	}
+	assert.Equal(t, []int{45, 40, 35, 30, 25, 20, 15, 10, 5, 0}, keys)
+
+	keys = keys[:0]
+	tree.Ascend(20, func(key int, value int) bool {
+		keys = append(keys, key)
+		return key < 30
+	})
+	assert.Equal(t, []int{20, 25, 30}, keys)
+
+	it := tree.Search(func(key int) bool { return key*key > 1000 })
+	require.True(t, it.Valid())
+	assert.Equal(t, 35, it.Key())
+	assert.False(t, tree.Seek(46).Valid())
+	assert.Equal(t, 0, tree.Seek(-1).Key())
+}
+
+func TestBTreeBulkLoad(t *testing.T) {
+	cases := []struct {
+		TestName string
+		Count    int
+		Order    int
+	}{
+		{TestName: "Empty", Count: 0, Order: 4},
+		{TestName: "One leaf", Count: 3, Order: 4},
+		{TestName: "Two levels", Count: 10, Order: 4},
+		{TestName: "Many levels", Count: 1000, Order: 3},
+		{TestName: "Default order", Count: 5000, Order: DefaultOrder},
+	}
+
+	for _, c := range cases {
+		t.Run(c.TestName, func(tt *testing.T) {
+			keys := make([]int, c.Count)
+			values := make([]int, c.Count)
+			for i := range keys {
+				keys[i], values[i] = i*2, i
+			}
+			tree := New[int, int](cmp.Compare[int], c.Order)
+			tree.Put(-1, -1)
+			require.Nil(tt, tree.BulkLoad(keys, values))
+
+			assert.Equal(tt, c.Count, tree.Len())
+			assert.Equal(tt, keys, append([]int{}, tree.Keys()...))
+			checkTree(tt, tree)
+
+			// the loaded tree is changed as usual
+			tree.Put(3, 3)
+			if c.Count > 1 {
+				assert.Nil(tt, tree.Delete(2))
+			}
+			checkTree(tt, tree)
+		})
+	}
+
+	tree := New[int, int](cmp.Compare[int])
+	assert.ErrorIs(t, tree.BulkLoad([]int{1, 3, 2}, []int{1, 2, 3}), ErrUnsortedKeys)
+	assert.ErrorIs(t, tree.BulkLoad([]int{1, 1}, []int{1, 2}), ErrUnsortedKeys)
+	assert.Error(t, tree.BulkLoad([]int{1}, nil))
+}
+
+func TestBTreeJSON(t *testing.T) {
+	tree := New[string, []int](strings.Compare, 3)
+	tree.Put("b", []int{2})
+	tree.Put("a", []int{1, 1})
+	tree.Put("c", nil)
+
+	var buffer bytes.Buffer
+	_, err := tree.WriteTo(&buffer)
+	require.Nil(t, err)
+	assert.Equal(t, `[{"key":"a","value":[1,1]},{"key":"b","value":[2]},{"key":"c","value":null}]`, buffer.String())
+
+	loaded := New[string, []int](strings.Compare, 3)
+	_, err = loaded.ReadFrom(&buffer)
+	require.Nil(t, err)
+	assert.Equal(t, tree.String(), loaded.String())
+	assert.Equal(t, "[a:[1 1] b:[2] c:[]]", loaded.String())
+
+	_, err = New[string, int](nil).ReadFrom(strings.NewReader(`[{"key":"a","value":1}]`))
+	assert.ErrorIs(t, err, ErrNoCompare)
+}
+
+func TestBTreeRandom(t *testing.T) {
+	tree := New[int, int](cmp.Compare[int], 5)
+	expected := make(map[int]int)
+	random := rand.New(rand.NewSource(42))
+
+	for i := 0; i < 5000; i++ {
+		key := random.Intn(500)
+		if random.Intn(3) == 0 {
+			_, ok := expected[key]
+			err := tree.Delete(key)
+			if ok {
+				assert.Nil(t, err)
+			} else {
+				assert.ErrorIs(t, err, ErrKeyNotFound)
+			}
+			delete(expected, key)
+		} else {
+			tree.Put(key, i)
+			expected[key] = i
+		}
+	}
+	checkTree(t, tree)
+
+	keys := make([]int, 0, len(expected))
+	for key, value := range expected {
+		keys = append(keys, key)
+		got, ok := tree.Get(key)
+		assert.True(t, ok)
+		assert.Equal(t, value, got)
+	}
+	slices.Sort(keys)
+	assert.Equal(t, keys, tree.Keys())
+}
+
+// checkTree checks the order of keys, sizes of nodes, depth of leaves and links between leaves
+func checkTree[K any, V any](t *testing.T, tree *BTree[K, V]) {
+	t.Helper()
+
+	leaves := make([]*node[K, V], 0)
+	count := 0
+	var walk func(n *node[K, V], depth int, isRoot bool)
+	walk = func(n *node[K, V], depth int, isRoot bool) {
+		for i := 1; i < len(n.keys); i++ {
+			require.Negative(t, tree.compare(n.keys[i-1], n.keys[i]))
+		}
+		require.Less(t, len(n.keys), tree.order)
+		if !isRoot {
+			require.GreaterOrEqual(t, len(n.keys), tree.minKeys())
+		}
+		if n.leaf {
+			require.Equal(t, tree.Height(), depth)
+			require.Len(t, n.values, len(n.keys))
+			leaves = append(leaves, n)
+			count += len(n.keys)
+			return
+		}
+		require.Len(t, n.children, len(n.keys)+1)
+		for i, child := range n.children {
+			// keys of the child are between separators
+			for _, key := range child.keys {
+				if i > 0 && child.leaf {
+					require.GreaterOrEqual(t, tree.compare(key, n.keys[i-1]), 0)
+				}
+				if i < len(n.keys) {
+					require.Negative(t, tree.compare(key, n.keys[i]))
+				}
+			}
+			walk(child, depth+1, false)
+		}
+	}
+	walk(tree.root, 1, true)
+
+	require.Equal(t, tree.Len(), count)
+	for i, leaf := range leaves {
+		if i > 0 {
+			require.Same(t, leaves[i-1], leaf.prev)
+		} else {
+			require.Nil(t, leaf.prev)
+		}
+		if i < len(leaves)-1 {
+			require.Same(t, leaves[i+1], leaf.next)
+		} else {
+			require.Nil(t, leaf.next)
+		}
+	}
+}
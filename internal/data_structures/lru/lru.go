@@ -0,0 +1,169 @@
+package lru
+
+import (
+	mymap "JacuteSQL/internal/data_structures/mymap"
+	"fmt"
+	"strings"
+)
+
+// LRU is the cache of at most Cap values by string keys, the least recently used value is evicted first
+//
+// Values are kept in the doubly linked list from the most recently used, the hash map finds elements of the list.
+// LRU isn't safe for concurrent use.
+type LRU[V any] struct {
+	capacity int
+	elements *mymap.CustomMap
+	// head is the most recently used element, tail is the least recently used one
+	head *element[V]
+	tail *element[V]
+}
+
+type element[V any] struct {
+	key   string
+	value V
+	prev  *element[V]
+	next  *element[V]
+}
+
+// New creates the cache of at most capacity values, capacity is at least 1
+func New[V any](capacity int) *LRU[V] {
+	if capacity < 1 {
+		capacity = 1
+	}
+	return &LRU[V]{capacity: capacity, elements: mymap.New()}
+}
+
+// Len returns the number of values in the cache
+func (c *LRU[V]) Len() int {
+	return c.elements.Len()
+}
+
+// Cap returns the maximum number of values in the cache
+func (c *LRU[V]) Cap() int {
+	return c.capacity
+}
+
+// Get returns the value by the key and marks it as the most recently used
+func (c *LRU[V]) Get(key string) (V, bool) {
+	e := c.element(key)
+	if e == nil {
+		var zero V
+		return zero, false
+	}
+	c.unlink(e)
+	c.pushFront(e)
+	return e.value, true
+}
+
+// Peek returns the value by the key without changing the order of values
+func (c *LRU[V]) Peek(key string) (V, bool) {
+	e := c.element(key)
+	if e == nil {
+		var zero V
+		return zero, false
+	}
+	return e.value, true
+}
+
+// Put adds or replaces the value by the key, the evicted key is returned if the cache was full
+func (c *LRU[V]) Put(key string, value V) (string, bool) {
+	if e := c.element(key); e != nil {
+		e.value = value
+		c.unlink(e)
+		c.pushFront(e)
+		return "", false
+	}
+
+	e := &element[V]{key: key, value: value}
+	c.elements.Add(key, e)
+	c.pushFront(e)
+	if c.elements.Len() <= c.capacity {
+		return "", false
+	}
+	evicted := c.tail
+	c.remove(evicted)
+	return evicted.key, true
+}
+
+// Delete removes the value by the key, false is returned if there is no such key
+func (c *LRU[V]) Delete(key string) bool {
+	e := c.element(key)
+	if e == nil {
+		return false
+	}
+	c.remove(e)
+	return true
+}
+
+// DeleteFunc removes values with keys for which fn returns true and returns the number of removed values
+func (c *LRU[V]) DeleteFunc(fn func(key string) bool) int {
+	count := 0
+	for e := c.head; e != nil; {
+		next := e.next
+		if fn(e.key) {
+			c.remove(e)
+			count++
+		}
+		e = next
+	}
+	return count
+}
+
+// Clear removes all values
+func (c *LRU[V]) Clear() {
+	c.elements = mymap.New()
+	c.head, c.tail = nil, nil
+}
+
+// Keys returns keys from the most recently used to the least recently used
+func (c *LRU[V]) Keys() []string {
+	keys := make([]string, 0, c.elements.Len())
+	for e := c.head; e != nil; e = e.next {
+		keys = append(keys, e.key)
+	}
+	return keys
+}
+
+// String returns keys and values from the most recently used, e.g. [b:2 a:1]
+func (c *LRU[V]) String() string {
+	pairs := make([]string, 0, c.elements.Len())
+	for e := c.head; e != nil; e = e.next {
+		pairs = append(pairs, fmt.Sprintf("%s:%v", e.key, e.value))
+	}
+	return "[" + strings.Join(pairs, " ") + "]"
+}
+
+func (c *LRU[V]) element(key string) *element[V] {
+	e, _ := c.elements.Get(key).(*element[V])
+	return e
+}
+
+func (c *LRU[V]) remove(e *element[V]) {
+	c.unlink(e)
+	c.elements.Delete(e.key)
+}
+
+func (c *LRU[V]) pushFront(e *element[V]) {
+	e.prev, e.next = nil, c.head
+	if c.head != nil {
+		c.head.prev = e
+	}
+	c.head = e
+	if c.tail == nil {
+		c.tail = e
+	}
+}
+
+func (c *LRU[V]) unlink(e *element[V]) {
+	if e.prev != nil {
+		e.prev.next = e.next
+	} else {
+		c.head = e.next
+	}
+	if e.next != nil {
+		e.next.prev = e.prev
+	} else {
+		c.tail = e.prev
+	}
+	e.prev, e.next = nil, nil
+}
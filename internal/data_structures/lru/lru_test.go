@@ -0,0 +1,127 @@
+package lru
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLRUHappyPath(t *testing.T) {
+	cache := New[int](3)
+
+	for i, key := range []string{"a", "b", "c"} {
+		_, evicted := cache.Put(key, i)
+		assert.False(t, evicted)
+	}
+	assert.Equal(t, "[c:2 b:1 a:0]", cache.String())
+
+	value, ok := cache.Get("a")
+	assert.True(t, ok)
+	assert.Equal(t, 0, value)
+	assert.Equal(t, []string{"a", "c", "b"}, cache.Keys())
+
+	key, evicted := cache.Put("d", 3)
+	assert.True(t, evicted)
+	assert.Equal(t, "b", key)
+	_, ok = cache.Get("b")
+	assert.False(t, ok)
+	assert.Equal(t, 3, cache.Len())
+	assert.Equal(t, 3, cache.Cap())
+
+	// replaced value becomes the most recently used, Peek doesn't change the order
+	_, evicted = cache.Put("c", 20)
+	assert.False(t, evicted)
+	value, ok = cache.Peek("a")
+	assert.True(t, ok)
+	assert.Equal(t, 0, value)
+	assert.Equal(t, "[c:20 d:3 a:0]", cache.String())
+}
+
+func TestLRUDelete(t *testing.T) {
+	cache := New[string](10)
+	for i := 0; i < 10; i++ {
+		cache.Put(fmt.Sprintf("table%d/%d.csv", i%2, i), "sheet")
+	}
+
+	assert.True(t, cache.Delete("table0/0.csv"))
+	assert.False(t, cache.Delete("table0/0.csv"))
+	assert.Equal(t, 4, cache.DeleteFunc(func(key string) bool {
+		return strings.HasPrefix(key, "table0/")
+	}))
+	assert.Equal(t, []string{"table1/9.csv", "table1/7.csv", "table1/5.csv", "table1/3.csv", "table1/1.csv"}, cache.Keys())
+
+	cache.Clear()
+	assert.Equal(t, 0, cache.Len())
+	assert.Equal(t, "[]", cache.String())
+	cache.Put("a", "b")
+	assert.Equal(t, []string{"a"}, cache.Keys())
+
+	assert.Equal(t, 1, New[int](0).Cap())
+}
+
+func TestLRURandom(t *testing.T) {
+	const capacity = 16
+	cache := New[int](capacity)
+	// expected keeps keys from the least recently used
+	expected := make([]string, 0)
+	values := make(map[string]int)
+	touch := func(key string) {
+		for i, k := range expected {
+			if k == key {
+				expected = append(expected[:i], expected[i+1:]...)
+				break
+			}
+		}
+		expected = append(expected, key)
+	}
+	random := rand.New(rand.NewSource(42))
+
+	for i := 0; i < 5000; i++ {
+		key := fmt.Sprint(random.Intn(40))
+		switch random.Intn(3) {
+		case 0:
+			value, ok := cache.Get(key)
+			_, want := values[key]
+			require.Equal(t, want, ok)
+			if ok {
+				assert.Equal(t, values[key], value)
+				touch(key)
+			}
+		case 1:
+			deleted := cache.Delete(key)
+			_, want := values[key]
+			require.Equal(t, want, deleted)
+			if deleted {
+				delete(values, key)
+				for j, k := range expected {
+					if k == key {
+						expected = append(expected[:j], expected[j+1:]...)
+						break
+					}
+				}
+			}
+		default:
+			evictedKey, evicted := cache.Put(key, i)
+			values[key] = i
+			touch(key)
+			if len(expected) > capacity {
+				require.True(t, evicted)
+				require.Equal(t, expected[0], evictedKey)
+				delete(values, expected[0])
+				expected = expected[1:]
+			} else {
+				require.False(t, evicted)
+			}
+		}
+	}
+
+	require.Equal(t, len(expected), cache.Len())
+	keys := cache.Keys()
+	for i, key := range keys {
+		assert.Equal(t, expected[len(expected)-1-i], key)
+	}
+}
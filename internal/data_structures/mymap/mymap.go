@@ -120,9 +120,10 @@ func (cm *CustomMap) Get(key string) interface{} {
 
 func (cm *CustomMap) Delete(key string) error {
 	h1 := int(cm.HashFunc(key) % uint32(cm.BucketSize))
-	for _, bucket := range cm.Buckets[h1] {
+	for i, bucket := range cm.Buckets[h1] {
 		if bucket.Key == key {
-			cm.Buckets[h1] = nil
+			cm.Buckets[h1] = append(cm.Buckets[h1][:i], cm.Buckets[h1][i+1:]...)
+			cm.FilledSize--
 			return nil
 		}
 	}
@@ -34,3 +34,19 @@ func TestCustomMapHappyPath(t *testing.T) {
 
 	fmt.Println(myMap)
 }
+
+func TestCustomMapDelete(t *testing.T) {
+	myMap := New(1)
+
+	myMap.Add("random_key1", "1")
+	myMap.Add("random_key2", "2")
+	myMap.Add("random_key3", "3")
+
+	assert.Nil(t, myMap.Delete("random_key2"))
+	assert.ErrorIs(t, myMap.Delete("random_key2"), ErrKeyNotFound)
+
+	assert.Equal(t, 2, myMap.Len())
+	assert.Nil(t, myMap.Get("random_key2"))
+	assert.Equal(t, "1", myMap.Get("random_key1"))
+	assert.Equal(t, "3", myMap.Get("random_key3"))
+}
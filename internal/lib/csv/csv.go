@@ -3,8 +3,11 @@ package csv
 import (
 	"JacuteSQL/internal/data_structures/mymap"
 	"JacuteSQL/internal/data_structures/mysl"
+	"JacuteSQL/internal/lib/utils"
+	"bytes"
 	"encoding/csv"
 	"errors"
+	"fmt"
 	"io"
 	"os"
 )
@@ -16,77 +19,155 @@ var (
 )
 
 func ReadCSV(filename string, table string) (*mysl.MySl[*mymap.CustomMap], int, error) {
-	file, err := os.Open(filename)
+	reader, err := NewReader(filename, table)
 	if err != nil {
-		return &mysl.MySl[*mymap.CustomMap]{}, 0, ErrOpenFile
+		return &mysl.MySl[*mymap.CustomMap]{}, 0, err
 	}
-	defer file.Close()
+	defer reader.Close()
 
 	result := mysl.New[*mymap.CustomMap]()
-	reader := csv.NewReader(file)
-	headers, err := reader.Read()
-	if err != nil {
-		return &mysl.MySl[*mymap.CustomMap]{}, 0, err
-	}
-	rowCount := 0
 	for {
-		record, err := reader.Read()
+		row, err := reader.Read()
 		if err == io.EOF {
 			break
 		}
-		rowCount++
 		if err != nil {
 			return &mysl.MySl[*mymap.CustomMap]{}, 0, err
 		}
-		newElement := mymap.New()
-		for i, col := range record {
-			newElement.Add(table+"."+headers[i], col)
-		}
-		result.Append(newElement)
+		result.Append(row)
 	}
 
-	return result, rowCount, nil
+	return result, result.Len(), nil
 }
 
-func AddRow(filename string, cols []string) error {
-	file, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0755)
+// Reader reads rows of the sheet one by one, keys of rows are table.column
+type Reader struct {
+	file    *os.File
+	reader  *csv.Reader
+	table   string
+	headers []string
+}
+
+// NewReader opens the sheet and reads its header
+func NewReader(filename string, table string) (*Reader, error) {
+	file, err := os.Open(filename)
 	if err != nil {
-		return ErrOpenFile
+		return nil, ErrOpenFile
 	}
 
-	writer := csv.NewWriter(file)
-	err = writer.Write(cols)
+	reader := csv.NewReader(file)
+	headers, err := reader.Read()
 	if err != nil {
-		return ErrWriteFile
+		file.Close()
+		return nil, err
+	}
+	return &Reader{
+		file:    file,
+		reader:  reader,
+		table:   table,
+		headers: headers,
+	}, nil
+}
+
+// Read returns the next row, io.EOF is returned after the last row
+func (r *Reader) Read() (*mymap.CustomMap, error) {
+	record, err := r.reader.Read()
+	if err != nil {
+		return nil, err
+	}
+	row := mymap.New()
+	for i, col := range record {
+		row.Add(r.table+"."+r.headers[i], col)
+	}
+	return row, nil
+}
+
+// Close closes the sheet
+func (r *Reader) Close() error {
+	return r.file.Close()
+}
+
+// ReadRecords reads the header and values of all rows of the sheet, io.EOF is returned if there is no header
+func ReadRecords(filename string) ([]string, [][]string, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, nil, ErrOpenFile
+	}
+	return ParseRecords(data)
+}
+
+// ParseRecords parses the header and values of all rows of the sheet read to memory
+func ParseRecords(data []byte) ([]string, [][]string, error) {
+	records, err := csv.NewReader(bytes.NewReader(data)).ReadAll()
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(records) == 0 {
+		return nil, nil, io.EOF
+	}
+	return records[0], records[1:], nil
+}
+
+// FormatRow returns the row as it's written to the sheet by AddRow
+func FormatRow(cols []string) ([]byte, error) {
+	var buffer bytes.Buffer
+	writer := csv.NewWriter(&buffer)
+	if err := writer.Write(cols); err != nil {
+		return nil, err
 	}
 	writer.Flush()
-	return nil
+	if err := writer.Error(); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
 }
 
-func WriteFile(filename string, tableName string, rows *mysl.MySl[*mymap.CustomMap], header []string) error {
-	file, err := os.OpenFile(filename, os.O_TRUNC|os.O_CREATE|os.O_WRONLY, 0755)
+// AddRow appends the row to the end of the sheet
+func AddRow(filename string, cols []string) error {
+	file, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0755)
 	if err != nil {
 		return ErrOpenFile
 	}
 	defer file.Close()
 
 	writer := csv.NewWriter(file)
-	err = writer.Write(header)
+	err = writer.Write(cols)
 	if err != nil {
 		return ErrWriteFile
 	}
+	writer.Flush()
+	if writer.Error() != nil {
+		return ErrWriteFile
+	}
+	return nil
+}
 
-	for i := 0; i < rows.Len(); i++ {
-		forWrite := mysl.New[string]()
-		for _, col := range header {
-			forWrite.Append(rows.Get(i).Get(tableName + "." + col).(string))
+// WriteFile rewrites the sheet with the header and rows
+//
+// Rows are written to a temporary file which replaces the sheet, so the sheet isn't lost if writing fails.
+func WriteFile(filename string, tableName string, rows *mysl.MySl[*mymap.CustomMap], header []string) error {
+	err := utils.ReplaceFile(filename, func(file *os.File) error {
+		writer := csv.NewWriter(file)
+		if err := writer.Write(header); err != nil {
+			return err
 		}
-		err = writer.Write(forWrite.GetData())
-		if err != nil {
-			return ErrWriteFile
+
+		for i := 0; i < rows.Len(); i++ {
+			forWrite := mysl.New[string]()
+			for _, col := range header {
+				value, _ := rows.Get(i).Get(tableName + "." + col).(string)
+				forWrite.Append(value)
+			}
+			if err := writer.Write(forWrite.GetData()); err != nil {
+				return err
+			}
 		}
-	}
 
-	writer.Flush()
+		writer.Flush()
+		return writer.Error()
+	})
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrWriteFile, err)
+	}
 	return nil
 }
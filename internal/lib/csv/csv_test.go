@@ -1,7 +1,13 @@
 package csv
 
 import (
+	"JacuteSQL/internal/data_structures/mymap"
+	"JacuteSQL/internal/data_structures/mysl"
+	"errors"
 	"fmt"
+	"io"
+	"os"
+	"path"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -17,3 +23,72 @@ func TestReadCSV(t *testing.T) {
 		fmt.Print(data.Get(i))
 	}
 }
+
+func TestReader(t *testing.T) {
+	reader, err := NewReader(testFilename, "test")
+	assert.Nil(t, err)
+	defer reader.Close()
+
+	row, err := reader.Read()
+	assert.Nil(t, err)
+	assert.Equal(t, "Pavel", row.Get("test.name"))
+	row, err = reader.Read()
+	assert.Nil(t, err)
+	assert.Equal(t, "54", row.Get("test.age"))
+	_, err = reader.Read()
+	assert.Equal(t, io.EOF, err)
+
+	_, err = NewReader("missing.csv", "test")
+	assert.Equal(t, ErrOpenFile, err)
+}
+
+func TestReadRecords(t *testing.T) {
+	header, records, err := ReadRecords(testFilename)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"name", "surname", "age"}, header)
+	assert.Len(t, records, 2)
+	assert.Equal(t, "Pavel", records[0][0])
+
+	_, _, err = ReadRecords("missing.csv")
+	assert.Equal(t, ErrOpenFile, err)
+	emptyPath := path.Join(t.TempDir(), "1.csv")
+	assert.Nil(t, os.WriteFile(emptyPath, nil, 0644))
+	_, _, err = ReadRecords(emptyPath)
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestFormatRow(t *testing.T) {
+	line, err := FormatRow([]string{"Pavel", "it's, \"quoted\"", ""})
+	assert.Nil(t, err)
+	assert.Equal(t, "Pavel,\"it's, \"\"quoted\"\"\",\n", string(line))
+
+	sheetPath := path.Join(t.TempDir(), "1.csv")
+	assert.Nil(t, AddRow(sheetPath, []string{"Pavel", "it's, \"quoted\"", ""}))
+	data, err := os.ReadFile(sheetPath)
+	assert.Nil(t, err)
+	assert.Equal(t, line, data)
+}
+
+func TestWriteFile(t *testing.T) {
+	sheetPath := path.Join(t.TempDir(), "1.csv")
+	assert.Nil(t, os.WriteFile(sheetPath, []byte("name,age\nPavel,54\n"), 0644))
+
+	rows := mysl.New[*mymap.CustomMap]()
+	row := mymap.New()
+	row.Add("test.name", "Ivan")
+	row.Add("test.age", "30")
+	rows.Append(row)
+	assert.Nil(t, WriteFile(sheetPath, "test", rows, []string{"name", "age"}))
+	data, err := os.ReadFile(sheetPath)
+	assert.Nil(t, err)
+	assert.Equal(t, "name,age\nIvan,30\n", string(data))
+	_, err = os.Stat(sheetPath + ".tmp")
+	assert.True(t, errors.Is(err, os.ErrNotExist))
+
+	// the sheet isn't changed if it can't be replaced
+	err = WriteFile(path.Join(sheetPath, "missing", "1.csv"), "test", rows, []string{"name", "age"})
+	assert.True(t, errors.Is(err, ErrWriteFile))
+	data, err = os.ReadFile(sheetPath)
+	assert.Nil(t, err)
+	assert.Equal(t, "name,age\nIvan,30\n", string(data))
+}
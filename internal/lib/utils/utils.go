@@ -2,8 +2,13 @@ package utils
 
 import (
 	"errors"
+	"io/fs"
 	"os"
+	"path/filepath"
 	"regexp"
+	"slices"
+	"strconv"
+	"strings"
 )
 
 var (
@@ -28,6 +33,7 @@ func FileExists(filePath string) bool {
 	return err == nil
 }
 
+// GetSheetsFromFiles returns names of sheets <number>.csv of the table sorted by number
 func GetSheetsFromFiles(tablePath string) ([]string, error) {
 	sheets := make([]string, 0)
 	files, err := os.ReadDir(tablePath)
@@ -39,6 +45,83 @@ func GetSheetsFromFiles(tablePath string) ([]string, error) {
 			sheets = append(sheets, file.Name())
 		}
 	}
+	slices.SortFunc(sheets, func(a, b string) int {
+		return SheetNumber(a) - SheetNumber(b)
+	})
 
 	return sheets, nil
 }
+
+// SheetNumber returns the number of the sheet <number>.csv
+func SheetNumber(sheet string) int {
+	number, _ := strconv.Atoi(strings.TrimSuffix(sheet, ".csv"))
+	return number
+}
+
+// WriteFileAtomic writes data to a temporary file, syncs it and renames it to filePath
+//
+// The file contains either old or new data after a crash.
+func WriteFileAtomic(filePath string, data []byte) error {
+	return ReplaceFile(filePath, func(file *os.File) error {
+		_, err := file.Write(data)
+		return err
+	})
+}
+
+// ReplaceFile writes the file by write to <filePath>.tmp, fsync, rename over filePath and fsync of the directory
+//
+// The temporary file is removed if write returns an error.
+func ReplaceFile(filePath string, write func(file *os.File) error) error {
+	tmpPath := filePath + ".tmp"
+	file, err := os.OpenFile(tmpPath, os.O_TRUNC|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	err = write(file)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, filePath)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return SyncDir(filepath.Dir(filePath))
+}
+
+// SyncDir flushes entries of the directory to the disk, so created, renamed and removed files are kept after a crash
+func SyncDir(dirPath string) error {
+	dir, err := os.Open(dirPath)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// CopyDir copies the directory with its files and subdirectories to dst, files are synced to the disk
+func CopyDir(src string, dst string) error {
+	return filepath.WalkDir(src, func(filePath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(src, filePath)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, relPath)
+		if entry.IsDir() {
+			return os.MkdirAll(target, 0755)
+		}
+		data, err := os.ReadFile(filePath)
+		if err != nil {
+			return err
+		}
+		return WriteFileAtomic(target, data)
+	})
+}
@@ -0,0 +1,506 @@
+package storage
+
+import (
+	"JacuteSQL/internal/data_structures/mymap"
+	"JacuteSQL/internal/lib/csv"
+	"JacuteSQL/internal/lib/utils"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+
+	"github.com/jacute/prettylogger"
+)
+
+// kinds of problems found by Inspect
+const (
+	ProblemHeader        = "header"
+	ProblemDamaged       = "damaged"
+	ProblemMissingSheet  = "missing_sheet"
+	ProblemDuplicatePk   = "duplicate_pk"
+	ProblemPkSequence    = "pk_sequence"
+	ProblemStrayFile     = "stray_file"
+	ProblemOrphanedTable = "orphaned_table"
+	ProblemMissingTable  = "missing_table"
+	ProblemPendingWAL    = "pending_wal"
+	ProblemMigration     = "interrupted_migration"
+)
+
+// lostFoundDirName is the directory of the database where stray files of tables are moved by repair
+const lostFoundDirName = "lost+found"
+
+var sheetFileRegexp = regexp.MustCompile(`^\d+\.csv$`)
+
+// Problem is an inconsistency of files of the table, Repaired is true if it's fixed by Inspect
+type Problem struct {
+	Table    string
+	File     string
+	Kind     string
+	Detail   string
+	Repaired bool
+}
+
+func (p Problem) String() string {
+	status := "found"
+	if p.Repaired {
+		status = "repaired"
+	}
+	return fmt.Sprintf("%s,%s,%s,%s,%s", p.Table, p.File, p.Kind, status, p.Detail)
+}
+
+// TableStats is the size of the table on the disk
+type TableStats struct {
+	Table  string
+	Engine string
+	Rows   int
+	Sheets int
+	Bytes  int64
+	NextPk int64
+}
+
+// Inspect checks files of durable tables and fixes problems if repair is true, it's used at startup and by the admin tool
+//
+// Headers of csv sheets are compared with columns of the schema, a sheet with missing columns is repaired, a sheet with
+// renamed columns is repaired by position only if consistency.rename_columns is set.
+// The catalog listing missing sheets is built again from the remaining sheets. Rows with a duplicate pk get new pks,
+// the pk sequence lower than the largest pk is moved after it, files which aren't files of the table and directories
+// of unknown tables are moved to the directory lost+found of the database. Damaged sheets aren't repaired.
+// The storage opened by OpenReadOnly can't be repaired, the wal which isn't replayed and the interrupted migration
+// are reported.
+func (s *Storage) Inspect(repair bool) ([]Problem, error) {
+	const op = "storage.Inspect"
+	log := s.log.With(
+		slog.String("op", op),
+	)
+
+	if repair && s.readOnly {
+		return nil, fmt.Errorf("%s: %w", op, ErrStorageReadOnly)
+	}
+
+	problems, err := s.inspectDatabase(repair)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	for _, table := range s.tableNames() {
+		found, err := s.inspectTable(table, repair)
+		if err != nil {
+			return nil, err
+		}
+		problems = append(problems, found...)
+	}
+	for _, problem := range problems {
+		log.Warn(
+			"Table problem",
+			slog.String("table", problem.Table),
+			slog.String("file", problem.File),
+			slog.String("kind", problem.Kind),
+			slog.String("detail", problem.Detail),
+			slog.Bool("repaired", problem.Repaired),
+		)
+	}
+	return problems, nil
+}
+
+// inspectDatabase finds directories of the database which aren't directories of tables or views
+func (s *Storage) inspectDatabase(repair bool) ([]Problem, error) {
+	entries, err := os.ReadDir(s.databasePath())
+	if err != nil {
+		return nil, err
+	}
+	known := append(s.tableNames(), indexesDirName, lostFoundDirName)
+	for _, view := range s.getViews() {
+		known = append(known, view.Name)
+	}
+	problems := make([]Problem, 0)
+	if s.pendingWAL > 0 {
+		problems = append(problems, Problem{File: walFileName, Kind: ProblemPendingWAL, Detail: fmt.Sprintf("%d entries aren't replayed, repair replays them", s.pendingWAL)})
+	}
+	if utils.FileExists(s.databasePath() + migrationSnapshotExt) {
+		problems = append(problems, Problem{File: s.Schema.Name + migrationSnapshotExt, Kind: ProblemMigration, Detail: "migration isn't finished, repair rolls it back"})
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() || slices.Contains(known, entry.Name()) {
+			continue
+		}
+		problem := Problem{Table: entry.Name(), Kind: ProblemOrphanedTable, Detail: "directory isn't a table or a view of the schema"}
+		if repair {
+			if err := s.moveToLostFound(s.databasePath(), entry.Name(), ""); err != nil {
+				return nil, err
+			}
+			problem.Detail = "directory is moved to " + lostFoundDirName
+			problem.Repaired = true
+		}
+		problems = append(problems, problem)
+	}
+	return problems, nil
+}
+
+// moveToLostFound moves the file of the directory to lost+found/<table> of the database or to lost+found if table is empty
+func (s *Storage) moveToLostFound(dirPath string, file string, table string) error {
+	lostPath := path.Join(s.databasePath(), lostFoundDirName, table)
+	if err := os.MkdirAll(lostPath, 0755); err != nil {
+		return err
+	}
+	return os.Rename(path.Join(dirPath, file), path.Join(lostPath, file))
+}
+
+// inspectTable checks files of the table
+func (s *Storage) inspectTable(table string, repair bool) ([]Problem, error) {
+	const op = "storage.inspectTable"
+
+	if err := s.blockTables([]string{table}); err != nil {
+		return nil, err
+	}
+	defer s.unBlockTables([]string{table})
+
+	engine, ok := s.tableEngine(table)
+	if !ok {
+		return nil, ErrIncorectTable
+	}
+	if !engine.Durable() {
+		return nil, nil
+	}
+	columns, _ := s.tableColumns(table)
+	tablePath, _ := s.tablePath(table)
+	name := s.engineName(table)
+	if !utils.FileExists(tablePath) {
+		// directories of tables are created by Create, not by OpenReadOnly
+		return []Problem{{Table: table, Kind: ProblemMissingTable, Detail: "directory of the table doesn't exist, repair creates it"}}, nil
+	}
+
+	problems, err := s.inspectFiles(table, name, tablePath, repair)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	if name == CSVEngine {
+		found, err := inspectHeaders(table, tablePath, columns, repair, s.Schema.Consistency.RenameColumns)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+		problems = append(problems, found...)
+		missing, err := inspectSheets(table, tablePath, engine, repair)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+		problems = append(problems, missing...)
+		if slices.ContainsFunc(append(found, missing...), func(p Problem) bool { return p.Repaired }) {
+			// the catalog doesn't match repaired sheets
+			if err := engine.Recover(); err != nil {
+				return nil, fmt.Errorf("%s: %w", op, err)
+			}
+		}
+	}
+
+	statuses, err := engine.Check()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	for _, status := range statuses {
+		missing := slices.ContainsFunc(problems, func(p Problem) bool { return p.Kind == ProblemMissingSheet && p.File == status.Name })
+		if status.Err != nil && !missing {
+			problems = append(problems, Problem{Table: table, File: status.Name, Kind: ProblemDamaged, Detail: status.Err.Error()})
+		}
+	}
+	if slices.ContainsFunc(problems, func(p Problem) bool { return !p.Repaired && p.Kind != ProblemStrayFile }) {
+		// pks of damaged sheets and sheets with wrong headers can't be read
+		return problems, nil
+	}
+
+	found, err := inspectPks(table, columns, engine, repair)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	problems = append(problems, found...)
+	if slices.ContainsFunc(found, func(p Problem) bool { return p.Kind == ProblemDuplicatePk && p.Repaired }) {
+		s.resetIndexes(table)
+	}
+	return problems, nil
+}
+
+// inspectFiles finds files in the directory of the table which aren't written by its engine
+func (s *Storage) inspectFiles(table string, name string, tablePath string, repair bool) ([]Problem, error) {
+	entries, err := os.ReadDir(tablePath)
+	if err != nil {
+		return nil, err
+	}
+	problems := make([]Problem, 0)
+	for _, entry := range entries {
+		if isTableFile(table, name, entry.Name()) {
+			continue
+		}
+		problem := Problem{Table: table, File: entry.Name(), Kind: ProblemStrayFile, Detail: "file isn't a file of the table"}
+		if repair {
+			if err := s.moveToLostFound(tablePath, entry.Name(), table); err != nil {
+				return nil, err
+			}
+			problem.Detail = "file is moved to " + path.Join(lostFoundDirName, table)
+			problem.Repaired = true
+		}
+		problems = append(problems, problem)
+	}
+	return problems, nil
+}
+
+// isTableFile reports whether the file is written by the engine of the table
+func isTableFile(table string, name string, file string) bool {
+	switch name {
+	case CSVEngine:
+		return sheetFileRegexp.MatchString(file) || file == table+metaFileSuffix || file == table+pkSequenceSuffix
+	case BinaryEngine:
+		return file == pagesFileName
+	}
+	return false
+}
+
+// inspectHeaders compares headers of csv sheets with columns of the table
+//
+// The sheet is repaired if its columns are columns of the table, values of missing columns are empty,
+// or if it has as many columns as the table and rename is set, they are renamed by position.
+func inspectHeaders(table string, tablePath string, columns []string, repair bool, rename bool) ([]Problem, error) {
+	sheets, err := utils.GetSheetsFromFiles(tablePath)
+	if err != nil {
+		return nil, err
+	}
+	problems := make([]Problem, 0)
+	for _, sheet := range sheets {
+		sheetPath := path.Join(tablePath, sheet)
+		header, records, err := csv.ReadRecords(sheetPath)
+		if err != nil || slices.Equal(header, columns) {
+			// unreadable sheets are reported by the check of the engine
+			continue
+		}
+		problem := Problem{Table: table, File: sheet, Kind: ProblemHeader, Detail: fmt.Sprintf("columns are %v instead of %v", header, columns)}
+		mapping, ok := headerMapping(header, columns, rename)
+		if !ok && !rename && len(header) == len(columns) {
+			problem.Detail += ", they are renamed by position only with rename_columns"
+		}
+		if repair && ok {
+			if err := writeSheet(sheetPath, columns, remapRecords(records, mapping)); err != nil {
+				return nil, err
+			}
+			problem.Repaired = true
+		}
+		problems = append(problems, problem)
+	}
+	return problems, nil
+}
+
+// inspectSheets finds sheets of the catalog of the csv table which don't exist, rows of them are lost
+func inspectSheets(table string, tablePath string, engine TableEngine, repair bool) ([]Problem, error) {
+	meta, err := engine.Meta()
+	if err != nil {
+		// the catalog is built from sheets if it can't be read
+		return nil, nil
+	}
+	problems := make([]Problem, 0)
+	for _, sheet := range meta.Sheets {
+		if utils.FileExists(path.Join(tablePath, sheet.Name)) {
+			continue
+		}
+		problems = append(problems, Problem{
+			Table:    table,
+			File:     sheet.Name,
+			Kind:     ProblemMissingSheet,
+			Detail:   fmt.Sprintf("sheet with %d rows is missing", sheet.Rows),
+			Repaired: repair,
+		})
+	}
+	return problems, nil
+}
+
+// headerMapping returns the index of each column of the table in the header, -1 if the column is missing
+//
+// If the header has unknown columns, columns are mapped by position if byPosition is set and counts are equal.
+func headerMapping(header []string, columns []string, byPosition bool) ([]int, bool) {
+	mapping := make([]int, len(columns))
+	subset := true
+	for i, column := range columns {
+		mapping[i] = slices.Index(header, column)
+	}
+	for _, column := range header {
+		if !slices.Contains(columns, column) {
+			subset = false
+		}
+	}
+	if subset {
+		return mapping, true
+	}
+	if byPosition && len(header) == len(columns) {
+		for i := range mapping {
+			mapping[i] = i
+		}
+		return mapping, true
+	}
+	return nil, false
+}
+
+// remapRecords returns values of records in order of columns of the mapping
+func remapRecords(records [][]string, mapping []int) [][]string {
+	values := make([][]string, len(records))
+	for i, record := range records {
+		values[i] = make([]string, len(mapping))
+		for j, index := range mapping {
+			if index >= 0 && index < len(record) {
+				values[i][j] = record[index]
+			}
+		}
+	}
+	return values
+}
+
+// writeSheet replaces the csv sheet with the header and values of rows
+func writeSheet(sheetPath string, columns []string, values [][]string) error {
+	data, err := csv.FormatRow(columns)
+	if err != nil {
+		return err
+	}
+	for _, row := range values {
+		line, err := csv.FormatRow(row)
+		if err != nil {
+			return err
+		}
+		data = append(data, line...)
+	}
+	return utils.WriteFileAtomic(sheetPath, data)
+}
+
+// inspectPks finds rows with the same pk and the pk sequence lower than the largest pk
+func inspectPks(table string, columns []string, engine TableEngine, repair bool) ([]Problem, error) {
+	cursor, err := engine.Scan()
+	if err != nil {
+		return nil, err
+	}
+	counts := make(map[string]int)
+	order := make([]string, 0)
+	var largest int64
+	for {
+		row, err := cursor.Next()
+		if err != nil {
+			cursor.Close()
+			return nil, err
+		}
+		if row == nil {
+			break
+		}
+		pk := rowValues(table, columns, row)[0]
+		if counts[pk] == 1 {
+			order = append(order, pk)
+		}
+		counts[pk]++
+		if id, err := strconv.ParseInt(pk, 10, 64); err == nil {
+			largest = max(largest, id)
+		}
+	}
+	cursor.Close()
+
+	nextPk, err := engine.PeekPk()
+	if err != nil {
+		return nil, err
+	}
+	problems := make([]Problem, 0)
+	next := max(nextPk, largest+1)
+	for _, pk := range order {
+		problem := Problem{Table: table, Kind: ProblemDuplicatePk, Detail: fmt.Sprintf("pk %s is used by %d rows", pk, counts[pk])}
+		if repair {
+			problem.Detail += fmt.Sprintf(", other rows get pks from %d", next)
+			problem.Repaired = true
+			next += int64(counts[pk] - 1)
+		}
+		problems = append(problems, problem)
+	}
+	if nextPk <= largest {
+		problems = append(problems, Problem{
+			Table:    table,
+			Kind:     ProblemPkSequence,
+			Detail:   fmt.Sprintf("next pk is %d, the largest pk is %d", nextPk, largest),
+			Repaired: repair,
+		})
+	}
+	if !repair || len(problems) == 0 {
+		return problems, nil
+	}
+	if len(order) > 0 {
+		if err := renumberDuplicates(table, columns, engine, max(nextPk, largest+1)); err != nil {
+			return nil, err
+		}
+	}
+	if err := engine.SetPk(next); err != nil {
+		return nil, err
+	}
+	return problems, nil
+}
+
+// renumberDuplicates gives new pks from next to rows with the pk of a previous row
+func renumberDuplicates(table string, columns []string, engine TableEngine, next int64) error {
+	seen := make(map[string]bool)
+	_, err := engine.Rewrite(nil, func(row *mymap.CustomMap) (*mymap.CustomMap, bool) {
+		key := table + "." + columns[0]
+		pk, _ := row.Get(key).(string)
+		if !seen[pk] {
+			seen[pk] = true
+			return row, false
+		}
+		row.Add(key, strconv.FormatInt(next, 10))
+		next++
+		return row, true
+	})
+	return err
+}
+
+// Stats returns sizes of all tables
+func (s *Storage) Stats() ([]TableStats, error) {
+	stats := make([]TableStats, 0)
+	for _, table := range s.tableNames() {
+		engine, ok := s.tableEngine(table)
+		if !ok {
+			continue
+		}
+		if tablePath, _ := s.tablePath(table); engine.Durable() && !utils.FileExists(tablePath) {
+			stats = append(stats, TableStats{Table: table, Engine: s.engineName(table)})
+			continue
+		}
+		meta, err := engine.Meta()
+		if err != nil {
+			return nil, err
+		}
+		nextPk, err := engine.PeekPk()
+		if err != nil {
+			return nil, err
+		}
+		tableStats := TableStats{Table: table, Engine: s.engineName(table), Sheets: len(meta.Sheets), NextPk: nextPk}
+		for _, sheet := range meta.Sheets {
+			tableStats.Rows += sheet.Rows
+		}
+		if engine.Durable() {
+			tablePath, _ := s.tablePath(table)
+			tableStats.Bytes, err = dirSize(tablePath)
+			if err != nil {
+				s.log.Warn("Can't get size of table", prettylogger.Err(err), slog.String("table", table))
+			}
+		}
+		stats = append(stats, tableStats)
+	}
+	return stats, nil
+}
+
+// dirSize returns the total size of files in the directory
+func dirSize(dirPath string) (int64, error) {
+	entries, err := os.ReadDir(dirPath)
+	if err != nil {
+		return 0, err
+	}
+	var size int64
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			return 0, err
+		}
+		if !info.IsDir() {
+			size += info.Size()
+		}
+	}
+	return size, nil
+}
@@ -0,0 +1,171 @@
+package storage
+
+import (
+	"JacuteSQL/internal/data_structures/mymap"
+	"JacuteSQL/internal/data_structures/mysl"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	aggregateRegexp = regexp.MustCompile(`(?i)^(COUNT|SUM|MIN|MAX|AVG)\(\s*(\*|[\w\d]+\.[\w\d]+)\s*\)$`)
+)
+
+// Aggregate is an aggregate function in the list of selected fields, e.g. SUM(user_lot.quantity)
+type Aggregate struct {
+	Func  string
+	Field string
+}
+
+// accumulator stores intermediate result of the aggregate function for one group
+type accumulator struct {
+	count int
+	sum   float64
+	value string
+}
+
+// group stores values of GROUP BY fields and accumulators for each selected field
+type group struct {
+	row          *mymap.CustomMap
+	accumulators []*accumulator
+}
+
+// parseAggregate checks if field is an aggregate function
+func parseAggregate(field string) (*Aggregate, bool) {
+	matches := aggregateRegexp.FindStringSubmatch(field)
+	if matches == nil {
+		return nil, false
+	}
+	aggregate := &Aggregate{
+		Func:  strings.ToUpper(matches[1]),
+		Field: matches[2],
+	}
+	if aggregate.Field == "*" && aggregate.Func != "COUNT" {
+		return nil, false
+	}
+	return aggregate, true
+}
+
+// aggregateRows groups rows by groupBy fields and calculates aggregate functions for each group
+//
+// Without GROUP BY all rows are in one group. Keys of result rows are selected fields and GROUP BY fields.
+func aggregateRows(fields []string, groupBy []string, rows *mysl.MySl[*mymap.CustomMap]) (*mysl.MySl[*mymap.CustomMap], error) {
+	groups := mymap.New()
+	groupKeys := mysl.New[string]()
+	if len(groupBy) == 0 {
+		groups.Add("", newGroup(mymap.New(), len(fields)))
+		groupKeys.Append("")
+	}
+
+	for i := 0; i < rows.Len(); i++ {
+		row := rows.Get(i)
+
+		keyParts := make([]string, len(groupBy))
+		for j, field := range groupBy {
+			keyParts[j], _ = row.Get(field).(string)
+		}
+		key := strings.Join(keyParts, "\x00")
+
+		g, ok := groups.Get(key).(*group)
+		if !ok {
+			g = newGroup(row, len(fields))
+			groups.Add(key, g)
+			groupKeys.Append(key)
+		}
+
+		for j, field := range fields {
+			aggregate, ok := parseAggregate(field)
+			if !ok {
+				continue
+			}
+			if err := g.accumulators[j].add(aggregate, row); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	result := mysl.New[*mymap.CustomMap]()
+	for i := 0; i < groupKeys.Len(); i++ {
+		g := groups.Get(groupKeys.Get(i)).(*group)
+		resultRow := mymap.New()
+		for _, field := range groupBy {
+			value, _ := g.row.Get(field).(string)
+			resultRow.Add(field, value)
+		}
+		for j, field := range fields {
+			if aggregate, ok := parseAggregate(field); ok {
+				resultRow.Add(field, g.accumulators[j].result(aggregate))
+			}
+		}
+		result.Append(resultRow)
+	}
+	return result, nil
+}
+
+func newGroup(row *mymap.CustomMap, fieldsCount int) *group {
+	accumulators := make([]*accumulator, fieldsCount)
+	for i := range accumulators {
+		accumulators[i] = &accumulator{}
+	}
+	return &group{
+		row:          row,
+		accumulators: accumulators,
+	}
+}
+
+func (a *accumulator) add(aggregate *Aggregate, row *mymap.CustomMap) error {
+	if aggregate.Field == "*" {
+		a.count++
+		return nil
+	}
+	value, _ := row.Get(aggregate.Field).(string)
+
+	switch aggregate.Func {
+	case "SUM", "AVG":
+		number, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return fmt.Errorf("can't calculate %s: value '%s' of %s is not a number", aggregate.Func, value, aggregate.Field)
+		}
+		a.sum += number
+	case "MIN":
+		if a.count == 0 || compareValues(value, a.value) < 0 {
+			a.value = value
+		}
+	case "MAX":
+		if a.count == 0 || compareValues(value, a.value) > 0 {
+			a.value = value
+		}
+	}
+	a.count++
+	return nil
+}
+
+func (a *accumulator) result(aggregate *Aggregate) string {
+	switch aggregate.Func {
+	case "COUNT":
+		return strconv.Itoa(a.count)
+	case "SUM":
+		if a.count == 0 {
+			return ""
+		}
+		return formatNumber(a.sum)
+	case "AVG":
+		if a.count == 0 {
+			return ""
+		}
+		return formatNumber(a.sum / float64(a.count))
+	default:
+		return a.value
+	}
+}
+
+// columnName returns the default column name for the aggregate in views
+func (a *Aggregate) columnName() string {
+	return strings.ToLower(a.Func)
+}
+
+func formatNumber(number float64) string {
+	return strconv.FormatFloat(number, 'f', -1, 64)
+}
@@ -0,0 +1,847 @@
+package storage
+
+import (
+	"JacuteSQL/internal/data_structures/mymap"
+	"JacuteSQL/internal/lib/utils"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"sync"
+)
+
+const (
+	pagesFileName = "pages.bin"
+
+	binaryPageSize       = 4096
+	binaryPageHeaderSize = 16
+	binarySlotSize       = 4
+	binaryFormatVersion  = 1
+
+	binaryFileMagic = "JSQF"
+	binaryPageMagic = "JSQP"
+)
+
+// tags of typed values in records
+const (
+	valueNull  byte = 0
+	valueInt   byte = 1
+	valueFloat byte = 2
+	valueText  byte = 3
+)
+
+var (
+	ErrRowTooLarge = errors.New("row doesn't fit into a page")
+	ErrDamagedPage = errors.New("damaged page")
+
+	// errPagesUnchanged stops rewriting of the file if no row is changed
+	errPagesUnchanged = errors.New("pages aren't changed")
+)
+
+// binaryEngine stores the table in the file pages.bin of fixed-size pages with typed values
+//
+// Page 0 is the file header: magic, version, page size, number of columns and the pk of the next row.
+// A data page has the header (magic, page number, number of slots, start of records, crc32 of the page), the slot directory
+// with offsets and lengths of records after the header and records written from the end of the page.
+// A record is the number of values and values, each is a tag and data: null, int64, float64 or text with its length.
+// Checksums of pages are verified when pages are read, the table with a damaged page is read-only.
+type binaryEngine struct {
+	table     string
+	tablePath string
+	columns   []string
+	cache     *sheetCache
+	damaged   quarantine
+	// mu protects the state below, it's read from the file on the first use
+	mu     sync.Mutex
+	loaded bool
+	// free are free bytes of data pages, pages are numbers of rows and ranges of pks in them
+	free   []int
+	pages  []SheetMeta
+	nextPk int64
+}
+
+// newBinaryEngine creates the directory of the table and the file with the header page if they don't exist
+func newBinaryEngine(s *Storage, table string, tablePath string, columns []string) (TableEngine, error) {
+	e := &binaryEngine{table: table, tablePath: tablePath, columns: columns, cache: s.cache}
+	if s.readOnly {
+		return e, nil
+	}
+	if err := os.MkdirAll(tablePath, 0755); err != nil {
+		return nil, err
+	}
+	if !utils.FileExists(e.filePath()) {
+		if err := e.writeEmpty(); err != nil {
+			return nil, err
+		}
+	}
+	return e, nil
+}
+
+func (e *binaryEngine) filePath() string {
+	return path.Join(e.tablePath, pagesFileName)
+}
+
+// Scan returns the cursor over data pages in order of their numbers
+func (e *binaryEngine) Scan() (RowCursor, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if err := e.load(); err != nil {
+		return nil, err
+	}
+	pages := make([]int, len(e.free))
+	for i := range pages {
+		pages[i] = i + 1
+	}
+	return &binaryCursor{engine: e, pages: pages, page: -1, row: -1}, nil
+}
+
+// ScanSheets returns the cursor over data pages with the numbers
+func (e *binaryEngine) ScanSheets(sheets []int) (RowCursor, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if err := e.load(); err != nil {
+		return nil, err
+	}
+	pages := make([]int, 0, len(sheets))
+	for number := 1; number <= len(e.free); number++ {
+		if slices.Contains(sheets, number) {
+			pages = append(pages, number)
+		}
+	}
+	return &binaryCursor{engine: e, pages: pages, page: -1, row: -1}, nil
+}
+
+// Append adds the row to the first page with enough free space, a new page is added if there is no such page
+func (e *binaryEngine) Append(values []string) (RowLocation, error) {
+	if err := e.damaged.check(); err != nil {
+		return RowLocation{}, err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if err := e.load(); err != nil {
+		return RowLocation{}, err
+	}
+	record := encodeRecord(values)
+	if len(record)+binarySlotSize > binaryPageSize-binaryPageHeaderSize {
+		return RowLocation{}, fmt.Errorf("%w: %d bytes", ErrRowTooLarge, len(record))
+	}
+
+	file, err := os.OpenFile(e.filePath(), os.O_RDWR, 0644)
+	if err != nil {
+		return RowLocation{}, err
+	}
+	defer file.Close()
+
+	index := len(e.free)
+	for i, free := range e.free {
+		if free >= len(record)+binarySlotSize {
+			index = i
+			break
+		}
+	}
+	var p page
+	if index < len(e.free) {
+		if p, err = e.readPage(file, index); err != nil {
+			return RowLocation{}, err
+		}
+	} else {
+		p = newPage(index + 1)
+	}
+	p.insert(record)
+	p.seal()
+	e.cache.remove(pageKey(e.filePath(), index+1))
+	if _, err := file.WriteAt(p, pageOffset(index)); err != nil {
+		e.loaded = false
+		return RowLocation{}, err
+	}
+	if index == len(e.free) {
+		e.free = append(e.free, 0)
+		e.pages = append(e.pages, SheetMeta{Name: strconv.Itoa(index + 1)})
+	}
+	e.free[index] = p.freeSpace()
+	e.pages[index].addPk(values[0])
+	return RowLocation{Sheet: index + 1, Row: p.slots() - 1}, nil
+}
+
+// Rewrite writes changed pages to the new file and renames it over the old one
+//
+// Rows which don't fit into their page after the update are moved to new pages at the end.
+func (e *binaryEngine) Rewrite(sheets []int, change func(row *mymap.CustomMap) (*mymap.CustomMap, bool)) ([]int, error) {
+	if err := e.damaged.check(); err != nil {
+		return nil, err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if err := e.load(); err != nil {
+		return nil, err
+	}
+	old, err := os.Open(e.filePath())
+	if err != nil {
+		return nil, err
+	}
+	defer old.Close()
+
+	free := make([]int, 0, len(e.free))
+	pages := make([]SheetMeta, 0, len(e.pages))
+	rewritten := make([]int, 0)
+	defer e.cache.removePrefix(e.filePath() + "#")
+	err = utils.ReplaceFile(e.filePath(), func(file *os.File) error {
+		if _, err := file.Write(e.fileHeader()); err != nil {
+			return err
+		}
+		changed := false
+		moved := make([][]byte, 0)
+		for i := range e.free {
+			p, err := e.readPage(old, i)
+			if err != nil {
+				return err
+			}
+			if sheets != nil && !slices.Contains(sheets, i+1) {
+				if _, err := file.Write(p); err != nil {
+					return err
+				}
+				free = append(free, p.freeSpace())
+				pages = append(pages, e.pages[i])
+				continue
+			}
+			newP := newPage(i + 1)
+			pageChanged := false
+			for _, record := range p.records() {
+				values, err := decodeRecord(record)
+				if err != nil {
+					return fmt.Errorf("%w %d of table %s: %w", ErrDamagedPage, i+1, e.table, err)
+				}
+				row, ok := change(e.row(values))
+				if !ok {
+					if !newP.insert(record) {
+						moved = append(moved, record)
+					}
+					continue
+				}
+				pageChanged = true
+				if row == nil {
+					continue
+				}
+				record = encodeRecord(rowValues(e.table, e.columns, row))
+				if len(record)+binarySlotSize > binaryPageSize-binaryPageHeaderSize {
+					return fmt.Errorf("%w: %d bytes", ErrRowTooLarge, len(record))
+				}
+				if !newP.insert(record) {
+					moved = append(moved, record)
+				}
+			}
+			pageMeta := e.pages[i]
+			if pageChanged {
+				changed = true
+				p = newP
+				p.seal()
+				rewritten = append(rewritten, i+1)
+				if pageMeta, err = p.meta(i + 1); err != nil {
+					return err
+				}
+			}
+			if _, err := file.Write(p); err != nil {
+				return err
+			}
+			free = append(free, p.freeSpace())
+			pages = append(pages, pageMeta)
+		}
+		if !changed {
+			return errPagesUnchanged
+		}
+		for len(moved) > 0 {
+			p := newPage(len(free) + 1)
+			for len(moved) > 0 && p.insert(moved[0]) {
+				moved = moved[1:]
+			}
+			p.seal()
+			if _, err := file.Write(p); err != nil {
+				return err
+			}
+			pageMeta, err := p.meta(len(free) + 1)
+			if err != nil {
+				return err
+			}
+			free = append(free, p.freeSpace())
+			pages = append(pages, pageMeta)
+			rewritten = append(rewritten, len(free))
+		}
+		return nil
+	})
+	if errors.Is(err, errPagesUnchanged) {
+		return nil, nil
+	}
+	if err != nil {
+		e.loaded = false
+		e.damaged.set(err)
+		return nil, err
+	}
+	e.free, e.pages = free, pages
+	return rewritten, nil
+}
+
+// Truncate replaces the file with the header page and resets the pk sequence
+func (e *binaryEngine) Truncate() error {
+	if err := e.damaged.check(); err != nil {
+		return err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	defer e.cache.removePrefix(e.filePath() + "#")
+	return e.writeEmpty()
+}
+
+// NextPk returns the pk of a new row and writes the next one to the header page
+func (e *binaryEngine) NextPk() (int64, error) {
+	if err := e.damaged.check(); err != nil {
+		return 0, err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if err := e.load(); err != nil {
+		return 0, err
+	}
+	id := e.nextPk
+	e.nextPk++
+	if err := e.writeHeader(); err != nil {
+		e.nextPk--
+		return 0, err
+	}
+	return id, nil
+}
+
+// PeekPk returns the pk of the next row without advancing the pk sequence
+func (e *binaryEngine) PeekPk() (int64, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if err := e.load(); err != nil {
+		return 0, err
+	}
+	return e.nextPk, nil
+}
+
+// SetPk sets the pk of the next row in the header page
+func (e *binaryEngine) SetPk(id int64) error {
+	if err := e.damaged.check(); err != nil {
+		return err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if err := e.load(); err != nil {
+		return err
+	}
+	old := e.nextPk
+	e.nextPk = id
+	if err := e.writeHeader(); err != nil {
+		e.nextPk = old
+		return err
+	}
+	return nil
+}
+
+// Meta returns data pages as sheets, FreeSheet is the first page with free space
+func (e *binaryEngine) Meta() (TableMeta, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if err := e.load(); err != nil {
+		return TableMeta{}, err
+	}
+	meta := TableMeta{Sheets: make([]SheetMeta, len(e.free)), FreeSheet: len(e.free), NextPk: e.nextPk}
+	for i := range e.free {
+		meta.Sheets[i] = e.pages[i]
+		if meta.FreeSheet == len(e.free) && e.free[i] > binarySlotSize {
+			meta.FreeSheet = i
+		}
+	}
+	return meta, nil
+}
+
+// Durable reports that pages are kept on the disk
+func (e *binaryEngine) Durable() bool {
+	return true
+}
+
+// Sync flushes the file and the directory of the table
+func (e *binaryEngine) Sync() error {
+	if err := syncFile(e.filePath()); err != nil {
+		return err
+	}
+	return utils.SyncDir(e.tablePath)
+}
+
+// Recover cuts the partially written page at the end of the file and reads the state again
+func (e *binaryEngine) Recover() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.loaded = false
+	e.cache.removePrefix(e.filePath() + "#")
+	info, err := os.Stat(e.filePath())
+	if err != nil {
+		return err
+	}
+	if info.Size()%binaryPageSize != 0 {
+		return os.Truncate(e.filePath(), info.Size()-info.Size()%binaryPageSize)
+	}
+	return nil
+}
+
+// Drop removes the file of the table
+func (e *binaryEngine) Drop() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.loaded = false
+	e.cache.removePrefix(e.filePath() + "#")
+	if err := os.Remove(e.filePath()); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return utils.SyncDir(e.tablePath)
+}
+
+// Writable returns ErrReadOnly while a page is damaged
+func (e *binaryEngine) Writable() error {
+	return e.damaged.check()
+}
+
+// Check reads and decodes all pages, the table leaves quarantine if no page is damaged
+func (e *binaryEngine) Check() ([]SheetStatus, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.loaded = false
+	if err := e.load(); err != nil && !errors.Is(err, ErrDamagedPage) {
+		return nil, err
+	}
+	file, err := os.Open(e.filePath())
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]SheetStatus, 0)
+	for number := 1; number < int(info.Size()/binaryPageSize); number++ {
+		status := SheetStatus{Name: strconv.Itoa(number)}
+		p, err := e.readPage(file, number-1)
+		if err == nil {
+			var values [][]string
+			values, err = e.decodePage(p, number)
+			status.Rows = len(values)
+		}
+		status.Err = err
+		statuses = append(statuses, status)
+	}
+	if info.Size()%binaryPageSize != 0 {
+		statuses = append(statuses, SheetStatus{
+			Name: strconv.Itoa(int(info.Size() / binaryPageSize)),
+			Err:  fmt.Errorf("%w %d of table %s: page is written partially", ErrDamagedPage, info.Size()/binaryPageSize, e.table),
+		})
+	}
+	e.damaged.reset(statuses)
+	return statuses, nil
+}
+
+// load reads headers of all pages, mu must be locked
+func (e *binaryEngine) load() error {
+	if e.loaded {
+		return nil
+	}
+	file, err := os.Open(e.filePath())
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	header := make([]byte, binaryPageSize)
+	if _, err := file.ReadAt(header, 0); err != nil {
+		return fmt.Errorf("can't read header of %s: %w", e.filePath(), err)
+	}
+	if string(header[0:4]) != binaryFileMagic {
+		return fmt.Errorf("%s isn't a file of pages", e.filePath())
+	}
+	if version := binary.BigEndian.Uint16(header[4:6]); version != binaryFormatVersion {
+		return fmt.Errorf("unsupported version %d of %s", version, e.filePath())
+	}
+	if size := binary.BigEndian.Uint16(header[6:8]); size != binaryPageSize {
+		return fmt.Errorf("page size of %s is %d instead of %d", e.filePath(), size, binaryPageSize)
+	}
+	if columns := int(binary.BigEndian.Uint16(header[8:10])); columns != len(e.columns) {
+		return fmt.Errorf("pages of table %s have %d columns instead of %d", e.table, columns, len(e.columns))
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	pages := int(info.Size()/binaryPageSize) - 1
+	e.free = make([]int, pages)
+	e.pages = make([]SheetMeta, pages)
+	for i := 0; i < pages; i++ {
+		p, err := e.readPage(file, i)
+		if err != nil {
+			e.damaged.set(err)
+			return err
+		}
+		e.free[i] = p.freeSpace()
+		if e.pages[i], err = p.meta(i + 1); err != nil {
+			err = fmt.Errorf("%w %d of table %s: %w", ErrDamagedPage, i+1, e.table, err)
+			e.damaged.set(err)
+			return err
+		}
+	}
+	e.nextPk = int64(binary.BigEndian.Uint64(header[16:24]))
+	e.loaded = true
+	return nil
+}
+
+// readPage reads the data page by its index and checks its header
+func (e *binaryEngine) readPage(file *os.File, index int) (page, error) {
+	p := make(page, binaryPageSize)
+	if _, err := file.ReadAt(p, pageOffset(index)); err != nil {
+		return nil, fmt.Errorf("can't read page %d of table %s: %w", index+1, e.table, err)
+	}
+	if err := p.check(index + 1); err != nil {
+		return nil, fmt.Errorf("%w %d of table %s: %w", ErrDamagedPage, index+1, e.table, err)
+	}
+	return p, nil
+}
+
+// fileHeader returns the header page with the current pk sequence
+func (e *binaryEngine) fileHeader() []byte {
+	header := make([]byte, binaryPageSize)
+	copy(header[0:4], binaryFileMagic)
+	binary.BigEndian.PutUint16(header[4:6], binaryFormatVersion)
+	binary.BigEndian.PutUint16(header[6:8], binaryPageSize)
+	binary.BigEndian.PutUint16(header[8:10], uint16(len(e.columns)))
+	binary.BigEndian.PutUint64(header[16:24], uint64(e.nextPk))
+	return header
+}
+
+// writeHeader writes the header page in place, mu must be locked
+func (e *binaryEngine) writeHeader() error {
+	file, err := os.OpenFile(e.filePath(), os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = file.WriteAt(e.fileHeader(), 0)
+	return err
+}
+
+// writeEmpty replaces the file with the header page without data pages, mu must be locked
+func (e *binaryEngine) writeEmpty() error {
+	e.loaded = false
+	e.nextPk = 1
+	if err := utils.WriteFileAtomic(e.filePath(), e.fileHeader()); err != nil {
+		return err
+	}
+	e.free, e.pages = nil, nil
+	e.loaded = true
+	return nil
+}
+
+// row returns the row with keys table.column
+func (e *binaryEngine) row(values []string) *mymap.CustomMap {
+	row := mymap.New()
+	for i, column := range e.columns {
+		row.Add(e.table+"."+column, values[i])
+	}
+	return row
+}
+
+// pageOffset returns the offset of the data page in the file, the header page is before data pages
+func pageOffset(index int) int64 {
+	return int64(index+1) * binaryPageSize
+}
+
+// page is a data page of the file
+type page []byte
+
+// newPage returns the empty page with the number
+func newPage(number int) page {
+	p := make(page, binaryPageSize)
+	copy(p[0:4], binaryPageMagic)
+	binary.BigEndian.PutUint32(p[4:8], uint32(number))
+	binary.BigEndian.PutUint16(p[10:12], binaryPageSize)
+	return p
+}
+
+// check checks the header and the slot directory of the page
+func (p page) check(number int) error {
+	if string(p[0:4]) != binaryPageMagic {
+		return errors.New("wrong magic")
+	}
+	if got := int(binary.BigEndian.Uint32(p[4:8])); got != number {
+		return fmt.Errorf("page number is %d", got)
+	}
+	if stored := binary.BigEndian.Uint32(p[12:16]); stored != 0 && stored != p.checksum() {
+		return fmt.Errorf("checksum is %08x instead of %08x", p.checksum(), stored)
+	}
+	if p.freeSpace() < 0 || p.upper() > binaryPageSize {
+		return errors.New("slot directory overlaps records")
+	}
+	for i := 0; i < p.slots(); i++ {
+		offset, length := p.slot(i)
+		if offset < p.upper() || offset+length > binaryPageSize {
+			return fmt.Errorf("slot %d is out of records", i)
+		}
+	}
+	return nil
+}
+
+// checksum returns crc32 of the page with zero checksum field
+func (p page) checksum() uint32 {
+	crc := crc32.ChecksumIEEE(p[0:12])
+	crc = crc32.Update(crc, crc32.IEEETable, []byte{0, 0, 0, 0})
+	return crc32.Update(crc, crc32.IEEETable, p[16:])
+}
+
+// seal writes the checksum of the page before the page is written, pages written before checksums were added have 0 and aren't verified
+func (p page) seal() {
+	binary.BigEndian.PutUint32(p[12:16], p.checksum())
+}
+
+// slots returns the number of slots
+func (p page) slots() int {
+	return int(binary.BigEndian.Uint16(p[8:10]))
+}
+
+// upper returns the offset of the first record
+func (p page) upper() int {
+	return int(binary.BigEndian.Uint16(p[10:12]))
+}
+
+// slot returns the offset and the length of the record
+func (p page) slot(i int) (int, int) {
+	start := binaryPageHeaderSize + i*binarySlotSize
+	return int(binary.BigEndian.Uint16(p[start : start+2])), int(binary.BigEndian.Uint16(p[start+2 : start+4]))
+}
+
+// freeSpace returns the number of bytes between the slot directory and records
+func (p page) freeSpace() int {
+	return p.upper() - binaryPageHeaderSize - p.slots()*binarySlotSize
+}
+
+// insert writes the record and its slot, it returns false if there is no space
+func (p page) insert(record []byte) bool {
+	if p.freeSpace() < len(record)+binarySlotSize {
+		return false
+	}
+	slots := p.slots()
+	offset := p.upper() - len(record)
+	copy(p[offset:], record)
+	start := binaryPageHeaderSize + slots*binarySlotSize
+	binary.BigEndian.PutUint16(p[start:start+2], uint16(offset))
+	binary.BigEndian.PutUint16(p[start+2:start+4], uint16(len(record)))
+	binary.BigEndian.PutUint16(p[8:10], uint16(slots+1))
+	binary.BigEndian.PutUint16(p[10:12], uint16(offset))
+	return true
+}
+
+// records returns records of the page in order of slots
+func (p page) records() [][]byte {
+	records := make([][]byte, 0, p.slots())
+	for i := 0; i < p.slots(); i++ {
+		offset, length := p.slot(i)
+		records = append(records, p[offset:offset+length])
+	}
+	return records
+}
+
+// meta returns the number of rows of the page and the range of their pks
+func (p page) meta(number int) (SheetMeta, error) {
+	meta := SheetMeta{Name: strconv.Itoa(number)}
+	for _, record := range p.records() {
+		values, err := decodeRecord(record)
+		if err != nil {
+			return meta, err
+		}
+		if len(values) == 0 {
+			return meta, fmt.Errorf("record without values")
+		}
+		meta.addPk(values[0])
+	}
+	return meta, nil
+}
+
+// encodeRecord encodes values of the row, numbers are stored as int64 or float64 if they are written back the same way
+func encodeRecord(values []string) []byte {
+	record := binary.BigEndian.AppendUint16(nil, uint16(len(values)))
+	for _, value := range values {
+		if value == "" {
+			record = append(record, valueNull)
+			continue
+		}
+		if number, err := strconv.ParseInt(value, 10, 64); err == nil && strconv.FormatInt(number, 10) == value {
+			record = append(record, valueInt)
+			record = binary.BigEndian.AppendUint64(record, uint64(number))
+			continue
+		}
+		if number, err := strconv.ParseFloat(value, 64); err == nil && strconv.FormatFloat(number, 'f', -1, 64) == value {
+			record = append(record, valueFloat)
+			record = binary.BigEndian.AppendUint64(record, math.Float64bits(number))
+			continue
+		}
+		record = append(record, valueText)
+		record = binary.AppendUvarint(record, uint64(len(value)))
+		record = append(record, value...)
+	}
+	return record
+}
+
+// decodeRecord decodes values of the row
+func decodeRecord(record []byte) ([]string, error) {
+	if len(record) < 2 {
+		return nil, io.ErrUnexpectedEOF
+	}
+	values := make([]string, binary.BigEndian.Uint16(record))
+	record = record[2:]
+	for i := range values {
+		if len(record) == 0 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		tag := record[0]
+		record = record[1:]
+		switch tag {
+		case valueNull:
+		case valueInt, valueFloat:
+			if len(record) < 8 {
+				return nil, io.ErrUnexpectedEOF
+			}
+			bits := binary.BigEndian.Uint64(record)
+			record = record[8:]
+			if tag == valueInt {
+				values[i] = strconv.FormatInt(int64(bits), 10)
+			} else {
+				values[i] = strconv.FormatFloat(math.Float64frombits(bits), 'f', -1, 64)
+			}
+		case valueText:
+			length, n := binary.Uvarint(record)
+			if n <= 0 || uint64(len(record)-n) < length {
+				return nil, io.ErrUnexpectedEOF
+			}
+			values[i] = string(record[n : n+int(length)])
+			record = record[n+int(length):]
+		default:
+			return nil, fmt.Errorf("unknown type %d of value", tag)
+		}
+	}
+	return values, nil
+}
+
+// pageValues returns decoded rows of the data page from the cache, the page is read from the file and cached on a miss
+func (e *binaryEngine) pageValues(file *os.File, number int) ([][]string, error) {
+	key := pageKey(e.filePath(), number)
+	if cached := e.cache.get(key, nil); cached != nil {
+		return cached.values, nil
+	}
+	p, err := e.readPage(file, number-1)
+	if err == nil {
+		var values [][]string
+		if values, err = e.decodePage(p, number); err == nil {
+			e.cache.put(key, &cachedSheet{columns: e.columns, values: values})
+			return values, nil
+		}
+	}
+	e.damaged.set(err)
+	return nil, err
+}
+
+// decodePage decodes values of all rows of the page
+func (e *binaryEngine) decodePage(p page, number int) ([][]string, error) {
+	values := make([][]string, 0, p.slots())
+	for _, record := range p.records() {
+		rowValues, err := decodeRecord(record)
+		if err != nil {
+			return nil, fmt.Errorf("%w %d of table %s: %w", ErrDamagedPage, number, e.table, err)
+		}
+		if len(rowValues) != len(e.columns) {
+			return nil, fmt.Errorf("%w %d of table %s: row has %d values", ErrDamagedPage, number, e.table, len(rowValues))
+		}
+		values = append(values, rowValues)
+	}
+	return values, nil
+}
+
+// binaryCursor reads rows of the table page by page, only one page is kept by the cursor
+type binaryCursor struct {
+	engine *binaryEngine
+	file   *os.File
+	// pages are numbers of pages to read, page is the index of the read page in them
+	pages []int
+	page  int
+	// values are rows of the read page, row is the index of the last returned row
+	values [][]string
+	row    int
+}
+
+func (c *binaryCursor) Next() (*mymap.CustomMap, error) {
+	for c.row+1 >= len(c.values) {
+		if c.page+1 >= len(c.pages) {
+			c.Close()
+			return nil, nil
+		}
+		if c.file == nil {
+			file, err := os.Open(c.engine.filePath())
+			if err != nil {
+				return nil, err
+			}
+			c.file = file
+		}
+		c.page++
+		c.values, c.row = nil, -1
+		values, err := c.engine.pageValues(c.file, c.pages[c.page])
+		if err != nil {
+			return nil, err
+		}
+		c.values = values
+	}
+	c.row++
+	return c.engine.row(c.values[c.row]), nil
+}
+
+func (c *binaryCursor) Location() RowLocation {
+	if c.page < 0 || c.page >= len(c.pages) {
+		return RowLocation{}
+	}
+	return RowLocation{Sheet: c.pages[c.page], Row: c.row}
+}
+
+func (c *binaryCursor) Rewind() {
+	c.Close()
+	c.page = -1
+	c.values, c.row = nil, -1
+}
+
+func (c *binaryCursor) Close() {
+	if c.file != nil {
+		c.file.Close()
+		c.file = nil
+	}
+}
+
+func (c *binaryCursor) Sheets() int {
+	return len(c.pages)
+}
+
+func (c *binaryCursor) SheetsRead() int {
+	return c.page + 1
+}
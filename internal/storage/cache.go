@@ -0,0 +1,179 @@
+package storage
+
+import (
+	"JacuteSQL/internal/data_structures/lru"
+	"JacuteSQL/internal/data_structures/mymap"
+	"JacuteSQL/internal/lib/csv"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+const defaultCacheSheets = 64
+
+var (
+	showCacheRegexp = regexp.MustCompile(`(?i)^SHOW\s+CACHE\s*;?$`)
+)
+
+// sheetCache keeps parsed sheets of csv tables and views and decoded pages of binary tables, it's shared by all connections
+//
+// A sheet is cached by its path with the state of its file, the sheet changed outside of the engine is read again.
+// A page is cached by the path of the file and its number, the binary engine removes pages of the file on changes.
+// The least recently used sheet is evicted when the cache is full. The nil cache doesn't keep sheets.
+type sheetCache struct {
+	mu     sync.Mutex
+	sheets *lru.LRU[*cachedSheet]
+	hits   int64
+	misses int64
+}
+
+// cachedSheet is values of rows in order of columns, info is the state of the sheet file and nil for pages
+type cachedSheet struct {
+	info    os.FileInfo
+	columns []string
+	values  [][]string
+}
+
+// newSheetCache creates the cache of at most size sheets, the default size is used if it's 0, nil is returned if it's negative
+func newSheetCache(size int) *sheetCache {
+	if size < 0 {
+		return nil
+	}
+	if size == 0 {
+		size = defaultCacheSheets
+	}
+	return &sheetCache{sheets: lru.New[*cachedSheet](size)}
+}
+
+// get returns the cached sheet, the sheet is dropped if info doesn't match the state of its file
+func (c *sheetCache) get(key string, info os.FileInfo) *cachedSheet {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	sheet, ok := c.sheets.Get(key)
+	if ok && sheet.info != nil && !sameFileState(sheet.info, info) {
+		c.sheets.Delete(key)
+		ok = false
+	}
+	if !ok {
+		c.misses++
+		return nil
+	}
+	c.hits++
+	return sheet
+}
+
+// put caches the sheet, it replaces the cached one
+func (c *sheetCache) put(key string, sheet *cachedSheet) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sheets.Put(key, sheet)
+}
+
+// remove drops the sheet from the cache
+func (c *sheetCache) remove(key string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sheets.Delete(key)
+}
+
+// removePrefix drops sheets of the directory or pages of the file
+func (c *sheetCache) removePrefix(prefix string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sheets.DeleteFunc(func(key string) bool {
+		return strings.HasPrefix(key, prefix)
+	})
+}
+
+// readSheet returns the csv sheet from the cache, on a miss it's read from the file, verified and cached
+//
+// The sheet isn't verified if the checksum is empty.
+func (c *sheetCache) readSheet(sheetPath string, checksum string) (*cachedSheet, error) {
+	info, err := os.Stat(sheetPath)
+	if err != nil {
+		return nil, csv.ErrOpenFile
+	}
+	if sheet := c.get(sheetPath, info); sheet != nil {
+		return sheet, nil
+	}
+	data, err := os.ReadFile(sheetPath)
+	if err != nil {
+		return nil, csv.ErrOpenFile
+	}
+	if checksum != "" {
+		if got := sheetChecksum(data); got != checksum {
+			return nil, fmt.Errorf("%w %s: checksum is %s instead of %s", ErrDamagedSheet, sheetPath, got, checksum)
+		}
+	}
+	columns, values, err := csv.ParseRecords(data)
+	if err != nil {
+		return nil, fmt.Errorf("%w %s: %w", ErrDamagedSheet, sheetPath, err)
+	}
+	sheet := &cachedSheet{info: info, columns: columns, values: values}
+	c.put(sheetPath, sheet)
+	return sheet, nil
+}
+
+// writeSheet caches values of rows written to the csv sheet
+func (c *sheetCache) writeSheet(sheetPath string, columns []string, values [][]string) {
+	if c == nil {
+		return
+	}
+	info, err := os.Stat(sheetPath)
+	if err != nil {
+		c.remove(sheetPath)
+		return
+	}
+	c.put(sheetPath, &cachedSheet{info: info, columns: columns, values: values})
+}
+
+// stats returns the number of cached sheets, the size of the cache, hits and misses
+func (c *sheetCache) stats() (int, int, int64, int64) {
+	if c == nil {
+		return 0, 0, 0, 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.sheets.Len(), c.sheets.Cap(), c.hits, c.misses
+}
+
+// row returns the i-th row of the sheet with keys table.column
+func (sheet *cachedSheet) row(table string, i int) *mymap.CustomMap {
+	row := mymap.New()
+	for j, value := range sheet.values[i] {
+		row.Add(table+"."+sheet.columns[j], value)
+	}
+	return row
+}
+
+// sameFileState reports whether both states are of the same file with the same size and modification time
+func sameFileState(cached os.FileInfo, current os.FileInfo) bool {
+	return current != nil && os.SameFile(cached, current) &&
+		cached.Size() == current.Size() && cached.ModTime().Equal(current.ModTime())
+}
+
+// pageKey returns the key of the page of the binary file in the cache
+func pageKey(filePath string, number int) string {
+	return fmt.Sprintf("%s#%d", filePath, number)
+}
+
+// ShowCache returns the number of cached sheets, the size of the cache and numbers of hits and misses
+func (s *Storage) ShowCache() string {
+	sheets, size, hits, misses := s.cache.stats()
+	return fmt.Sprintf("sheets,size,hits,misses\n%d,%d,%d,%d\n", sheets, size, hits, misses)
+}
@@ -0,0 +1,199 @@
+package storage
+
+import (
+	"JacuteSQL/internal/data_structures/mymap"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// parseDefault parses DEFAULT expression: 'string', number, NULL, CURRENT_TIMESTAMP or function of sequence
+func parseDefault(expr string) (literal, error) {
+	expr = strings.TrimSpace(expr)
+	if expr == "" {
+		return literal{}, fmt.Errorf("empty expression")
+	}
+	value, end, err := readLiteral(expr, 0)
+	if err != nil {
+		return literal{}, err
+	}
+	if end != len(expr) {
+		return literal{}, fmt.Errorf("unexpected %s after value", expr[end:])
+	}
+	if value.Param > 0 || value.Default {
+		return literal{}, fmt.Errorf("%s is not allowed in DEFAULT", expr)
+	}
+	return value, nil
+}
+
+// parseCheck parses the CHECK expression of the table, columns without table name are qualified by the table
+//
+// Returns the condition tree and columns used in the expression
+func parseCheck(table string, expr string, tableColumns []string) (*Node, []string, error) {
+	if strings.TrimSpace(expr) == "" {
+		return nil, nil, fmt.Errorf("empty CHECK expression on table %s", table)
+	}
+	head := newConditionTree(expr)
+	columns := make([]string, 0)
+	qualify := func(field string) (string, error) {
+		column := field
+		if fieldTable := tableOfField(field); fieldTable != "" {
+			if fieldTable != table {
+				return "", fmt.Errorf("CHECK on table %s uses column %s of other table", table, field)
+			}
+			column = strings.TrimPrefix(field, table+".")
+		}
+		if !slices.Contains(tableColumns, column) {
+			return "", fmt.Errorf("column %s used in CHECK not exists in table %s", column, table)
+		}
+		if !slices.Contains(columns, column) {
+			columns = append(columns, column)
+		}
+		return table + "." + column, nil
+	}
+
+	var walk func(node *Node) error
+	walk = func(node *Node) error {
+		if node.NodeType != ConditionNode {
+			if err := walk(node.Left); err != nil {
+				return err
+			}
+			return walk(node.Right)
+		}
+		if node.Field == "" {
+			return fmt.Errorf("invalid CHECK expression %s on table %s", node.Value, table)
+		}
+		if node.Operand.Param > 0 {
+			return fmt.Errorf("parameters are not allowed in CHECK on table %s", table)
+		}
+		var err error
+		if node.Field, err = qualify(node.Field); err != nil {
+			return err
+		}
+		if !node.Operand.Quoted && !numberRegexp.MatchString(node.Operand.Value) {
+			if node.Operand.Value, err = qualify(node.Operand.Value); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := walk(head); err != nil {
+		return nil, nil, err
+	}
+	slices.Sort(columns)
+	return head, columns, nil
+}
+
+// checkPasses checks the row by CHECK condition, comparison with empty value is not a violation
+func checkPasses(node *Node, row *mymap.CustomMap) bool {
+	switch node.NodeType {
+	case OrNode:
+		return checkPasses(node.Left, row) || checkPasses(node.Right, row)
+	case AndNode:
+		return checkPasses(node.Left, row) && checkPasses(node.Right, row)
+	default:
+		value, _ := row.Get(node.Field).(string)
+		operand := node.Operand.Value
+		if !node.Operand.Quoted && !numberRegexp.MatchString(operand) {
+			operand, _ = row.Get(operand).(string)
+		}
+		if value == "" || operand == "" {
+			return true
+		}
+		return compareByOperator(node.Operator, value, operand)
+	}
+}
+
+// checkRows checks NOT NULL and CHECK constraints of the table on rows
+func (s *Storage) checkRows(table string, rows []*mymap.CustomMap) error {
+	columns, _ := s.tableColumns(table)
+	for _, constraint := range s.constraints() {
+		if constraint.Table != table {
+			continue
+		}
+		switch constraint.Type {
+		case NotNullConstraint:
+			for _, row := range rows {
+				for _, column := range constraint.Columns {
+					if value, _ := row.Get(table + "." + column).(string); value == "" {
+						return fmt.Errorf("%w: %s, column %s can't be empty", ErrConstraintViolation, constraint.Name, column)
+					}
+				}
+			}
+		case CheckConstraint:
+			head, _, err := parseCheck(table, constraint.Check, columns)
+			if err != nil {
+				return err
+			}
+			for _, row := range rows {
+				if !checkPasses(head, row) {
+					return fmt.Errorf("%w: %s, row doesn't satisfy %s", ErrConstraintViolation, constraint.Name, constraint.Check)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// columnDefault returns the default value of the column, empty if the column has no DEFAULT
+func (s *Storage) columnDefault(table string, column string) (string, error) {
+	for _, constraint := range s.constraints() {
+		if constraint.Table == table && constraint.Type == DefaultConstraint && constraint.Columns[0] == column {
+			value, err := parseDefault(constraint.Default)
+			if err != nil {
+				return "", err
+			}
+			return s.evalLiteral(value)
+		}
+	}
+	return "", nil
+}
+
+// insertValues returns values of all columns of the table except the pk
+//
+// Columns that are not listed or set to DEFAULT get the default value, nil columns means all columns
+// in the table order except generated ones. Generated columns are computed by Insert.
+func (s *Storage) insertValues(table string, columns []string, values []literal) ([]string, error) {
+	tableColumns, ok := s.tableColumns(table)
+	if !ok {
+		return nil, fmt.Errorf("table %s not exists", table)
+	}
+	tableColumns = tableColumns[1:]
+	if columns == nil {
+		columns = slices.DeleteFunc(slices.Clone(tableColumns), func(column string) bool {
+			return s.isGenerated(table, column)
+		})
+	}
+	if len(columns) != len(values) {
+		return nil, ErrIncorrectNumberOfColumns
+	}
+	for i, column := range columns {
+		name := strings.TrimPrefix(column, table+".")
+		if !slices.Contains(tableColumns, name) {
+			return nil, fmt.Errorf("column %s not exists in table %s", column, table)
+		}
+		if s.isGenerated(table, name) && !values[i].Default {
+			return nil, fmt.Errorf("generated column %s can't be inserted", name)
+		}
+	}
+
+	result := make([]string, len(tableColumns))
+	for i, column := range tableColumns {
+		j := slices.Index(columns, column)
+		if j == -1 {
+			j = slices.Index(columns, table+"."+column)
+		}
+		var value string
+		var err error
+		if j != -1 && !values[j].Default {
+			value, err = s.evalLiteral(values[j])
+		} else {
+			value, err = s.columnDefault(table, column)
+		}
+		if err != nil {
+			return nil, err
+		}
+		result[i] = value
+	}
+	return result, nil
+}
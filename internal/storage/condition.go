@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"regexp"
 	"slices"
+	"strconv"
 	"strings"
 )
 
@@ -17,22 +18,35 @@ const (
 	AndNode
 )
 
+var (
+	simpleConditionRegexp = regexp.MustCompile(`^([\w\d\.]+)\s*(<=|>=|<>|!=|=|<|>)\s*(.+)$`)
+)
+
 // Структура для узла дерева выражений
 type Node struct {
 	NodeType    NodeType
 	Value       string
 	Left, Right *Node
+
+	// Parts of simple condition: Field Operator Operand
+	Field    string
+	Operator string
+	Operand  literal
 }
 
 // GetConditionTree splits the condition into tree with priority
 func (s *Storage) GetConditionTree(query string) *Node {
+	return newConditionTree(query)
+}
+
+func newConditionTree(query string) *Node {
 	orParts := splitByOperator(query, "OR")
 
 	// OR
 	if len(orParts) > 1 {
 		root := &Node{NodeType: OrNode}
-		root.Left = s.GetConditionTree(orParts[0])
-		root.Right = s.GetConditionTree(strings.Join(orParts[1:], "OR"))
+		root.Left = newConditionTree(orParts[0])
+		root.Right = newConditionTree(strings.Join(orParts[1:], " OR "))
 		return root
 	}
 
@@ -40,13 +54,75 @@ func (s *Storage) GetConditionTree(query string) *Node {
 	andParts := splitByOperator(query, "AND")
 	if len(andParts) > 1 {
 		root := &Node{NodeType: AndNode}
-		root.Left = s.GetConditionTree(andParts[0])
-		root.Right = s.GetConditionTree(strings.Join(andParts[1:], "AND"))
+		root.Left = newConditionTree(andParts[0])
+		root.Right = newConditionTree(strings.Join(andParts[1:], " AND "))
 		return root
 	}
 
 	// For simple condition
-	return &Node{NodeType: ConditionNode, Value: strings.TrimSpace(query)}
+	node := &Node{NodeType: ConditionNode, Value: strings.TrimSpace(query)}
+	if matches := simpleConditionRegexp.FindStringSubmatch(node.Value); matches != nil {
+		node.Field = matches[1]
+		node.Operator = matches[2]
+		node.Operand = parseOperand(matches[3])
+	}
+	return node
+}
+
+// bindCondition returns a copy of the tree with parameters replaced by values
+func bindCondition(node *Node, values []string) (*Node, error) {
+	if node == nil {
+		return nil, nil
+	}
+	bound := *node
+	if node.Operand.Param > 0 {
+		if node.Operand.Param > len(values) {
+			return nil, fmt.Errorf("no value for parameter $%d", node.Operand.Param)
+		}
+		bound.Operand = literal{Value: values[node.Operand.Param-1], Quoted: true}
+	}
+	var err error
+	if bound.Left, err = bindCondition(node.Left, values); err != nil {
+		return nil, err
+	}
+	if bound.Right, err = bindCondition(node.Right, values); err != nil {
+		return nil, err
+	}
+	return &bound, nil
+}
+
+// String returns the condition in SQL syntax
+func (n *Node) String() string {
+	if n == nil {
+		return ""
+	}
+	switch n.NodeType {
+	case OrNode:
+		return n.Left.String() + " OR " + n.Right.String()
+	case AndNode:
+		return n.Left.operandString() + " AND " + n.Right.operandString()
+	default:
+		if n.Field == "" {
+			return n.Value
+		}
+		return fmt.Sprintf("%s %s %s", n.Field, n.Operator, n.Operand)
+	}
+}
+
+// operandString returns the condition as operand of AND, OR is wrapped in parentheses
+func (n *Node) operandString() string {
+	if n != nil && n.NodeType == OrNode {
+		return "(" + n.String() + ")"
+	}
+	return n.String()
+}
+
+// maxParam returns the max number of parameter in the tree
+func maxParam(node *Node) int {
+	if node == nil {
+		return 0
+	}
+	return max(node.Operand.Param, maxParam(node.Left), maxParam(node.Right))
 }
 
 func splitByOperator(query, operator string) []string {
@@ -59,34 +135,122 @@ func splitByOperator(query, operator string) []string {
 //
 // neededTables - all tables for condition, curTable - current table for condition
 func (s *Storage) IsValidRow(node *Node, row *mymap.CustomMap, neededTables []string, curTable string) bool {
+	return s.matchRow(node, row, neededTables, []string{curTable})
+}
+
+// matchRow checks row by tree with conditions
+//
+// rowTables - tables whose columns are stored in the row, conditions on other tables are skipped
+func (s *Storage) matchRow(node *Node, row *mymap.CustomMap, neededTables []string, rowTables []string) bool {
 	if node == nil {
 		return false
 	}
 	switch node.NodeType {
 	case ConditionNode:
-		parts := strings.SplitN(node.Value, "=", 2)
-		if len(parts) < 2 {
+		table := tableOfField(node.Field)
+		if table == "" || !slices.Contains(neededTables, table) || node.Operand.Param > 0 {
 			return false
 		}
-		part1, value := strings.TrimSpace(parts[0]), strings.Trim(strings.TrimSpace(parts[1]), "'")
-		part1Splitted := strings.SplitN(part1, ".", 2)
-		if len(part1Splitted) != 2 {
-			return false
-		}
-		table, _ := part1Splitted[0], part1Splitted[1]
-		if !slices.Contains(neededTables, table) {
-			return false
+		if !slices.Contains(rowTables, table) {
+			return true
 		}
-		rowValue, _ := row.Get(part1).(string)
-		if curTable == table && rowValue != value {
-			return false
+		rowValue, _ := row.Get(node.Field).(string)
+
+		value := node.Operand.Value
+		// Compare with other column, e.g. order.pair_id = pair.pair_pk
+		if node.Operand.isField(neededTables) {
+			if !slices.Contains(rowTables, tableOfField(value)) {
+				return true
+			}
+			value, _ = row.Get(value).(string)
 		}
-		return true
+		return compareByOperator(node.Operator, rowValue, value)
 	case OrNode:
-		return s.IsValidRow(node.Left, row, neededTables, curTable) || s.IsValidRow(node.Right, row, neededTables, curTable)
+		return s.matchRow(node.Left, row, neededTables, rowTables) || s.matchRow(node.Right, row, neededTables, rowTables)
 	case AndNode:
-		return s.IsValidRow(node.Left, row, neededTables, curTable) && s.IsValidRow(node.Right, row, neededTables, curTable)
+		return s.matchRow(node.Left, row, neededTables, rowTables) && s.matchRow(node.Right, row, neededTables, rowTables)
+	default:
+		return false
+	}
+}
+
+// tableOfField returns table name from the field table.column or empty string
+func tableOfField(field string) string {
+	fieldSplitted := strings.SplitN(field, ".", 2)
+	if len(fieldSplitted) != 2 || fieldSplitted[0] == "" || fieldSplitted[1] == "" {
+		return ""
+	}
+	return fieldSplitted[0]
+}
+
+// compareByOperator checks the condition "a operator b"
+//
+// = and <> compare values as strings, other operators compare numbers as numbers
+func compareByOperator(operator string, a, b string) bool {
+	switch operator {
+	case "=":
+		return a == b
+	case "<>", "!=":
+		return a != b
+	case "<":
+		return compareValues(a, b) < 0
+	case "<=":
+		return compareValues(a, b) <= 0
+	case ">":
+		return compareValues(a, b) > 0
+	case ">=":
+		return compareValues(a, b) >= 0
 	default:
 		return false
 	}
 }
+
+// compareValues compares values as numbers if both are numbers, otherwise as strings
+func compareValues(a, b string) int {
+	numberA, errA := strconv.ParseFloat(a, 64)
+	numberB, errB := strconv.ParseFloat(b, 64)
+	if errA == nil && errB == nil {
+		switch {
+		case numberA < numberB:
+			return -1
+		case numberA > numberB:
+			return 1
+		default:
+			return 0
+		}
+	}
+	return strings.Compare(a, b)
+}
+
+// conditionForTables returns the part of the condition which can be checked on rows with columns of rowTables
+//
+// Conditions on other tables are removed, nil means that the part is always true.
+func conditionForTables(node *Node, neededTables []string, rowTables []string) *Node {
+	if node == nil {
+		return nil
+	}
+	switch node.NodeType {
+	case AndNode, OrNode:
+		left := conditionForTables(node.Left, neededTables, rowTables)
+		right := conditionForTables(node.Right, neededTables, rowTables)
+		if node.NodeType == OrNode && (left == nil || right == nil) {
+			return nil
+		}
+		if left == nil {
+			return right
+		}
+		if right == nil {
+			return left
+		}
+		return &Node{NodeType: node.NodeType, Left: left, Right: right}
+	default:
+		table := tableOfField(node.Field)
+		if slices.Contains(neededTables, table) && !slices.Contains(rowTables, table) {
+			return nil
+		}
+		if node.Operand.isField(neededTables) && !slices.Contains(rowTables, tableOfField(node.Operand.Value)) {
+			return nil
+		}
+		return node
+	}
+}
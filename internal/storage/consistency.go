@@ -0,0 +1,77 @@
+package storage
+
+import (
+	"fmt"
+	"log/slog"
+	"slices"
+)
+
+// policies of the consistency check at startup
+const (
+	ConsistencyReport = "report"
+	ConsistencyRepair = "repair"
+	ConsistencyRefuse = "refuse"
+	ConsistencyOff    = "off"
+)
+
+// checkConsistency inspects tables after the wal is replayed and reports problems, repairs them or refuses to start
+// according to the policy
+//
+// The report of the check is logged as one record, the error is returned if the policy is refuse and a problem is found.
+// Files are changed only by the repair policy.
+func (s *Storage) checkConsistency() error {
+	const op = "storage.checkConsistency"
+	log := s.log.With(
+		slog.String("op", op),
+	)
+
+	policy := s.Schema.Consistency.Policy
+	if policy == "" {
+		policy = ConsistencyReport
+	}
+	if !slices.Contains([]string{ConsistencyReport, ConsistencyRepair, ConsistencyRefuse, ConsistencyOff}, policy) {
+		return fmt.Errorf("%s: unknown consistency policy %s", op, policy)
+	}
+	if policy == ConsistencyOff {
+		return nil
+	}
+
+	problems, err := s.Inspect(policy == ConsistencyRepair)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	kinds := make(map[string]int)
+	tables := make([]string, 0)
+	repaired := 0
+	for _, problem := range problems {
+		kinds[problem.Kind]++
+		if !slices.Contains(tables, problem.Table) {
+			tables = append(tables, problem.Table)
+		}
+		if problem.Repaired {
+			repaired++
+		}
+	}
+	report := []any{
+		slog.String("policy", policy),
+		slog.Int("problems", len(problems)),
+		slog.Int("repaired", repaired),
+		slog.Any("kinds", kinds),
+		slog.Any("tables", tables),
+	}
+
+	switch {
+	case len(problems) == 0:
+		log.Info("Storage is consistent", report...)
+	case policy == ConsistencyRefuse:
+		log.Error("Storage is inconsistent", report...)
+		return fmt.Errorf("%s: found %d problems in tables %v", op, len(problems), tables)
+	case policy == ConsistencyReport:
+		log.Warn("Storage is inconsistent, problems aren't repaired", report...)
+	case repaired < len(problems):
+		log.Error("Storage is repaired partially", report...)
+	default:
+		log.Warn("Storage is repaired", report...)
+	}
+	return nil
+}
@@ -0,0 +1,415 @@
+package storage
+
+import (
+	"JacuteSQL/internal/config"
+	"JacuteSQL/internal/data_structures/mymap"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/jacute/prettylogger"
+)
+
+const (
+	PrimaryKeyConstraint = "PRIMARY KEY"
+	UniqueConstraint     = "UNIQUE"
+	ForeignKeyConstraint = "FOREIGN KEY"
+	NotNullConstraint    = "NOT NULL"
+	DefaultConstraint    = "DEFAULT"
+	CheckConstraint      = "CHECK"
+	GeneratedConstraint  = "GENERATED"
+)
+
+// actions on delete of the row referenced by foreign key
+const (
+	RestrictAction = "RESTRICT"
+	CascadeAction  = "CASCADE"
+	SetNullAction  = "SET NULL"
+)
+
+var (
+	ErrConstraintViolation = errors.New("constraint violation")
+)
+
+// uniqueIndex maps values of constraint columns to pk of the row, so uniqueness is checked without reading sheets
+type uniqueIndex struct {
+	constraint config.Constraint
+	keys       *mymap.CustomMap
+}
+
+// normalizeConstraint checks the constraint of the table and fills its default name
+func normalizeConstraint(constraint config.Constraint, tableColumns func(string) ([]string, bool)) (config.Constraint, error) {
+	columns, ok := tableColumns(constraint.Table)
+	if !ok {
+		return constraint, fmt.Errorf("table %s of constraint not exists", constraint.Table)
+	}
+	constraint.Type = normalizeKeyword(constraint.Type)
+	switch constraint.Type {
+	case PrimaryKeyConstraint, UniqueConstraint, NotNullConstraint:
+		if err := checkConstraintColumns(constraint, constraint.Columns, columns, constraint.Table); err != nil {
+			return constraint, err
+		}
+	case ForeignKeyConstraint:
+		if err := checkConstraintColumns(constraint, constraint.Columns, columns, constraint.Table); err != nil {
+			return constraint, err
+		}
+		refColumns, ok := tableColumns(constraint.References)
+		if !ok {
+			return constraint, fmt.Errorf("table %s referenced by foreign key on table %s not exists", constraint.References, constraint.Table)
+		}
+		if len(constraint.RefColumns) == 0 {
+			constraint.RefColumns = []string{constraint.References + "_pk"}
+		}
+		if len(constraint.RefColumns) != len(constraint.Columns) {
+			return constraint, fmt.Errorf("foreign key on table %s has %d columns, but references %d", constraint.Table, len(constraint.Columns), len(constraint.RefColumns))
+		}
+		if err := checkConstraintColumns(constraint, constraint.RefColumns, refColumns, constraint.References); err != nil {
+			return constraint, err
+		}
+		constraint.OnDelete = normalizeKeyword(constraint.OnDelete)
+		if constraint.OnDelete == "" || constraint.OnDelete == "NO ACTION" {
+			constraint.OnDelete = RestrictAction
+		}
+		if constraint.OnDelete != RestrictAction && constraint.OnDelete != CascadeAction && constraint.OnDelete != SetNullAction {
+			return constraint, fmt.Errorf("unknown action ON DELETE %s of foreign key on table %s", constraint.OnDelete, constraint.Table)
+		}
+	case DefaultConstraint:
+		if err := checkConstraintColumns(constraint, constraint.Columns, columns, constraint.Table); err != nil {
+			return constraint, err
+		}
+		if len(constraint.Columns) != 1 {
+			return constraint, fmt.Errorf("DEFAULT constraint on table %s must have one column", constraint.Table)
+		}
+		if _, err := parseDefault(constraint.Default); err != nil {
+			return constraint, fmt.Errorf("invalid DEFAULT of column %s of table %s: %w", constraint.Columns[0], constraint.Table, err)
+		}
+	case GeneratedConstraint:
+		if err := checkConstraintColumns(constraint, constraint.Columns, columns, constraint.Table); err != nil {
+			return constraint, err
+		}
+		column := constraint.Columns[0]
+		if len(constraint.Columns) != 1 || column == constraint.Table+"_pk" {
+			return constraint, fmt.Errorf("GENERATED constraint on table %s must have one column except the pk", constraint.Table)
+		}
+		expr, err := parseExpression(constraint.Table, constraint.Expression)
+		if err != nil {
+			return constraint, fmt.Errorf("invalid expression of generated column %s of table %s: %w", column, constraint.Table, err)
+		}
+		for _, exprColumn := range expr.columns() {
+			if exprColumn == column || !slices.Contains(columns, exprColumn) {
+				return constraint, fmt.Errorf("generated column %s of table %s can't use column %s", column, constraint.Table, exprColumn)
+			}
+		}
+	case CheckConstraint:
+		_, checkColumns, err := parseCheck(constraint.Table, constraint.Check, columns)
+		if err != nil {
+			return constraint, err
+		}
+		constraint.Columns = checkColumns
+	default:
+		return constraint, fmt.Errorf("unknown constraint type %s on table %s", constraint.Type, constraint.Table)
+	}
+
+	if constraint.Name == "" {
+		switch constraint.Type {
+		case PrimaryKeyConstraint:
+			constraint.Name = constraint.Table + "_pkey"
+		case UniqueConstraint:
+			constraint.Name = constraint.Table + "_" + strings.Join(constraint.Columns, "_") + "_key"
+		case ForeignKeyConstraint:
+			constraint.Name = constraint.Table + "_" + strings.Join(constraint.Columns, "_") + "_fkey"
+		case NotNullConstraint:
+			constraint.Name = constraint.Table + "_" + strings.Join(constraint.Columns, "_") + "_not_null"
+		case DefaultConstraint:
+			constraint.Name = constraint.Table + "_" + constraint.Columns[0] + "_default"
+		case GeneratedConstraint:
+			constraint.Name = constraint.Table + "_" + constraint.Columns[0] + "_generated"
+		default:
+			constraint.Name = constraint.Table + "_" + strings.Join(constraint.Columns, "_") + "_check"
+		}
+	}
+	return constraint, nil
+}
+
+// checkConstraintColumns checks that columns of the constraint exist in the table and have no duplicates
+func checkConstraintColumns(constraint config.Constraint, columns []string, tableColumns []string, table string) error {
+	if len(columns) == 0 {
+		return fmt.Errorf("%s constraint on table %s has no columns", constraint.Type, constraint.Table)
+	}
+	for i, column := range columns {
+		if !slices.Contains(tableColumns, column) {
+			return fmt.Errorf("column %s of %s constraint not exists in table %s", column, constraint.Type, table)
+		}
+		if slices.Contains(columns[i+1:], column) {
+			return fmt.Errorf("duplicate column %s in %s constraint on table %s", column, constraint.Type, constraint.Table)
+		}
+	}
+	return nil
+}
+
+// validateConstraints normalizes constraints of all tables
+//
+// A table can have only one primary key, foreign key must reference the pk column or unique columns.
+func validateConstraints(constraints []config.Constraint, tableColumns func(string) ([]string, bool)) ([]config.Constraint, error) {
+	normalized := make([]config.Constraint, 0, len(constraints))
+	names := make([]string, 0, len(constraints))
+	primaryKeys := make([]string, 0)
+	defaults := make([]string, 0)
+	for _, constraint := range constraints {
+		named := constraint.Name != ""
+		constraint, err := normalizeConstraint(constraint, tableColumns)
+		if err != nil {
+			return nil, err
+		}
+		// several checks on the same columns get numbered names
+		if !named && constraint.Type == CheckConstraint {
+			name := constraint.Name
+			for i := 1; slices.Contains(names, constraint.Name); i++ {
+				constraint.Name = name + strconv.Itoa(i)
+			}
+		}
+		if slices.Contains(names, constraint.Name) {
+			return nil, fmt.Errorf("duplicate constraint name %s", constraint.Name)
+		}
+		switch constraint.Type {
+		case PrimaryKeyConstraint:
+			if slices.Contains(primaryKeys, constraint.Table) {
+				return nil, fmt.Errorf("multiple primary keys for table %s are not allowed", constraint.Table)
+			}
+			primaryKeys = append(primaryKeys, constraint.Table)
+		case DefaultConstraint, GeneratedConstraint:
+			// generated column can't have DEFAULT
+			column := constraint.Table + "." + constraint.Columns[0]
+			if slices.Contains(defaults, column) {
+				return nil, fmt.Errorf("multiple defaults or expressions for column %s are not allowed", column)
+			}
+			defaults = append(defaults, column)
+		}
+		names = append(names, constraint.Name)
+		normalized = append(normalized, constraint)
+	}
+
+	for _, constraint := range normalized {
+		if constraint.Type == GeneratedConstraint {
+			expr, _ := parseExpression(constraint.Table, constraint.Expression)
+			for _, column := range expr.columns() {
+				if slices.ContainsFunc(normalized, func(other config.Constraint) bool {
+					return other.Type == GeneratedConstraint && other.Table == constraint.Table && other.Columns[0] == column
+				}) {
+					return nil, fmt.Errorf("generated column %s can't use generated column %s", constraint.Name, column)
+				}
+			}
+		}
+		if constraint.Type != ForeignKeyConstraint {
+			continue
+		}
+		if _, ok := findUniqueConstraint(normalized, constraint.References, constraint.RefColumns); !ok {
+			return nil, fmt.Errorf(
+				"foreign key %s references columns (%s) of table %s, which are not unique",
+				constraint.Name, strings.Join(constraint.RefColumns, ", "), constraint.References,
+			)
+		}
+	}
+	return normalized, nil
+}
+
+// findUniqueConstraint returns the unique constraint of the table with the same set of columns
+func findUniqueConstraint(constraints []config.Constraint, table string, columns []string) (config.Constraint, bool) {
+	constraints = append([]config.Constraint{pkConstraint(table)}, constraints...)
+	for _, constraint := range constraints {
+		if constraint.Table != table || !isUniqueConstraint(constraint) || len(constraint.Columns) != len(columns) {
+			continue
+		}
+		if !slices.ContainsFunc(columns, func(column string) bool { return !slices.Contains(constraint.Columns, column) }) {
+			return constraint, true
+		}
+	}
+	return config.Constraint{}, false
+}
+
+// isUniqueConstraint checks if the constraint is PRIMARY KEY or UNIQUE
+func isUniqueConstraint(constraint config.Constraint) bool {
+	return constraint.Type == PrimaryKeyConstraint || constraint.Type == UniqueConstraint
+}
+
+// pkConstraint returns the constraint of the pk column, which is always unique
+func pkConstraint(table string) config.Constraint {
+	return config.Constraint{
+		Name:    table + "_pk",
+		Table:   table,
+		Type:    UniqueConstraint,
+		Columns: []string{table + "_pk"},
+	}
+}
+
+// normalizeKeyword returns the keyword in upper case with single spaces, e.g. "set  null" -> "SET NULL"
+func normalizeKeyword(keyword string) string {
+	return strings.Join(strings.Fields(strings.ToUpper(keyword)), " ")
+}
+
+// tableConstraints returns unique constraints of the table, the pk column is always unique
+func (s *Storage) tableConstraints(table string) []config.Constraint {
+	s.tablesMutex.RLock()
+	defer s.tablesMutex.RUnlock()
+
+	constraints := []config.Constraint{pkConstraint(table)}
+	for _, constraint := range s.Schema.Constraints {
+		if constraint.Table == table && isUniqueConstraint(constraint) {
+			constraints = append(constraints, constraint)
+		}
+	}
+	return constraints
+}
+
+// uniqueIndexes returns indexes of unique constraints of the table, they are built from sheets on first use
+//
+// The table must be locked
+func (s *Storage) uniqueIndexes(table string) ([]*uniqueIndex, error) {
+	const op = "storage.uniqueIndexes"
+	log := s.log.With(
+		slog.String("op", op),
+		slog.String("table", table),
+	)
+
+	s.indexesMutex.Lock()
+	indexes, ok := s.indexes.Get(table).([]*uniqueIndex)
+	s.indexesMutex.Unlock()
+	if ok {
+		return indexes, nil
+	}
+
+	for _, constraint := range s.tableConstraints(table) {
+		indexes = append(indexes, &uniqueIndex{constraint: constraint, keys: mymap.New()})
+	}
+	err := s.scanRows(table, func(row *mymap.CustomMap) error {
+		for _, index := range indexes {
+			key, ok := index.key(row)
+			if !ok {
+				continue
+			}
+			if index.keys.Get(key) != nil {
+				log.Warn(
+					"Existing rows violate constraint",
+					slog.String("constraint", index.constraint.Name),
+					prettylogger.Err(index.violation(row)),
+				)
+				continue
+			}
+			index.keys.Add(key, rowPk(table, row))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	s.indexesMutex.Lock()
+	s.indexes.Add(table, indexes)
+	s.indexesMutex.Unlock()
+	return indexes, nil
+}
+
+// builtIndexes returns indexes of the table if they are already built, otherwise they don't need updates
+func (s *Storage) builtIndexes(table string) []*uniqueIndex {
+	s.indexesMutex.Lock()
+	defer s.indexesMutex.Unlock()
+
+	indexes, _ := s.indexes.Get(table).([]*uniqueIndex)
+	return indexes
+}
+
+// dropIndexes removes indexes of the table, they are built again on next use
+func (s *Storage) dropIndexes(table string) {
+	s.indexesMutex.Lock()
+	defer s.indexesMutex.Unlock()
+
+	s.indexes.Delete(table)
+}
+
+// checkUnique checks that new rows don't violate unique constraints
+//
+// replaced are pks of rows which are replaced by new rows, their old values are not conflicts
+func checkUnique(indexes []*uniqueIndex, table string, rows []*mymap.CustomMap, replaced []string) error {
+	for _, index := range indexes {
+		seen := mymap.New()
+		for _, row := range rows {
+			key, ok := index.key(row)
+			if !ok {
+				if index.constraint.Type == PrimaryKeyConstraint {
+					return fmt.Errorf(
+						"%w: empty value in column of primary key %s (%s)",
+						ErrConstraintViolation, index.constraint.Name, strings.Join(index.constraint.Columns, ", "),
+					)
+				}
+				continue
+			}
+			if seen.Get(key) != nil {
+				return index.violation(row)
+			}
+			pk := rowPk(table, row)
+			seen.Add(key, pk)
+
+			owner, _ := index.keys.Get(key).(string)
+			if owner != "" && !slices.Contains(replaced, owner) {
+				return index.violation(row)
+			}
+		}
+	}
+	return nil
+}
+
+// updateIndexes removes keys of old rows and adds keys of new rows
+func updateIndexes(indexes []*uniqueIndex, table string, oldRows []*mymap.CustomMap, newRows []*mymap.CustomMap) {
+	for _, index := range indexes {
+		for _, row := range oldRows {
+			if key, ok := index.key(row); ok && index.keys.Get(key) == rowPk(table, row) {
+				index.keys.Delete(key)
+			}
+		}
+		for _, row := range newRows {
+			if key, ok := index.key(row); ok {
+				index.keys.Add(key, rowPk(table, row))
+			}
+		}
+	}
+}
+
+// key returns the key of the row in the index, ok is false if one of values is empty
+func (idx *uniqueIndex) key(row *mymap.CustomMap) (string, bool) {
+	values := idx.values(row)
+	for _, value := range values {
+		if value == "" {
+			return "", false
+		}
+	}
+	return strings.Join(values, "\x00"), true
+}
+
+func (idx *uniqueIndex) values(row *mymap.CustomMap) []string {
+	values := make([]string, len(idx.constraint.Columns))
+	for i, column := range idx.constraint.Columns {
+		values[i], _ = row.Get(idx.constraint.Table + "." + column).(string)
+	}
+	return values
+}
+
+// violation returns the error for the row which duplicates the key
+func (idx *uniqueIndex) violation(row *mymap.CustomMap) error {
+	return fmt.Errorf(
+		"%w: duplicate key (%s)=(%s) violates %s constraint %s",
+		ErrConstraintViolation,
+		strings.Join(idx.constraint.Columns, ", "),
+		strings.Join(idx.values(row), ", "),
+		strings.ToLower(idx.constraint.Type),
+		idx.constraint.Name,
+	)
+}
+
+// rowPk returns value of the pk column of the row
+func rowPk(table string, row *mymap.CustomMap) string {
+	pk, _ := row.Get(table + "." + table + "_pk").(string)
+	return pk
+}
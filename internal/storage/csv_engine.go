@@ -0,0 +1,679 @@
+package storage
+
+import (
+	"JacuteSQL/internal/data_structures/mymap"
+	"JacuteSQL/internal/data_structures/mysl"
+	"JacuteSQL/internal/lib/csv"
+	"JacuteSQL/internal/lib/utils"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const metaFileSuffix = "_meta.json"
+
+// csvEngine stores the table in the directory with sheets <number>.csv of at most tuples_limit rows
+//
+// The catalog <table>_meta.json is kept in memory after the first use, so Append doesn't read sheets to find free space.
+// Changes of the catalog are saved by Flush after the statement, the wal restores them after a crash. Checksums of sheets in the catalog are verified when sheets are read, the table with a damaged sheet is read-only.
+type csvEngine struct {
+	table       string
+	tablePath   string
+	columns     []string
+	tuplesLimit int
+	cache       *sheetCache
+	damaged     quarantine
+	// readOnly engines don't create files and don't save the catalog built from sheets
+	readOnly bool
+	// mu protects the catalog
+	mu   sync.Mutex
+	meta *TableMeta
+	// metaDirty and pkDirty are set if the catalog or the pk sequence is changed and isn't saved
+	metaDirty bool
+	pkDirty   bool
+}
+
+// newCSVEngine creates the directory of the table with the first sheet and the pk sequence file if they don't exist
+func newCSVEngine(s *Storage, table string, tablePath string, columns []string) (TableEngine, error) {
+	engine := &csvEngine{
+		table:       table,
+		tablePath:   tablePath,
+		columns:     columns,
+		tuplesLimit: s.Schema.TuplesLimit,
+		cache:       s.cache,
+		readOnly:    s.readOnly,
+	}
+	if s.readOnly {
+		return engine, nil
+	}
+	if err := os.MkdirAll(tablePath, 0755); err != nil {
+		return nil, err
+	}
+	s.CreateTable(table, tablePath, columns)
+	return engine, nil
+}
+
+// Scan returns the cursor over sheets in order of their numbers
+func (e *csvEngine) Scan() (RowCursor, error) {
+	return e.cursor(nil)
+}
+
+// ScanSheets returns the cursor over the sheets with the numbers
+func (e *csvEngine) ScanSheets(sheets []int) (RowCursor, error) {
+	return e.cursor(sheets)
+}
+
+// cursor returns the cursor over the sheets with the numbers or over all sheets if numbers is nil
+//
+// Sheets are verified by checksums of the catalog, sheets are read without the check if the catalog can't be read.
+func (e *csvEngine) cursor(numbers []int) (RowCursor, error) {
+	cursor, err := newCursor(e.table, e.tablePath, e.cache)
+	if err != nil {
+		return nil, err
+	}
+	if numbers != nil {
+		cursor.sheets = filterSheets(cursor.sheets, numbers)
+	}
+	cursor.damaged = &e.damaged
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	meta, err := e.catalog()
+	if err != nil {
+		e.damaged.set(err)
+		return cursor, nil
+	}
+	cursor.checksums = make(map[string]string, len(meta.Sheets))
+	for _, sheet := range meta.Sheets {
+		cursor.checksums[sheet.Name] = sheet.Checksum
+	}
+	return cursor, nil
+}
+
+// Append adds the row to the first sheet with free space, a new sheet is created if all sheets are full
+func (e *csvEngine) Append(values []string) (RowLocation, error) {
+	if err := e.damaged.check(); err != nil {
+		return RowLocation{}, err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	meta, err := e.catalog()
+	if err != nil {
+		return RowLocation{}, err
+	}
+	if meta.FreeSheet == len(meta.Sheets) {
+		name := "1.csv"
+		if len(meta.Sheets) > 0 {
+			name = fmt.Sprintf("%d.csv", utils.SheetNumber(meta.Sheets[len(meta.Sheets)-1].Name)+1)
+		}
+		header := strings.Join(e.columns, ",") + "\n"
+		if err := utils.WriteFile(path.Join(e.tablePath, name), header); err != nil {
+			return RowLocation{}, err
+		}
+		meta.Sheets = append(meta.Sheets, SheetMeta{Name: name, Checksum: sheetChecksum([]byte(header))})
+		e.metaDirty = true
+	}
+
+	sheet := meta.Sheets[meta.FreeSheet]
+	sheetPath := path.Join(e.tablePath, sheet.Name)
+	e.cache.remove(sheetPath)
+	if err := csv.AddRow(sheetPath, values); err != nil {
+		e.discard()
+		return RowLocation{}, err
+	}
+	meta.Sheets[meta.FreeSheet].addPk(values[0])
+	line, err := csv.FormatRow(values)
+	if err != nil {
+		line = nil
+	}
+	meta.Sheets[meta.FreeSheet].Checksum = extendChecksum(meta.Sheets[meta.FreeSheet].Checksum, line)
+	meta.updateFreeSheet(meta.FreeSheet, e.tuplesLimit)
+	e.metaDirty = true
+	return RowLocation{Sheet: utils.SheetNumber(sheet.Name), Row: sheet.Rows}, nil
+}
+
+// Rewrite rewrites sheets with changed rows one by one
+func (e *csvEngine) Rewrite(numbers []int, change func(row *mymap.CustomMap) (*mymap.CustomMap, bool)) ([]int, error) {
+	if err := e.damaged.check(); err != nil {
+		return nil, err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	meta, err := e.catalog()
+	if err != nil {
+		return nil, err
+	}
+	sheets, err := utils.GetSheetsFromFiles(e.tablePath)
+	if err != nil {
+		return nil, err
+	}
+	if numbers != nil {
+		sheets = filterSheets(sheets, numbers)
+	}
+	rewritten := make([]int, 0)
+	for _, sheet := range sheets {
+		sheetPath := path.Join(e.tablePath, sheet)
+		cached, err := e.cache.readSheet(sheetPath, meta.checksum(sheet))
+		if err != nil {
+			e.damaged.set(err)
+			return rewritten, fmt.Errorf("can't read sheet %s: %w", sheetPath, err)
+		}
+		changed := false
+		kept := mysl.New[*mymap.CustomMap]()
+		values := make([][]string, 0, len(cached.values))
+		pks := make([]string, 0, len(cached.values))
+		for i := range cached.values {
+			row, ok := change(cached.row(e.table, i))
+			changed = changed || ok
+			if row != nil {
+				kept.Append(row)
+				values = append(values, rowValues(e.table, e.columns, row))
+				pks = append(pks, rowPk(e.table, row))
+			}
+		}
+		if !changed {
+			continue
+		}
+		if err := csv.WriteFile(sheetPath, e.table, kept, e.columns); err != nil {
+			e.discard()
+			e.cache.remove(sheetPath)
+			return rewritten, fmt.Errorf("can't write sheet %s: %w", sheetPath, err)
+		}
+		e.cache.writeSheet(sheetPath, e.columns, values)
+		rewritten = append(rewritten, utils.SheetNumber(sheet))
+		if err := meta.sheetRewritten(sheet, pks, recordsChecksum(e.columns, values), e.tuplesLimit); err != nil {
+			e.discard()
+			return rewritten, err
+		}
+		e.metaDirty = true
+	}
+	return rewritten, nil
+}
+
+// Truncate replaces the first sheet with the header, removes other sheets and resets the catalog
+func (e *csvEngine) Truncate() error {
+	if err := e.damaged.check(); err != nil {
+		return err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	sheets, err := utils.GetSheetsFromFiles(e.tablePath)
+	if err != nil {
+		return err
+	}
+	e.meta = nil
+	defer e.cache.removePrefix(e.tablePath + "/")
+	header := []byte(strings.Join(e.columns, ",") + "\n")
+	if err := utils.WriteFileAtomic(path.Join(e.tablePath, "1.csv"), header); err != nil {
+		return err
+	}
+	for i := len(sheets) - 1; i >= 0; i-- {
+		if sheets[i] == "1.csv" {
+			continue
+		}
+		if err := os.Remove(path.Join(e.tablePath, sheets[i])); err != nil {
+			return err
+		}
+	}
+	if err := utils.SyncDir(e.tablePath); err != nil {
+		return err
+	}
+
+	meta := &TableMeta{Sheets: []SheetMeta{{Name: "1.csv", Checksum: sheetChecksum(header)}}, NextPk: 1}
+	e.metaDirty, e.pkDirty = false, false
+	if err := e.saveMeta(meta); err != nil {
+		return err
+	}
+	e.meta = meta
+	return nil
+}
+
+// NextPk returns the pk of a new row and advances the pk sequence of the table
+func (e *csvEngine) NextPk() (int64, error) {
+	if err := e.damaged.check(); err != nil {
+		return 0, err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	meta, err := e.catalog()
+	if err != nil {
+		return 0, err
+	}
+	if err := e.syncPk(meta); err != nil {
+		return 0, err
+	}
+	id := meta.NextPk
+	meta.NextPk++
+	e.pkDirty = true
+	return id, nil
+}
+
+// PeekPk returns the pk of the next row without advancing the pk sequence
+func (e *csvEngine) PeekPk() (int64, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	meta, err := e.catalog()
+	if err != nil {
+		return 0, err
+	}
+	if err := e.syncPk(meta); err != nil {
+		return 0, err
+	}
+	return meta.NextPk, nil
+}
+
+// SetPk sets the pk of the next row of the table, the catalog is saved at once
+func (e *csvEngine) SetPk(id int64) error {
+	if err := e.damaged.check(); err != nil {
+		return err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	meta, err := e.catalog()
+	if err != nil {
+		return err
+	}
+	meta.NextPk = id
+	e.pkDirty = true
+	return e.flush()
+}
+
+// Flush saves changes of the catalog and the pk sequence, it's called after each statement changing the table
+func (e *csvEngine) Flush() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.flush()
+}
+
+// flush saves the catalog if it's changed or only the pk sequence if only it's changed, mu must be locked
+func (e *csvEngine) flush() error {
+	if e.meta == nil {
+		return nil
+	}
+	if e.metaDirty {
+		if err := e.saveMeta(e.meta); err != nil {
+			return err
+		}
+	} else if e.pkDirty {
+		if err := e.savePk(e.meta); err != nil {
+			return err
+		}
+	}
+	e.metaDirty, e.pkDirty = false, false
+	return nil
+}
+
+// discard drops the catalog after a failed write, mu must be locked
+//
+// The saved catalog is removed if it's behind sheets, so it's built from sheets again. The pk sequence is saved,
+// so given pks aren't given again.
+func (e *csvEngine) discard() {
+	if e.meta != nil && e.pkDirty {
+		e.savePk(e.meta)
+	}
+	if e.metaDirty {
+		os.Remove(path.Join(e.tablePath, e.table+metaFileSuffix))
+	}
+	e.meta = nil
+	e.metaDirty, e.pkDirty = false, false
+}
+
+// Meta returns the copy of the catalog
+func (e *csvEngine) Meta() (TableMeta, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	meta, err := e.catalog()
+	if err != nil {
+		return TableMeta{}, err
+	}
+	return meta.clone(), nil
+}
+
+// Durable reports that sheets are kept on the disk
+func (e *csvEngine) Durable() bool {
+	return true
+}
+
+// Sync saves the catalog and flushes all files of the table directory and the directory itself
+func (e *csvEngine) Sync() error {
+	if err := e.Flush(); err != nil {
+		return err
+	}
+	files, err := os.ReadDir(e.tablePath)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+		if err := syncFile(path.Join(e.tablePath, file.Name())); err != nil {
+			return err
+		}
+	}
+	return utils.SyncDir(e.tablePath)
+}
+
+// Recover removes the catalog if it's behind sheets after a crash, it's built from sheets again
+//
+// The catalog is kept if all sheets match their checksums, so changes of sheets are still detected after a restart.
+func (e *csvEngine) Recover() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.meta = nil
+	e.metaDirty, e.pkDirty = false, false
+	if e.catalogMatches() {
+		return nil
+	}
+	err := os.Remove(path.Join(e.tablePath, e.table+metaFileSuffix))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Drop removes sheets, the catalog and the pk sequence file
+func (e *csvEngine) Drop() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.meta = nil
+	e.metaDirty, e.pkDirty = false, false
+	defer e.cache.removePrefix(e.tablePath + "/")
+	sheets, err := utils.GetSheetsFromFiles(e.tablePath)
+	if err != nil {
+		return err
+	}
+	for _, file := range append(sheets, e.table+metaFileSuffix, e.table+pkSequenceSuffix) {
+		if err := os.Remove(path.Join(e.tablePath, file)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return utils.SyncDir(e.tablePath)
+}
+
+// catalog returns the catalog of the table, mu must be locked
+//
+// The catalog is read from the meta file or built from sheets if the file doesn't exist.
+// The pk sequence file edited by hand while the server was stopped is preferred, the damaged one is ignored.
+func (e *csvEngine) catalog() (*TableMeta, error) {
+	if e.meta != nil {
+		return e.meta, nil
+	}
+
+	meta := &TableMeta{}
+	data, err := os.ReadFile(path.Join(e.tablePath, e.table+metaFileSuffix))
+	if err == nil {
+		err = json.Unmarshal(data, meta)
+	}
+	if err == nil {
+		e.readPkFile(meta)
+		meta.pkFile, _ = os.Stat(path.Join(e.tablePath, e.table+pkSequenceSuffix))
+	}
+	if err != nil {
+		meta, err = e.buildMeta()
+		if err != nil {
+			return nil, err
+		}
+		if e.readOnly {
+			e.meta = meta
+			return meta, nil
+		}
+		if err := e.saveMeta(meta); err != nil {
+			return nil, err
+		}
+	}
+	e.meta = meta
+	return meta, nil
+}
+
+// buildMeta counts rows of sheets with ranges of their pks and checksums and reads the pk sequence file of the table
+func (e *csvEngine) buildMeta() (*TableMeta, error) {
+	sheets, err := utils.GetSheetsFromFiles(e.tablePath)
+	if err != nil {
+		return nil, err
+	}
+	meta := &TableMeta{Sheets: make([]SheetMeta, 0, len(sheets)), NextPk: 1}
+	for _, sheet := range sheets {
+		sheetMeta, err := e.readSheetMeta(sheet)
+		if err != nil {
+			return nil, err
+		}
+		meta.Sheets = append(meta.Sheets, sheetMeta)
+	}
+	meta.updateFreeSheet(0, e.tuplesLimit)
+
+	if err := e.readPkFile(meta); err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+// readSheetMeta reads the sheet and returns the number of its rows, the range of their pks and the checksum
+func (e *csvEngine) readSheetMeta(sheet string) (SheetMeta, error) {
+	sheetMeta := SheetMeta{Name: sheet}
+	data, err := os.ReadFile(path.Join(e.tablePath, sheet))
+	if err != nil {
+		return sheetMeta, fmt.Errorf("can't read sheet %s: %w", sheet, err)
+	}
+	columns, records, err := csv.ParseRecords(data)
+	if err != nil {
+		return sheetMeta, fmt.Errorf("%w %s of table %s: %w", ErrDamagedSheet, sheet, e.table, err)
+	}
+	pk := slices.Index(columns, e.table+"_pk")
+	for _, record := range records {
+		if pk < 0 {
+			sheetMeta.addPk("")
+			continue
+		}
+		sheetMeta.addPk(record[pk])
+	}
+	sheetMeta.Checksum = sheetChecksum(data)
+	return sheetMeta, nil
+}
+
+// Writable returns ErrReadOnly while a sheet is damaged
+func (e *csvEngine) Writable() error {
+	return e.damaged.check()
+}
+
+// Check reads all sheets and compares them with the catalog, the table leaves quarantine if no sheet is damaged
+func (e *csvEngine) Check() ([]SheetStatus, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	meta, err := e.catalog()
+	if err != nil {
+		e.damaged.set(err)
+		return nil, err
+	}
+	sheets, err := utils.GetSheetsFromFiles(e.tablePath)
+	if err != nil {
+		return nil, err
+	}
+	statuses := make([]SheetStatus, 0, len(meta.Sheets))
+	for _, want := range meta.Sheets {
+		status := SheetStatus{Name: want.Name, Rows: want.Rows}
+		got, err := e.readSheetMeta(want.Name)
+		switch {
+		case err != nil:
+			status.Err = err
+		case want.Checksum != "" && got.Checksum != want.Checksum:
+			status.Err = fmt.Errorf("%w %s of table %s: checksum is %s instead of %s", ErrDamagedSheet, want.Name, e.table, got.Checksum, want.Checksum)
+		case got.Rows != want.Rows:
+			status.Err = fmt.Errorf("%w %s of table %s: %d rows instead of %d", ErrDamagedSheet, want.Name, e.table, got.Rows, want.Rows)
+		}
+		statuses = append(statuses, status)
+	}
+	for _, sheet := range sheets {
+		if !slices.ContainsFunc(meta.Sheets, func(s SheetMeta) bool { return s.Name == sheet }) {
+			statuses = append(statuses, SheetStatus{Name: sheet, Err: fmt.Errorf("%w %s of table %s: sheet isn't in the catalog", ErrDamagedSheet, sheet, e.table)})
+		}
+	}
+	e.damaged.reset(statuses)
+	return statuses, nil
+}
+
+// catalogMatches reports whether the saved catalog lists all sheets with their current checksums
+func (e *csvEngine) catalogMatches() bool {
+	data, err := os.ReadFile(path.Join(e.tablePath, e.table+metaFileSuffix))
+	if err != nil {
+		return false
+	}
+	var meta TableMeta
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return false
+	}
+	sheets, err := utils.GetSheetsFromFiles(e.tablePath)
+	if err != nil || len(sheets) != len(meta.Sheets) {
+		return false
+	}
+	for _, want := range meta.Sheets {
+		data, err := os.ReadFile(path.Join(e.tablePath, want.Name))
+		if err != nil || want.Checksum == "" || sheetChecksum(data) != want.Checksum {
+			return false
+		}
+	}
+	return true
+}
+
+// readPkFile sets NextPk from <table>_pk_sequence, it isn't changed if the file doesn't exist
+func (e *csvEngine) readPkFile(meta *TableMeta) error {
+	data, err := os.ReadFile(path.Join(e.tablePath, e.table+pkSequenceSuffix))
+	if err != nil {
+		return nil
+	}
+	id, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return fmt.Errorf("pk sequence of table %s isn't number: %w", e.table, err)
+	}
+	meta.NextPk = id
+	return nil
+}
+
+// syncPk reads NextPk from <table>_pk_sequence again if the file was changed after the last write
+func (e *csvEngine) syncPk(meta *TableMeta) error {
+	info, err := os.Stat(path.Join(e.tablePath, e.table+pkSequenceSuffix))
+	if err != nil || meta.pkFile == nil {
+		return nil
+	}
+	if info.ModTime().Equal(meta.pkFile.ModTime()) && info.Size() == meta.pkFile.Size() {
+		return nil
+	}
+	if err := e.readPkFile(meta); err != nil {
+		return err
+	}
+	meta.pkFile = info
+	return nil
+}
+
+// saveMeta writes the catalog to a temporary file and renames it, so the catalog is never written partially
+//
+// The pk of the next row is also written to <table>_pk_sequence for tools reading it.
+func (e *csvEngine) saveMeta(meta *TableMeta) error {
+	data, err := json.MarshalIndent(meta, "", "    ")
+	if err != nil {
+		return err
+	}
+	if err := utils.WriteFileAtomic(path.Join(e.tablePath, e.table+metaFileSuffix), data); err != nil {
+		return err
+	}
+	return e.savePk(meta)
+}
+
+// savePk writes the pk of the next row to <table>_pk_sequence through a temporary file
+func (e *csvEngine) savePk(meta *TableMeta) error {
+	pkPath := path.Join(e.tablePath, e.table+pkSequenceSuffix)
+	if err := utils.WriteFileAtomic(pkPath, []byte(strconv.FormatInt(meta.NextPk, 10))); err != nil {
+		return err
+	}
+	var err error
+	meta.pkFile, err = os.Stat(pkPath)
+	return err
+}
+
+// updateFreeSheet moves FreeSheet to the first sheet with free space starting from the index
+func (m *TableMeta) updateFreeSheet(from int, tuplesLimit int) {
+	m.FreeSheet = from
+	for m.FreeSheet < len(m.Sheets) && m.Sheets[m.FreeSheet].Rows >= tuplesLimit {
+		m.FreeSheet++
+	}
+}
+
+// sheetRewritten sets the number of rows of the rewritten sheet, the range of their pks and the checksum
+func (m *TableMeta) sheetRewritten(sheet string, pks []string, checksum string, tuplesLimit int) error {
+	for i := range m.Sheets {
+		if m.Sheets[i].Name != sheet {
+			continue
+		}
+		m.Sheets[i].setPks(pks)
+		m.Sheets[i].Checksum = checksum
+		if len(pks) < tuplesLimit && i < m.FreeSheet {
+			m.FreeSheet = i
+		}
+		return nil
+	}
+	return fmt.Errorf("sheet %s isn't in the catalog", sheet)
+}
+
+// checksum returns the checksum of the sheet, it's empty if the sheet isn't in the catalog or its checksum is unknown
+func (m *TableMeta) checksum(sheet string) string {
+	for _, sheetMeta := range m.Sheets {
+		if sheetMeta.Name == sheet {
+			return sheetMeta.Checksum
+		}
+	}
+	return ""
+}
+
+// sheetChecksum returns crc32 of the sheet file in hex
+func sheetChecksum(data []byte) string {
+	return fmt.Sprintf("%08x", crc32.ChecksumIEEE(data))
+}
+
+// extendChecksum returns the checksum of the sheet after data is appended to it, the unknown checksum stays unknown
+func extendChecksum(checksum string, data []byte) string {
+	crc, err := strconv.ParseUint(checksum, 16, 32)
+	if checksum == "" || data == nil || err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%08x", crc32.Update(uint32(crc), crc32.IEEETable, data))
+}
+
+// recordsChecksum returns the checksum of the sheet written by csv.WriteFile with the header and values of rows
+func recordsChecksum(columns []string, values [][]string) string {
+	header, err := csv.FormatRow(columns)
+	if err != nil {
+		return ""
+	}
+	checksum := sheetChecksum(header)
+	for _, row := range values {
+		line, err := csv.FormatRow(row)
+		if err != nil {
+			return ""
+		}
+		checksum = extendChecksum(checksum, line)
+	}
+	return checksum
+}
+
+// clone returns the copy of the catalog
+func (m *TableMeta) clone() TableMeta {
+	clone := *m
+	clone.Sheets = append([]SheetMeta(nil), m.Sheets...)
+	return clone
+}
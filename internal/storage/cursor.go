@@ -0,0 +1,170 @@
+package storage
+
+import (
+	"JacuteSQL/internal/data_structures/mymap"
+	"JacuteSQL/internal/lib/utils"
+	"errors"
+	"fmt"
+	"path"
+	"slices"
+)
+
+// rowCursor reads rows of the table sheet by sheet in order of sheet numbers
+//
+// Only one sheet is kept by the cursor at a time, sheets are read through the cache shared by all connections.
+type rowCursor struct {
+	table   string
+	dirPath string
+	sheets  []string
+	cache   *sheetCache
+	// checksums are checksums of sheets by names, damaged is the quarantine of the table with the sheets
+	checksums map[string]string
+	damaged   *quarantine
+	// sheet is the index of the open sheet in sheets, row is the number of rows read from it
+	sheet int
+	row   int
+	open  *cachedSheet
+}
+
+// newCursor creates the cursor over sheets of the directory, rows have keys table.column
+func newCursor(table string, dirPath string, cache *sheetCache) (*rowCursor, error) {
+	sheets, err := utils.GetSheetsFromFiles(dirPath)
+	if err != nil {
+		return nil, err
+	}
+	return &rowCursor{table: table, dirPath: dirPath, sheets: sheets, cache: cache, sheet: -1}, nil
+}
+
+// filterSheets keeps sheets with the numbers, sheets stay in order of numbers
+func filterSheets(sheets []string, numbers []int) []string {
+	filtered := make([]string, 0, len(numbers))
+	for _, sheet := range sheets {
+		if slices.Contains(numbers, utils.SheetNumber(sheet)) {
+			filtered = append(filtered, sheet)
+		}
+	}
+	return filtered
+}
+
+// tableCursor creates the cursor over rows of the table by its engine
+func (s *Storage) tableCursor(table string) (RowCursor, error) {
+	engine, ok := s.tableEngine(table)
+	if !ok {
+		return nil, ErrIncorectTable
+	}
+	return engine.Scan()
+}
+
+// Next returns the next row or nil after the last row, the cursor is closed at the end
+func (c *rowCursor) Next() (*mymap.CustomMap, error) {
+	for {
+		if c.open != nil && c.row < len(c.open.values) {
+			c.row++
+			return c.open.row(c.table, c.row-1), nil
+		}
+		c.open = nil
+
+		if c.sheet+1 >= len(c.sheets) {
+			return nil, nil
+		}
+		c.sheet++
+		c.row = 0
+		sheet, err := c.cache.readSheet(c.sheetPath(), c.checksums[c.sheets[c.sheet]])
+		if errors.Is(err, ErrDamagedSheet) {
+			if c.damaged != nil {
+				c.damaged.set(err)
+			}
+			return nil, err
+		}
+		if err != nil {
+			return nil, fmt.Errorf("can't read sheet %s: %w", c.sheetPath(), err)
+		}
+		c.open = sheet
+	}
+}
+
+// Location returns the number of the open sheet and the index of the last read row in it
+func (c *rowCursor) Location() RowLocation {
+	if c.sheet < 0 || c.sheet >= len(c.sheets) {
+		return RowLocation{}
+	}
+	return RowLocation{Sheet: utils.SheetNumber(c.sheets[c.sheet]), Row: c.row - 1}
+}
+
+// sheetPath returns the path of the open sheet
+func (c *rowCursor) sheetPath() string {
+	return path.Join(c.dirPath, c.sheets[c.sheet])
+}
+
+// Rewind closes the open sheet and moves the cursor before the first sheet
+func (c *rowCursor) Rewind() {
+	c.Close()
+	c.sheet = -1
+}
+
+// Sheets returns the number of sheets of the table
+func (c *rowCursor) Sheets() int {
+	return len(c.sheets)
+}
+
+// SheetsRead returns the number of opened sheets
+func (c *rowCursor) SheetsRead() int {
+	return c.sheet + 1
+}
+
+// Close releases the open sheet, it's safe to call it several times
+func (c *rowCursor) Close() {
+	c.open = nil
+}
+
+// scanRows calls fn for each row of the table
+func (s *Storage) scanRows(table string, fn func(row *mymap.CustomMap) error) error {
+	return s.scanLocated(table, nil, func(row *mymap.CustomMap, location RowLocation) error {
+		return fn(row)
+	})
+}
+
+// scanLookup reads rows found by the lookup, all rows are read if it's nil
+func (s *Storage) scanLookup(table string, lookup *indexLookup, fn func(row *mymap.CustomMap, location RowLocation) error) error {
+	if lookup == nil {
+		return s.scanLocated(table, nil, fn)
+	}
+	return s.scanLocated(table, lookup.sheets, func(row *mymap.CustomMap, location RowLocation) error {
+		if !lookup.contains(location) {
+			return nil
+		}
+		return fn(row, location)
+	})
+}
+
+// scanLocated calls fn for each row of the sheets of the table with the location of the row, nil sheets are all sheets
+func (s *Storage) scanLocated(table string, sheets []int, fn func(row *mymap.CustomMap, location RowLocation) error) error {
+	engine, ok := s.tableEngine(table)
+	if !ok {
+		return ErrIncorectTable
+	}
+	var cursor RowCursor
+	var err error
+	if sheets == nil {
+		cursor, err = engine.Scan()
+	} else {
+		cursor, err = engine.ScanSheets(sheets)
+	}
+	if err != nil {
+		return err
+	}
+	defer cursor.Close()
+
+	for {
+		row, err := cursor.Next()
+		if err != nil {
+			return err
+		}
+		if row == nil {
+			return nil
+		}
+		if err := fn(row, cursor.Location()); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,468 @@
+package storage
+
+import (
+	"JacuteSQL/internal/data_structures/mymap"
+	"JacuteSQL/internal/lib/utils"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/jacute/prettylogger"
+)
+
+// names of table engines
+const (
+	CSVEngine    = "csv"
+	MemoryEngine = "memory"
+	BinaryEngine = "binary"
+)
+
+const (
+	enginesFileName = "engines.json"
+)
+
+var (
+	ErrUnknownEngine = errors.New("unknown table engine")
+	ErrDamagedSheet  = errors.New("damaged sheet")
+	ErrReadOnly      = errors.New("table is read-only")
+	ErrNotDurable    = errors.New("engine doesn't keep rows after restart")
+)
+
+// TableEngine stores rows of one table, the executor reads and changes tables only through it
+//
+// Rows have keys table.column, values passed to Append are in order of columns, the pk is the first value.
+// Methods which change rows are called with the table locked.
+type TableEngine interface {
+	// Scan returns the cursor over all rows of the table
+	Scan() (RowCursor, error)
+	// ScanSheets returns the cursor over rows of the sheets, unknown sheets are skipped
+	ScanSheets(sheets []int) (RowCursor, error)
+	// Append adds the row to the table and returns its location
+	Append(values []string) (RowLocation, error)
+	// Rewrite calls change for each row of the sheets or of all sheets if sheets is nil,
+	// change returns the new row or nil to delete the row and true if the row is changed.
+	// Returns numbers of rewritten sheets, locations of rows in them are changed.
+	Rewrite(sheets []int, change func(row *mymap.CustomMap) (*mymap.CustomMap, bool)) ([]int, error)
+	// Truncate deletes all rows and resets the pk sequence
+	Truncate() error
+	// NextPk returns the pk of a new row and advances the pk sequence
+	NextPk() (int64, error)
+	// PeekPk returns the pk of the next row without advancing the pk sequence
+	PeekPk() (int64, error)
+	// SetPk sets the pk of the next row
+	SetPk(id int64) error
+	// Meta returns the catalog of the table
+	Meta() (TableMeta, error)
+	// Durable reports if rows are kept after restart, changes of other tables aren't written to the wal
+	Durable() bool
+	// Sync flushes written rows to the disk
+	Sync() error
+	// Recover drops cached state which can be behind the data after a crash, it's called before the wal is replayed
+	Recover() error
+	// Drop removes rows and files of the table, the directory of the table is kept
+	Drop() error
+	// Check verifies all sheets, the table is read-only while one of them is damaged
+	Check() ([]SheetStatus, error)
+	// Writable returns ErrReadOnly if the table is in quarantine
+	Writable() error
+}
+
+// flusher is an engine keeping changes of its catalog in memory, they are saved by Flush after each statement
+type flusher interface {
+	Flush() error
+}
+
+// flushTables saves catalogs of the tables changed by the statement, the error is logged because rows are already written
+func (s *Storage) flushTables(tables []string) {
+	for _, table := range tables {
+		engine, ok := s.tableEngine(table)
+		if !ok {
+			continue
+		}
+		if engine, ok := engine.(flusher); ok {
+			if err := engine.Flush(); err != nil {
+				s.log.Error("Can't save catalog of table", prettylogger.Err(err), slog.String("table", table))
+			}
+		}
+	}
+}
+
+// TableMeta is the catalog of the table: sheets or pages with numbers of rows and the pk of the next row
+type TableMeta struct {
+	Sheets []SheetMeta `json:"sheets"`
+	// FreeSheet is the index of the first sheet with free space, it's len(Sheets) if all sheets are full
+	FreeSheet int `json:"free_sheet"`
+	// NextPk is the pk of the next row, it's also written to <table>_pk_sequence
+	NextPk int64 `json:"next_pk"`
+	// pkFile is the state of <table>_pk_sequence after the last write, it's changed if the file is edited by hand
+	pkFile os.FileInfo
+}
+
+// SheetMeta is the name of the sheet, the number of rows in it and the range of their pks
+type SheetMeta struct {
+	Name string `json:"name"`
+	Rows int    `json:"rows"`
+	// Pks is nil if the range is unknown, e.g. in catalogs written before ranges were added, such sheets are always read
+	Pks *PkRange `json:"pks,omitempty"`
+	// Checksum is crc32 of the sheet file in hex, it's verified when the sheet is read and empty if it's unknown
+	Checksum string `json:"checksum,omitempty"`
+}
+
+// PkRange is the smallest and the largest pk of rows of the sheet
+type PkRange struct {
+	Min int64 `json:"min"`
+	Max int64 `json:"max"`
+}
+
+// addPk counts the added row and extends the range of pks of the sheet by its pk
+func (m *SheetMeta) addPk(pk string) {
+	id, err := strconv.ParseInt(pk, 10, 64)
+	switch {
+	case err != nil:
+		m.Pks = nil
+	case m.Rows == 0:
+		m.Pks = &PkRange{Min: id, Max: id}
+	case m.Pks != nil:
+		// the range is replaced, because copies of the catalog share it
+		m.Pks = &PkRange{Min: min(m.Pks.Min, id), Max: max(m.Pks.Max, id)}
+	}
+	m.Rows++
+}
+
+// setPks sets the number of rows and the range of pks of the rewritten sheet
+func (m *SheetMeta) setPks(pks []string) {
+	m.Rows, m.Pks = 0, nil
+	for _, pk := range pks {
+		m.addPk(pk)
+	}
+}
+
+// SheetStatus is the result of the check of the sheet or page, Err is nil if the sheet isn't damaged
+type SheetStatus struct {
+	Name string
+	Rows int
+	Err  error
+}
+
+// quarantine keeps the error of the damaged sheet of the table, the table is read-only while it's set
+type quarantine struct {
+	mu  sync.Mutex
+	err error
+}
+
+// set puts the table into quarantine if the error is about a damaged sheet or page
+func (q *quarantine) set(err error) {
+	if !errors.Is(err, ErrDamagedSheet) && !errors.Is(err, ErrDamagedPage) {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.err == nil {
+		q.err = err
+	}
+}
+
+// reset sets the result of the check of all sheets, the table leaves quarantine if there is no damaged sheet
+func (q *quarantine) reset(statuses []SheetStatus) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.err = nil
+	for _, status := range statuses {
+		if status.Err != nil {
+			q.err = status.Err
+			return
+		}
+	}
+}
+
+// check returns ErrReadOnly with the reason if the table is in quarantine
+func (q *quarantine) check() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.err != nil {
+		return fmt.Errorf("%w: %w", ErrReadOnly, q.err)
+	}
+	return nil
+}
+
+// RowLocation is the place of the row: the number of the sheet or page and the index of the row in it
+type RowLocation struct {
+	Sheet int `json:"sheet"`
+	Row   int `json:"row"`
+}
+
+// RowCursor reads rows of the table one by one
+type RowCursor interface {
+	// Next returns the next row or nil after the last row
+	Next() (*mymap.CustomMap, error)
+	// Location returns the location of the row returned by Next
+	Location() RowLocation
+	// Rewind moves the cursor before the first row
+	Rewind()
+	// Close releases resources of the cursor, it's safe to call it several times
+	Close()
+	// Sheets returns the number of sheets or pages of the table
+	Sheets() int
+	// SheetsRead returns the number of opened sheets or pages
+	SheetsRead() int
+}
+
+// engineFactory creates the engine of the table with the directory and columns
+type engineFactory func(s *Storage, table string, tablePath string, columns []string) (TableEngine, error)
+
+// engineFactories are available table engines by names
+var engineFactories = map[string]engineFactory{
+	CSVEngine:    newCSVEngine,
+	MemoryEngine: newMemoryEngine,
+	BinaryEngine: newBinaryEngine,
+}
+
+// engineNames returns names of available engines
+func engineNames() []string {
+	names := make([]string, 0, len(engineFactories))
+	for name := range engineFactories {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// normalizeEngine returns the lower case name of the engine, the empty name is csv
+func normalizeEngine(name string) (string, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if name == "" {
+		return CSVEngine, nil
+	}
+	if _, ok := engineFactories[name]; !ok {
+		return "", fmt.Errorf("%w %s, available engines: %s", ErrUnknownEngine, name, strings.Join(engineNames(), ", "))
+	}
+	return name, nil
+}
+
+// openEngine creates the engine of the table by the schema and registers the table, tablesMutex must be locked
+func (s *Storage) openEngine(table string, tablePath string, columns []string) error {
+	name, err := normalizeEngine(s.Schema.Engines[table])
+	if err != nil {
+		return err
+	}
+	if !s.readOnly {
+		s.recoverVacuum(tablePath)
+	}
+	engine, err := engineFactories[name](s, table, tablePath, columns)
+	if err != nil {
+		return err
+	}
+	s.engines.Add(table, engine)
+	s.TablePathes.Add(table, tablePath)
+	return nil
+}
+
+// setEngineName sets the engine of the table in the schema, tablesMutex must be locked
+func (s *Storage) setEngineName(table string, name string) {
+	if name == "" {
+		return
+	}
+	if s.Schema.Engines == nil {
+		s.Schema.Engines = make(map[string]string)
+	}
+	s.Schema.Engines[table] = name
+}
+
+// tableEngine returns the engine of the table
+func (s *Storage) tableEngine(table string) (TableEngine, bool) {
+	s.tablesMutex.RLock()
+	defer s.tablesMutex.RUnlock()
+
+	engine, ok := s.engines.Get(table).(TableEngine)
+	return engine, ok
+}
+
+// engineName returns the name of the engine of the table
+func (s *Storage) engineName(table string) string {
+	s.tablesMutex.RLock()
+	defer s.tablesMutex.RUnlock()
+
+	name, _ := normalizeEngine(s.Schema.Engines[table])
+	return name
+}
+
+// ConvertTable moves rows of the table to the new engine, e.g. from csv sheets to binary pages and back
+//
+// Rows are copied and synced before the engine is switched, so the table keeps the old engine after a failure.
+// Files of the old engine are removed after the switch, so a durable table can't be moved to the memory engine.
+func (s *Storage) ConvertTable(table string, name string) error {
+	const op = "storage.ConvertTable"
+	log := s.log.With(
+		slog.String("op", op),
+		slog.String("table", table),
+	)
+
+	name, err := normalizeEngine(name)
+	if err != nil {
+		return err
+	}
+	if err := s.blockTables([]string{table}); err != nil {
+		return err
+	}
+	defer s.unBlockTables([]string{table})
+
+	old, ok := s.tableEngine(table)
+	if !ok {
+		return ErrIncorectTable
+	}
+	oldName := s.engineName(table)
+	if oldName == name {
+		return nil
+	}
+	columns, _ := s.tableColumns(table)
+	tablePath, _ := s.tablePath(table)
+
+	engine, err := engineFactories[name](s, table, tablePath, columns)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if old.Durable() && !engine.Durable() {
+		return fmt.Errorf("%w: table %s can't be converted to %s, its rows would be lost", ErrNotDurable, table, name)
+	}
+	rowCount, err := copyRows(table, columns, old, engine)
+	if err != nil {
+		engine.Drop()
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	s.tablesMutex.Lock()
+	s.setEngineName(table, name)
+	err = s.saveEngineName(table, name)
+	if err != nil {
+		s.setEngineName(table, oldName)
+	} else {
+		s.engines.Add(table, engine)
+	}
+	s.tablesMutex.Unlock()
+	if err != nil {
+		engine.Drop()
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	// locations of rows are different in the new engine
+	s.resetIndexes(table)
+	if err := old.Drop(); err != nil {
+		log.Warn(
+			"Can't remove files of the old engine",
+			prettylogger.Err(err),
+			slog.String("engine", oldName),
+		)
+	}
+	log.Info(
+		"table converted",
+		slog.String("from", oldName),
+		slog.String("to", name),
+		slog.Int("rows", rowCount),
+	)
+	return nil
+}
+
+// copyRows replaces rows of the target engine with rows of the source one and copies the pk sequence
+func copyRows(table string, columns []string, source TableEngine, target TableEngine) (int, error) {
+	if err := target.Truncate(); err != nil {
+		return 0, err
+	}
+	cursor, err := source.Scan()
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close()
+
+	rowCount := 0
+	for {
+		row, err := cursor.Next()
+		if err != nil {
+			return 0, err
+		}
+		if row == nil {
+			break
+		}
+		if _, err := target.Append(rowValues(table, columns, row)); err != nil {
+			return 0, err
+		}
+		rowCount++
+	}
+	id, err := source.PeekPk()
+	if err != nil {
+		return 0, err
+	}
+	if err := target.SetPk(id); err != nil {
+		return 0, err
+	}
+	return rowCount, target.Sync()
+}
+
+// saveEngineName saves the engine of the table, tablesMutex must be locked
+//
+// Engines of tables created by CREATE TABLE are saved to tables.json, engines of tables from schema.json to engines.json.
+func (s *Storage) saveEngineName(table string, name string) error {
+	for _, definition := range s.createdTables {
+		if definition.Name != table {
+			continue
+		}
+		old := definition.Engine
+		definition.Engine = name
+		if err := s.saveTables(); err != nil {
+			definition.Engine = old
+			return err
+		}
+		return nil
+	}
+
+	engines, err := s.readEngines()
+	if err != nil {
+		return err
+	}
+	engines[table] = name
+	data, err := json.MarshalIndent(engines, "", "    ")
+	if err != nil {
+		return err
+	}
+	return utils.WriteFileAtomic(path.Join(s.databasePath(), enginesFileName), data)
+}
+
+// readEngines reads engines of converted tables from schema.json
+func (s *Storage) readEngines() (map[string]string, error) {
+	engines := make(map[string]string)
+	data, err := os.ReadFile(path.Join(s.databasePath(), enginesFileName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return engines, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &engines); err != nil {
+		return nil, fmt.Errorf("%s: %w", enginesFileName, err)
+	}
+	return engines, nil
+}
+
+// loadEngines sets engines of converted tables from schema.json, they take precedence over the schema
+func (s *Storage) loadEngines() error {
+	engines, err := s.readEngines()
+	if err != nil {
+		return fmt.Errorf("storage.loadEngines: %w", err)
+	}
+
+	s.tablesMutex.Lock()
+	defer s.tablesMutex.Unlock()
+
+	for table, name := range engines {
+		if s.Schema.Tables.Get(table) != nil {
+			s.setEngineName(table, name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,452 @@
+package storage
+
+import (
+	"JacuteSQL/internal/config"
+	"JacuteSQL/internal/data_structures/mymap"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+
+	"github.com/jacute/prettylogger"
+)
+
+// deletePlan collects rows deleted by DELETE and rows changed by referential actions
+//
+// Changes are applied only after all tables are checked, so RESTRICT doesn't leave half-deleted rows
+type deletePlan struct {
+	tables []string
+	// table -> pk -> deleted row, only pks are kept for the table which isn't referenced
+	deleted *mymap.CustomMap
+	// table -> pk -> row with columns set to empty values by SET NULL
+	nulled *mymap.CustomMap
+	// table -> locations of deleted and nulled rows, only their sheets are rewritten
+	located *mymap.CustomMap
+}
+
+// constraints returns all constraints of the schema
+func (s *Storage) constraints() []config.Constraint {
+	s.tablesMutex.RLock()
+	defer s.tablesMutex.RUnlock()
+
+	return slices.Clone(s.Schema.Constraints)
+}
+
+// foreignKeys returns foreign keys of the table
+func (s *Storage) foreignKeys(table string) []config.Constraint {
+	keys := make([]config.Constraint, 0)
+	for _, constraint := range s.constraints() {
+		if constraint.Type == ForeignKeyConstraint && constraint.Table == table {
+			keys = append(keys, constraint)
+		}
+	}
+	return keys
+}
+
+// referencingKeys returns foreign keys which reference the table
+func (s *Storage) referencingKeys(table string) []config.Constraint {
+	keys := make([]config.Constraint, 0)
+	for _, constraint := range s.constraints() {
+		if constraint.Type == ForeignKeyConstraint && constraint.References == table {
+			keys = append(keys, constraint)
+		}
+	}
+	return keys
+}
+
+// relatedTables returns tables with tables which their changes can check or change, result is sorted
+//
+// Direct parents are read to check inserted and updated rows, direct children are checked or changed by ON DELETE.
+// Children of tables reached by CASCADE are added too, because cascaded deletes apply their actions as well.
+func (s *Storage) relatedTables(tables []string) []string {
+	related := slices.Clone(tables)
+	constraints := s.constraints()
+	for _, constraint := range constraints {
+		if constraint.Type == ForeignKeyConstraint && slices.Contains(tables, constraint.Table) {
+			related = append(related, constraint.References)
+		}
+	}
+	cascaded := slices.Clone(tables)
+	for i := 0; i < len(cascaded); i++ {
+		for _, constraint := range constraints {
+			if constraint.Type != ForeignKeyConstraint || constraint.References != cascaded[i] {
+				continue
+			}
+			related = append(related, constraint.Table)
+			if constraint.OnDelete == CascadeAction && !slices.Contains(cascaded, constraint.Table) {
+				cascaded = append(cascaded, constraint.Table)
+			}
+		}
+	}
+	slices.Sort(related)
+	return slices.Compact(related)
+}
+
+// checkForeignKeys checks that rows of the table reference existing rows
+//
+// Rows with empty values in columns of the foreign key aren't checked. Tables must be locked.
+func (s *Storage) checkForeignKeys(table string, rows []*mymap.CustomMap) error {
+	for _, fk := range s.foreignKeys(table) {
+		index, err := s.referencedIndex(fk)
+		if err != nil {
+			return err
+		}
+		for _, row := range rows {
+			values, ok := fkValues(fk.Table, fk.Columns, row)
+			if !ok {
+				continue
+			}
+			// key of the parent index has its own order of columns
+			keyValues := make([]string, len(index.constraint.Columns))
+			for i, column := range index.constraint.Columns {
+				keyValues[i] = values[slices.Index(fk.RefColumns, column)]
+			}
+			if index.keys.Get(strings.Join(keyValues, "\x00")) == nil {
+				return fmt.Errorf(
+					"%w: (%s)=(%s) of table %s violates foreign key %s, it is not present in table %s",
+					ErrConstraintViolation, strings.Join(fk.Columns, ", "), strings.Join(values, ", "), table, fk.Name, fk.References,
+				)
+			}
+		}
+	}
+	return nil
+}
+
+// checkReferenced checks that updated rows don't change values referenced by other tables
+func (s *Storage) checkReferenced(table string, oldRows []*mymap.CustomMap, newRows []*mymap.CustomMap) error {
+	for _, fk := range s.referencingKeys(table) {
+		changedKeys := mymap.New()
+		for i, row := range oldRows {
+			oldValues, ok := fkValues(table, fk.RefColumns, row)
+			if !ok {
+				continue
+			}
+			newValues, _ := fkValues(table, fk.RefColumns, newRows[i])
+			if !slices.Equal(oldValues, newValues) {
+				changedKeys.Add(strings.Join(oldValues, "\x00"), true)
+			}
+		}
+		if changedKeys.Len() == 0 {
+			continue
+		}
+
+		err := s.scanRows(fk.Table, func(child *mymap.CustomMap) error {
+			values, ok := fkValues(fk.Table, fk.Columns, child)
+			if ok && changedKeys.Get(strings.Join(values, "\x00")) != nil {
+				return fmt.Errorf(
+					"%w: (%s)=(%s) of table %s is still referenced by foreign key %s from table %s",
+					ErrConstraintViolation, strings.Join(fk.RefColumns, ", "), strings.Join(values, ", "), table, fk.Name, fk.Table,
+				)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// referencedIndex returns the unique index of the referenced table for the foreign key
+func (s *Storage) referencedIndex(fk config.Constraint) (*uniqueIndex, error) {
+	indexes, err := s.uniqueIndexes(fk.References)
+	if err != nil {
+		return nil, err
+	}
+	constraint, _ := findUniqueConstraint(s.constraints(), fk.References, fk.RefColumns)
+	for _, index := range indexes {
+		if index.constraint.Name == constraint.Name {
+			return index, nil
+		}
+	}
+	return nil, fmt.Errorf("no unique index for foreign key %s", fk.Name)
+}
+
+// deleteRows deletes rows of the table which match and applies ON DELETE actions of foreign keys
+//
+// Rows of the table are read only from sheets found by the lookup if it isn't nil.
+// Returns the number of deleted rows of the table. All related tables must be locked.
+func (s *Storage) deleteRows(table string, lookup *indexLookup, match func(row *mymap.CustomMap) bool) (int, error) {
+	plan := &deletePlan{
+		deleted: mymap.New(),
+		nulled:  mymap.New(),
+		located: mymap.New(),
+	}
+	if len(s.referencingKeys(table)) == 0 {
+		deleted := plan.rows(plan.deleted, table)
+		err := s.scanLookup(table, lookup, func(row *mymap.CustomMap, location RowLocation) error {
+			if match(row) {
+				deleted.Add(rowPk(table, row), true)
+				plan.locate(table, location)
+			}
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		}
+	} else if err := s.planDelete(plan, table, lookup, match); err != nil {
+		return 0, err
+	}
+
+	// check rows changed by SET NULL before anything is written
+	for _, planTable := range plan.tables {
+		newRows, pks := plan.nulledRows(planTable)
+		if len(newRows) == 0 {
+			continue
+		}
+		if err := s.checkRows(planTable, newRows); err != nil {
+			return 0, err
+		}
+		indexes, err := s.uniqueIndexes(planTable)
+		if err != nil {
+			return 0, err
+		}
+		if err := checkUnique(indexes, planTable, newRows, pks); err != nil {
+			return 0, err
+		}
+		secondaryIndexes, err := s.tableIndexes(planTable)
+		if err != nil {
+			return 0, err
+		}
+		if err := checkIndexUnique(secondaryIndexes, newRows, plan.locations(planTable)); err != nil {
+			return 0, err
+		}
+	}
+
+	changes := make([]walOp, 0)
+	for _, planTable := range plan.tables {
+		deleted := plan.rows(plan.deleted, planTable).Keys()
+		if deleted.Len() > 0 {
+			changes = append(changes, walOp{Type: walDelete, Table: planTable, Pks: deleted.GetData()})
+		}
+		newRows, _ := plan.nulledRows(planTable)
+		if len(newRows) > 0 {
+			columns, _ := s.tableColumns(planTable)
+			change := walOp{Type: walUpdate, Table: planTable}
+			for _, row := range newRows {
+				change.Rows = append(change.Rows, rowValues(planTable, columns, row))
+			}
+			changes = append(changes, change)
+		}
+	}
+	done, err := s.logChanges(changes...)
+	if err != nil {
+		return 0, err
+	}
+	defer done()
+
+	for _, planTable := range plan.tables {
+		if err := s.applyDelete(plan, planTable); err != nil {
+			return 0, err
+		}
+	}
+	return plan.rows(plan.deleted, table).Len(), nil
+}
+
+// planDelete adds matched rows of the table to the plan and plans actions for rows which reference them
+func (s *Storage) planDelete(plan *deletePlan, table string, lookup *indexLookup, match func(row *mymap.CustomMap) bool) error {
+	deleted := plan.rows(plan.deleted, table)
+	newlyDeleted := make([]*mymap.CustomMap, 0)
+	err := s.scanLookup(table, lookup, func(row *mymap.CustomMap, location RowLocation) error {
+		if deleted.Get(rowPk(table, row)) == nil && match(row) {
+			deleted.Add(rowPk(table, row), row)
+			newlyDeleted = append(newlyDeleted, row)
+			plan.locate(table, location)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(newlyDeleted) == 0 {
+		return nil
+	}
+
+	for _, fk := range s.referencingKeys(table) {
+		keys := mymap.New()
+		for _, row := range newlyDeleted {
+			if values, ok := fkValues(table, fk.RefColumns, row); ok {
+				keys.Add(strings.Join(values, "\x00"), true)
+			}
+		}
+		references := func(row *mymap.CustomMap) bool {
+			values, ok := fkValues(fk.Table, fk.Columns, row)
+			return ok && keys.Get(strings.Join(values, "\x00")) != nil
+		}
+
+		switch fk.OnDelete {
+		case CascadeAction:
+			if err := s.planDelete(plan, fk.Table, nil, references); err != nil {
+				return err
+			}
+		case SetNullAction:
+			if err := s.planSetNull(plan, fk, references); err != nil {
+				return err
+			}
+		default:
+			childDeleted := plan.rows(plan.deleted, fk.Table)
+			err := s.scanRows(fk.Table, func(child *mymap.CustomMap) error {
+				if childDeleted.Get(rowPk(fk.Table, child)) == nil && references(child) {
+					values, _ := fkValues(fk.Table, fk.Columns, child)
+					return fmt.Errorf(
+						"%w: row of table %s is referenced by foreign key %s from table %s, (%s)=(%s)",
+						ErrConstraintViolation, table, fk.Name, fk.Table, strings.Join(fk.Columns, ", "), strings.Join(values, ", "),
+					)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// planSetNull plans empty values in columns of the foreign key for rows which reference deleted rows
+func (s *Storage) planSetNull(plan *deletePlan, fk config.Constraint, references func(row *mymap.CustomMap) bool) error {
+	nulled := plan.rows(plan.nulled, fk.Table)
+	return s.scanLocated(fk.Table, nil, func(child *mymap.CustomMap, location RowLocation) error {
+		if !references(child) {
+			return nil
+		}
+		plan.locate(fk.Table, location)
+		pk := rowPk(fk.Table, child)
+		newRow, ok := nulled.Get(pk).(*mymap.CustomMap)
+		if !ok {
+			newRow = mergeRows(child, mymap.New())
+		}
+		for _, column := range fk.Columns {
+			newRow.Add(fk.Table+"."+column, "")
+		}
+		if err := s.computeGenerated(fk.Table, newRow); err != nil {
+			return err
+		}
+		nulled.Add(pk, newRow)
+		return nil
+	})
+}
+
+// applyDelete rewrites sheets of the table with deleted and nulled rows of the plan
+func (s *Storage) applyDelete(plan *deletePlan, table string) error {
+	const op = "storage.applyDelete"
+	log := s.log.With(
+		slog.String("op", op),
+		slog.String("table", table),
+	)
+
+	engine, ok := s.tableEngine(table)
+	if !ok {
+		return ErrIncorectTable
+	}
+	deleted := plan.rows(plan.deleted, table)
+	nulled := plan.rows(plan.nulled, table)
+	if deleted.Len() == 0 && nulled.Len() == 0 {
+		return nil
+	}
+	indexes := s.builtIndexes(table)
+	secondaryIndexes, err := s.tableIndexes(table)
+	if err != nil {
+		return err
+	}
+	rewritten, err := engine.Rewrite(plan.sheets(table), func(row *mymap.CustomMap) (*mymap.CustomMap, bool) {
+		pk := rowPk(table, row)
+		if deleted.Get(pk) != nil {
+			updateIndexes(indexes, table, []*mymap.CustomMap{row}, nil)
+			return nil, true
+		}
+		if newRow, ok := nulled.Get(pk).(*mymap.CustomMap); ok {
+			updateIndexes(indexes, table, []*mymap.CustomMap{row}, []*mymap.CustomMap{newRow})
+			return newRow, true
+		}
+		return row, false
+	})
+	if err != nil {
+		log.Error(
+			"error writing rows",
+			prettylogger.Err(err),
+		)
+		s.dropIndexes(table)
+		s.resetIndexes(table)
+		return fmt.Errorf("error writing rows: %w", err)
+	}
+	if err := s.reindexSheets(table, secondaryIndexes, rewritten); err != nil {
+		log.Error(
+			"error saving indexes",
+			prettylogger.Err(err),
+		)
+		s.resetIndexes(table)
+	}
+	return nil
+}
+
+// rows returns rows of the table in the part of the plan
+func (p *deletePlan) rows(part *mymap.CustomMap, table string) *mymap.CustomMap {
+	if !slices.Contains(p.tables, table) {
+		p.tables = append(p.tables, table)
+	}
+	rows, ok := part.Get(table).(*mymap.CustomMap)
+	if !ok {
+		rows = mymap.New()
+		part.Add(table, rows)
+	}
+	return rows
+}
+
+// locate adds the location of the deleted or nulled row of the table
+func (p *deletePlan) locate(table string, location RowLocation) {
+	p.locations(table).Add(locationKey(location), location)
+}
+
+// locations returns locations of deleted and nulled rows of the table
+func (p *deletePlan) locations(table string) *mymap.CustomMap {
+	locations, ok := p.located.Get(table).(*mymap.CustomMap)
+	if !ok {
+		locations = mymap.New()
+		p.located.Add(table, locations)
+	}
+	return locations
+}
+
+// sheets returns numbers of sheets with deleted and nulled rows of the table
+func (p *deletePlan) sheets(table string) []int {
+	sheets := make([]int, 0)
+	keys := p.locations(table).Keys()
+	for i := 0; i < keys.Len(); i++ {
+		location := p.locations(table).Get(keys.Get(i)).(RowLocation)
+		if !slices.Contains(sheets, location.Sheet) {
+			sheets = append(sheets, location.Sheet)
+		}
+	}
+	slices.Sort(sheets)
+	return sheets
+}
+
+// nulledRows returns rows changed by SET NULL, which are not deleted, and their pks
+func (p *deletePlan) nulledRows(table string) ([]*mymap.CustomMap, []string) {
+	deleted := p.rows(p.deleted, table)
+	nulled := p.rows(p.nulled, table)
+	rows := make([]*mymap.CustomMap, 0)
+	pks := make([]string, 0)
+	keys := nulled.Keys()
+	for i := 0; i < keys.Len(); i++ {
+		if deleted.Get(keys.Get(i)) != nil {
+			continue
+		}
+		rows = append(rows, nulled.Get(keys.Get(i)).(*mymap.CustomMap))
+		pks = append(pks, keys.Get(i))
+	}
+	return rows, pks
+}
+
+// fkValues returns values of columns of the row, ok is false if one of them is empty
+func fkValues(table string, columns []string, row *mymap.CustomMap) ([]string, bool) {
+	values := make([]string, len(columns))
+	for i, column := range columns {
+		values[i], _ = row.Get(table + "." + column).(string)
+		if values[i] == "" {
+			return values, false
+		}
+	}
+	return values, true
+}
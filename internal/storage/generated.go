@@ -0,0 +1,295 @@
+package storage
+
+import (
+	"JacuteSQL/internal/config"
+	"JacuteSQL/internal/data_structures/mymap"
+	"fmt"
+	"math/big"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+var (
+	generatedRegexp = regexp.MustCompile(`(?is)^\s*GENERATED\s+ALWAYS\s+AS\s*\(`)
+	storedRegexp    = regexp.MustCompile(`(?i)^\s*STORED\b`)
+	tokenRegexp     = regexp.MustCompile(`^\s*(\d+(?:\.\d+)?|[\w]+(?:\.[\w]+)?|[-+*/()])`)
+)
+
+// divisionScale is the number of digits added to the scale of operands of division
+const divisionScale = 16
+
+// exprNode is a node of arithmetic expression of generated column
+//
+// Leaf is a column or a number, other nodes are operators + - * / with two operands
+type exprNode struct {
+	Operator    byte
+	Left, Right *exprNode
+	Column      string
+	Number      string
+}
+
+// exprParser parses tokens of the expression by priority of operators
+type exprParser struct {
+	tokens []string
+	pos    int
+}
+
+// parseExpression parses arithmetic expression of columns of the table and numbers, e.g. quantity * price
+//
+// Columns can be written with the table name, they are stored without it.
+func parseExpression(table string, str string) (*exprNode, error) {
+	tokens := make([]string, 0)
+	rest := strings.TrimSpace(str)
+	for rest != "" {
+		matches := tokenRegexp.FindStringSubmatch(rest)
+		if matches == nil {
+			return nil, fmt.Errorf("%w: unexpected %s in expression %s", ErrParse, rest, str)
+		}
+		tokens = append(tokens, matches[1])
+		rest = strings.TrimSpace(rest[len(matches[0]):])
+	}
+
+	parser := &exprParser{tokens: tokens}
+	node, err := parser.parseSum(table)
+	if err != nil {
+		return nil, err
+	}
+	if parser.pos != len(tokens) {
+		return nil, fmt.Errorf("%w: unexpected %s in expression %s", ErrParse, tokens[parser.pos], str)
+	}
+	return node, nil
+}
+
+// parseSum parses operands separated by + and -
+func (p *exprParser) parseSum(table string) (*exprNode, error) {
+	left, err := p.parseProduct(table)
+	if err != nil {
+		return nil, err
+	}
+	for p.pos < len(p.tokens) && (p.tokens[p.pos] == "+" || p.tokens[p.pos] == "-") {
+		operator := p.tokens[p.pos][0]
+		p.pos++
+		right, err := p.parseProduct(table)
+		if err != nil {
+			return nil, err
+		}
+		left = &exprNode{Operator: operator, Left: left, Right: right}
+	}
+	return left, nil
+}
+
+// parseProduct parses operands separated by * and /
+func (p *exprParser) parseProduct(table string) (*exprNode, error) {
+	left, err := p.parseOperand(table)
+	if err != nil {
+		return nil, err
+	}
+	for p.pos < len(p.tokens) && (p.tokens[p.pos] == "*" || p.tokens[p.pos] == "/") {
+		operator := p.tokens[p.pos][0]
+		p.pos++
+		right, err := p.parseOperand(table)
+		if err != nil {
+			return nil, err
+		}
+		left = &exprNode{Operator: operator, Left: left, Right: right}
+	}
+	return left, nil
+}
+
+// parseOperand parses a number, a column, an expression in parentheses or unary minus
+func (p *exprParser) parseOperand(table string) (*exprNode, error) {
+	if p.pos == len(p.tokens) {
+		return nil, fmt.Errorf("%w: operand expected at the end of expression", ErrParse)
+	}
+	token := p.tokens[p.pos]
+	p.pos++
+	switch {
+	case token == "(":
+		node, err := p.parseSum(table)
+		if err != nil {
+			return nil, err
+		}
+		if p.pos == len(p.tokens) || p.tokens[p.pos] != ")" {
+			return nil, fmt.Errorf("%w: ')' expected in expression", ErrParse)
+		}
+		p.pos++
+		return node, nil
+	case token == "-":
+		operand, err := p.parseOperand(table)
+		if err != nil {
+			return nil, err
+		}
+		return &exprNode{Operator: '-', Left: &exprNode{Number: "0"}, Right: operand}, nil
+	case numberRegexp.MatchString(token):
+		return &exprNode{Number: token}, nil
+	case columnRegexp.MatchString(token):
+		column := token
+		if fieldTable := tableOfField(token); fieldTable != "" {
+			if fieldTable != table {
+				return nil, fmt.Errorf("column %s of other table can't be used in expression of table %s", token, table)
+			}
+			column = strings.TrimPrefix(token, table+".")
+		}
+		return &exprNode{Column: column}, nil
+	default:
+		return nil, fmt.Errorf("%w: unexpected %s in expression", ErrParse, token)
+	}
+}
+
+// columns returns columns used in the expression
+func (n *exprNode) columns() []string {
+	if n == nil {
+		return nil
+	}
+	if n.Column != "" {
+		return []string{n.Column}
+	}
+	columns := n.Left.columns()
+	for _, column := range n.Right.columns() {
+		if !slices.Contains(columns, column) {
+			columns = append(columns, column)
+		}
+	}
+	return columns
+}
+
+// eval computes the expression on the row, the result is empty if any used column is empty
+func (n *exprNode) eval(table string, row *mymap.CustomMap) (string, bool, error) {
+	if n.Number != "" {
+		return n.Number, true, nil
+	}
+	if n.Column != "" {
+		value, _ := row.Get(table + "." + n.Column).(string)
+		if value == "" {
+			return "", false, nil
+		}
+		if _, ok := parseDecimal(value); !ok {
+			return "", false, fmt.Errorf("value '%s' of column %s is not a number", value, n.Column)
+		}
+		return value, true, nil
+	}
+
+	left, ok, err := n.Left.eval(table, row)
+	if !ok || err != nil {
+		return "", false, err
+	}
+	right, ok, err := n.Right.eval(table, row)
+	if !ok || err != nil {
+		return "", false, err
+	}
+	// Numbers are decimal, the result is rounded to the scale of operands, so 0.1 * 0.2 is 0.02
+	a, _ := parseDecimal(left)
+	b, _ := parseDecimal(right)
+	scale := max(decimalScale(a), decimalScale(b))
+	result := new(big.Rat)
+	switch n.Operator {
+	case '+':
+		result.Add(a, b)
+	case '-':
+		result.Sub(a, b)
+	case '*':
+		result.Mul(a, b)
+		scale = decimalScale(a) + decimalScale(b)
+	default:
+		if b.Sign() == 0 {
+			return "", false, fmt.Errorf("division by zero")
+		}
+		result.Quo(a, b)
+		scale += divisionScale
+	}
+	return formatDecimal(result, scale), true, nil
+}
+
+// parseDecimal parses the number exactly, without rounding it to a binary fraction
+func parseDecimal(value string) (*big.Rat, bool) {
+	if _, err := strconv.ParseFloat(value, 64); err != nil {
+		return nil, false
+	}
+	return new(big.Rat).SetString(value)
+}
+
+// decimalScale returns the number of digits after the point of the decimal number
+func decimalScale(number *big.Rat) int {
+	denom := new(big.Int).Set(number.Denom())
+	twos := 0
+	for denom.Bit(0) == 0 {
+		denom.Rsh(denom, 1)
+		twos++
+	}
+	fives := 0
+	five, rest := big.NewInt(5), new(big.Int)
+	for {
+		quotient, _ := new(big.Int).QuoRem(denom, five, rest)
+		if rest.Sign() != 0 {
+			break
+		}
+		denom = quotient
+		fives++
+	}
+	return max(twos, fives)
+}
+
+// formatDecimal rounds the number to the scale and trims trailing zeros
+func formatDecimal(number *big.Rat, scale int) string {
+	str := number.FloatString(scale)
+	if strings.Contains(str, ".") {
+		str = strings.TrimSuffix(strings.TrimRight(str, "0"), ".")
+	}
+	if str == "-0" {
+		return "0"
+	}
+	return str
+}
+
+// parseGeneratedOption parses "GENERATED ALWAYS AS (expr) STORED" of the column
+//
+// Returns the constraint and the rest of the string
+func parseGeneratedOption(constraint config.Constraint, str string) (config.Constraint, string, error) {
+	expr, end, ok := readParenthesized(str, len(generatedRegexp.FindString(str)))
+	if !ok {
+		return constraint, str, fmt.Errorf("%w: ')' expected after expression of generated column", ErrParse)
+	}
+	stored := storedRegexp.FindString(str[end:])
+	if stored == "" {
+		return constraint, str, fmt.Errorf("%w: STORED expected after expression of generated column", ErrParse)
+	}
+	constraint.Type = GeneratedConstraint
+	constraint.Expression = expr
+	return constraint, str[end+len(stored):], nil
+}
+
+// generatedColumns returns constraints of generated columns of the table
+func (s *Storage) generatedColumns(table string) []config.Constraint {
+	generated := make([]config.Constraint, 0)
+	for _, constraint := range s.constraints() {
+		if constraint.Table == table && constraint.Type == GeneratedConstraint {
+			generated = append(generated, constraint)
+		}
+	}
+	return generated
+}
+
+// isGenerated checks if the column of the table is generated
+func (s *Storage) isGenerated(table string, column string) bool {
+	return slices.ContainsFunc(s.generatedColumns(table), func(constraint config.Constraint) bool {
+		return constraint.Columns[0] == column
+	})
+}
+
+// computeGenerated writes values of generated columns to the row
+func (s *Storage) computeGenerated(table string, row *mymap.CustomMap) error {
+	for _, constraint := range s.generatedColumns(table) {
+		expr, err := parseExpression(table, constraint.Expression)
+		if err != nil {
+			return err
+		}
+		value, _, err := expr.eval(table, row)
+		if err != nil {
+			return fmt.Errorf("can't compute generated column %s: %w", constraint.Columns[0], err)
+		}
+		row.Add(table+"."+constraint.Columns[0], value)
+	}
+	return nil
+}
@@ -0,0 +1,803 @@
+package storage
+
+import (
+	"JacuteSQL/internal/data_structures/btree"
+	"JacuteSQL/internal/data_structures/mymap"
+	"JacuteSQL/internal/lib/utils"
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/jacute/prettylogger"
+)
+
+// types of indexes
+const (
+	HashIndex    = "hash"
+	OrderedIndex = "ordered"
+)
+
+const (
+	indexesFileName = "indexes.json"
+	indexesDirName  = "indexes"
+)
+
+var (
+	createIndexRegexp = regexp.MustCompile(`(?is)^CREATE\s+(UNIQUE\s+)?INDEX\s+(IF\s+NOT\s+EXISTS\s+)?(?:(\w+)\s+)?ON\s+(\w+)\s*(?:USING\s+(\w+)\s*)?\(([\w\s,]+)\)\s*;?$`)
+	dropIndexRegexp   = regexp.MustCompile(`(?i)^DROP\s+INDEX\s+(IF\s+EXISTS\s+)?(\w+)\s*;?$`)
+	showIndexesRegexp = regexp.MustCompile(`(?i)^SHOW\s+INDEXES\s*;?$`)
+)
+
+var (
+	ErrIndexNotFound = errors.New("index not found")
+)
+
+// Index is the secondary index created by CREATE INDEX, it maps values of columns to locations of rows
+//
+// The hash index is used for equality of all columns, the ordered one also for ranges of the first column.
+// Entries are written to indexes/<name>.json after each change of the table and built from rows if the file is missing.
+type Index struct {
+	Name    string   `json:"name"`
+	Table   string   `json:"table"`
+	Columns []string `json:"columns"`
+	Type    string   `json:"type"`
+	Unique  bool     `json:"unique,omitempty"`
+
+	// entries are read on first use and protected by the lock of the table
+	loaded bool
+	// keys maps joined values to entries, the tree keeps entries of the ordered index in order of values
+	keys *mymap.CustomMap
+	tree *btree.BTree[[]string, *indexEntry]
+}
+
+// indexEntry is the key of the index with locations of rows
+type indexEntry struct {
+	Values []string      `json:"values"`
+	Rows   []RowLocation `json:"rows"`
+}
+
+// indexLookup is the part of the condition which is checked by the index and locations of matching rows
+//
+// locations are nil if all rows of the sheets can match, e.g. for the range of pks.
+type indexLookup struct {
+	name      string
+	condition []*Node
+	locations *mymap.CustomMap
+	sheets    []int
+}
+
+// CreateIndex creates the index on columns of the table and builds it from rows
+func (s *Storage) CreateIndex(index *Index, ifNotExists bool) error {
+	const op = "storage.CreateIndex"
+	log := s.log.With(
+		slog.String("op", op),
+		slog.String("table", index.Table),
+	)
+
+	columns, ok := s.tableColumns(index.Table)
+	if !ok {
+		return fmt.Errorf("table %s not exists", index.Table)
+	}
+	if len(index.Columns) == 0 {
+		return fmt.Errorf("index on table %s has no columns", index.Table)
+	}
+	for i, column := range index.Columns {
+		if !slices.Contains(columns, column) {
+			return fmt.Errorf("column %s not exists in table %s", column, index.Table)
+		}
+		if slices.Contains(index.Columns[i+1:], column) {
+			return fmt.Errorf("duplicate column %s in index", column)
+		}
+	}
+	index.Type = strings.ToLower(index.Type)
+	if index.Type == "" {
+		index.Type = OrderedIndex
+	}
+	if index.Type != HashIndex && index.Type != OrderedIndex {
+		return fmt.Errorf("unknown index type %s, available types: %s, %s", index.Type, HashIndex, OrderedIndex)
+	}
+	if index.Name == "" {
+		index.Name = index.Table + "_" + strings.Join(index.Columns, "_") + "_idx"
+	}
+
+	if err := s.blockTables([]string{index.Table}); err != nil {
+		return err
+	}
+	defer s.unBlockTables([]string{index.Table})
+
+	s.secondaryMutex.Lock()
+	defer s.secondaryMutex.Unlock()
+
+	if s.secondaryIndexes.Get(index.Name) != nil {
+		if ifNotExists {
+			return nil
+		}
+		return fmt.Errorf("index %s already exists", index.Name)
+	}
+	if err := index.build(s); err != nil {
+		return err
+	}
+	if index.Unique {
+		for _, entry := range index.entries() {
+			if len(entry.Rows) > 1 && !emptyValues(entry.Values) {
+				return fmt.Errorf(
+					"%w: can't create unique index %s, key (%s)=(%s) is duplicated",
+					ErrConstraintViolation, index.Name, strings.Join(index.Columns, ", "), strings.Join(entry.Values, ", "),
+				)
+			}
+		}
+	}
+
+	s.secondaryIndexes.Add(index.Name, index)
+	if err := s.saveIndexes(); err != nil {
+		s.secondaryIndexes.Delete(index.Name)
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if err := s.saveIndexEntries(index); err != nil {
+		log.Warn("Can't save index entries", prettylogger.Err(err), slog.String("index", index.Name))
+	}
+
+	log.Info("index created", slog.String("index", index.Name), slog.Any("columns", index.Columns), slog.String("type", index.Type))
+	return nil
+}
+
+// DropIndex removes the index and its entries
+func (s *Storage) DropIndex(name string, ifExists bool) error {
+	const op = "storage.DropIndex"
+
+	s.secondaryMutex.RLock()
+	index, ok := s.secondaryIndexes.Get(name).(*Index)
+	s.secondaryMutex.RUnlock()
+	if !ok {
+		if ifExists {
+			return nil
+		}
+		return fmt.Errorf("%w: %s", ErrIndexNotFound, name)
+	}
+
+	if err := s.blockTables([]string{index.Table}); err != nil {
+		return err
+	}
+	defer s.unBlockTables([]string{index.Table})
+
+	s.secondaryMutex.Lock()
+	defer s.secondaryMutex.Unlock()
+
+	s.secondaryIndexes.Delete(name)
+	if err := s.saveIndexes(); err != nil {
+		s.secondaryIndexes.Add(name, index)
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	err := os.Remove(s.indexPath(name))
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	return nil
+}
+
+// ShowIndexes returns indexes with their tables, columns and types
+func (s *Storage) ShowIndexes() string {
+	s.secondaryMutex.RLock()
+	defer s.secondaryMutex.RUnlock()
+
+	names := s.secondaryIndexes.Keys().GetData()
+	slices.Sort(names)
+	var output strings.Builder
+	output.WriteString("index,table,columns,type,unique\n")
+	for _, name := range names {
+		index := s.secondaryIndexes.Get(name).(*Index)
+		output.WriteString(fmt.Sprintf("%s,%s,%s,%s,%t\n", index.Name, index.Table, strings.Join(index.Columns, " "), index.Type, index.Unique))
+	}
+	return output.String()
+}
+
+// loadIndexes reads definitions of indexes from the database directory, entries are read on first use
+func (s *Storage) loadIndexes() error {
+	const op = "storage.loadIndexes"
+	log := s.log.With(
+		slog.String("op", op),
+	)
+
+	data, err := os.ReadFile(path.Join(s.databasePath(), indexesFileName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	var indexes []*Index
+	if err := json.Unmarshal(data, &indexes); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	s.secondaryMutex.Lock()
+	defer s.secondaryMutex.Unlock()
+
+	for _, index := range indexes {
+		if _, ok := s.tableColumns(index.Table); !ok {
+			log.Warn("Index of unknown table is skipped", slog.String("index", index.Name), slog.String("table", index.Table))
+			continue
+		}
+		s.secondaryIndexes.Add(index.Name, index)
+	}
+	return nil
+}
+
+// saveIndexes writes definitions of indexes to the database directory, secondaryMutex must be locked
+func (s *Storage) saveIndexes() error {
+	names := s.secondaryIndexes.Keys().GetData()
+	slices.Sort(names)
+	indexes := make([]*Index, 0, len(names))
+	for _, name := range names {
+		indexes = append(indexes, s.secondaryIndexes.Get(name).(*Index))
+	}
+	data, err := json.MarshalIndent(indexes, "", "    ")
+	if err != nil {
+		return err
+	}
+	return utils.WriteFileAtomic(path.Join(s.databasePath(), indexesFileName), data)
+}
+
+// indexPath returns the path of the file with entries of the index
+func (s *Storage) indexPath(name string) string {
+	return path.Join(s.databasePath(), indexesDirName, name+".json")
+}
+
+// saveIndexEntries writes entries of the index, entries of tables which aren't durable are kept only in memory
+func (s *Storage) saveIndexEntries(index *Index) error {
+	if engine, ok := s.tableEngine(index.Table); !ok || !engine.Durable() {
+		return nil
+	}
+	data, err := json.Marshal(index.entries())
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(path.Join(s.databasePath(), indexesDirName), 0755); err != nil {
+		return err
+	}
+	return utils.WriteFileAtomic(s.indexPath(index.Name), data)
+}
+
+// tableIndexes returns indexes of the table with read entries, the table must be locked
+func (s *Storage) tableIndexes(table string) ([]*Index, error) {
+	s.secondaryMutex.RLock()
+	names := s.secondaryIndexes.Keys().GetData()
+	indexes := make([]*Index, 0)
+	for _, name := range names {
+		if index := s.secondaryIndexes.Get(name).(*Index); index.Table == table {
+			indexes = append(indexes, index)
+		}
+	}
+	s.secondaryMutex.RUnlock()
+	slices.SortFunc(indexes, func(a, b *Index) int { return strings.Compare(a.Name, b.Name) })
+
+	for _, index := range indexes {
+		if index.loaded {
+			continue
+		}
+		if err := s.readIndexEntries(index); err != nil {
+			s.log.Warn("Index is built from rows", prettylogger.Err(err), slog.String("index", index.Name))
+			if err := index.build(s); err != nil {
+				return nil, err
+			}
+			if err := s.saveIndexEntries(index); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return indexes, nil
+}
+
+// readIndexEntries reads entries of the index from its file
+func (s *Storage) readIndexEntries(index *Index) error {
+	data, err := os.ReadFile(s.indexPath(index.Name))
+	if err != nil {
+		return err
+	}
+	var entries []*indexEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return err
+	}
+	index.reset()
+	for _, entry := range entries {
+		if len(entry.Values) != len(index.Columns) {
+			return fmt.Errorf("entry of index %s has %d values", index.Name, len(entry.Values))
+		}
+		for _, location := range entry.Rows {
+			index.add(entry.Values, location)
+		}
+	}
+	index.loaded = true
+	return nil
+}
+
+// indexRows adds appended rows to indexes of the table and saves them
+func (s *Storage) indexRows(table string, indexes []*Index, rows []*mymap.CustomMap, locations []RowLocation) error {
+	for _, index := range indexes {
+		for i, row := range rows {
+			index.add(index.values(row), locations[i])
+		}
+		if err := s.saveIndexEntries(index); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reindexSheets replaces entries of rewritten sheets of the table by their rows and saves indexes
+func (s *Storage) reindexSheets(table string, indexes []*Index, sheets []int) error {
+	if len(indexes) == 0 || len(sheets) == 0 {
+		return nil
+	}
+	for _, index := range indexes {
+		index.removeSheets(sheets)
+	}
+	err := s.scanLocated(table, sheets, func(row *mymap.CustomMap, location RowLocation) error {
+		for _, index := range indexes {
+			index.add(index.values(row), location)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, index := range indexes {
+		if err := s.saveIndexEntries(index); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// clearIndexes removes all entries of indexes of the table after it's truncated
+func (s *Storage) clearIndexes(table string) error {
+	indexes, err := s.tableIndexes(table)
+	if err != nil {
+		return err
+	}
+	for _, index := range indexes {
+		index.reset()
+		index.loaded = true
+		if err := s.saveIndexEntries(index); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resetIndexes drops entries of indexes of the table, they are built from rows on next use
+//
+// It's called when locations of rows can differ from entries: after replay of the wal, conversion or a failed write.
+func (s *Storage) resetIndexes(table string) {
+	s.secondaryMutex.RLock()
+	defer s.secondaryMutex.RUnlock()
+
+	names := s.secondaryIndexes.Keys()
+	for i := 0; i < names.Len(); i++ {
+		index := s.secondaryIndexes.Get(names.Get(i)).(*Index)
+		if index.Table != table {
+			continue
+		}
+		index.reset()
+		err := os.Remove(s.indexPath(index.Name))
+		if err != nil && !os.IsNotExist(err) {
+			s.log.Warn("Can't remove index entries", prettylogger.Err(err), slog.String("index", index.Name))
+		}
+	}
+}
+
+// checkIndexUnique checks that new rows don't duplicate keys of unique indexes
+//
+// replaced are locations of rows which are replaced by new rows, their old keys are not conflicts
+func checkIndexUnique(indexes []*Index, rows []*mymap.CustomMap, replaced *mymap.CustomMap) error {
+	for _, index := range indexes {
+		if !index.Unique {
+			continue
+		}
+		seen := mymap.New()
+		for _, row := range rows {
+			values := index.values(row)
+			if emptyValues(values) {
+				continue
+			}
+			key := strings.Join(values, "\x00")
+			if seen.Get(key) != nil {
+				return index.violation(values)
+			}
+			seen.Add(key, true)
+
+			entry, ok := index.keys.Get(key).(*indexEntry)
+			if !ok {
+				continue
+			}
+			for _, location := range entry.Rows {
+				if replaced == nil || replaced.Get(locationKey(location)) == nil {
+					return index.violation(values)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// lookupIndex finds the index for the condition on the table and locations of rows which can match it
+//
+// The index is used for equality of all its columns, then ranges of pks of sheets are used for comparisons of the pk,
+// then the ordered index is used for comparisons of its first column.
+// Only conditions joined by AND are used, rows must be checked by the whole condition after the lookup.
+// Returns nil if there is no such index.
+func (s *Storage) lookupIndex(table string, head *Node, neededTables []string) (*indexLookup, error) {
+	predicates := indexPredicates(table, head, neededTables)
+	if len(predicates) == 0 {
+		return nil, nil
+	}
+	indexes, err := s.tableIndexes(table)
+	if err != nil {
+		return nil, err
+	}
+
+	// equality of all columns is preferred over a range
+	var lookup *indexLookup
+	for _, index := range indexes {
+		condition := make([]*Node, 0, len(index.Columns))
+		values := make([]string, 0, len(index.Columns))
+		for _, column := range index.Columns {
+			for _, predicate := range predicates {
+				if predicate.Field == table+"."+column && predicate.Operator == "=" {
+					condition = append(condition, predicate)
+					values = append(values, predicate.Operand.Value)
+					break
+				}
+			}
+		}
+		if len(condition) == len(index.Columns) {
+			lookup = &indexLookup{name: index.Name, condition: condition}
+			if entry, ok := index.keys.Get(strings.Join(values, "\x00")).(*indexEntry); ok {
+				lookup.setLocations(entry.Rows)
+			} else {
+				lookup.setLocations(nil)
+			}
+			return lookup, nil
+		}
+	}
+	if lookup, err := s.pkLookup(table, predicates); lookup != nil || err != nil {
+		return lookup, err
+	}
+	for _, index := range indexes {
+		if index.Type != OrderedIndex {
+			continue
+		}
+		condition := make([]*Node, 0)
+		for _, predicate := range predicates {
+			if predicate.Field == table+"."+index.Columns[0] {
+				condition = append(condition, predicate)
+			}
+		}
+		if len(condition) > 0 {
+			lookup = &indexLookup{name: index.Name, condition: condition}
+			lookup.setLocations(index.rangeLocations(condition))
+			return lookup, nil
+		}
+	}
+	return nil, nil
+}
+
+// pkLookup returns sheets whose ranges of pks can contain rows matching comparisons of the pk with numbers
+//
+// Returns nil if the pk isn't compared or the table has one sheet.
+func (s *Storage) pkLookup(table string, predicates []*Node) (*indexLookup, error) {
+	condition := make([]*Node, 0)
+	for _, predicate := range predicates {
+		if predicate.Field == table+"."+table+"_pk" && isIndexNumber(predicate.Operand.Value) {
+			condition = append(condition, predicate)
+		}
+	}
+	if len(condition) == 0 {
+		return nil, nil
+	}
+	engine, ok := s.tableEngine(table)
+	if !ok {
+		return nil, ErrIncorectTable
+	}
+	meta, err := engine.Meta()
+	if err != nil {
+		return nil, err
+	}
+	if len(meta.Sheets) <= 1 {
+		return nil, nil
+	}
+
+	lookup := &indexLookup{name: table + "_pk", condition: condition, sheets: make([]int, 0)}
+	for _, sheet := range meta.Sheets {
+		if sheet.Rows > 0 && (sheet.Pks == nil || sheet.Pks.matches(condition)) {
+			lookup.sheets = append(lookup.sheets, utils.SheetNumber(sheet.Name))
+		}
+	}
+	return lookup, nil
+}
+
+// matches checks that pks in the range can match all comparisons with numbers
+func (r *PkRange) matches(condition []*Node) bool {
+	low, high := float64(r.Min), float64(r.Max)
+	for _, node := range condition {
+		value, _ := strconv.ParseFloat(node.Operand.Value, 64)
+		switch node.Operator {
+		case "=":
+			if value < low || value > high {
+				return false
+			}
+		case "<":
+			if low >= value {
+				return false
+			}
+		case "<=":
+			if low > value {
+				return false
+			}
+		case ">":
+			if high <= value {
+				return false
+			}
+		case ">=":
+			if high < value {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// indexPredicates returns comparisons of columns of the table with values, which are joined by AND at the top of the condition
+func indexPredicates(table string, head *Node, neededTables []string) []*Node {
+	if head == nil {
+		return nil
+	}
+	switch head.NodeType {
+	case AndNode:
+		return append(indexPredicates(table, head.Left, neededTables), indexPredicates(table, head.Right, neededTables)...)
+	case ConditionNode:
+		if tableOfField(head.Field) != table || head.Operand.Param > 0 || head.Operand.isField(neededTables) {
+			return nil
+		}
+		if !slices.Contains([]string{"=", "<", "<=", ">", ">="}, head.Operator) {
+			return nil
+		}
+		return []*Node{head}
+	default:
+		return nil
+	}
+}
+
+// setLocations keeps locations of the lookup and their sheets in order of numbers
+func (l *indexLookup) setLocations(locations []RowLocation) {
+	l.locations = mymap.New()
+	l.sheets = make([]int, 0)
+	for _, location := range locations {
+		l.locations.Add(locationKey(location), true)
+		if !slices.Contains(l.sheets, location.Sheet) {
+			l.sheets = append(l.sheets, location.Sheet)
+		}
+	}
+	slices.Sort(l.sheets)
+}
+
+// contains checks that the row at the location is found by the index
+func (l *indexLookup) contains(location RowLocation) bool {
+	return l.locations == nil || l.locations.Get(locationKey(location)) != nil
+}
+
+// String returns the index and its condition for EXPLAIN
+func (l *indexLookup) String() string {
+	condition := make([]string, len(l.condition))
+	for i, node := range l.condition {
+		condition[i] = node.String()
+	}
+	return fmt.Sprintf("%s (%s)", l.name, strings.Join(condition, " AND "))
+}
+
+// build reads all rows of the table into entries of the index
+func (idx *Index) build(s *Storage) error {
+	idx.reset()
+	err := s.scanLocated(idx.Table, nil, func(row *mymap.CustomMap, location RowLocation) error {
+		idx.add(idx.values(row), location)
+		return nil
+	})
+	if err != nil {
+		idx.reset()
+		return err
+	}
+	idx.loaded = true
+	return nil
+}
+
+// reset removes all entries, they must be read again
+func (idx *Index) reset() {
+	idx.loaded = false
+	idx.keys = mymap.New()
+	idx.tree = btree.New[[]string, *indexEntry](compareIndexValues)
+}
+
+// values returns values of columns of the index in the row
+func (idx *Index) values(row *mymap.CustomMap) []string {
+	values := make([]string, len(idx.Columns))
+	for i, column := range idx.Columns {
+		values[i], _ = row.Get(idx.Table + "." + column).(string)
+	}
+	return values
+}
+
+// add adds the location of the row to the entry of values
+func (idx *Index) add(values []string, location RowLocation) {
+	key := strings.Join(values, "\x00")
+	entry, ok := idx.keys.Get(key).(*indexEntry)
+	if !ok {
+		entry = &indexEntry{Values: values}
+		idx.keys.Add(key, entry)
+		if idx.Type == OrderedIndex {
+			idx.tree.Put(values, entry)
+		}
+	}
+	entry.Rows = append(entry.Rows, location)
+}
+
+// removeSheets removes locations in the sheets and entries without locations
+func (idx *Index) removeSheets(sheets []int) {
+	keys := idx.keys.Keys()
+	for i := 0; i < keys.Len(); i++ {
+		entry := idx.keys.Get(keys.Get(i)).(*indexEntry)
+		entry.Rows = slices.DeleteFunc(entry.Rows, func(location RowLocation) bool {
+			return slices.Contains(sheets, location.Sheet)
+		})
+		if len(entry.Rows) == 0 {
+			idx.keys.Delete(keys.Get(i))
+			if idx.Type == OrderedIndex {
+				idx.tree.Delete(entry.Values)
+			}
+		}
+	}
+}
+
+// entries returns entries of the index, in order of values for the ordered index
+func (idx *Index) entries() []*indexEntry {
+	if idx.Type == OrderedIndex {
+		entries := make([]*indexEntry, 0, idx.tree.Len())
+		for it := idx.tree.First(); it.Valid(); it.Next() {
+			entries = append(entries, it.Value())
+		}
+		return entries
+	}
+	keys := idx.keys.Keys()
+	entries := make([]*indexEntry, 0, keys.Len())
+	for i := 0; i < keys.Len(); i++ {
+		entries = append(entries, idx.keys.Get(keys.Get(i)).(*indexEntry))
+	}
+	return entries
+}
+
+// rangeLocations returns locations of rows whose first column matches all comparisons
+//
+// Comparisons are checked by compareByOperator, so the result is the same as without the index.
+// Entries are searched by bounds where the order of the index agrees with the comparison, other entries are checked one by one.
+func (idx *Index) rangeLocations(condition []*Node) []RowLocation {
+	matches := func(entry *indexEntry) bool {
+		for _, node := range condition {
+			if !compareByOperator(node.Operator, entry.Values[0], node.Operand.Value) {
+				return false
+			}
+		}
+		return true
+	}
+	aboveLower := func(values []string) bool {
+		for _, node := range condition {
+			if slices.Contains([]string{"=", ">", ">="}, node.Operator) && compareValues(values[0], node.Operand.Value) < 0 {
+				return false
+			}
+		}
+		return true
+	}
+	belowUpper := func(entry *indexEntry) bool {
+		for _, node := range condition {
+			if slices.Contains([]string{"=", "<", "<="}, node.Operator) && compareValues(entry.Values[0], node.Operand.Value) > 0 {
+				return false
+			}
+		}
+		return true
+	}
+	numericOperands := true
+	for _, node := range condition {
+		numericOperands = numericOperands && isIndexNumber(node.Operand.Value)
+	}
+
+	isNaN := func(values []string) bool {
+		number, err := strconv.ParseFloat(values[0], 64)
+		return err == nil && math.IsNaN(number)
+	}
+	isNumber := func(values []string) bool {
+		_, err := strconv.ParseFloat(values[0], 64)
+		return err == nil
+	}
+
+	locations := make([]RowLocation, 0)
+	collect := func(it *btree.Iterator[[]string, *indexEntry], inSection func(values []string) bool, ordered bool) {
+		for ; it.Valid() && inSection(it.Key()); it.Next() {
+			if ordered && !belowUpper(it.Value()) {
+				break
+			}
+			if matches(it.Value()) {
+				locations = append(locations, it.Value().Rows...)
+			}
+		}
+	}
+	// NaN is a number for comparisons, but isn't ordered with other numbers
+	collect(idx.tree.First(), isNaN, false)
+	if numericOperands {
+		collect(idx.tree.Search(func(values []string) bool {
+			return !isNaN(values) && (!isNumber(values) || aboveLower(values))
+		}), isNumber, true)
+	} else {
+		collect(idx.tree.Search(func(values []string) bool { return !isNaN(values) }), isNumber, false)
+	}
+	collect(idx.tree.Search(func(values []string) bool {
+		return !isNumber(values) && aboveLower(values)
+	}), func(values []string) bool { return true }, true)
+	return locations
+}
+
+// violation returns the error for the duplicated key of the unique index
+func (idx *Index) violation(values []string) error {
+	return fmt.Errorf(
+		"%w: duplicate key (%s)=(%s) violates unique index %s",
+		ErrConstraintViolation, strings.Join(idx.Columns, ", "), strings.Join(values, ", "), idx.Name,
+	)
+}
+
+// compareIndexValues orders values of the ordered index, numbers are before other values and compared as numbers
+func compareIndexValues(a []string, b []string) int {
+	for i := range a {
+		if result := compareIndexValue(a[i], b[i]); result != 0 {
+			return result
+		}
+	}
+	return 0
+}
+
+func compareIndexValue(a string, b string) int {
+	numberA, errA := strconv.ParseFloat(a, 64)
+	numberB, errB := strconv.ParseFloat(b, 64)
+	switch {
+	case errA == nil && errB == nil:
+		if result := cmp.Compare(numberA, numberB); result != 0 {
+			return result
+		}
+	case errA == nil:
+		return -1
+	case errB == nil:
+		return 1
+	}
+	return strings.Compare(a, b)
+}
+
+// isIndexNumber checks that the value is compared as a number in order of the ordered index
+func isIndexNumber(value string) bool {
+	number, err := strconv.ParseFloat(value, 64)
+	return err == nil && !math.IsNaN(number)
+}
+
+// emptyValues checks that one of values is empty, such keys aren't checked by unique indexes
+func emptyValues(values []string) bool {
+	return slices.Contains(values, "")
+}
+
+// locationKey returns the key of the location for maps
+func locationKey(location RowLocation) string {
+	return strconv.Itoa(location.Sheet) + ":" + strconv.Itoa(location.Row)
+}
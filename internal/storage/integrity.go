@@ -0,0 +1,59 @@
+package storage
+
+import (
+	"fmt"
+	"log/slog"
+	"regexp"
+	"strings"
+
+	"github.com/jacute/prettylogger"
+)
+
+var (
+	checkTableRegexp = regexp.MustCompile(`(?i)^CHECK\s+TABLE\s+(\w+)\s*;?$`)
+)
+
+// CheckTable verifies all sheets of the table and returns the status of each sheet, "ok" or the reason of the damage
+//
+// The table with a damaged sheet is read-only until the check finds no damaged sheets, e.g. after the sheet is restored.
+func (s *Storage) CheckTable(table string) (string, error) {
+	const op = "storage.CheckTable"
+	log := s.log.With(
+		slog.String("op", op),
+		slog.String("table", table),
+	)
+
+	if err := s.blockTables([]string{table}); err != nil {
+		return "", err
+	}
+	defer s.unBlockTables([]string{table})
+
+	engine, ok := s.tableEngine(table)
+	if !ok {
+		return "", ErrIncorectTable
+	}
+	statuses, err := engine.Check()
+	if err != nil {
+		log.Error(
+			"Can't check table",
+			prettylogger.Err(err),
+		)
+		return "", err
+	}
+
+	var output strings.Builder
+	output.WriteString("sheet,rows,status\n")
+	for _, status := range statuses {
+		result := "ok"
+		if status.Err != nil {
+			result = status.Err.Error()
+			log.Warn(
+				"Damaged sheet",
+				slog.String("sheet", status.Name),
+				prettylogger.Err(status.Err),
+			)
+		}
+		output.WriteString(fmt.Sprintf("%s,%d,%s\n", status.Name, status.Rows, result))
+	}
+	return output.String(), nil
+}
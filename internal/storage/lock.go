@@ -1,16 +1,53 @@
 package storage
 
 import (
+	"errors"
 	"fmt"
+	"os"
+	"path"
 	"sync"
+	"syscall"
 )
 
+// databaseLockSuffix is the suffix of the lock file of the database in the storage directory
+const databaseLockSuffix = ".lock"
+
+var ErrDatabaseLocked = errors.New("database is used by another process")
+
+// LockDatabase takes the exclusive lock of the database for the process, the server and the admin tool take it at startup
+//
+// The lock is held while the returned file is open and it's released by the system when the process exits.
+func LockDatabase(storagePath string, name string) (*os.File, error) {
+	if err := os.MkdirAll(storagePath, 0755); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path.Join(storagePath, name+databaseLockSuffix), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		file.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, fmt.Errorf("%w: %s", ErrDatabaseLocked, name)
+		}
+		return nil, err
+	}
+	return file, nil
+}
+
+// blockTables locks tables, all tables are checked before locking
+//
+// To avoid deadlocks tables must be sorted and have no duplicates
 func (s *Storage) blockTables(tables []string) error {
+	mutexes := make([]*sync.Mutex, 0, len(tables))
 	for _, tableName := range tables {
-		mu, ok := s.tableBlockingMutex.Get(tableName).(*sync.Mutex)
+		mu, ok := s.tableMutex(tableName)
 		if !ok {
 			return fmt.Errorf("table %s not found", tableName)
 		}
+		mutexes = append(mutexes, mu)
+	}
+	for _, mu := range mutexes {
 		mu.Lock()
 	}
 	return nil
@@ -18,7 +55,7 @@ func (s *Storage) blockTables(tables []string) error {
 
 func (s *Storage) unBlockTables(tables []string) error {
 	for _, tableName := range tables {
-		mu, ok := s.tableBlockingMutex.Get(tableName).(*sync.Mutex)
+		mu, ok := s.tableMutex(tableName)
 		if !ok {
 			return fmt.Errorf("table %s not found", tableName)
 		}
@@ -26,3 +63,17 @@ func (s *Storage) unBlockTables(tables []string) error {
 	}
 	return nil
 }
+
+// tableMutex returns mutex of the table or materialized view
+func (s *Storage) tableMutex(name string) (*sync.Mutex, bool) {
+	s.tablesMutex.RLock()
+	mu, ok := s.tableBlockingMutex.Get(name).(*sync.Mutex)
+	s.tablesMutex.RUnlock()
+	if ok {
+		return mu, true
+	}
+	if view := s.getView(name); view != nil && view.Materialized {
+		return &view.mu, true
+	}
+	return nil, false
+}
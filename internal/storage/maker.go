@@ -1,8 +1,10 @@
 package storage
 
 import (
+	"JacuteSQL/internal/data_structures/mymap"
 	"JacuteSQL/internal/lib/utils"
 	"errors"
+	"fmt"
 	"log/slog"
 	"os"
 	"path"
@@ -31,18 +33,135 @@ func (s *Storage) Create() {
 		}
 	}
 
+	if err := s.recoverMigration(); err != nil {
+		panic("Can't roll back migration: " + err.Error())
+	}
+
+	if err := s.loadTables(); err != nil {
+		s.log.Error(
+			"Can't load tables",
+			prettylogger.Err(err),
+		)
+	}
+
+	if err := s.loadEngines(); err != nil {
+		panic("Can't load engines: " + err.Error())
+	}
+
 	keys := s.Schema.Tables.Keys()
 	for i := 0; i < keys.Len(); i++ {
 		tableName := keys.Get(i)
 		tablePath := path.Join(schemaPath, tableName)
+		if err := checkReservedName(tableName); err != nil {
+			panic("Invalid table: " + err.Error())
+		}
 
 		cols := s.Schema.Tables.Get(tableName).([]string)
 		s.Schema.Tables.Add(tableName, slices.Insert(cols, 0, tableName+"_pk"))
 		cols = s.Schema.Tables.Get(tableName).([]string)
-		s.CreateTable(tableName, tablePath, cols)
+		if err := s.openEngine(tableName, tablePath, cols); err != nil {
+			panic("Can't open table " + tableName + ": " + err.Error())
+		}
+	}
+
+	constraints, err := validateConstraints(s.Schema.Constraints, func(table string) ([]string, bool) {
+		columns, ok := s.Schema.Tables.Get(table).([]string)
+		return columns, ok
+	})
+	if err != nil {
+		panic("Invalid constraint: " + err.Error())
+	}
+	s.Schema.Constraints = constraints
+
+	if err := s.loadIndexes(); err != nil {
+		s.log.Error(
+			"Can't load indexes",
+			prettylogger.Err(err),
+		)
+	}
+
+	if err := s.recoverWAL(); err != nil {
+		panic("Can't recover from wal: " + err.Error())
+	}
+
+	if err := s.loadSequences(); err != nil {
+		s.log.Error(
+			"Can't load sequences",
+			prettylogger.Err(err),
+		)
+	}
+
+	if err := s.loadViews(); err != nil {
+		s.log.Error(
+			"Can't load views",
+			prettylogger.Err(err),
+		)
+	}
+
+	if err := s.checkConsistency(); err != nil {
+		panic("Storage is inconsistent: " + err.Error())
+	}
+
+	if err := s.migrateOnStartup(); err != nil {
+		panic("Can't migrate storage: " + err.Error())
 	}
 }
 
+// OpenReadOnly loads the existing database like Create without changes of files, it's used by checks of the admin tool
+//
+// The wal isn't replayed and an interrupted migration isn't rolled back, Inspect reports them as problems.
+// Directories and files of tables aren't created, catalogs aren't saved and changes of rows are refused.
+func (s *Storage) OpenReadOnly() error {
+	const op = "storage.OpenReadOnly"
+
+	if !utils.FileExists(s.databasePath()) {
+		return fmt.Errorf("%s: database %s doesn't exist", op, s.Schema.Name)
+	}
+	s.readOnly = true
+
+	if err := s.loadTables(); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if err := s.loadEngines(); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	keys := s.Schema.Tables.Keys()
+	for i := 0; i < keys.Len(); i++ {
+		tableName := keys.Get(i)
+		cols := s.Schema.Tables.Get(tableName).([]string)
+		s.Schema.Tables.Add(tableName, slices.Insert(cols, 0, tableName+"_pk"))
+		cols = s.Schema.Tables.Get(tableName).([]string)
+		if err := s.openEngine(tableName, path.Join(s.databasePath(), tableName), cols); err != nil {
+			return fmt.Errorf("%s: can't open table %s: %w", op, tableName, err)
+		}
+	}
+	constraints, err := validateConstraints(s.Schema.Constraints, func(table string) ([]string, bool) {
+		columns, ok := s.Schema.Tables.Get(table).([]string)
+		return columns, ok
+	})
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	s.Schema.Constraints = constraints
+	if err := s.loadIndexes(); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	entries, err := readWAL(path.Join(s.databasePath(), walFileName))
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	s.pendingWAL = len(entries)
+
+	if err := s.loadSequences(); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if err := s.loadViews(); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	return nil
+}
+
 // CreateTable adds a new table to the storage
 func (s *Storage) CreateTable(tableName string, tablePath string, columns []string) {
 	const op = "storage.CreateTable"
@@ -63,7 +182,6 @@ func (s *Storage) CreateTable(tableName string, tablePath string, columns []stri
 			panic("Can't create table: " + err.Error())
 		}
 	}
-	s.TablePathes.Add(tableName, tablePath)
 
 	header := strings.Join(columns, ",") + "\n"
 	firstSheetPath := path.Join(tablePath, "1.csv")
@@ -112,6 +230,14 @@ func (s *Storage) CreateTable(tableName string, tablePath string, columns []stri
 }
 
 func (s *Storage) Destroy() {
+	s.vacuumWG.Wait()
+	if s.wal != nil {
+		s.wal.close()
+		s.wal = nil
+	}
+	s.tablesMutex.Lock()
+	s.engines = mymap.New()
+	s.tablesMutex.Unlock()
 	if _, err := os.Stat(s.StoragePath); err == nil {
 		err = os.RemoveAll(s.StoragePath)
 		if err != nil {
@@ -0,0 +1,183 @@
+package storage
+
+import (
+	"JacuteSQL/internal/data_structures/mymap"
+	"slices"
+	"sync"
+)
+
+// memoryEngine keeps rows of the table in memory, the table is empty after restart
+//
+// It's used for tests and caches which don't need the disk, changes of the table aren't written to the wal.
+type memoryEngine struct {
+	table   string
+	columns []string
+	mu      sync.RWMutex
+	// rows have values in order of columns, a changed row is replaced by a new slice
+	rows   [][]string
+	nextPk int64
+}
+
+func newMemoryEngine(s *Storage, table string, tablePath string, columns []string) (TableEngine, error) {
+	return &memoryEngine{table: table, columns: columns, nextPk: 1}, nil
+}
+
+// Scan returns the cursor over rows of the table at the moment of the call
+func (e *memoryEngine) Scan() (RowCursor, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return &memoryCursor{engine: e, rows: e.rows, pos: -1}, nil
+}
+
+// ScanSheets returns the cursor over all rows if the sheet 1 is requested, all rows are in it
+func (e *memoryEngine) ScanSheets(sheets []int) (RowCursor, error) {
+	if !slices.Contains(sheets, 1) {
+		return &memoryCursor{engine: e, pos: -1}, nil
+	}
+	return e.Scan()
+}
+
+func (e *memoryEngine) Append(values []string) (RowLocation, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.rows = append(e.rows, append([]string(nil), values...))
+	return RowLocation{Sheet: 1, Row: len(e.rows) - 1}, nil
+}
+
+func (e *memoryEngine) Rewrite(sheets []int, change func(row *mymap.CustomMap) (*mymap.CustomMap, bool)) ([]int, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if sheets != nil && !slices.Contains(sheets, 1) {
+		return nil, nil
+	}
+	// scans started before keep the old slice
+	rows := make([][]string, 0, len(e.rows))
+	changed := false
+	for _, values := range e.rows {
+		row, ok := change(e.row(values))
+		changed = changed || ok
+		switch {
+		case !ok:
+			rows = append(rows, values)
+		case row != nil:
+			rows = append(rows, rowValues(e.table, e.columns, row))
+		}
+	}
+	e.rows = rows
+	if !changed {
+		return nil, nil
+	}
+	return []int{1}, nil
+}
+
+func (e *memoryEngine) Truncate() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.rows = nil
+	e.nextPk = 1
+	return nil
+}
+
+func (e *memoryEngine) NextPk() (int64, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.nextPk++
+	return e.nextPk - 1, nil
+}
+
+func (e *memoryEngine) PeekPk() (int64, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.nextPk, nil
+}
+
+func (e *memoryEngine) SetPk(id int64) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.nextPk = id
+	return nil
+}
+
+// Meta returns the catalog with one sheet for all rows
+func (e *memoryEngine) Meta() (TableMeta, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return TableMeta{Sheets: []SheetMeta{{Name: MemoryEngine, Rows: len(e.rows)}}, NextPk: e.nextPk}, nil
+}
+
+func (e *memoryEngine) Durable() bool {
+	return false
+}
+
+func (e *memoryEngine) Sync() error {
+	return nil
+}
+
+func (e *memoryEngine) Recover() error {
+	return nil
+}
+
+func (e *memoryEngine) Drop() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.rows = nil
+	return nil
+}
+
+// Check reports the only sheet of rows, rows in memory aren't damaged
+func (e *memoryEngine) Check() ([]SheetStatus, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return []SheetStatus{{Name: MemoryEngine, Rows: len(e.rows)}}, nil
+}
+
+func (e *memoryEngine) Writable() error {
+	return nil
+}
+
+// row returns the row with keys table.column
+func (e *memoryEngine) row(values []string) *mymap.CustomMap {
+	row := mymap.New()
+	for i, column := range e.columns {
+		row.Add(e.table+"."+column, values[i])
+	}
+	return row
+}
+
+// memoryCursor reads rows of the memory table
+type memoryCursor struct {
+	engine *memoryEngine
+	rows   [][]string
+	pos    int
+}
+
+func (c *memoryCursor) Next() (*mymap.CustomMap, error) {
+	if c.pos+1 >= len(c.rows) {
+		c.pos = len(c.rows)
+		return nil, nil
+	}
+	c.pos++
+	return c.engine.row(c.rows[c.pos]), nil
+}
+
+func (c *memoryCursor) Location() RowLocation {
+	return RowLocation{Sheet: 1, Row: c.pos}
+}
+
+func (c *memoryCursor) Rewind() {
+	c.pos = -1
+}
+
+func (c *memoryCursor) Close() {}
+
+func (c *memoryCursor) Sheets() int {
+	return 1
+}
+
+func (c *memoryCursor) SheetsRead() int {
+	if c.pos < 0 {
+		return 0
+	}
+	return 1
+}
@@ -0,0 +1,338 @@
+package storage
+
+import (
+	"JacuteSQL/internal/lib/utils"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/jacute/prettylogger"
+)
+
+var (
+	migrationFileRegexp = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+)
+
+const (
+	migrationsTable      = "schema_migrations"
+	migrationSnapshotExt = ".migration"
+)
+
+// directions of migrations
+const (
+	MigrationUp   = "up"
+	MigrationDown = "down"
+)
+
+// Migration is a pair of scripts <version>_<name>.up.sql and <version>_<name>.down.sql from the migrations directory
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+	Applied bool
+}
+
+// LoadMigrations reads scripts from the migrations directory and marks applied ones, migrations are sorted by version
+func (s *Storage) LoadMigrations() ([]*Migration, error) {
+	release, err := s.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return s.loadMigrations()
+}
+
+// loadMigrations is LoadMigrations for the caller holding the storage
+func (s *Storage) loadMigrations() ([]*Migration, error) {
+	const op = "storage.LoadMigrations"
+
+	migrations := make([]*Migration, 0)
+	dir := s.Schema.Migrations.Path
+	if dir == "" {
+		return migrations, nil
+	}
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	for _, file := range files {
+		matches := migrationFileRegexp.FindStringSubmatch(file.Name())
+		if file.IsDir() || matches == nil {
+			continue
+		}
+		version, _ := strconv.Atoi(matches[1])
+		i := slices.IndexFunc(migrations, func(migration *Migration) bool { return migration.Version == version })
+		if i < 0 {
+			migrations = append(migrations, &Migration{Version: version, Name: matches[2]})
+			i = len(migrations) - 1
+		} else if migrations[i].Name != matches[2] {
+			return nil, fmt.Errorf("%s: migrations %s and %s have the same version %d", op, migrations[i].Name, matches[2], version)
+		}
+		script, err := os.ReadFile(path.Join(dir, file.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+		if matches[3] == MigrationUp {
+			migrations[i].Up = stripComments(string(script))
+		} else {
+			migrations[i].Down = stripComments(string(script))
+		}
+	}
+	slices.SortFunc(migrations, func(a, b *Migration) int {
+		return a.Version - b.Version
+	})
+
+	applied, err := s.appliedMigrations()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	for _, migration := range migrations {
+		if _, ok := applied[migration.Version]; ok {
+			migration.Applied = true
+			delete(applied, migration.Version)
+		}
+	}
+	// scripts of applied migrations are removed, they can't be reverted
+	for version, name := range applied {
+		migrations = append(migrations, &Migration{Version: version, Name: name, Applied: true})
+	}
+	slices.SortFunc(migrations, func(a, b *Migration) int {
+		return a.Version - b.Version
+	})
+	return migrations, nil
+}
+
+// LatestMigration returns the largest version in the migrations directory, 0 if there are no migrations
+func (s *Storage) LatestMigration() (int, error) {
+	migrations, err := s.LoadMigrations()
+	if err != nil {
+		return 0, err
+	}
+	if len(migrations) == 0 {
+		return 0, nil
+	}
+	return migrations[len(migrations)-1].Version, nil
+}
+
+// Migrate applies up scripts of pending migrations up to the target version or down scripts of applied ones above it
+// by the direction
+//
+// Migrations are executed by the executor and recorded in schema_migrations in one transaction: the database
+// directory is copied once before the first migration and the copy is restored if a statement fails. Other commands
+// wait until migrations are finished. After the restore the storage is closed, commands return ErrStorageClosed and
+// it must be opened again, rows of memory tables aren't copied and they are lost like at restart.
+// Returns lines version,name,direction of applied migrations.
+func (s *Storage) Migrate(direction string, target int) (string, error) {
+	const op = "storage.Migrate"
+	log := s.log.With(
+		slog.String("op", op),
+		slog.String("direction", direction),
+		slog.Int("target", target),
+	)
+
+	if direction != MigrationUp && direction != MigrationDown {
+		return "", fmt.Errorf("unknown migration direction %s", direction)
+	}
+	s.exclusive.Lock()
+	defer s.exclusive.Unlock()
+	if s.closed {
+		return "", ErrStorageClosed
+	}
+	migrations, err := s.loadMigrations()
+	if err != nil {
+		return "", err
+	}
+	plan := make([]*Migration, 0)
+	for _, migration := range migrations {
+		switch {
+		case direction == MigrationUp && !migration.Applied && migration.Version <= target:
+			if migration.Up == "" {
+				return "", fmt.Errorf("migration %d_%s has no up script", migration.Version, migration.Name)
+			}
+			plan = append(plan, migration)
+		case direction == MigrationDown && migration.Applied && migration.Version > target:
+			if migration.Down == "" {
+				return "", fmt.Errorf("migration %d_%s has no down script", migration.Version, migration.Name)
+			}
+			plan = slices.Insert(plan, 0, migration)
+		}
+	}
+
+	var output strings.Builder
+	output.WriteString("version,name,direction\n")
+	if len(plan) == 0 {
+		return output.String(), nil
+	}
+	if err := s.snapshotDatabase(); err != nil {
+		return "", fmt.Errorf("%s: %w", op, err)
+	}
+	for _, migration := range plan {
+		if err := s.applyMigration(migration, direction); err != nil {
+			log.Error(
+				"Migration failed",
+				slog.Int("version", migration.Version),
+				prettylogger.Err(err),
+			)
+			err = fmt.Errorf("migration %d_%s %s failed: %w", migration.Version, migration.Name, direction, err)
+			// engines, caches and indexes don't match the restored files
+			s.closed = true
+			if restoreErr := s.restoreDatabase(); restoreErr != nil {
+				return "", fmt.Errorf("%w, database isn't restored: %s", err, restoreErr.Error())
+			}
+			return "", err
+		}
+		log.Info(
+			"Migration applied",
+			slog.Int("version", migration.Version),
+			slog.String("name", migration.Name),
+		)
+		output.WriteString(fmt.Sprintf("%d,%s,%s\n", migration.Version, migration.Name, direction))
+	}
+	if s.wal != nil {
+		if err := s.wal.sync(); err != nil {
+			return "", fmt.Errorf("%s: %w", op, err)
+		}
+	}
+	if err := os.RemoveAll(s.databasePath() + migrationSnapshotExt); err != nil {
+		return "", fmt.Errorf("%s: %w", op, err)
+	}
+	return output.String(), nil
+}
+
+// applyMigration executes the script of the migration and records its version, the storage is held by Migrate
+func (s *Storage) applyMigration(migration *Migration, direction string) error {
+	if err := s.ensureMigrationsTable(); err != nil {
+		return err
+	}
+	script := migration.Up
+	if direction == MigrationDown {
+		script = migration.Down
+	}
+	session := s.NewSession()
+	session.exclusive = true
+	if _, err := session.ExecScript(script); err != nil {
+		return err
+	}
+	var err error
+	if direction == MigrationUp {
+		_, err = s.exec(fmt.Sprintf("INSERT INTO %s (version, name) VALUES ('%d', '%s')", migrationsTable, migration.Version, migration.Name))
+	} else {
+		_, err = s.exec(fmt.Sprintf("DELETE FROM %s WHERE %s.version = '%d'", migrationsTable, migrationsTable, migration.Version))
+	}
+	return err
+}
+
+// ensureMigrationsTable creates the table of applied migrations if it doesn't exist
+func (s *Storage) ensureMigrationsTable() error {
+	_, err := s.exec(fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (version UNIQUE, name, applied_at DEFAULT CURRENT_TIMESTAMP)", migrationsTable))
+	return err
+}
+
+// appliedMigrations returns names of applied migrations by versions
+func (s *Storage) appliedMigrations() (map[int]string, error) {
+	applied := make(map[int]string)
+	if _, ok := s.tableColumns(migrationsTable); !ok {
+		return applied, nil
+	}
+	output, err := s.exec(fmt.Sprintf("SELECT %s.version, %s.name FROM %s", migrationsTable, migrationsTable, migrationsTable))
+	if err != nil {
+		return nil, err
+	}
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	for _, line := range lines[1:] {
+		values := strings.SplitN(line, ",", 2)
+		if len(values) != 2 {
+			continue
+		}
+		version, err := strconv.Atoi(values[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid migration version %s", values[0])
+		}
+		applied[version] = values[1]
+	}
+	return applied, nil
+}
+
+// snapshotDatabase copies the database directory to <database>.migration
+//
+// The copy is written to a temporary directory first, so an incomplete copy is never restored.
+func (s *Storage) snapshotDatabase() error {
+	s.vacuumWG.Wait()
+	databasePath := s.databasePath()
+	tmpPath := databasePath + migrationSnapshotExt + ".tmp"
+	if err := os.RemoveAll(tmpPath); err != nil {
+		return err
+	}
+	if err := utils.CopyDir(databasePath, tmpPath); err != nil {
+		os.RemoveAll(tmpPath)
+		return err
+	}
+	if err := os.Rename(tmpPath, databasePath+migrationSnapshotExt); err != nil {
+		return err
+	}
+	return utils.SyncDir(s.StoragePath)
+}
+
+// restoreDatabase replaces the database directory with the copy made before the migration
+func (s *Storage) restoreDatabase() error {
+	// tables compacted by statements of the migration
+	s.vacuumWG.Wait()
+	databasePath := s.databasePath()
+	if s.wal != nil {
+		s.wal.close()
+		s.wal = nil
+	}
+	if err := os.RemoveAll(databasePath); err != nil {
+		return err
+	}
+	if err := os.Rename(databasePath+migrationSnapshotExt, databasePath); err != nil {
+		return err
+	}
+	return utils.SyncDir(s.StoragePath)
+}
+
+// recoverMigration restores the database directory if the server is stopped during a migration
+func (s *Storage) recoverMigration() error {
+	const op = "storage.recoverMigration"
+
+	databasePath := s.databasePath()
+	if err := os.RemoveAll(databasePath + migrationSnapshotExt + ".tmp"); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if !utils.FileExists(databasePath + migrationSnapshotExt) {
+		return nil
+	}
+	if err := s.restoreDatabase(); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	s.log.Warn("Interrupted migration is rolled back", slog.String("op", op))
+	return nil
+}
+
+// migrateOnStartup applies pending migrations if migrations.auto is set in schema.json
+func (s *Storage) migrateOnStartup() error {
+	if !s.Schema.Migrations.Auto {
+		return nil
+	}
+	latest, err := s.LatestMigration()
+	if err != nil {
+		return err
+	}
+	_, err = s.Migrate(MigrationUp, latest)
+	return err
+}
+
+// stripComments removes lines starting with -- from the script
+func stripComments(script string) string {
+	lines := strings.Split(script, "\n")
+	lines = slices.DeleteFunc(lines, func(line string) bool {
+		return strings.HasPrefix(strings.TrimSpace(line), "--")
+	})
+	return strings.Join(lines, "\n")
+}
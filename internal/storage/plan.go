@@ -0,0 +1,578 @@
+package storage
+
+import (
+	"JacuteSQL/internal/data_structures/mymap"
+	"JacuteSQL/internal/data_structures/mysl"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// planNode is an operator of the query plan
+//
+// Rows are pulled from the root operator by next, each operator pulls rows from its children.
+type planNode interface {
+	open() error
+	// next returns the next row or nil if there are no more rows
+	next() (*mymap.CustomMap, error)
+	// describe returns the operator description for EXPLAIN
+	describe() string
+	children() []planNode
+	stats() *planStats
+}
+
+// planStats is collected while the plan is executed and printed by EXPLAIN ANALYZE
+type planStats struct {
+	rows    int
+	sheets  int
+	elapsed time.Duration
+}
+
+// scanNode reads rows of the table or materialized view by the cursor, one sheet is open at a time
+type scanNode struct {
+	table  string
+	cursor RowCursor
+	planStats
+}
+
+// indexScanNode reads only sheets with rows found by the index and skips other rows of these sheets
+type indexScanNode struct {
+	scanNode
+	lookup *indexLookup
+}
+
+// viewNode executes the plan of the view and renames fields to view columns
+type viewNode struct {
+	view  *View
+	child planNode
+	planStats
+}
+
+// filterNode returns rows of the child which match the condition
+type filterNode struct {
+	s            *Storage
+	head         *Node
+	neededTables []string
+	rowTables    []string
+	child        planNode
+	planStats
+}
+
+// joinNode returns the cross join of rows of children, the right child is read once and kept in memory
+type joinNode struct {
+	left      planNode
+	right     planNode
+	rightRows *mysl.MySl[*mymap.CustomMap]
+	leftRow   *mymap.CustomMap
+	row       int
+	planStats
+}
+
+// aggregateNode groups rows of the child and calculates aggregate functions
+type aggregateNode struct {
+	fields  []string
+	groupBy []string
+	child   planNode
+	rows    *mysl.MySl[*mymap.CustomMap]
+	row     int
+	planStats
+}
+
+// sortNode sorts rows of the child by ORDER BY fields
+type sortNode struct {
+	orderBy []orderField
+	child   planNode
+	rows    []*mymap.CustomMap
+	row     int
+	planStats
+}
+
+// projectNode keeps only selected fields of rows
+type projectNode struct {
+	fields []string
+	child  planNode
+	planStats
+}
+
+// buildPlan validates the query and builds its operator tree
+//
+// Parts of WHERE on one table are checked right after the scan, conditions between tables after the join.
+func (s *Storage) buildPlan(query *selectQuery) (planNode, error) {
+	if err := s.validateQuery(query); err != nil {
+		return nil, err
+	}
+
+	var root planNode
+	for _, table := range query.Tables {
+		source, err := s.sourcePlan(table)
+		if err != nil {
+			return nil, err
+		}
+		if query.head != nil {
+			if head := conditionForTables(query.head, query.Tables, []string{table}); head != nil {
+				if source, err = s.indexPlan(source, head, query.Tables); err != nil {
+					return nil, err
+				}
+				source = &filterNode{s: s, head: head, neededTables: query.Tables, rowTables: []string{table}, child: source}
+			}
+		}
+		if root == nil {
+			root = source
+		} else {
+			root = &joinNode{left: root, right: source}
+		}
+	}
+	if query.head != nil && len(query.Tables) > 1 {
+		root = &filterNode{s: s, head: query.head, neededTables: query.Tables, rowTables: query.Tables, child: root}
+	}
+
+	if query.aggregated() {
+		root = &aggregateNode{fields: query.Fields, groupBy: query.GroupBy, child: root}
+	}
+	if len(query.OrderBy) > 0 {
+		root = &sortNode{orderBy: query.OrderBy, child: root}
+	}
+	return &projectNode{fields: query.Fields, child: root}, nil
+}
+
+// sourcePlan returns the scan of the table or materialized view or the plan of the view
+func (s *Storage) sourcePlan(name string) (planNode, error) {
+	view := s.getView(name)
+	if view == nil {
+		cursor, err := s.tableCursor(name)
+		if err != nil {
+			return nil, err
+		}
+		return &scanNode{table: name, cursor: cursor}, nil
+	}
+	if view.Materialized {
+		cursor, err := newCursor(name, s.viewPath(view), s.cache)
+		if err != nil {
+			return nil, err
+		}
+		return &scanNode{table: name, cursor: cursor}, nil
+	}
+
+	if err := s.validateView(view); err != nil {
+		return nil, err
+	}
+	child, err := s.buildPlan(view.query)
+	if err != nil {
+		return nil, fmt.Errorf("view %s: %w", view.Name, err)
+	}
+	return &viewNode{view: view, child: child}, nil
+}
+
+// indexPlan replaces the scan of the table by the index scan if an index can be used for the condition
+func (s *Storage) indexPlan(source planNode, head *Node, neededTables []string) (planNode, error) {
+	scan, ok := source.(*scanNode)
+	if !ok || s.getView(scan.table) != nil {
+		return source, nil
+	}
+	lookup, err := s.lookupIndex(scan.table, head, neededTables)
+	if err != nil || lookup == nil {
+		return source, err
+	}
+	engine, _ := s.tableEngine(scan.table)
+	cursor, err := engine.ScanSheets(lookup.sheets)
+	if err != nil {
+		return nil, err
+	}
+	scan.cursor.Close()
+	return &indexScanNode{scanNode: scanNode{table: scan.table, cursor: cursor}, lookup: lookup}, nil
+}
+
+// validateQuery checks that all tables and fields of the query exist
+func (s *Storage) validateQuery(query *selectQuery) error {
+	for _, table := range query.Tables {
+		if _, err := s.sourceColumns(table); err != nil {
+			return err
+		}
+	}
+
+	for _, field := range query.Fields {
+		if aggregate, ok := parseAggregate(field); ok {
+			if aggregate.Field == "*" {
+				continue
+			}
+			field = aggregate.Field
+		}
+		if err := s.validateField(field, query.Tables); err != nil {
+			return err
+		}
+	}
+	for _, field := range query.GroupBy {
+		if err := s.validateField(field, query.Tables); err != nil {
+			return err
+		}
+	}
+
+	aggregated := query.aggregated()
+	if aggregated {
+		for _, field := range query.Fields {
+			if _, ok := parseAggregate(field); !ok && !slices.Contains(query.GroupBy, field) {
+				return fmt.Errorf("field %s must be in GROUP BY or used in aggregate function", field)
+			}
+		}
+	}
+	for _, order := range query.OrderBy {
+		if aggregated {
+			if !slices.Contains(query.Fields, order.Field) && !slices.Contains(query.GroupBy, order.Field) {
+				return fmt.Errorf("field %s in ORDER BY must be selected or in GROUP BY", order.Field)
+			}
+			continue
+		}
+		if err := s.validateField(order.Field, query.Tables); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runPlan executes the plan and returns all rows of the root operator
+func runPlan(root planNode) (*mysl.MySl[*mymap.CustomMap], error) {
+	rows := mysl.New[*mymap.CustomMap]()
+	err := streamPlan(root, func(row *mymap.CustomMap) error {
+		rows.Append(row)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rows, nil
+}
+
+// streamPlan executes the plan and passes rows of the root operator to fn without collecting them
+func streamPlan(root planNode, fn func(row *mymap.CustomMap) error) error {
+	defer closePlan(root)
+
+	if err := root.open(); err != nil {
+		return err
+	}
+	for {
+		row, err := root.next()
+		if err != nil {
+			return err
+		}
+		if row == nil {
+			return nil
+		}
+		if err := fn(row); err != nil {
+			return err
+		}
+	}
+}
+
+// closePlan closes sheets left open by scans if the plan isn't read to the end
+func closePlan(node planNode) {
+	switch scan := node.(type) {
+	case *scanNode:
+		scan.cursor.Close()
+	case *indexScanNode:
+		scan.cursor.Close()
+	}
+	for _, child := range node.children() {
+		closePlan(child)
+	}
+}
+
+// explainPlan returns the operator tree, with analyze each operator has its statistics
+func explainPlan(root planNode, analyze bool) string {
+	var output strings.Builder
+	output.WriteString("QUERY PLAN\n")
+	writePlan(&output, root, 0, analyze)
+	return output.String()
+}
+
+func writePlan(output *strings.Builder, node planNode, depth int, analyze bool) {
+	if depth > 0 {
+		output.WriteString(strings.Repeat("  ", depth-1) + "-> ")
+	}
+	output.WriteString(node.describe())
+	if analyze {
+		stats := node.stats()
+		output.WriteString(fmt.Sprintf(" (rows=%d", stats.rows))
+		switch node.(type) {
+		case *scanNode, *indexScanNode:
+			output.WriteString(fmt.Sprintf(" sheets=%d", stats.sheets))
+		}
+		output.WriteString(fmt.Sprintf(" time=%.3fms)", float64(stats.elapsed.Microseconds())/1000))
+	}
+	output.WriteString("\n")
+	for _, child := range node.children() {
+		writePlan(output, child, depth+1, analyze)
+	}
+}
+
+// measure adds time since start to elapsed time of the operator
+func (st *planStats) measure(start time.Time) {
+	st.elapsed += time.Since(start)
+}
+
+// produced counts the row returned by the operator
+func (st *planStats) produced(row *mymap.CustomMap) *mymap.CustomMap {
+	if row != nil {
+		st.rows++
+	}
+	return row
+}
+
+func (st *planStats) stats() *planStats {
+	return st
+}
+
+func (n *scanNode) open() error {
+	n.cursor.Rewind()
+	return nil
+}
+
+func (n *scanNode) next() (*mymap.CustomMap, error) {
+	defer n.measure(time.Now())
+
+	row, err := n.cursor.Next()
+	n.planStats.sheets = n.cursor.SheetsRead()
+	if err != nil {
+		return nil, err
+	}
+	return n.produced(row), nil
+}
+
+func (n *scanNode) describe() string {
+	return fmt.Sprintf("Scan on %s (%d sheets)", n.table, n.cursor.Sheets())
+}
+
+func (n *scanNode) children() []planNode {
+	return nil
+}
+
+func (n *indexScanNode) next() (*mymap.CustomMap, error) {
+	defer n.measure(time.Now())
+
+	for {
+		row, err := n.cursor.Next()
+		n.planStats.sheets = n.cursor.SheetsRead()
+		if err != nil || row == nil {
+			return nil, err
+		}
+		if n.lookup.contains(n.cursor.Location()) {
+			return n.produced(row), nil
+		}
+	}
+}
+
+func (n *indexScanNode) describe() string {
+	return fmt.Sprintf("Index Scan on %s using %s (%d sheets)", n.table, n.lookup, n.cursor.Sheets())
+}
+
+func (n *viewNode) open() error {
+	defer n.measure(time.Now())
+	return n.child.open()
+}
+
+func (n *viewNode) next() (*mymap.CustomMap, error) {
+	defer n.measure(time.Now())
+
+	row, err := n.child.next()
+	if err != nil || row == nil {
+		return nil, err
+	}
+	viewRow := mymap.New()
+	for i, column := range n.view.Columns {
+		viewRow.Add(n.view.Name+"."+column, row.Get(n.view.query.Fields[i]))
+	}
+	return n.produced(viewRow), nil
+}
+
+func (n *viewNode) describe() string {
+	return fmt.Sprintf("View %s (%s)", n.view.Name, strings.Join(n.view.Columns, ", "))
+}
+
+func (n *viewNode) children() []planNode {
+	return []planNode{n.child}
+}
+
+func (n *filterNode) open() error {
+	defer n.measure(time.Now())
+	return n.child.open()
+}
+
+func (n *filterNode) next() (*mymap.CustomMap, error) {
+	defer n.measure(time.Now())
+
+	for {
+		row, err := n.child.next()
+		if err != nil || row == nil {
+			return nil, err
+		}
+		if n.s.matchRow(n.head, row, n.neededTables, n.rowTables) {
+			return n.produced(row), nil
+		}
+	}
+}
+
+func (n *filterNode) describe() string {
+	return fmt.Sprintf("Filter (%s)", n.head)
+}
+
+func (n *filterNode) children() []planNode {
+	return []planNode{n.child}
+}
+
+func (n *joinNode) open() error {
+	defer n.measure(time.Now())
+
+	if err := n.left.open(); err != nil {
+		return err
+	}
+	rows, err := runPlan(n.right)
+	if err != nil {
+		return err
+	}
+	n.rightRows = rows
+	n.leftRow = nil
+	n.row = 0
+	return nil
+}
+
+func (n *joinNode) next() (*mymap.CustomMap, error) {
+	defer n.measure(time.Now())
+
+	if n.rightRows.Len() == 0 {
+		return nil, nil
+	}
+	if n.leftRow == nil || n.row == n.rightRows.Len() {
+		row, err := n.left.next()
+		if err != nil || row == nil {
+			return nil, err
+		}
+		n.leftRow = row
+		n.row = 0
+	}
+	n.row++
+	return n.produced(mergeRows(n.leftRow, n.rightRows.Get(n.row-1))), nil
+}
+
+func (n *joinNode) describe() string {
+	return "Nested Loop (cross join)"
+}
+
+func (n *joinNode) children() []planNode {
+	return []planNode{n.left, n.right}
+}
+
+func (n *aggregateNode) open() error {
+	defer n.measure(time.Now())
+
+	rows, err := runPlan(n.child)
+	if err != nil {
+		return err
+	}
+	n.rows, err = aggregateRows(n.fields, n.groupBy, rows)
+	n.row = 0
+	return err
+}
+
+func (n *aggregateNode) next() (*mymap.CustomMap, error) {
+	if n.row == n.rows.Len() {
+		return nil, nil
+	}
+	n.row++
+	return n.produced(n.rows.Get(n.row - 1)), nil
+}
+
+func (n *aggregateNode) describe() string {
+	description := fmt.Sprintf("Aggregate (%s)", strings.Join(n.fields, ", "))
+	if len(n.groupBy) > 0 {
+		description += fmt.Sprintf(" GROUP BY %s", strings.Join(n.groupBy, ", "))
+	}
+	return description
+}
+
+func (n *aggregateNode) children() []planNode {
+	return []planNode{n.child}
+}
+
+func (n *sortNode) open() error {
+	defer n.measure(time.Now())
+
+	rows, err := runPlan(n.child)
+	if err != nil {
+		return err
+	}
+	n.rows = rows.GetData()
+	slices.SortStableFunc(n.rows, func(a, b *mymap.CustomMap) int {
+		for _, order := range n.orderBy {
+			valueA, _ := a.Get(order.Field).(string)
+			valueB, _ := b.Get(order.Field).(string)
+			if result := compareValues(valueA, valueB); result != 0 {
+				if order.Desc {
+					return -result
+				}
+				return result
+			}
+		}
+		return 0
+	})
+	n.row = 0
+	return nil
+}
+
+func (n *sortNode) next() (*mymap.CustomMap, error) {
+	if n.row == len(n.rows) {
+		return nil, nil
+	}
+	n.row++
+	return n.produced(n.rows[n.row-1]), nil
+}
+
+func (n *sortNode) describe() string {
+	orderBy := make([]string, len(n.orderBy))
+	for i, order := range n.orderBy {
+		orderBy[i] = order.String()
+	}
+	return fmt.Sprintf("Sort (%s)", strings.Join(orderBy, ", "))
+}
+
+func (n *sortNode) children() []planNode {
+	return []planNode{n.child}
+}
+
+func (n *projectNode) open() error {
+	defer n.measure(time.Now())
+	return n.child.open()
+}
+
+func (n *projectNode) next() (*mymap.CustomMap, error) {
+	defer n.measure(time.Now())
+
+	row, err := n.child.next()
+	if err != nil || row == nil {
+		return nil, err
+	}
+	projected := mymap.New()
+	for _, field := range n.fields {
+		projected.Add(field, row.Get(field))
+	}
+	return n.produced(projected), nil
+}
+
+func (n *projectNode) describe() string {
+	return fmt.Sprintf("Project (%s)", strings.Join(n.fields, ", "))
+}
+
+func (n *projectNode) children() []planNode {
+	return []planNode{n.child}
+}
+
+// mergeRows returns a new row with fields of both rows
+func mergeRows(row1, row2 *mymap.CustomMap) *mymap.CustomMap {
+	merged := mymap.New()
+	for _, row := range []*mymap.CustomMap{row1, row2} {
+		keys := row.Keys()
+		for i := 0; i < keys.Len(); i++ {
+			merged.Add(keys.Get(i), row.Get(keys.Get(i)))
+		}
+	}
+	return merged
+}
@@ -0,0 +1,395 @@
+package storage
+
+import (
+	"JacuteSQL/internal/lib/utils"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	createSequenceRegexp = regexp.MustCompile(`(?i)^CREATE\s+SEQUENCE\s+(IF\s+NOT\s+EXISTS\s+)?(\w+)((?:\s+(?:INCREMENT\s+(?:BY\s+)?|START\s+(?:WITH\s+)?)-?\d+)*)\s*;?$`)
+	sequenceOptionRegexp = regexp.MustCompile(`(?i)(INCREMENT|START)\s+(?:BY\s+|WITH\s+)?(-?\d+)`)
+	dropSequenceRegexp   = regexp.MustCompile(`(?i)^DROP\s+SEQUENCE\s+(IF\s+EXISTS\s+)?(\w+)\s*;?$`)
+	callRegexp           = regexp.MustCompile(`(?is)^SELECT\s+(\w+\s*\(.*\))\s*;?$`)
+	functionRegexp       = regexp.MustCompile(`^(\w+)\s*\(`)
+)
+
+var (
+	ErrSequenceExists   = errors.New("sequence already exists")
+	ErrSequenceNotFound = errors.New("sequence not found")
+)
+
+const (
+	sequencesFileName = "sequences.json"
+	pkSequenceSuffix  = "_pk_sequence"
+	currentTimestamp  = "CURRENT_TIMESTAMP"
+	timestampFormat   = "2006-01-02 15:04:05"
+)
+
+// Sequence is a named counter, Value is the last value returned by nextval or set by setval
+type Sequence struct {
+	Name      string `json:"name"`
+	Start     int64  `json:"start"`
+	Increment int64  `json:"increment"`
+	Value     int64  `json:"value"`
+	Called    bool   `json:"called,omitempty"`
+}
+
+// functionCall is a call of function in values: nextval('seq'), currval('seq'), setval('seq', n) or CURRENT_TIMESTAMP
+type functionCall struct {
+	Name string
+	Args []literal
+}
+
+// callQuery is a parsed SELECT of function without tables, e.g. SELECT nextval('seq')
+type callQuery struct {
+	Call *functionCall
+}
+
+// parseFunction parses the function call starting from the position start
+//
+// Returns the call and the position after the closing parenthesis
+func parseFunction(str string, start int) (*functionCall, int, error) {
+	matches := functionRegexp.FindStringSubmatch(str[start:])
+	name := strings.ToLower(matches[1])
+	if name != "nextval" && name != "currval" && name != "setval" {
+		return nil, 0, fmt.Errorf("%w: unknown function %s", ErrParse, matches[1])
+	}
+
+	inner, end, ok := readParenthesized(str, start+len(matches[0]))
+	if !ok {
+		return nil, 0, fmt.Errorf("%w: ')' expected after arguments of %s", ErrParse, name)
+	}
+	args, err := parseLiterals(inner)
+	if err != nil {
+		return nil, 0, err
+	}
+	call := &functionCall{Name: name, Args: args}
+	if err := call.validate(); err != nil {
+		return nil, 0, err
+	}
+	return call, end, nil
+}
+
+// validate checks count and types of arguments
+func (c *functionCall) validate() error {
+	count := 1
+	if c.Name == "setval" {
+		count = 2
+	}
+	if len(c.Args) != count {
+		return fmt.Errorf("%w: %s expects %d arguments, got %d", ErrParse, c.Name, count, len(c.Args))
+	}
+	for _, arg := range c.Args {
+		if arg.Call != nil || arg.Param > 0 {
+			return fmt.Errorf("%w: arguments of %s must be constants", ErrParse, c.Name)
+		}
+	}
+	if !c.Args[0].Quoted {
+		return fmt.Errorf("%w: name of sequence in %s must be in quotes", ErrParse, c.Name)
+	}
+	if c.Name == "setval" {
+		if _, err := strconv.ParseInt(c.Args[1].Value, 10, 64); err != nil {
+			return fmt.Errorf("%w: value of setval must be integer", ErrParse)
+		}
+	}
+	return nil
+}
+
+func (c *functionCall) String() string {
+	if c.Name == "current_timestamp" {
+		return currentTimestamp
+	}
+	args := make([]string, len(c.Args))
+	for i, arg := range c.Args {
+		args[i] = arg.String()
+	}
+	return c.Name + "(" + strings.Join(args, ", ") + ")"
+}
+
+// call evaluates the function
+func (s *Storage) call(c *functionCall) (string, error) {
+	switch c.Name {
+	case "current_timestamp":
+		return time.Now().UTC().Format(timestampFormat), nil
+	case "nextval":
+		return s.nextval(c.Args[0].Value)
+	case "currval":
+		return s.currval(c.Args[0].Value)
+	default:
+		value, _ := strconv.ParseInt(c.Args[1].Value, 10, 64)
+		return s.setval(c.Args[0].Value, value)
+	}
+}
+
+// evalLiteral returns the value of the literal, functions are called
+func (s *Storage) evalLiteral(value literal) (string, error) {
+	if value.Call != nil {
+		return s.call(value.Call)
+	}
+	return value.Value, nil
+}
+
+func (q *callQuery) exec(s *Storage) (string, error) {
+	value, err := s.call(q.Call)
+	if err != nil {
+		return "", err
+	}
+	return q.Call.Name + "\n" + value + "\n", nil
+}
+
+func (q *callQuery) bind(values []string) (statement, error) {
+	return q, nil
+}
+
+func (q *callQuery) paramsCount() int {
+	return 0
+}
+
+// parseSequenceOptions parses "INCREMENT [BY] n" and "START [WITH] n" of CREATE SEQUENCE
+//
+// By default increment is 1, sequence starts from 1 or from -1 if increment is negative
+func parseSequenceOptions(str string) (start int64, increment int64, err error) {
+	increment = 1
+	startSet := false
+	for _, option := range sequenceOptionRegexp.FindAllStringSubmatch(str, -1) {
+		value, err := strconv.ParseInt(option[2], 10, 64)
+		if err != nil {
+			return 0, 0, fmt.Errorf("%w: invalid value %s of %s", ErrParse, option[2], option[1])
+		}
+		if strings.EqualFold(option[1], "START") {
+			start, startSet = value, true
+		} else {
+			increment = value
+		}
+	}
+	if !startSet {
+		start = 1
+		if increment < 0 {
+			start = -1
+		}
+	}
+	return start, increment, nil
+}
+
+// CreateSequence adds a new sequence and saves it to the database directory
+func (s *Storage) CreateSequence(name string, start int64, increment int64, ifNotExists bool) error {
+	const op = "storage.CreateSequence"
+	log := s.log.With(
+		slog.String("op", op),
+		slog.String("sequence", name),
+	)
+
+	if increment == 0 {
+		return fmt.Errorf("increment of sequence %s can't be zero", name)
+	}
+	if strings.HasSuffix(name, pkSequenceSuffix) {
+		return fmt.Errorf("names ending with %s are used by pk sequences of tables", pkSequenceSuffix)
+	}
+
+	s.sequencesMutex.Lock()
+	defer s.sequencesMutex.Unlock()
+
+	if s.sequences.Get(name) != nil {
+		if ifNotExists {
+			return nil
+		}
+		return ErrSequenceExists
+	}
+	s.sequences.Add(name, &Sequence{
+		Name:      name,
+		Start:     start,
+		Increment: increment,
+		Value:     start,
+	})
+	if err := s.saveSequences(); err != nil {
+		s.sequences.Delete(name)
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	log.Info("sequence created", slog.Int64("start", start), slog.Int64("increment", increment))
+	return nil
+}
+
+// DropSequence removes the sequence
+func (s *Storage) DropSequence(name string, ifExists bool) error {
+	const op = "storage.DropSequence"
+
+	s.sequencesMutex.Lock()
+	defer s.sequencesMutex.Unlock()
+
+	sequence, ok := s.sequences.Get(name).(*Sequence)
+	if !ok {
+		if ifExists {
+			return nil
+		}
+		return ErrSequenceNotFound
+	}
+	s.sequences.Delete(name)
+	if err := s.saveSequences(); err != nil {
+		s.sequences.Add(name, sequence)
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	return nil
+}
+
+// nextval advances the sequence and returns its new value
+//
+// For <table>_pk_sequence the pk of the next row of the table is returned and skipped by Insert.
+func (s *Storage) nextval(name string) (string, error) {
+	if table, ok := s.pkSequenceTable(name); ok {
+		id, err := s.nextPk(table)
+		if err == nil {
+			// the pk isn't logged by the wal, so it's saved at once
+			s.flushTables([]string{table})
+		}
+		return id, err
+	}
+
+	s.sequencesMutex.Lock()
+	defer s.sequencesMutex.Unlock()
+
+	sequence, ok := s.sequences.Get(name).(*Sequence)
+	if !ok {
+		return "", fmt.Errorf("%w: %s", ErrSequenceNotFound, name)
+	}
+	value := sequence.Value
+	if sequence.Called {
+		value += sequence.Increment
+	}
+	sequence.Value, sequence.Called = value, true
+	if err := s.saveSequences(); err != nil {
+		return "", err
+	}
+	return strconv.FormatInt(value, 10), nil
+}
+
+// currval returns the last value of the sequence, it's an error if nextval wasn't called yet
+func (s *Storage) currval(name string) (string, error) {
+	if table, ok := s.pkSequenceTable(name); ok {
+		engine, _ := s.tableEngine(table)
+		id, err := engine.PeekPk()
+		if err != nil {
+			return "", err
+		}
+		if id <= 1 {
+			return "", fmt.Errorf("currval of sequence %s is not yet defined", name)
+		}
+		return strconv.FormatInt(id-1, 10), nil
+	}
+
+	s.sequencesMutex.Lock()
+	defer s.sequencesMutex.Unlock()
+
+	sequence, ok := s.sequences.Get(name).(*Sequence)
+	if !ok {
+		return "", fmt.Errorf("%w: %s", ErrSequenceNotFound, name)
+	}
+	if !sequence.Called {
+		return "", fmt.Errorf("currval of sequence %s is not yet defined", name)
+	}
+	return strconv.FormatInt(sequence.Value, 10), nil
+}
+
+// setval sets the last value of the sequence, the next call of nextval returns value + increment
+func (s *Storage) setval(name string, value int64) (string, error) {
+	if table, ok := s.pkSequenceTable(name); ok {
+		if value < 0 {
+			return "", fmt.Errorf("value of sequence %s can't be negative", name)
+		}
+		engine, _ := s.tableEngine(table)
+		if err := engine.SetPk(value + 1); err != nil {
+			return "", err
+		}
+		return strconv.FormatInt(value, 10), nil
+	}
+
+	s.sequencesMutex.Lock()
+	defer s.sequencesMutex.Unlock()
+
+	sequence, ok := s.sequences.Get(name).(*Sequence)
+	if !ok {
+		return "", fmt.Errorf("%w: %s", ErrSequenceNotFound, name)
+	}
+	sequence.Value, sequence.Called = value, true
+	if err := s.saveSequences(); err != nil {
+		return "", err
+	}
+	return strconv.FormatInt(value, 10), nil
+}
+
+// nextPk returns the pk of a new row and advances the pk sequence of the table
+func (s *Storage) nextPk(table string) (string, error) {
+	engine, ok := s.tableEngine(table)
+	if !ok {
+		return "", ErrIncorectTable
+	}
+	id, err := engine.NextPk()
+	if err != nil {
+		return "", err
+	}
+	return strconv.FormatInt(id, 10), nil
+}
+
+// pkSequenceTable returns the table if the name is <table>_pk_sequence
+func (s *Storage) pkSequenceTable(name string) (string, bool) {
+	table, ok := strings.CutSuffix(name, pkSequenceSuffix)
+	if !ok {
+		return "", false
+	}
+	_, ok = s.tableEngine(table)
+	return table, ok
+}
+
+// loadSequences reads sequences from the database directory
+func (s *Storage) loadSequences() error {
+	const op = "storage.loadSequences"
+
+	sequencesPath := path.Join(s.databasePath(), sequencesFileName)
+	if !utils.FileExists(sequencesPath) {
+		return nil
+	}
+	data, err := os.ReadFile(sequencesPath)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	var sequences []*Sequence
+	if err := json.Unmarshal(data, &sequences); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	s.sequencesMutex.Lock()
+	defer s.sequencesMutex.Unlock()
+	for _, sequence := range sequences {
+		s.sequences.Add(sequence.Name, sequence)
+	}
+	return nil
+}
+
+// saveSequences writes all sequences to the database directory, sequencesMutex must be locked
+func (s *Storage) saveSequences() error {
+	names := s.sequences.Keys()
+	sequences := make([]*Sequence, 0, names.Len())
+	for i := 0; i < names.Len(); i++ {
+		sequences = append(sequences, s.sequences.Get(names.Get(i)).(*Sequence))
+	}
+	slices.SortFunc(sequences, func(a, b *Sequence) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+
+	data, err := json.MarshalIndent(sequences, "", "    ")
+	if err != nil {
+		return err
+	}
+	return utils.WriteFileAtomic(path.Join(s.databasePath(), sequencesFileName), data)
+}
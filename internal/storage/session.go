@@ -0,0 +1,311 @@
+package storage
+
+import (
+	"JacuteSQL/internal/data_structures/mymap"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	prepareRegexp    = regexp.MustCompile(`(?is)^PREPARE\s+(\w+)\s*(?:\(([\w\s,]+)\))?\s+AS\s+(.+?)\s*;?$`)
+	executeRegexp    = regexp.MustCompile(`(?is)^EXECUTE\s+(\w+)\s*(?:\((.*)\))?\s*;?$`)
+	deallocateRegexp = regexp.MustCompile(`(?i)^DEALLOCATE\s+(?:PREPARE\s+)?(\w+)\s*;?$`)
+)
+
+var (
+	ErrPreparedExists   = errors.New("prepared statement already exists")
+	ErrPreparedNotFound = errors.New("prepared statement not found")
+)
+
+// PreparedStatement is a parsed statement with typed parameters $1, $2, ...
+type PreparedStatement struct {
+	Name  string
+	Types []string
+	Query string
+
+	stmt statement
+}
+
+// Session is a state of one client connection
+//
+// Prepared statements are stored in the session and aren't visible in other connections
+type Session struct {
+	storage  *Storage
+	prepared *mymap.CustomMap
+	// exclusive is set for the session of Migrate, the storage is already held by it
+	exclusive bool
+}
+
+// NewSession creates a new session for the connection
+func (s *Storage) NewSession() *Session {
+	return &Session{
+		storage:  s,
+		prepared: mymap.New(),
+	}
+}
+
+// Exec parse the command and execute it, PREPARE/EXECUTE/DEALLOCATE are executed in the session
+func (ss *Session) Exec(str string) (string, error) {
+	var output strings.Builder
+	if err := ss.ExecTo(&output, str); err != nil {
+		return "", err
+	}
+	return output.String(), nil
+}
+
+// ExecTo executes the command like Exec and writes its output, rows of SELECT are written while they are read
+func (ss *Session) ExecTo(output io.Writer, str string) error {
+	if !ss.exclusive {
+		release, err := ss.storage.acquire()
+		if err != nil {
+			return fmt.Errorf("error: " + err.Error())
+		}
+		defer release()
+	}
+	str = strings.TrimSpace(str)
+	if prepareRegexp.Match([]byte(str)) {
+		matches := prepareRegexp.FindStringSubmatch(str)
+		var types []string
+		if matches[2] != "" {
+			types = splitList(matches[2])
+		}
+
+		if err := ss.Prepare(matches[1], types, matches[3]); err != nil {
+			return fmt.Errorf("error: " + err.Error())
+		}
+		return nil
+	} else if executeRegexp.Match([]byte(str)) {
+		matches := executeRegexp.FindStringSubmatch(str)
+		args, err := parseLiterals(matches[2])
+		if err != nil {
+			return fmt.Errorf("error: " + err.Error())
+		}
+		values := make([]string, len(args))
+		for i, arg := range args {
+			if arg.Param > 0 {
+				return fmt.Errorf("error: Parameters can't be used as arguments of EXECUTE")
+			}
+			if arg.Call != nil {
+				return fmt.Errorf("error: Functions can't be used as arguments of EXECUTE")
+			}
+			values[i] = arg.Value
+		}
+
+		stmt, err := ss.bindPrepared(matches[1], values)
+		if err == nil {
+			err = execStatementTo(ss.storage, stmt, output)
+		}
+		if err != nil {
+			return fmt.Errorf("error: " + err.Error())
+		}
+		return nil
+	} else if deallocateRegexp.Match([]byte(str)) {
+		matches := deallocateRegexp.FindStringSubmatch(str)
+
+		if err := ss.Deallocate(matches[1]); err != nil {
+			return fmt.Errorf("error: " + err.Error())
+		}
+		return nil
+	}
+
+	return ss.storage.execTo(output, str)
+}
+
+// ExecScript executes statements separated by ';' in order and stops at the first error
+//
+// Returns outputs of executed statements, the error contains the number of failed statement
+func (ss *Session) ExecScript(script string) ([]string, error) {
+	builders := make([]*strings.Builder, 0)
+	err := ss.ExecScriptTo(script, func(i int, count int) io.Writer {
+		builders = append(builders, &strings.Builder{})
+		return builders[i]
+	})
+	// the output of the failed statement is dropped
+	if err != nil && len(builders) > 0 {
+		builders = builders[:len(builders)-1]
+	}
+	outputs := make([]string, len(builders))
+	for i, builder := range builders {
+		outputs[i] = builder.String()
+	}
+	return outputs, err
+}
+
+// ExecScriptTo executes statements like ExecScript, the output of statement i of count is written to output(i, count)
+//
+// output is called before the statement is executed, so the previous statement is completed successfully.
+func (ss *Session) ExecScriptTo(script string, output func(i int, count int) io.Writer) error {
+	statements := splitStatements(script)
+	if len(statements) == 0 {
+		return fmt.Errorf("error: Incorrect command")
+	}
+
+	for i, str := range statements {
+		if err := ss.ExecTo(output(i, len(statements)), str); err != nil {
+			if len(statements) == 1 {
+				return err
+			}
+			return fmt.Errorf("error: statement %d failed (%s): %s", i+1, str, strings.TrimPrefix(err.Error(), "error: "))
+		}
+	}
+	return nil
+}
+
+// Prepare parses the query and saves it in the session
+//
+// Parameters are written as $1, $2, ... or ?, types of parameters are text if they aren't specified
+func (ss *Session) Prepare(name string, types []string, query string) error {
+	if ss.prepared.Get(name) != nil {
+		return ErrPreparedExists
+	}
+
+	for i, typ := range types {
+		normalized, ok := normalizeParamType(typ)
+		if !ok {
+			return fmt.Errorf("unknown type %s of parameter $%d", typ, i+1)
+		}
+		types[i] = normalized
+	}
+
+	stmt, ok, err := parseStatement(numberPlaceholders(strings.TrimSpace(query)))
+	if !ok {
+		return fmt.Errorf("%w: only SELECT, INSERT, UPDATE, DELETE and EXPLAIN can be prepared", ErrParse)
+	}
+	if err != nil {
+		return err
+	}
+
+	count := stmt.paramsCount()
+	if types == nil {
+		types = make([]string, count)
+		for i := range types {
+			types[i] = "text"
+		}
+	}
+	if count > len(types) {
+		return fmt.Errorf("statement uses parameter $%d, but %d types are specified", count, len(types))
+	}
+
+	ss.prepared.Add(name, &PreparedStatement{
+		Name:  name,
+		Types: types,
+		Query: query,
+		stmt:  stmt,
+	})
+	return nil
+}
+
+// Execute binds values to parameters of the prepared statement and executes it
+func (ss *Session) Execute(name string, values []string) (string, error) {
+	if !ss.exclusive {
+		release, err := ss.storage.acquire()
+		if err != nil {
+			return "", err
+		}
+		defer release()
+	}
+	stmt, err := ss.bindPrepared(name, values)
+	if err != nil {
+		return "", err
+	}
+	return stmt.exec(ss.storage)
+}
+
+// bindPrepared checks values by types of parameters and returns the prepared statement with bound values
+func (ss *Session) bindPrepared(name string, values []string) (statement, error) {
+	prepared, ok := ss.prepared.Get(name).(*PreparedStatement)
+	if !ok {
+		return nil, ErrPreparedNotFound
+	}
+	if len(values) != len(prepared.Types) {
+		return nil, fmt.Errorf("prepared statement %s expects %d parameters, got %d", name, len(prepared.Types), len(values))
+	}
+
+	bound := make([]string, len(values))
+	for i, value := range values {
+		var err error
+		bound[i], err = bindParam(prepared.Types[i], value)
+		if err != nil {
+			return nil, fmt.Errorf("parameter $%d: %w", i+1, err)
+		}
+	}
+
+	return prepared.stmt.bind(bound)
+}
+
+// Deallocate removes the prepared statement from the session, ALL removes all statements
+func (ss *Session) Deallocate(name string) error {
+	if strings.EqualFold(name, "ALL") {
+		ss.prepared = mymap.New()
+		return nil
+	}
+	if err := ss.prepared.Delete(name); err != nil {
+		return ErrPreparedNotFound
+	}
+	return nil
+}
+
+// normalizeParamType returns the type used for binding: text, int, float or bool
+func normalizeParamType(typ string) (string, bool) {
+	switch strings.ToLower(typ) {
+	case "text", "varchar":
+		return "text", true
+	case "int", "integer":
+		return "int", true
+	case "float", "numeric":
+		return "float", true
+	case "bool", "boolean":
+		return "bool", true
+	default:
+		return "", false
+	}
+}
+
+// bindParam checks that the value has the type of parameter and normalizes it
+func bindParam(typ string, value string) (string, error) {
+	switch typ {
+	case "int":
+		number, err := strconv.Atoi(value)
+		if err != nil {
+			return "", fmt.Errorf("value '%s' is not int", value)
+		}
+		return strconv.Itoa(number), nil
+	case "float":
+		number, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return "", fmt.Errorf("value '%s' is not float", value)
+		}
+		return formatNumber(number), nil
+	case "bool":
+		boolean, err := strconv.ParseBool(value)
+		if err != nil {
+			return "", fmt.Errorf("value '%s' is not bool", value)
+		}
+		return strconv.FormatBool(boolean), nil
+	default:
+		return value, nil
+	}
+}
+
+// numberPlaceholders replaces placeholders ? outside of quotes with $1, $2, ...
+func numberPlaceholders(query string) string {
+	var result strings.Builder
+	inQuotes := false
+	count := 0
+	for _, char := range query {
+		if char == '\'' {
+			inQuotes = !inQuotes
+		}
+		if char == '?' && !inQuotes {
+			count++
+			result.WriteString("$" + strconv.Itoa(count))
+			continue
+		}
+		result.WriteRune(char)
+	}
+	return result.String()
+}
@@ -0,0 +1,653 @@
+package storage
+
+import (
+	"JacuteSQL/internal/data_structures/mymap"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+var (
+	paramRegexp   = regexp.MustCompile(`^\$(\d+)$`)
+	numberRegexp  = regexp.MustCompile(`^-?\d+(\.\d+)?$`)
+	explainRegexp = regexp.MustCompile(`(?is)^EXPLAIN\s+(ANALYZE\s+)?(.+)$`)
+	columnRegexp  = regexp.MustCompile(`^[\w\d]+(\.[\w\d]+)?$`)
+)
+
+// statement is a parsed command, which can be prepared once and executed many times
+type statement interface {
+	// exec executes the statement and returns its output
+	exec(s *Storage) (string, error)
+	// bind returns a copy of the statement with parameters $n replaced by values
+	bind(values []string) (statement, error)
+	// paramsCount returns the max number of parameter used in the statement
+	paramsCount() int
+}
+
+// streamingStatement is a statement which writes rows of its output while they are read
+type streamingStatement interface {
+	execTo(s *Storage, output io.Writer) error
+}
+
+// execStatementTo executes the statement and writes its output, rows are streamed if the statement supports it
+func execStatementTo(s *Storage, stmt statement, output io.Writer) error {
+	if err := s.checkReadOnly(stmt); err != nil {
+		return err
+	}
+	if streaming, ok := stmt.(streamingStatement); ok {
+		return streaming.execTo(s, output)
+	}
+	result, err := stmt.exec(s)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(output, result)
+	return err
+}
+
+// checkReadOnly refuses statements except SELECT and EXPLAIN if the storage is opened by OpenReadOnly,
+// other commands are refused for nil
+func (s *Storage) checkReadOnly(stmt statement) error {
+	if !s.readOnly {
+		return nil
+	}
+	switch stmt.(type) {
+	case *selectQuery, *explainQuery:
+		return nil
+	}
+	return ErrStorageReadOnly
+}
+
+// literal is a value in the command: quoted string, bare word (number or field), parameter $n or function call
+type literal struct {
+	Value   string
+	Quoted  bool
+	Param   int
+	Default bool
+	Call    *functionCall
+}
+
+// selectQuery is a parsed SELECT command
+type selectQuery struct {
+	Fields    []string
+	Tables    []string
+	Condition string
+	GroupBy   []string
+	OrderBy   []orderField
+
+	head *Node
+}
+
+// updateQuery is a parsed UPDATE command, condition is empty if all rows are updated
+type updateQuery struct {
+	Table     string
+	Columns   []string
+	Values    []literal
+	Condition string
+
+	head *Node
+}
+
+// orderField is a field in ORDER BY
+type orderField struct {
+	Field string
+	Desc  bool
+}
+
+// explainQuery is a parsed EXPLAIN command, with Analyze the query is executed
+type explainQuery struct {
+	Analyze bool
+	Query   *selectQuery
+}
+
+// insertQuery is a parsed INSERT command, columns are nil if they aren't listed
+type insertQuery struct {
+	Table   string
+	Columns []string
+	Values  []literal
+}
+
+// deleteQuery is a parsed DELETE command, condition is empty if all rows are deleted
+type deleteQuery struct {
+	Tables    []string
+	Condition string
+
+	head *Node
+}
+
+// parseStatement parses SELECT, INSERT, UPDATE, DELETE and EXPLAIN commands
+//
+// ok is false if the command is not one of them
+func parseStatement(str string) (stmt statement, ok bool, err error) {
+	if matches := explainRegexp.FindStringSubmatch(str); matches != nil {
+		query, ok := parseSelect(strings.TrimSpace(matches[2]))
+		if !ok {
+			return nil, true, fmt.Errorf("%w: EXPLAIN supports only SELECT", ErrParse)
+		}
+		return &explainQuery{Analyze: matches[1] != "", Query: query}, true, nil
+	} else if query, ok := parseSelect(str); ok {
+		return query, true, nil
+	} else if matches := callRegexp.FindStringSubmatch(str); matches != nil {
+		value, end, err := readLiteral(matches[1], 0)
+		if err != nil {
+			return nil, true, err
+		}
+		if value.Call == nil || end != len(matches[1]) {
+			return nil, true, fmt.Errorf("%w: FROM expected", ErrParse)
+		}
+		return &callQuery{Call: value.Call}, true, nil
+	} else if insertRegexp.Match([]byte(str)) {
+		matches := insertRegexp.FindStringSubmatch(str)
+		values, err := parseLiterals(matches[3])
+		if err != nil {
+			return nil, true, err
+		}
+		query := &insertQuery{Table: matches[1], Values: values}
+		if matches[2] != "" {
+			query.Columns = splitList(matches[2])
+		}
+		return query, true, nil
+	} else if updateRegexp.Match([]byte(str)) {
+		matches := updateRegexp.FindStringSubmatch(str)
+		columns, values, err := parseAssignments(matches[2])
+		if err != nil {
+			return nil, true, err
+		}
+		query := &updateQuery{Table: matches[1], Columns: columns, Values: values, Condition: matches[3]}
+		if query.Condition != "" {
+			query.head = newConditionTree(query.Condition)
+		}
+		return query, true, nil
+	} else if deleteRegexp.Match([]byte(str)) {
+		matches := deleteRegexp.FindStringSubmatch(str)
+		return &deleteQuery{Tables: splitList(matches[1])}, true, nil
+	} else if deleteWhereRegexp.Match([]byte(str)) {
+		matches := deleteWhereRegexp.FindStringSubmatch(str)
+		return &deleteQuery{
+			Tables:    splitList(matches[1]),
+			Condition: matches[2],
+			head:      newConditionTree(matches[2]),
+		}, true, nil
+	}
+	return nil, false, nil
+}
+
+// parseSelect parses SELECT command with optional WHERE, GROUP BY and ORDER BY
+func parseSelect(str string) (*selectQuery, bool) {
+	if !selectRegexp.Match([]byte(str)) {
+		return nil, false
+	}
+	matches := selectRegexp.FindStringSubmatch(str)
+	query := &selectQuery{
+		Fields:    splitList(matches[1]),
+		Tables:    splitList(matches[2]),
+		Condition: matches[3],
+	}
+	if matches[4] != "" {
+		query.GroupBy = splitList(matches[4])
+	}
+	if matches[5] != "" {
+		for _, item := range splitList(matches[5]) {
+			order := orderField{Field: item}
+			words := strings.Fields(item)
+			if len(words) == 2 && (strings.EqualFold(words[1], "ASC") || strings.EqualFold(words[1], "DESC")) {
+				order = orderField{Field: words[0], Desc: strings.EqualFold(words[1], "DESC")}
+			}
+			query.OrderBy = append(query.OrderBy, order)
+		}
+	}
+	if query.Condition != "" {
+		query.head = newConditionTree(query.Condition)
+	}
+	return query, true
+}
+
+func (q *selectQuery) exec(s *Storage) (string, error) {
+	var output strings.Builder
+	if err := q.execTo(s, &output); err != nil {
+		return "", err
+	}
+	return output.String(), nil
+}
+
+// execTo writes rows to the output while they are read, tables are locked until the last row is written
+func (q *selectQuery) execTo(s *Storage, output io.Writer) error {
+	lockedTables := s.baseTables(q.Tables)
+	if err := s.blockTables(lockedTables); err != nil {
+		return err
+	}
+	err := s.selectRows(q, newRowWriter(output, q.Fields))
+	s.unBlockTables(lockedTables)
+	return err
+}
+
+func (q *selectQuery) bind(values []string) (statement, error) {
+	bound := *q
+	head, err := bindCondition(q.head, values)
+	if err != nil {
+		return nil, err
+	}
+	bound.head = head
+	return &bound, nil
+}
+
+func (q *selectQuery) paramsCount() int {
+	return maxParam(q.head)
+}
+
+// aggregated checks if the query uses GROUP BY or aggregate functions
+func (q *selectQuery) aggregated() bool {
+	if len(q.GroupBy) > 0 {
+		return true
+	}
+	for _, field := range q.Fields {
+		if _, ok := parseAggregate(field); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (o orderField) String() string {
+	if o.Desc {
+		return o.Field + " DESC"
+	}
+	return o.Field
+}
+
+func (q *explainQuery) exec(s *Storage) (string, error) {
+	lockedTables := s.baseTables(q.Query.Tables)
+	if err := s.blockTables(lockedTables); err != nil {
+		return "", err
+	}
+	defer s.unBlockTables(lockedTables)
+
+	root, err := s.buildPlan(q.Query)
+	if err != nil {
+		return "", err
+	}
+	if q.Analyze {
+		if err := streamPlan(root, func(row *mymap.CustomMap) error { return nil }); err != nil {
+			return "", err
+		}
+	}
+	return explainPlan(root, q.Analyze), nil
+}
+
+func (q *explainQuery) bind(values []string) (statement, error) {
+	query, err := q.Query.bind(values)
+	if err != nil {
+		return nil, err
+	}
+	return &explainQuery{Analyze: q.Analyze, Query: query.(*selectQuery)}, nil
+}
+
+func (q *explainQuery) paramsCount() int {
+	return q.Query.paramsCount()
+}
+
+func (q *insertQuery) exec(s *Storage) (string, error) {
+	lockedTables := s.relatedTables([]string{q.Table})
+	if err := s.blockTables(lockedTables); err != nil {
+		return "", err
+	}
+	values, err := s.insertValues(q.Table, q.Columns, q.Values)
+	id := ""
+	if err == nil {
+		id, err = s.Insert(q.Table, values)
+	}
+	s.unBlockTables(lockedTables)
+	if err != nil {
+		if errors.Is(err, ErrIncorrectNumberOfColumns) {
+			return "", fmt.Errorf("Incorrect number of columns")
+		}
+		return "", err
+	}
+
+	return id, nil
+}
+
+func (q *insertQuery) bind(values []string) (statement, error) {
+	bound := *q
+	bound.Values = slices.Clone(q.Values)
+	for i, value := range bound.Values {
+		if value.Param == 0 {
+			continue
+		}
+		if value.Param > len(values) {
+			return nil, fmt.Errorf("no value for parameter $%d", value.Param)
+		}
+		bound.Values[i] = literal{Value: values[value.Param-1], Quoted: true}
+	}
+	return &bound, nil
+}
+
+func (q *insertQuery) paramsCount() int {
+	count := 0
+	for _, value := range q.Values {
+		count = max(count, value.Param)
+	}
+	return count
+}
+
+func (q *updateQuery) exec(s *Storage) (string, error) {
+	values := make([]string, len(q.Values))
+	for i, value := range q.Values {
+		var err error
+		if value.Default {
+			values[i], err = s.columnDefault(q.Table, strings.TrimPrefix(q.Columns[i], q.Table+"."))
+		} else {
+			values[i], err = s.evalLiteral(value)
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+
+	lockedTables := s.relatedTables([]string{q.Table})
+	if err := s.blockTables(lockedTables); err != nil {
+		return "", err
+	}
+	updated, err := s.Update(q.Table, q.Columns, values, q.head)
+	s.unBlockTables(lockedTables)
+	if err != nil {
+		return "", err
+	}
+	s.autoVacuum(lockedTables)
+
+	return fmt.Sprintf("updated %d rows", updated), nil
+}
+
+func (q *updateQuery) bind(values []string) (statement, error) {
+	bound := *q
+	bound.Values = slices.Clone(q.Values)
+	for i, value := range bound.Values {
+		if value.Param == 0 {
+			continue
+		}
+		if value.Param > len(values) {
+			return nil, fmt.Errorf("no value for parameter $%d", value.Param)
+		}
+		bound.Values[i] = literal{Value: values[value.Param-1], Quoted: true}
+	}
+	head, err := bindCondition(q.head, values)
+	if err != nil {
+		return nil, err
+	}
+	bound.head = head
+	return &bound, nil
+}
+
+func (q *updateQuery) paramsCount() int {
+	count := maxParam(q.head)
+	for _, value := range q.Values {
+		count = max(count, value.Param)
+	}
+	return count
+}
+
+func (q *deleteQuery) exec(s *Storage) (string, error) {
+	count := 0
+	for _, tableName := range q.Tables {
+		lockedTables := s.relatedTables([]string{tableName})
+		if err := s.blockTables(lockedTables); err != nil {
+			return "", err
+		}
+		var err error
+		if q.head == nil {
+			err = s.Delete(tableName)
+		} else {
+			var deleted int
+			err, deleted = s.deleteWhere(tableName, q.head)
+			count += deleted
+		}
+		s.unBlockTables(lockedTables)
+		if err != nil {
+			return "", err
+		}
+		s.autoVacuum(lockedTables)
+	}
+
+	if q.head == nil {
+		return "", nil
+	}
+	return fmt.Sprintf("deleted %d rows", count), nil
+}
+
+func (q *deleteQuery) bind(values []string) (statement, error) {
+	bound := *q
+	head, err := bindCondition(q.head, values)
+	if err != nil {
+		return nil, err
+	}
+	bound.head = head
+	return &bound, nil
+}
+
+func (q *deleteQuery) paramsCount() int {
+	return maxParam(q.head)
+}
+
+// parseLiterals parses comma separated list of values: 'string', number or $n
+//
+// Quote inside the string is written as ''
+func parseLiterals(str string) ([]literal, error) {
+	literals := make([]literal, 0)
+	i := 0
+	for {
+		i = skipSpaces(str, i)
+		if i == len(str) {
+			if len(literals) > 0 {
+				return nil, fmt.Errorf("%w: value expected after ','", ErrParse)
+			}
+			return literals, nil
+		}
+
+		value, end, err := readLiteral(str, i)
+		if err != nil {
+			return nil, err
+		}
+		i = end
+		literals = append(literals, value)
+
+		i = skipSpaces(str, i)
+		if i == len(str) {
+			return literals, nil
+		}
+		if str[i] != ',' {
+			return nil, fmt.Errorf("%w: ',' expected after value %s", ErrParse, value)
+		}
+		i++
+	}
+}
+
+// parseAssignments parses SET list of UPDATE: column = value, ...
+func parseAssignments(str string) ([]string, []literal, error) {
+	columns := make([]string, 0)
+	values := make([]literal, 0)
+	i := 0
+	for {
+		eq := strings.IndexByte(str[i:], '=')
+		if eq == -1 {
+			return nil, nil, fmt.Errorf("%w: '=' expected in %s", ErrParse, strings.TrimSpace(str[i:]))
+		}
+		column := strings.TrimSpace(str[i : i+eq])
+		if !columnRegexp.MatchString(column) {
+			return nil, nil, fmt.Errorf("%w: invalid column %s", ErrParse, column)
+		}
+		i = skipSpaces(str, i+eq+1)
+		if i == len(str) {
+			return nil, nil, fmt.Errorf("%w: value expected for column %s", ErrParse, column)
+		}
+
+		value, end, err := readLiteral(str, i)
+		if err != nil {
+			return nil, nil, err
+		}
+		columns = append(columns, column)
+		values = append(values, value)
+
+		i = skipSpaces(str, end)
+		if i == len(str) {
+			return columns, values, nil
+		}
+		if str[i] != ',' {
+			return nil, nil, fmt.Errorf("%w: ',' expected after value %s", ErrParse, value)
+		}
+		i++
+	}
+}
+
+// readLiteral reads the value starting from the position start up to ',' or the end of the string
+//
+// Returns the literal and the position after it
+func readLiteral(str string, start int) (literal, int, error) {
+	if str[start] == '\'' {
+		return readQuoted(str, start)
+	}
+	end := strings.IndexByte(str[start:], ',')
+	if end == -1 {
+		end = len(str) - start
+	}
+	if functionRegexp.MatchString(str[start:]) {
+		call, end, err := parseFunction(str, start)
+		if err != nil {
+			return literal{}, 0, err
+		}
+		return literal{Value: call.String(), Call: call}, end, nil
+	}
+	word := strings.TrimSpace(str[start : start+end])
+	switch strings.ToUpper(word) {
+	case "DEFAULT":
+		return literal{Value: "DEFAULT", Default: true}, start + end, nil
+	case "NULL":
+		return literal{}, start + end, nil
+	case currentTimestamp:
+		return literal{Value: currentTimestamp, Call: &functionCall{Name: "current_timestamp"}}, start + end, nil
+	}
+	value := parseOperand(word)
+	if value.Param == 0 && !numberRegexp.MatchString(word) {
+		return literal{}, 0, fmt.Errorf("%w: invalid value %s, strings must be in quotes", ErrParse, word)
+	}
+	return value, start + end, nil
+}
+
+func skipSpaces(str string, i int) int {
+	for i < len(str) && strings.ContainsRune(" \t\r\n", rune(str[i])) {
+		i++
+	}
+	return i
+}
+
+// readQuoted reads string in quotes starting from the position start
+//
+// Returns the literal and the position after the closing quote
+func readQuoted(str string, start int) (literal, int, error) {
+	var value strings.Builder
+	for i := start + 1; i < len(str); i++ {
+		if str[i] != '\'' {
+			value.WriteByte(str[i])
+			continue
+		}
+		if i+1 < len(str) && str[i+1] == '\'' {
+			value.WriteByte('\'')
+			i++
+			continue
+		}
+		return literal{Value: value.String(), Quoted: true}, i + 1, nil
+	}
+	return literal{}, 0, fmt.Errorf("%w: unterminated string %s", ErrParse, str[start:])
+}
+
+// parseOperand parses the right part of the condition
+func parseOperand(str string) literal {
+	str = strings.TrimSpace(str)
+	if strings.HasPrefix(str, "'") {
+		if value, end, err := readQuoted(str, 0); err == nil && end == len(str) {
+			return value
+		}
+		return literal{Value: strings.Trim(str, "'"), Quoted: true}
+	}
+	if matches := paramRegexp.FindStringSubmatch(str); matches != nil {
+		param, _ := strconv.Atoi(matches[1])
+		return literal{Value: str, Param: param}
+	}
+	return literal{Value: str}
+}
+
+// isField checks if the literal is a column of one of tables, e.g. pair.pair_pk
+func (l literal) isField(tables []string) bool {
+	if l.Quoted || l.Param > 0 {
+		return false
+	}
+	table := tableOfField(l.Value)
+	return table != "" && slices.Contains(tables, table)
+}
+
+func (l literal) String() string {
+	if l.Call != nil {
+		return l.Call.String()
+	}
+	if l.Value == "" && !l.Quoted {
+		return "NULL"
+	}
+	if l.Quoted {
+		return "'" + strings.ReplaceAll(l.Value, "'", "''") + "'"
+	}
+	return l.Value
+}
+
+// splitStatements splits the script by ';' outside of quotes, empty statements are skipped
+func splitStatements(script string) []string {
+	statements := make([]string, 0)
+	inQuotes := false
+	start := 0
+	for i := 0; i <= len(script); i++ {
+		if i < len(script) {
+			if script[i] == '\'' {
+				inQuotes = !inQuotes
+			}
+			if script[i] != ';' || inQuotes {
+				continue
+			}
+		}
+		if str := strings.TrimSpace(script[start:i]); str != "" {
+			statements = append(statements, str)
+		}
+		start = i + 1
+	}
+	return statements
+}
+
+// splitList splits comma separated list and trims spaces
+func splitList(str string) []string {
+	splitted := strings.Split(str, ",")
+	for i := range splitted {
+		splitted[i] = strings.TrimSpace(splitted[i])
+	}
+	return splitted
+}
+
+// newRowWriter returns fn which writes rows separated by ',', the header is written before the first row
+//
+// fn writes only the header if values are nil, so nothing is written if the query fails before rows are read
+func newRowWriter(output io.Writer, header []string) func(values []string) error {
+	started := false
+	return func(values []string) error {
+		if !started {
+			started = true
+			if _, err := io.WriteString(output, strings.Join(header, ",")+"\n"); err != nil {
+				return err
+			}
+		}
+		if len(values) == 0 {
+			return nil
+		}
+		_, err := io.WriteString(output, strings.Join(values, ",")+"\n")
+		return err
+	}
+}
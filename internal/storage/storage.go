@@ -4,12 +4,10 @@ import (
 	"JacuteSQL/internal/config"
 	"JacuteSQL/internal/data_structures/mymap"
 	"JacuteSQL/internal/data_structures/mysl"
-	"JacuteSQL/internal/lib/csv"
-	"JacuteSQL/internal/lib/utils"
 	"errors"
 	"fmt"
+	"io"
 	"log/slog"
-	"os"
 	"path"
 	"regexp"
 	"slices"
@@ -21,9 +19,9 @@ import (
 )
 
 var (
-	selectRegexp      = regexp.MustCompile(`(?i)^SELECT\s+([\w\d\.,\s]+)\s+FROM\s+([\w\d,\s]+)$`)
-	selectWhereRegexp = regexp.MustCompile(`(?i)^SELECT\s+([\w\d\.,\s]+)\s+FROM\s+([\w\d,\s]+)\s+\s*WHERE\s+(.+?)?\s*;?$`)
-	insertRegexp      = regexp.MustCompile(`(?i)^INSERT\s+INTO\s+(\w+)\s+VALUES\s+\((.+)\)\s*;?$`)
+	selectRegexp      = regexp.MustCompile(`(?i)^SELECT\s+(.+?)\s+FROM\s+([\w\d,\s]+?)(?:\s+WHERE\s+(.+?))?(?:\s+GROUP\s+BY\s+([\w\d\.,\s]+?))?(?:\s+ORDER\s+BY\s+([\w\d\.,\s\(\)\*]+?))?\s*;?$`)
+	insertRegexp      = regexp.MustCompile(`(?is)^INSERT\s+INTO\s+(\w+)\s*(?:\(([\w\s,\.]+)\)\s*)?VALUES\s*\((.+)\)\s*;?$`)
+	updateRegexp      = regexp.MustCompile(`(?is)^UPDATE\s+(\w+)\s+SET\s+(.+?)(?:\s+WHERE\s+(.+?))?\s*;?$`)
 	deleteRegexp      = regexp.MustCompile(`(?i)^DELETE\s+FROM\s+([\w\d,\s]+)\s*;?$`)
 	deleteWhereRegexp = regexp.MustCompile(`(?i)^DELETE\s+FROM\s+([\w\d,\s]+)\s*WHERE\s+(.+?)?\s*;?$`)
 )
@@ -33,6 +31,9 @@ var (
 	ErrIncorrectNumberOfColumns = errors.New("invalid number of columns")
 	ErrIncorectTable            = errors.New("incorrect table")
 	ErrParse                    = errors.New("parse error")
+	ErrValueComma               = errors.New("Values can't contain ',' symbol")
+	ErrStorageReadOnly          = errors.New("storage is opened read-only")
+	ErrStorageClosed            = errors.New("storage is closed after the failed migration, it must be opened again")
 )
 
 type Storage struct {
@@ -40,7 +41,37 @@ type Storage struct {
 	Schema             *config.Schema
 	TablePathes        *mymap.CustomMap
 	tableBlockingMutex *mymap.CustomMap
-	log                *slog.Logger
+	// tablesMutex protects tables of the schema, they are added by CREATE TABLE
+	tablesMutex   sync.RWMutex
+	createdTables []*tableDefinition
+	views         *mymap.CustomMap
+	viewsMutex    sync.RWMutex
+	indexes       *mymap.CustomMap
+	indexesMutex  sync.Mutex
+	// secondaryIndexes are indexes created by CREATE INDEX
+	secondaryIndexes *mymap.CustomMap
+	secondaryMutex   sync.RWMutex
+	// sequencesMutex protects sequences
+	sequences      *mymap.CustomMap
+	sequencesMutex sync.Mutex
+	// engines are engines of tables, they are protected by tablesMutex
+	engines *mymap.CustomMap
+	// cache keeps parsed sheets of all tables and views
+	cache *sheetCache
+	// vacuuming are tables compacted in the background, vacuumWG waits for them
+	vacuuming   *mymap.CustomMap
+	vacuumMutex sync.Mutex
+	vacuumWG    sync.WaitGroup
+	wal         *wal
+	// exclusive is held for writing by migrations, commands hold it for reading
+	exclusive sync.RWMutex
+	// closed is set when the database is restored after a failed migration, the storage must be opened again
+	closed bool
+	// readOnly is set by OpenReadOnly, files aren't created or changed and the wal isn't replayed
+	readOnly bool
+	// pendingWAL is the number of entries of the wal which aren't replayed by OpenReadOnly
+	pendingWAL int
+	log        *slog.Logger
 }
 
 // New creates a new Storage
@@ -57,145 +88,171 @@ func New(storagePath string, schema *config.Schema, log *slog.Logger) *Storage {
 		log:                log,
 		TablePathes:        mymap.New(),
 		tableBlockingMutex: tableBlockingMutex,
+		views:              mymap.New(),
+		indexes:            mymap.New(),
+		secondaryIndexes:   mymap.New(),
+		sequences:          mymap.New(),
+		engines:            mymap.New(),
+		cache:              newSheetCache(schema.Cache.Sheets),
+		vacuuming:          mymap.New(),
 	}
 }
 
-// Exec parse the command and execute select/insert/delete
+// Exec parse the command and execute it
 func (s *Storage) Exec(str string) (string, error) {
-	str = strings.TrimSpace(str)
-	if selectRegexp.Match([]byte(str)) {
-		matches := selectRegexp.FindStringSubmatch(str)
-		fields := matches[1]
-		tables := matches[2]
+	release, err := s.acquire()
+	if err != nil {
+		return "", fmt.Errorf("error: " + err.Error())
+	}
+	defer release()
+	return s.exec(str)
+}
+
+// acquire holds the storage for a command until the returned function is called, it waits for the running migration
+func (s *Storage) acquire() (func(), error) {
+	s.exclusive.RLock()
+	if s.closed {
+		s.exclusive.RUnlock()
+		return nil, ErrStorageClosed
+	}
+	return s.exclusive.RUnlock, nil
+}
 
-		fieldsSplitted := strings.Split(fields, ",")
-		for i := range fieldsSplitted {
-			fieldsSplitted[i] = strings.TrimSpace(fieldsSplitted[i])
+// exec executes the command, the storage is held by the caller
+func (s *Storage) exec(str string) (string, error) {
+	str = strings.TrimSpace(str)
+	if stmt, ok, err := parseStatement(str); ok {
+		if err != nil {
+			return "", fmt.Errorf("error: " + err.Error())
 		}
-		tablesSplitted := strings.Split(tables, ",")
-		for i := range tablesSplitted {
-			tablesSplitted[i] = strings.TrimSpace(tablesSplitted[i])
+		if stmt.paramsCount() > 0 {
+			return "", fmt.Errorf("error: Parameters can be used only in prepared statements")
 		}
-
-		if err := s.blockTables(tablesSplitted); err != nil {
+		if err := s.checkReadOnly(stmt); err != nil {
+			return "", fmt.Errorf("error: " + err.Error())
+		}
+		output, err := stmt.exec(s)
+		if err != nil {
 			return "", fmt.Errorf("error: " + err.Error())
 		}
-		rows, err := s.Select(fieldsSplitted, tablesSplitted, "")
-		s.unBlockTables(tablesSplitted)
+		return output, nil
+	}
+	if err := s.checkReadOnly(nil); err != nil {
+		return "", fmt.Errorf("error: " + err.Error())
+	}
+
+	if createTableRegexp.Match([]byte(str)) {
+		matches := createTableRegexp.FindStringSubmatch(str)
+		definition, err := parseTableDefinition(matches[2], matches[3])
 		if err != nil {
 			return "", fmt.Errorf("error: " + err.Error())
 		}
+		definition.Engine = matches[4]
 
-		output := strings.Join(fieldsSplitted, ",") + "\n"
-		for i := 0; i < rows.Len(); i++ {
-			row := rows.Get(i)
-			if row.Len() > 0 {
-				output += strings.Join(row.GetData(), ",") + "\n"
-			}
+		if err := s.AddTable(definition, matches[1] != ""); err != nil {
+			return "", fmt.Errorf("error: " + err.Error())
 		}
-		return output, nil
-	} else if selectWhereRegexp.Match([]byte(str)) {
-		matches := selectWhereRegexp.FindStringSubmatch(str)
-		fields := matches[1]
-		tables := matches[2]
-		condition := matches[3]
+	} else if dropTableRegexp.Match([]byte(str)) {
+		matches := dropTableRegexp.FindStringSubmatch(str)
+
+		if err := s.DropTable(matches[2], matches[1] != ""); err != nil {
+			return "", fmt.Errorf("error: " + err.Error())
+		}
+	} else if alterEngineRegexp.Match([]byte(str)) {
+		matches := alterEngineRegexp.FindStringSubmatch(str)
 
-		fieldsSplitted := strings.Split(fields, ",")
-		for i := range fieldsSplitted {
-			fieldsSplitted[i] = strings.TrimSpace(fieldsSplitted[i])
+		if err := s.ConvertTable(matches[1], matches[2]); err != nil {
+			return "", fmt.Errorf("error: " + err.Error())
 		}
-		tablesSplitted := strings.Split(tables, ",")
-		for i := range tablesSplitted {
-			tablesSplitted[i] = strings.TrimSpace(tablesSplitted[i])
+	} else if createIndexRegexp.Match([]byte(str)) {
+		matches := createIndexRegexp.FindStringSubmatch(str)
+		index := &Index{
+			Name:    matches[3],
+			Table:   matches[4],
+			Columns: splitList(matches[6]),
+			Type:    matches[5],
+			Unique:  matches[1] != "",
 		}
 
-		if err := s.blockTables(tablesSplitted); err != nil {
+		if err := s.CreateIndex(index, matches[2] != ""); err != nil {
 			return "", fmt.Errorf("error: " + err.Error())
 		}
-		rows, err := s.Select(fieldsSplitted, tablesSplitted, condition)
+	} else if dropIndexRegexp.Match([]byte(str)) {
+		matches := dropIndexRegexp.FindStringSubmatch(str)
+
+		if err := s.DropIndex(matches[2], matches[1] != ""); err != nil {
+			return "", fmt.Errorf("error: " + err.Error())
+		}
+	} else if createSequenceRegexp.Match([]byte(str)) {
+		matches := createSequenceRegexp.FindStringSubmatch(str)
+		start, increment, err := parseSequenceOptions(matches[3])
 		if err != nil {
 			return "", fmt.Errorf("error: " + err.Error())
 		}
-		s.unBlockTables(tablesSplitted)
 
-		output := strings.Join(fieldsSplitted, ",") + "\n"
-		for i := 0; i < rows.Len(); i++ {
-			row := rows.Get(i)
-			if row.Len() > 0 {
-				output += strings.Join(row.GetData(), ",") + "\n"
-			}
+		if err := s.CreateSequence(matches[2], start, increment, matches[1] != ""); err != nil {
+			return "", fmt.Errorf("error: " + err.Error())
+		}
+	} else if dropSequenceRegexp.Match([]byte(str)) {
+		matches := dropSequenceRegexp.FindStringSubmatch(str)
+
+		if err := s.DropSequence(matches[2], matches[1] != ""); err != nil {
+			return "", fmt.Errorf("error: " + err.Error())
+		}
+	} else if createViewRegexp.Match([]byte(str)) {
+		matches := createViewRegexp.FindStringSubmatch(str)
+		var columns []string
+		if matches[3] != "" {
+			columns = splitList(matches[3])
 		}
 
-		return output, nil
-	} else if insertRegexp.Match([]byte(str)) {
-		matches := insertRegexp.FindStringSubmatch(str)
-		tableName := matches[1]
-		values := matches[2]
+		if err := s.CreateView(matches[2], columns, matches[4], matches[1] != ""); err != nil {
+			return "", fmt.Errorf("error: " + err.Error())
+		}
+	} else if dropViewRegexp.Match([]byte(str)) {
+		matches := dropViewRegexp.FindStringSubmatch(str)
 
-		valuesSplitted := strings.Split(values, ",")
-		for i := range valuesSplitted {
-			valuesSplitted[i] = strings.TrimSpace(valuesSplitted[i])
-			valuesSplitted[i] = strings.Trim(valuesSplitted[i], "'")
-			if strings.Contains(valuesSplitted[i], ",") {
-				return "", fmt.Errorf("error: Values can't contain ',' symbol")
-			}
+		if err := s.DropView(matches[3], matches[2] != "", matches[1] != ""); err != nil {
+			return "", fmt.Errorf("error: " + err.Error())
+		}
+	} else if refreshViewRegexp.Match([]byte(str)) {
+		matches := refreshViewRegexp.FindStringSubmatch(str)
+
+		if err := s.RefreshMaterializedView(matches[1]); err != nil {
+			return "", fmt.Errorf("error: " + err.Error())
+		}
+	} else if showTablesRegexp.Match([]byte(str)) {
+		return s.ShowTables(), nil
+	} else if showViewsRegexp.Match([]byte(str)) {
+		return s.ShowViews(), nil
+	} else if showIndexesRegexp.Match([]byte(str)) {
+		return s.ShowIndexes(), nil
+	} else if showCacheRegexp.Match([]byte(str)) {
+		return s.ShowCache(), nil
+	} else if checkTableRegexp.Match([]byte(str)) {
+		matches := checkTableRegexp.FindStringSubmatch(str)
+
+		output, err := s.CheckTable(matches[1])
+		if err != nil {
+			return "", fmt.Errorf("error: " + err.Error())
 		}
+		return output, nil
+	} else if vacuumRegexp.Match([]byte(str)) {
+		matches := vacuumRegexp.FindStringSubmatch(str)
 
-		if err := s.blockTables([]string{tableName}); err != nil {
+		output, err := s.VacuumTables(matches[1])
+		if err != nil {
 			return "", fmt.Errorf("error: " + err.Error())
 		}
-		id, err := s.Insert(tableName, valuesSplitted)
+		return output, nil
+	} else if describeRegexp.Match([]byte(str)) {
+		matches := describeRegexp.FindStringSubmatch(str)
+
+		output, err := s.Describe(matches[1])
 		if err != nil {
-			if errors.Is(err, ErrIncorrectNumberOfColumns) {
-				return "", fmt.Errorf("error: Incorrect number of columns")
-			}
 			return "", fmt.Errorf("error: " + err.Error())
 		}
-		s.unBlockTables([]string{tableName})
-
-		return id, nil
-	} else if deleteRegexp.Match([]byte(str)) {
-		matches := deleteRegexp.FindStringSubmatch(str)
-		tables := matches[1]
-
-		tablesSplitted := strings.Split(tables, ",")
-		for i := range tablesSplitted {
-			tablesSplitted[i] = strings.TrimSpace(tablesSplitted[i])
-		}
-
-		for _, tableName := range tablesSplitted {
-			if err := s.blockTables([]string{tableName}); err != nil {
-				return "", fmt.Errorf("error: " + err.Error())
-			}
-			err := s.Delete(tableName)
-			if err != nil {
-				return "", fmt.Errorf("error: " + err.Error())
-			}
-			s.unBlockTables([]string{tableName})
-		}
-	} else if deleteWhereRegexp.Match([]byte(str)) {
-		matches := deleteWhereRegexp.FindStringSubmatch(str)
-		tables := matches[1]
-		condition := matches[2]
-
-		tablesSplitted := strings.Split(tables, ",")
-		for i := range tablesSplitted {
-			tablesSplitted[i] = strings.TrimSpace(tablesSplitted[i])
-		}
-		count := 0
-		for _, tableName := range tablesSplitted {
-			if err := s.blockTables([]string{tableName}); err != nil {
-				return "", fmt.Errorf("error: " + err.Error())
-			}
-			var err error
-			err, count = s.DeleteWhere(tableName, condition)
-			if err != nil {
-				return "", fmt.Errorf("error: " + err.Error())
-			}
-			s.unBlockTables([]string{tableName})
-		}
-
-		return fmt.Sprintf("deleted %d rows", count), nil
+		return output, nil
 	} else {
 		return "", fmt.Errorf("error: Incorrect command")
 	}
@@ -203,6 +260,43 @@ func (s *Storage) Exec(str string) (string, error) {
 	return "", nil
 }
 
+// checkValues returns ErrValueComma if a value contains ',', rows are written to sheets and output separated by ','
+func checkValues(values []string) error {
+	for _, value := range values {
+		if strings.Contains(value, ",") {
+			return ErrValueComma
+		}
+	}
+	return nil
+}
+
+// ExecTo executes the command like Exec and writes its output, rows of SELECT are written while they are read
+func (s *Storage) ExecTo(output io.Writer, str string) error {
+	release, err := s.acquire()
+	if err != nil {
+		return fmt.Errorf("error: " + err.Error())
+	}
+	defer release()
+	return s.execTo(output, str)
+}
+
+// execTo executes the command like exec and writes its output, the storage is held by the caller
+func (s *Storage) execTo(output io.Writer, str string) error {
+	str = strings.TrimSpace(str)
+	if stmt, ok, err := parseStatement(str); ok && err == nil && stmt.paramsCount() == 0 {
+		if err := execStatementTo(s, stmt, output); err != nil {
+			return fmt.Errorf("error: " + err.Error())
+		}
+		return nil
+	}
+	result, err := s.exec(str)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(output, result)
+	return err
+}
+
 // Insert adds a new row to the table with given values
 func (s *Storage) Insert(table string, values []string) (string, error) {
 	const op = "storage.Insert"
@@ -212,437 +306,487 @@ func (s *Storage) Insert(table string, values []string) (string, error) {
 		slog.Any("values", values),
 	)
 
-	tablePath := s.TablePathes.Get(table).(string)
-	if tablePath == "" {
+	// Validate columns count
+	schemaColumns, ok := s.tableColumns(table)
+	if !ok {
 		return "", ErrIncorectTable
 	}
-
-	// Validate columns count
-	schemaColumns, _ := s.Schema.Tables.Get(table).([]string)
 	if len(values) != len(schemaColumns)-1 {
 		return "", ErrIncorrectNumberOfColumns
 	}
+	if err := checkValues(values); err != nil {
+		return "", err
+	}
 
-	// Read pk and add to the columns
-	pkPath := path.Join(tablePath, table+"_pk_sequence")
-	idBytes, err := os.ReadFile(pkPath)
+	engine, _ := s.tableEngine(table)
+	if err := engine.Writable(); err != nil {
+		return "", err
+	}
+	indexes, err := s.uniqueIndexes(table)
 	if err != nil {
 		log.Error(
-			"PK reading error",
-			slog.String("pkpath", pkPath),
+			"Indexes building error",
+			prettylogger.Err(err),
 		)
 		return "", fmt.Errorf("%s: %w", op, err)
 	}
+	secondaryIndexes, err := s.tableIndexes(table)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", op, err)
+	}
+	// checkRow builds the row with the pk and checks constraints, unique ones by indexes
+	checkRow := func(id string) ([]string, *mymap.CustomMap, error) {
+		rowWithPk := append([]string{id}, values...)
+		row := mymap.New()
+		for i, column := range schemaColumns {
+			row.Add(table+"."+column, rowWithPk[i])
+		}
+		if err := s.computeGenerated(table, row); err != nil {
+			return nil, nil, err
+		}
+		for i, column := range schemaColumns {
+			rowWithPk[i], _ = row.Get(table + "." + column).(string)
+		}
+		if err := s.checkRows(table, []*mymap.CustomMap{row}); err != nil {
+			return nil, nil, err
+		}
+		if err := checkUnique(indexes, table, []*mymap.CustomMap{row}, nil); err != nil {
+			return nil, nil, err
+		}
+		if err := checkIndexUnique(secondaryIndexes, []*mymap.CustomMap{row}, nil); err != nil {
+			return nil, nil, err
+		}
+		if err := s.checkForeignKeys(table, []*mymap.CustomMap{row}); err != nil {
+			return nil, nil, err
+		}
+		return rowWithPk, row, nil
+	}
 
-	id := strings.TrimSpace(string(idBytes))
-	idInt, err := strconv.Atoi(id)
+	// The row is checked with the pk of the next row, the pk is taken from the pk sequence only after checks pass,
+	// so a rejected row doesn't use up a pk
+	next, err := engine.PeekPk()
 	if err != nil {
 		log.Error(
-			"id isn't number",
-			slog.String("pkpath", pkPath),
+			"PK reading error",
+			prettylogger.Err(err),
 		)
 		return "", fmt.Errorf("%s: %w", op, err)
 	}
-	values = append([]string{id}, values...)
-
-	sheets, err := utils.GetSheetsFromFiles(tablePath)
+	checked := strconv.FormatInt(next, 10)
+	rowWithPk, row, err := checkRow(checked)
+	if err != nil {
+		return "", err
+	}
+	id, err := s.nextPk(table)
 	if err != nil {
 		log.Error(
-			"Sheets getting error",
+			"PK reading error",
 			prettylogger.Err(err),
 		)
 		return "", fmt.Errorf("%s: %w", op, err)
 	}
+	if id != checked {
+		// the pk is taken by nextval of the pk sequence after the check
+		if rowWithPk, row, err = checkRow(id); err != nil {
+			return "", err
+		}
+	}
+	values = rowWithPk
 
-	for _, sheetName := range sheets {
-		sheetPath := path.Join(tablePath, sheetName)
-		// Check for rowCount
-		_, rowCount, err := csv.ReadCSV(sheetPath, table)
-		if err != nil {
-			log.Error(
-				"Sheet reading error",
-				prettylogger.Err(err),
-				slog.String("sheetpath", sheetPath),
-			)
-			return "", fmt.Errorf("%s: %v", op, err)
-		}
-		// If rowCount > tuples_limit, write to the next sheet
-		if rowCount < s.Schema.TuplesLimit {
-			err = csv.AddRow(sheetPath, values)
-			if err != nil {
-				log.Error(
-					"Error adding row",
-					prettylogger.Err(err),
-					slog.String("sheetpath", sheetPath),
-				)
-				return "", fmt.Errorf("%s: %v", op, err)
-			}
-
-			err = os.WriteFile(pkPath, []byte(strconv.Itoa(idInt+1)), 0644)
-			if err != nil {
-				log.Error(
-					"Error writing a new pk",
-					slog.String("pkpath", pkPath),
-				)
-				return "", err
-			}
-
-			return id, nil
-		}
-	}
-	log.Info("Creating new sheet")
-	newSheetPath := path.Join(tablePath, fmt.Sprintf("%d.csv", len(sheets)+1))
-
-	utils.WriteFile(newSheetPath, strings.Join(schemaColumns, ",")+"\n")
-
-	err = csv.AddRow(newSheetPath, values)
+	done, err := s.logChanges(walOp{Type: walInsert, Table: table, Rows: [][]string{values}})
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", op, err)
+	}
+	defer done()
+	location, err := engine.Append(values)
 	if err != nil {
 		log.Error(
 			"Error adding row",
 			prettylogger.Err(err),
-			slog.String("sheetpath", newSheetPath),
 		)
 		return "", fmt.Errorf("%s: %v", op, err)
 	}
-	err = os.WriteFile(pkPath, []byte(strconv.Itoa(idInt+1)), 0644)
-	if err != nil {
+
+	updateIndexes(indexes, table, nil, []*mymap.CustomMap{row})
+	if err := s.indexRows(table, secondaryIndexes, []*mymap.CustomMap{row}, []RowLocation{location}); err != nil {
 		log.Error(
-			"Error writing a new pk",
-			slog.String("pkpath", pkPath),
+			"Error saving indexes",
+			prettylogger.Err(err),
 		)
-		return "", err
+		s.resetIndexes(table)
 	}
-
 	return id, nil
 }
 
-func (s *Storage) Select(fields []string, tables []string, condition string) (*mysl.MySl[*mysl.MySl[string]], error) {
+// Select returns rows for the query
+func (s *Storage) Select(query *selectQuery) (*mysl.MySl[*mysl.MySl[string]], error) {
+	result := mysl.New[*mysl.MySl[string]]()
+	err := s.selectRows(query, func(values []string) error {
+		if values == nil {
+			return nil
+		}
+		selectedRow := mysl.New[string]()
+		for _, value := range values {
+			selectedRow.Append(value)
+		}
+		result.Append(selectedRow)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// selectRows executes the query and passes selected values of each row to fn
+//
+// Rows are streamed from sheets through the plan, only sort and aggregation keep rows in memory.
+// fn is called with nil values once the plan is built, before the first row.
+func (s *Storage) selectRows(query *selectQuery, fn func(values []string) error) error {
 	const op = "storage.Select"
 	log := s.log.With(
 		slog.String("op", op),
-		slog.Any("fields", fields),
-		slog.Any("tables", tables),
-		slog.String("condition", condition),
+		slog.Any("fields", query.Fields),
+		slog.Any("tables", query.Tables),
+		slog.String("condition", query.Condition),
 	)
 
-	// validate all tables
-	for _, table := range tables {
-		if _, ok := s.TablePathes.Get(table).(string); !ok {
-			return nil, fmt.Errorf("table %s is not exists", table)
-		}
-	}
-
-	// validate all fields
-	for _, field := range fields {
-		fieldSplitted := strings.Split(field, ".")
-		if len(fieldSplitted) != 2 {
-			return nil, fmt.Errorf("field %s is not valid", field)
-		}
-		table := fieldSplitted[0]
-		column := fieldSplitted[1]
-		if !slices.Contains(tables, table) {
-			return nil, fmt.Errorf("field %s not in tables", field)
-		}
-		tableCols, ok := s.Schema.Tables.Get(table).([]string)
-		if !ok || !slices.Contains(tableCols, column) {
-			return nil, fmt.Errorf("column %s not exists in table %s", column, table)
-		}
-	}
-
-	var result *mysl.MySl[*mysl.MySl[string]]
-	// No Where
-	if condition == "" {
-		if len(tables) == 1 {
-			result = mysl.New[*mysl.MySl[string]]()
-			data, err := s.getAllColumns(tables[0])
-			if err != nil {
-				return nil, err
-			}
-			for i := 0; i < data.Len(); i++ {
-				result.Append(mysl.New[string]())
-			}
-
-			for _, field := range fields {
-				for j := 0; j < data.Len(); j++ {
-					value := data.Get(j).Get(field).(string)
-					result.Get(j).Append(value)
-				}
-			}
-		} else { // Cross Join
-			// Get all data
-			allTablesData := mysl.New[*mysl.MySl[*mymap.CustomMap]]()
-			for _, table := range tables {
-				data, err := s.getAllColumns(table)
-				if err != nil {
-					return nil, err
-				}
-				tableData := mysl.New[*mymap.CustomMap]()
-				for j := 0; j < data.Len(); j++ {
-					tableData.Append(data.Get(j))
-				}
-				allTablesData.Append(tableData)
-			}
-			// get cross join fields
-			joinedRows := crossJoin(allTablesData)
-			// Get needed fields
-			result = mysl.New[*mysl.MySl[string]]()
-			for i := 0; i < joinedRows.Len(); i++ {
-				selectedRow := mysl.New[string]()
-				for _, field := range fields {
-					value, ok := joinedRows.Get(i).Get(field).(string)
-					if ok {
-						selectedRow.Append(value)
-					}
-				}
-				result.Append(selectedRow)
-			}
-		}
-	} else { // For Where
-		head := s.GetConditionTree(condition)
-		result = mysl.New[*mysl.MySl[string]]()
-		if len(tables) == 1 {
-			for _, field := range fields {
-				fieldSplitted := strings.Split(field, ".")
-				tableName := fieldSplitted[0]
-				tablePath := s.TablePathes.Get(tableName).(string)
-
-				sheets, err := utils.GetSheetsFromFiles(tablePath)
-				if err != nil {
-					log.Error(
-						"Error getting sheets from table",
-						prettylogger.Err(err),
-						slog.String("tableName", tableName),
-						slog.String("tablePath", tablePath),
-					)
-					return nil, fmt.Errorf("error getting sheets from table %s", tableName)
-				}
-				for _, sheetName := range sheets {
-					sheetpath := path.Join(tablePath, sheetName)
-
-					data, _, err := csv.ReadCSV(sheetpath, tableName)
-					if err != nil {
-						slog.Error(
-							"Error reading sheet",
-							prettylogger.Err(err),
-							slog.String("sheetname", sheetName),
-							slog.String("sheetpath", sheetpath),
-						)
-						return nil, fmt.Errorf("error reading sheet %s", sheetpath)
-					}
-					for j := 0; j < data.Len(); j++ {
-						if j >= result.Len() {
-							result.Append(mysl.New[string]())
-						}
-						row := data.Get(j)
-						if s.IsValidRow(head, row, tables, tableName) {
-							value, ok := row.Get(field).(string)
-							if ok {
-								result.Get(j).Append(value)
-							}
-						}
-					}
-				}
-			}
-		} else { // Cross Join
-			// get data from each field and validate it by condition
-			validatedData := mysl.New[*mysl.MySl[*mymap.CustomMap]]()
-			for i := 0; i < len(tables); i++ {
-				validatedData.Append(mysl.New[*mymap.CustomMap]())
-			}
-			for _, field := range fields {
-				fieldSplitted := strings.Split(field, ".")
-				tableName := fieldSplitted[0]
-				tableIndex := slices.Index(tables, tableName)
-				tablePath := s.TablePathes.Get(tableName).(string)
-
-				sheets, err := utils.GetSheetsFromFiles(tablePath)
-				if err != nil {
-					return nil, fmt.Errorf("error getting sheets from table %s", tableName)
-				}
-
-				// read sheet -> validate each row -> if valid append to validatedData
-				for _, sheetName := range sheets {
-					sheetpath := path.Join(tablePath, sheetName)
-
-					data, _, err := csv.ReadCSV(sheetpath, tableName)
-					if err != nil {
-						return nil, fmt.Errorf("error reading sheet %s", sheetpath)
-					}
-					for j := 0; j < data.Len(); j++ {
-						row := data.Get(j)
-						if s.IsValidRow(head, row, tables, tableName) {
-							validatedData.Get(tableIndex).Append(row)
-						}
-					}
-				}
-			}
-
-			// get cross join fields
-			joinedRows := crossJoin(validatedData)
-
-			// get needed fields
-			for i := 0; i < joinedRows.Len(); i++ {
-				selectedRow := mysl.New[string]()
-				for _, field := range fields {
-					value, ok := joinedRows.Get(i).Get(field).(string)
-					if !ok {
-						continue
-					}
-					selectedRow.Append(value)
-				}
-				result.Append(selectedRow)
-			}
-		}
-	}
-
-	s.log.Info(
-		"select completed successfully",
-		slog.Any("fields", fields),
-		slog.Any("tables", tables),
-		slog.String("condition", condition),
-	)
+	root, err := s.buildPlan(query)
+	if err != nil {
+		return err
+	}
+	if err := fn(nil); err != nil {
+		return err
+	}
+	values := make([]string, len(query.Fields))
+	err = streamPlan(root, func(row *mymap.CustomMap) error {
+		for i, field := range query.Fields {
+			values[i], _ = row.Get(field).(string)
+		}
+		return fn(values)
+	})
+	if err != nil {
+		log.Error(
+			"Error executing query",
+			prettylogger.Err(err),
+		)
+		return err
+	}
 
-	return result, nil
+	log.Info("select completed successfully")
+	return nil
 }
 
-// crossJoin gets Dekart mult of slice of tables
-func crossJoin(tables *mysl.MySl[*mysl.MySl[*mymap.CustomMap]]) *mysl.MySl[*mymap.CustomMap] {
-	if tables.Len() == 0 {
-		return &mysl.MySl[*mymap.CustomMap]{}
+func (s *Storage) validateField(field string, tables []string) error {
+	fieldSplitted := strings.Split(field, ".")
+	if len(fieldSplitted) != 2 {
+		return fmt.Errorf("field %s is not valid", field)
+	}
+	table := fieldSplitted[0]
+	column := fieldSplitted[1]
+	if !slices.Contains(tables, table) {
+		return fmt.Errorf("field %s not in tables", field)
 	}
+	tableCols, err := s.sourceColumns(table)
+	if err != nil || !slices.Contains(tableCols, column) {
+		return fmt.Errorf("column %s not exists in table %s", column, table)
+	}
+	return nil
+}
 
-	result := tables.Get(0)
+// sourceColumns returns columns of the table or view
+func (s *Storage) sourceColumns(name string) ([]string, error) {
+	if columns, ok := s.tableColumns(name); ok {
+		return columns, nil
+	}
+	if view := s.getView(name); view != nil {
+		return view.Columns, nil
+	}
+	return nil, fmt.Errorf("table %s is not exists", name)
+}
 
-	for i := 1; i < tables.Len(); i++ {
-		result = combine(result, tables.Get(i))
+// baseTables replaces views with tables used by them, result is sorted and has no duplicates
+//
+// Materialized views are kept as is, because they are locked like tables
+func (s *Storage) baseTables(names []string) []string {
+	tables := make([]string, 0, len(names))
+	for _, name := range names {
+		if view := s.getView(name); view != nil && !view.Materialized && !s.viewReferences(view, view.Name) {
+			tables = append(tables, s.baseTables(view.query.Tables)...)
+		} else {
+			tables = append(tables, name)
+		}
 	}
+	slices.Sort(tables)
+	return slices.Compact(tables)
+}
 
-	return result
+// tableNames returns names of all tables in alphabetical order
+func (s *Storage) tableNames() []string {
+	s.tablesMutex.RLock()
+	tables := s.Schema.Tables.Keys().GetData()
+	s.tablesMutex.RUnlock()
+	slices.Sort(tables)
+	return tables
 }
 
-// combine merges rows from two tables
-func combine(table1, table2 *mysl.MySl[*mymap.CustomMap]) *mysl.MySl[*mymap.CustomMap] {
-	result := mysl.New[*mymap.CustomMap]()
+// tableColumns returns columns of the table including the pk column
+func (s *Storage) tableColumns(table string) ([]string, bool) {
+	s.tablesMutex.RLock()
+	defer s.tablesMutex.RUnlock()
+
+	columns, ok := s.Schema.Tables.Get(table).([]string)
+	return columns, ok
+}
+
+// tablePath returns the directory with sheets of the table
+func (s *Storage) tablePath(table string) (string, bool) {
+	s.tablesMutex.RLock()
+	defer s.tablesMutex.RUnlock()
+
+	tablePath, ok := s.TablePathes.Get(table).(string)
+	return tablePath, ok
+}
 
-	for i := range table1.Len() {
-		for j := range table2.Len() {
-			row1, row2 := table1.Get(i), table2.Get(j)
-			keys1, keys2 := row1.Keys(), row2.Keys()
-			// merge rows from table2 and table1
-			combinedMap := mymap.New()
-			for i := 0; i < keys1.Len(); i++ {
-				key := keys1.Get(i)
-				val := row1.Get(key)
-				combinedMap.Add(key, val)
-			}
-			for i := 0; i < keys2.Len(); i++ {
-				key := keys2.Get(i)
-				val := row2.Get(key)
-				combinedMap.Add(key, val)
-			}
-			result.Append(combinedMap)
-		}
-	}
-
-	return result
+// databasePath returns the directory of the database
+func (s *Storage) databasePath() string {
+	return path.Join(s.StoragePath, s.Schema.Name)
 }
 
-func (s *Storage) getAllColumns(table string) (*mysl.MySl[*mymap.CustomMap], error) {
-	const op = "storage.getAllColumns"
+// readSheets reads all sheets from the directory, keys of rows are table.column
+func (s *Storage) readSheets(table string, tablePath string) (*mysl.MySl[*mymap.CustomMap], error) {
+	const op = "storage.readSheets"
 	log := s.log.With(
 		slog.String("op", op),
 	)
 
-	result := mysl.New[*mymap.CustomMap]()
-
-	tablePath := s.TablePathes.Get(table).(string)
-	sheets, err := utils.GetSheetsFromFiles(tablePath)
+	cursor, err := newCursor(table, tablePath, s.cache)
 	if err != nil {
 		return nil, err
 	}
-	for _, sheet := range sheets {
-		sheetPath := path.Join(tablePath, sheet)
-		data, _, err := csv.ReadCSV(sheetPath, table)
+	defer cursor.Close()
+
+	result := mysl.New[*mymap.CustomMap]()
+	for {
+		row, err := cursor.Next()
 		if err != nil {
 			log.Error(
 				"Sheet reading error",
 				prettylogger.Err(err),
-				slog.String("sheetpath", sheetPath),
 			)
 			return nil, err
 		}
-		for i := 0; i < data.Len(); i++ {
-			result.Append(data.Get(i))
+		if row == nil {
+			return result, nil
 		}
+		result.Append(row)
 	}
-	return result, nil
+}
+
+// Update sets values of columns in rows which match the condition, all rows are updated if head is nil
+//
+// Constraints are checked for all updated rows before sheets are rewritten.
+func (s *Storage) Update(table string, columns []string, values []string, head *Node) (int, error) {
+	const op = "storage.Update"
+	log := s.log.With(
+		slog.String("op", op),
+		slog.String("table", table),
+		slog.String("condition", head.String()),
+	)
+
+	engine, ok := s.tableEngine(table)
+	if !ok {
+		return 0, ErrIncorectTable
+	}
+	schemaColumns, _ := s.tableColumns(table)
+	if err := checkValues(values); err != nil {
+		return 0, err
+	}
+
+	// new values with keys table.column
+	changes := mymap.New()
+	for i, column := range columns {
+		column = strings.TrimPrefix(column, table+".")
+		if !slices.Contains(schemaColumns, column) {
+			return 0, fmt.Errorf("column %s not exists in table %s", column, table)
+		}
+		if column == table+"_pk" || s.isGenerated(table, column) {
+			return 0, fmt.Errorf("column %s can't be updated", column)
+		}
+		if changes.Get(table+"."+column) != nil {
+			return 0, fmt.Errorf("column %s is set more than once", column)
+		}
+		changes.Add(table+"."+column, values[i])
+	}
+
+	// rows are replaced only after constraints are checked
+	oldRows := make([]*mymap.CustomMap, 0)
+	newRows := make([]*mymap.CustomMap, 0)
+	updatedPks := make([]string, 0)
+	// pk -> new row
+	updated := mymap.New()
+	// locations of updated rows and their sheets, only these sheets are rewritten
+	replaced := mymap.New()
+	sheets := make([]int, 0)
+	lookup, err := s.lookupIndex(table, head, []string{table})
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	var scanSheets []int
+	if lookup != nil {
+		scanSheets = lookup.sheets
+	}
+	err = s.scanLocated(table, scanSheets, func(row *mymap.CustomMap, location RowLocation) error {
+		if lookup != nil && !lookup.contains(location) {
+			return nil
+		}
+		if head != nil && !s.IsValidRow(head, row, []string{table}, table) {
+			return nil
+		}
+		replaced.Add(locationKey(location), true)
+		if !slices.Contains(sheets, location.Sheet) {
+			sheets = append(sheets, location.Sheet)
+		}
+		newRow := mergeRows(row, changes)
+		if err := s.computeGenerated(table, newRow); err != nil {
+			return err
+		}
+		oldRows = append(oldRows, row)
+		newRows = append(newRows, newRow)
+		updatedPks = append(updatedPks, rowPk(table, row))
+		updated.Add(rowPk(table, row), newRow)
+		return nil
+	})
+	if err != nil {
+		log.Error(
+			"error reading rows",
+			prettylogger.Err(err),
+		)
+		return 0, err
+	}
+	if len(newRows) == 0 {
+		return 0, nil
+	}
+
+	if err := s.checkRows(table, newRows); err != nil {
+		return 0, err
+	}
+	indexes, err := s.uniqueIndexes(table)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	if err := checkUnique(indexes, table, newRows, updatedPks); err != nil {
+		return 0, err
+	}
+	secondaryIndexes, err := s.tableIndexes(table)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	if err := checkIndexUnique(secondaryIndexes, newRows, replaced); err != nil {
+		return 0, err
+	}
+	if err := s.checkForeignKeys(table, newRows); err != nil {
+		return 0, err
+	}
+	if err := s.checkReferenced(table, oldRows, newRows); err != nil {
+		return 0, err
+	}
+
+	change := walOp{Type: walUpdate, Table: table}
+	for _, row := range newRows {
+		change.Rows = append(change.Rows, rowValues(table, schemaColumns, row))
+	}
+	done, err := s.logChanges(change)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	defer done()
+
+	rewritten, err := engine.Rewrite(sheets, func(row *mymap.CustomMap) (*mymap.CustomMap, bool) {
+		newRow, ok := updated.Get(rowPk(table, row)).(*mymap.CustomMap)
+		if !ok {
+			return row, false
+		}
+		return newRow, true
+	})
+	if err != nil {
+		log.Error(
+			"error writing rows",
+			prettylogger.Err(err),
+		)
+		s.dropIndexes(table)
+		s.resetIndexes(table)
+		return 0, fmt.Errorf("error writing rows: %w", err)
+	}
+	updateIndexes(indexes, table, oldRows, newRows)
+	if err := s.reindexSheets(table, secondaryIndexes, rewritten); err != nil {
+		log.Error(
+			"error saving indexes",
+			prettylogger.Err(err),
+		)
+		s.resetIndexes(table)
+	}
+
+	return len(newRows), nil
 }
 
 func (s *Storage) Delete(tableName string) error {
-	tablePath, ok1 := s.TablePathes.Get(tableName).(string)
-	columns, ok2 := s.Schema.Tables.Get(tableName).([]string)
-	if !ok1 || !ok2 {
+	engine, ok := s.tableEngine(tableName)
+	if !ok {
 		return ErrIncorectTable
 	}
 
-	os.RemoveAll(tablePath)
-	s.CreateTable(tableName, tablePath, columns)
+	// referenced rows are deleted one by one to apply actions of foreign keys
+	if len(s.referencingKeys(tableName)) > 0 {
+		_, err := s.deleteRows(tableName, nil, func(row *mymap.CustomMap) bool { return true })
+		return err
+	}
 
+	done, err := s.logChanges(walOp{Type: walTruncate, Table: tableName})
+	if err != nil {
+		return err
+	}
+	defer done()
+	s.dropIndexes(tableName)
+	if err := engine.Truncate(); err != nil {
+		s.resetIndexes(tableName)
+		return fmt.Errorf("can't truncate table %s: %w", tableName, err)
+	}
+	if err := s.clearIndexes(tableName); err != nil {
+		s.resetIndexes(tableName)
+	}
 	return nil
 }
 
 func (s *Storage) DeleteWhere(tableName string, condition string) (error, int) {
+	return s.deleteWhere(tableName, s.GetConditionTree(condition))
+}
+
+func (s *Storage) deleteWhere(tableName string, head *Node) (error, int) {
 	const op = "storage.deleteWhere"
 	log := s.log.With(
 		slog.String("op", op),
 		slog.String("tableName", tableName),
-		slog.String("condition", condition),
+		slog.String("condition", head.String()),
 	)
 
-	head := s.GetConditionTree(condition)
-
-	tablePath := s.TablePathes.Get(tableName).(string)
-	if tablePath == "" {
-		return ErrIncorectTable, 0
-	}
-
-	sheets, err := utils.GetSheetsFromFiles(tablePath)
+	lookup, err := s.lookupIndex(tableName, head, []string{tableName})
 	if err != nil {
 		log.Error(
-			"error getting sheets",
+			"error reading index",
 			prettylogger.Err(err),
-			slog.String("tablePath", tablePath),
 		)
-		return fmt.Errorf("error getting sheets"), 0
+		return err, 0
 	}
-	deleted := 0
-	for _, sheet := range sheets {
-		sheetPath := path.Join(tablePath, sheet)
-		rows, _, err := csv.ReadCSV(sheetPath, tableName)
-		if err != nil {
-			log.Error(
-				"error reading csv",
-				prettylogger.Err(err),
-				slog.String("sheetPath", sheetPath),
-			)
-			return fmt.Errorf("error reading csv"), 0
-		}
-		for i := 0; i < rows.Len(); i++ {
-			if s.IsValidRow(head, rows.Get(i), []string{tableName}, tableName) {
-				rows.Delete(i)
-				i--
-				deleted++
-			}
-		}
-		cols, ok := s.Schema.Tables.Get(tableName).([]string)
-		if !ok {
-			log.Error(
-				"cols for table not found in schema",
-				slog.String("tableName", tableName),
-			)
-			return fmt.Errorf("table %s not found", tableName), deleted
-		}
-		csv.WriteFile(sheetPath, tableName, rows, cols)
+	deleted, err := s.deleteRows(tableName, lookup, func(row *mymap.CustomMap) bool {
+		return s.IsValidRow(head, row, []string{tableName}, tableName)
+	})
+	if err != nil {
+		log.Error(
+			"error deleting rows",
+			prettylogger.Err(err),
+		)
+		return err, 0
 	}
 	return nil, deleted
 }
@@ -0,0 +1,422 @@
+package storage
+
+import (
+	"JacuteSQL/internal/config"
+	"JacuteSQL/internal/lib/utils"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/jacute/prettylogger"
+)
+
+var (
+	createTableRegexp     = regexp.MustCompile(`(?is)^CREATE\s+TABLE\s+(IF\s+NOT\s+EXISTS\s+)?(\w+)\s*\((.+)\)(?:\s*ENGINE\s*=?\s*(\w+))?\s*;?$`)
+	alterEngineRegexp     = regexp.MustCompile(`(?i)^ALTER\s+TABLE\s+(\w+)\s+SET\s+ENGINE\s*=?\s*(\w+)\s*;?$`)
+	dropTableRegexp       = regexp.MustCompile(`(?i)^DROP\s+TABLE\s+(IF\s+EXISTS\s+)?(\w+)\s*;?$`)
+	tableConstraintRegexp = regexp.MustCompile(`(?is)^(PRIMARY\s+KEY|UNIQUE|FOREIGN\s+KEY)\s*\(([\w\s,]+)\)(.*)$`)
+	columnDefRegexp       = regexp.MustCompile(`(?is)^(\w+)(.*)$`)
+	columnOptionRegexp    = regexp.MustCompile(`(?i)^\s*(PRIMARY\s+KEY|UNIQUE|NOT\s+NULL)\b`)
+	defaultOptionRegexp   = regexp.MustCompile(`(?is)^\s*DEFAULT\s+('(?:[^']|'')*'|-?\d+(?:\.\d+)?|\w+\s*\([^)]*\)|\w+)`)
+	checkRegexp           = regexp.MustCompile(`(?is)^\s*CHECK\s*\(`)
+	referencesRegexp      = regexp.MustCompile(`(?is)^\s*REFERENCES\s+(\w+)(?:\s*\(([\w\s,]+)\))?(?:\s+ON\s+DELETE\s+(CASCADE|RESTRICT|SET\s+NULL|NO\s+ACTION))?`)
+)
+
+const (
+	tablesFileName = "tables.json"
+)
+
+// reservedNames are names of files and directories of the storage in the database directory,
+// tables and views can't have them because their files are stored in directories with their names
+var reservedNames = []string{
+	indexesDirName, lostFoundDirName, tablesFileName, indexesFileName, viewsFileName, sequencesFileName, enginesFileName, walFileName,
+}
+
+// checkReservedName returns an error if the name of the table or the view is reserved by the storage
+func checkReservedName(name string) error {
+	if slices.Contains(reservedNames, name) {
+		return fmt.Errorf("name %s is reserved by the storage", name)
+	}
+	return nil
+}
+
+// tableDefinition is a table created by CREATE TABLE, definitions are stored in the database directory
+type tableDefinition struct {
+	Name        string              `json:"name"`
+	Columns     []string            `json:"columns"`
+	Constraints []config.Constraint `json:"constraints,omitempty"`
+	Engine      string              `json:"engine,omitempty"`
+}
+
+// parseTableDefinition parses columns and constraints of CREATE TABLE
+//
+// Column is "name [NOT NULL] [DEFAULT value] [GENERATED ALWAYS AS (expr) STORED] [CHECK (expr)] [UNIQUE] [PRIMARY KEY] [REFERENCES table [(col)] [ON DELETE action]]",
+// table constraint is "UNIQUE (col, ...)", "PRIMARY KEY (col, ...)", "CHECK (expr)" or "FOREIGN KEY (col, ...) REFERENCES ..."
+func parseTableDefinition(name string, body string) (*tableDefinition, error) {
+	definition := &tableDefinition{Name: name}
+	for _, item := range splitDefinitions(body) {
+		if checkRegexp.MatchString(item) {
+			constraint, rest, err := parseCheckOption(config.Constraint{Table: name}, item)
+			if err != nil {
+				return nil, err
+			}
+			if strings.TrimSpace(rest) != "" {
+				return nil, fmt.Errorf("%w: unexpected %s in constraint", ErrParse, strings.TrimSpace(rest))
+			}
+			definition.Constraints = append(definition.Constraints, constraint)
+			continue
+		}
+		if matches := tableConstraintRegexp.FindStringSubmatch(item); matches != nil {
+			constraint := config.Constraint{
+				Table:   name,
+				Type:    matches[1],
+				Columns: splitList(matches[2]),
+			}
+			rest := matches[3]
+			if normalizeKeyword(constraint.Type) == ForeignKeyConstraint {
+				var err error
+				if constraint, rest, err = parseReferences(constraint, rest); err != nil {
+					return nil, err
+				}
+			}
+			if strings.TrimSpace(rest) != "" {
+				return nil, fmt.Errorf("%w: unexpected %s in constraint", ErrParse, strings.TrimSpace(rest))
+			}
+			definition.Constraints = append(definition.Constraints, constraint)
+			continue
+		}
+
+		matches := columnDefRegexp.FindStringSubmatch(item)
+		if matches == nil {
+			return nil, fmt.Errorf("%w: invalid column definition %s", ErrParse, item)
+		}
+		column, options := matches[1], matches[2]
+		definition.Columns = append(definition.Columns, column)
+		for strings.TrimSpace(options) != "" {
+			constraint := config.Constraint{
+				Table:   name,
+				Columns: []string{column},
+			}
+			var err error
+			if option := columnOptionRegexp.FindStringSubmatch(options); option != nil {
+				constraint.Type = option[1]
+				options = options[len(option[0]):]
+			} else if option := defaultOptionRegexp.FindStringSubmatch(options); option != nil {
+				constraint.Type = DefaultConstraint
+				constraint.Default = option[1]
+				options = options[len(option[0]):]
+			} else if checkRegexp.MatchString(options) {
+				if constraint, options, err = parseCheckOption(constraint, options); err != nil {
+					return nil, err
+				}
+			} else if generatedRegexp.MatchString(options) {
+				if constraint, options, err = parseGeneratedOption(constraint, options); err != nil {
+					return nil, err
+				}
+			} else if referencesRegexp.MatchString(options) {
+				constraint.Type = ForeignKeyConstraint
+				if constraint, options, err = parseReferences(constraint, options); err != nil {
+					return nil, err
+				}
+			} else {
+				return nil, fmt.Errorf("%w: unknown option of column %s: %s", ErrParse, column, strings.TrimSpace(options))
+			}
+			definition.Constraints = append(definition.Constraints, constraint)
+		}
+	}
+	return definition, nil
+}
+
+// parseReferences parses "REFERENCES table [(col, ...)] [ON DELETE action]" of the foreign key
+//
+// Returns the constraint and the rest of the string
+func parseReferences(constraint config.Constraint, str string) (config.Constraint, string, error) {
+	matches := referencesRegexp.FindStringSubmatch(str)
+	if matches == nil {
+		return constraint, str, fmt.Errorf("%w: REFERENCES expected for foreign key on %s", ErrParse, strings.Join(constraint.Columns, ", "))
+	}
+	constraint.References = matches[1]
+	if matches[2] != "" {
+		constraint.RefColumns = splitList(matches[2])
+	}
+	constraint.OnDelete = matches[3]
+	return constraint, str[len(matches[0]):], nil
+}
+
+// parseCheckOption parses "CHECK (expr)", parentheses inside the expression must be balanced
+//
+// Returns the constraint and the rest of the string
+func parseCheckOption(constraint config.Constraint, str string) (config.Constraint, string, error) {
+	expr, end, ok := readParenthesized(str, len(checkRegexp.FindString(str)))
+	if !ok {
+		return constraint, str, fmt.Errorf("%w: ')' expected after CHECK expression", ErrParse)
+	}
+	constraint.Type = CheckConstraint
+	constraint.Columns = nil
+	constraint.Check = expr
+	return constraint, str[end:], nil
+}
+
+// readParenthesized reads the string up to the closing parenthesis, start is the position after the opening one
+//
+// Returns the trimmed string inside parentheses and the position after the closing parenthesis
+func readParenthesized(str string, start int) (string, int, bool) {
+	depth := 1
+	inQuotes := false
+	for i := start; i < len(str); i++ {
+		switch {
+		case str[i] == '\'':
+			inQuotes = !inQuotes
+		case inQuotes:
+		case str[i] == '(':
+			depth++
+		case str[i] == ')':
+			depth--
+		}
+		if depth == 0 {
+			return strings.TrimSpace(str[start:i]), i + 1, true
+		}
+	}
+	return "", 0, false
+}
+
+// AddTable creates a new table by its definition and saves the definition to the database directory
+func (s *Storage) AddTable(definition *tableDefinition, ifNotExists bool) error {
+	const op = "storage.AddTable"
+	log := s.log.With(
+		slog.String("op", op),
+		slog.String("table", definition.Name),
+	)
+
+	if err := checkReservedName(definition.Name); err != nil {
+		return err
+	}
+	if s.getView(definition.Name) != nil {
+		return fmt.Errorf("view %s already exists", definition.Name)
+	}
+
+	s.tablesMutex.Lock()
+	defer s.tablesMutex.Unlock()
+
+	if s.Schema.Tables.Get(definition.Name) != nil {
+		if ifNotExists {
+			return nil
+		}
+		return fmt.Errorf("table %s already exists", definition.Name)
+	}
+	if len(definition.Columns) == 0 {
+		return fmt.Errorf("table %s has no columns", definition.Name)
+	}
+	for i, column := range definition.Columns {
+		if column == definition.Name+"_pk" {
+			return fmt.Errorf("column %s is added to the table automatically", column)
+		}
+		if slices.Contains(definition.Columns[i+1:], column) {
+			return fmt.Errorf("duplicate column %s in table %s", column, definition.Name)
+		}
+	}
+	columns := slices.Insert(slices.Clone(definition.Columns), 0, definition.Name+"_pk")
+	existing := len(s.Schema.Constraints)
+	constraints, err := validateConstraints(append(slices.Clone(s.Schema.Constraints), definition.Constraints...), func(table string) ([]string, bool) {
+		if table == definition.Name {
+			return columns, true
+		}
+		tableColumns, ok := s.Schema.Tables.Get(table).([]string)
+		return tableColumns, ok
+	})
+	if err != nil {
+		return err
+	}
+	definition.Constraints = constraints[existing:]
+	if definition.Engine, err = normalizeEngine(definition.Engine); err != nil {
+		return err
+	}
+
+	tablePath := path.Join(s.databasePath(), definition.Name)
+	s.createdTables = append(s.createdTables, definition)
+	if err := s.saveTables(); err != nil {
+		s.createdTables = s.createdTables[:len(s.createdTables)-1]
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	s.Schema.Tables.Add(definition.Name, columns)
+	s.Schema.Constraints = constraints
+	s.setEngineName(definition.Name, definition.Engine)
+	if err := s.openEngine(definition.Name, tablePath, columns); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	s.tableBlockingMutex.Add(definition.Name, &sync.Mutex{})
+
+	log.Info("table created", slog.Any("columns", definition.Columns))
+	return nil
+}
+
+// DropTable removes the table created by CREATE TABLE with its rows, constraints and indexes
+//
+// Tables from schema.json, tables referenced by foreign keys of other tables and tables used by views can't be dropped.
+func (s *Storage) DropTable(name string, ifExists bool) error {
+	const op = "storage.DropTable"
+	log := s.log.With(
+		slog.String("op", op),
+		slog.String("table", name),
+	)
+
+	if _, ok := s.tableColumns(name); !ok {
+		if ifExists {
+			return nil
+		}
+		return fmt.Errorf("table %s not found", name)
+	}
+	for _, view := range s.getViews() {
+		if s.viewReferences(view, name) {
+			return fmt.Errorf("view %s depends on table %s", view.Name, name)
+		}
+	}
+
+	if err := s.blockTables([]string{name}); err != nil {
+		return err
+	}
+	defer s.unBlockTables([]string{name})
+
+	s.tablesMutex.Lock()
+	i := slices.IndexFunc(s.createdTables, func(definition *tableDefinition) bool { return definition.Name == name })
+	if i < 0 {
+		s.tablesMutex.Unlock()
+		return fmt.Errorf("table %s is declared in schema.json and can't be dropped", name)
+	}
+	for _, constraint := range s.Schema.Constraints {
+		if constraint.Type == ForeignKeyConstraint && constraint.References == name && constraint.Table != name {
+			s.tablesMutex.Unlock()
+			return fmt.Errorf("constraint %s of table %s references table %s", constraint.Name, constraint.Table, name)
+		}
+	}
+	definition := s.createdTables[i]
+	s.createdTables = slices.Delete(s.createdTables, i, i+1)
+	if err := s.saveTables(); err != nil {
+		s.createdTables = slices.Insert(s.createdTables, i, definition)
+		s.tablesMutex.Unlock()
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	engine, _ := s.engines.Get(name).(TableEngine)
+	tablePath, _ := s.TablePathes.Get(name).(string)
+	s.Schema.Tables.Delete(name)
+	s.Schema.Constraints = slices.DeleteFunc(s.Schema.Constraints, func(constraint config.Constraint) bool {
+		return constraint.Table == name
+	})
+	delete(s.Schema.Engines, name)
+	s.engines.Delete(name)
+	s.TablePathes.Delete(name)
+	s.tablesMutex.Unlock()
+
+	s.indexesMutex.Lock()
+	s.indexes.Delete(name)
+	s.indexesMutex.Unlock()
+	s.secondaryMutex.Lock()
+	for _, key := range s.secondaryIndexes.Keys().GetData() {
+		index := s.secondaryIndexes.Get(key).(*Index)
+		if index.Table != name {
+			continue
+		}
+		s.secondaryIndexes.Delete(key)
+		os.Remove(s.indexPath(key))
+	}
+	err := s.saveIndexes()
+	s.secondaryMutex.Unlock()
+	if err != nil {
+		log.Error("Error saving indexes", prettylogger.Err(err))
+	}
+
+	if engine != nil {
+		if err := engine.Drop(); err != nil {
+			log.Error("Error dropping rows", prettylogger.Err(err))
+		}
+	}
+	if tablePath != "" {
+		s.cache.removePrefix(tablePath + "/")
+		if err := os.RemoveAll(tablePath); err != nil {
+			log.Error("Error removing table directory", prettylogger.Err(err))
+		}
+	}
+
+	log.Info("table dropped")
+	return nil
+}
+
+// loadTables adds tables created by CREATE TABLE to the schema
+func (s *Storage) loadTables() error {
+	const op = "storage.loadTables"
+	log := s.log.With(
+		slog.String("op", op),
+	)
+
+	data, err := os.ReadFile(path.Join(s.databasePath(), tablesFileName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	var definitions []*tableDefinition
+	if err := json.Unmarshal(data, &definitions); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	s.tablesMutex.Lock()
+	defer s.tablesMutex.Unlock()
+
+	for _, definition := range definitions {
+		if s.Schema.Tables.Get(definition.Name) != nil {
+			log.Warn("Table is declared in schema and created by CREATE TABLE", slog.String("table", definition.Name))
+			continue
+		}
+		s.Schema.Tables.Add(definition.Name, slices.Clone(definition.Columns))
+		s.Schema.Constraints = append(s.Schema.Constraints, definition.Constraints...)
+		s.setEngineName(definition.Name, definition.Engine)
+		s.tableBlockingMutex.Add(definition.Name, &sync.Mutex{})
+		s.createdTables = append(s.createdTables, definition)
+	}
+	return nil
+}
+
+// saveTables writes definitions of created tables to the database directory, tablesMutex must be locked
+func (s *Storage) saveTables() error {
+	data, err := json.MarshalIndent(s.createdTables, "", "    ")
+	if err != nil {
+		return err
+	}
+	return utils.WriteFileAtomic(path.Join(s.databasePath(), tablesFileName), data)
+}
+
+// splitDefinitions splits the body of CREATE TABLE by commas outside of parentheses and quotes
+func splitDefinitions(body string) []string {
+	definitions := make([]string, 0)
+	depth := 0
+	inQuotes := false
+	start := 0
+	for i := 0; i <= len(body); i++ {
+		if i < len(body) {
+			switch {
+			case body[i] == '\'':
+				inQuotes = !inQuotes
+			case inQuotes:
+			case body[i] == '(':
+				depth++
+			case body[i] == ')':
+				depth--
+			}
+			if body[i] != ',' || depth > 0 || inQuotes {
+				continue
+			}
+		}
+		definitions = append(definitions, strings.TrimSpace(body[start:i]))
+		start = i + 1
+	}
+	return definitions
+}
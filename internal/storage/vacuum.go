@@ -0,0 +1,279 @@
+package storage
+
+import (
+	"JacuteSQL/internal/lib/utils"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/jacute/prettylogger"
+)
+
+const vacuumSuffix = ".vacuum"
+
+var (
+	vacuumRegexp = regexp.MustCompile(`(?i)^VACUUM(?:\s+(\w+))?\s*;?$`)
+)
+
+// vacuumResult is the number of rows of the compacted table and numbers of its sheets before and after VACUUM
+type vacuumResult struct {
+	Table  string
+	Rows   int
+	Before int
+	After  int
+}
+
+// VacuumTables compacts the table or all tables if the name is empty and returns the report
+func (s *Storage) VacuumTables(table string) (string, error) {
+	tables := []string{table}
+	if table == "" {
+		tables = s.tableNames()
+	}
+
+	var output strings.Builder
+	output.WriteString("table,rows,sheets_before,sheets_after\n")
+	for _, table := range tables {
+		result, err := s.Vacuum(table)
+		if err != nil {
+			return "", err
+		}
+		output.WriteString(fmt.Sprintf("%s,%d,%d,%d\n", result.Table, result.Rows, result.Before, result.After))
+	}
+	return output.String(), nil
+}
+
+// Vacuum packs rows of the table into the minimum number of sheets in order of pks
+//
+// Rows are copied to a new engine in the directory <table>.vacuum, which replaces the directory of the table
+// after sync, so the table keeps old sheets after a failure. Locations of rows are changed, so secondary indexes are rebuilt.
+func (s *Storage) Vacuum(table string) (vacuumResult, error) {
+	const op = "storage.Vacuum"
+	log := s.log.With(
+		slog.String("op", op),
+		slog.String("table", table),
+	)
+
+	if err := s.blockTables([]string{table}); err != nil {
+		return vacuumResult{}, err
+	}
+	defer s.unBlockTables([]string{table})
+
+	old, ok := s.tableEngine(table)
+	if !ok {
+		return vacuumResult{}, ErrIncorectTable
+	}
+	name := s.engineName(table)
+	columns, _ := s.tableColumns(table)
+	tablePath, _ := s.tablePath(table)
+
+	meta, err := old.Meta()
+	if err != nil {
+		return vacuumResult{}, fmt.Errorf("%s: %w", op, err)
+	}
+	rows, err := sortedRows(table, columns, old)
+	if err != nil {
+		return vacuumResult{}, fmt.Errorf("%s: %w", op, err)
+	}
+	nextPk, err := old.PeekPk()
+	if err != nil {
+		return vacuumResult{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	var engine TableEngine
+	if old.Durable() {
+		engine, err = s.packTable(table, name, tablePath, columns, rows, nextPk)
+	} else {
+		engine, err = engineFactories[name](s, table, tablePath, columns)
+		if err == nil {
+			err = appendRows(engine, rows, nextPk)
+		}
+	}
+	if err != nil {
+		log.Error(
+			"Can't compact table",
+			prettylogger.Err(err),
+		)
+		return vacuumResult{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	s.tablesMutex.Lock()
+	s.engines.Add(table, engine)
+	s.tablesMutex.Unlock()
+	// locations of rows are different after packing
+	s.resetIndexes(table)
+
+	packed, err := engine.Meta()
+	if err != nil {
+		return vacuumResult{}, fmt.Errorf("%s: %w", op, err)
+	}
+	result := vacuumResult{Table: table, Rows: len(rows), Before: len(meta.Sheets), After: len(packed.Sheets)}
+	log.Info(
+		"table vacuumed",
+		slog.Int("rows", result.Rows),
+		slog.Int("sheets_before", result.Before),
+		slog.Int("sheets_after", result.After),
+	)
+	return result, nil
+}
+
+// packTable writes rows to the new engine in <table>.vacuum, replaces the directory of the table with it and opens the engine again
+func (s *Storage) packTable(table string, name string, tablePath string, columns []string, rows [][]string, nextPk int64) (TableEngine, error) {
+	vacuumPath := tablePath + vacuumSuffix
+	oldPath := tablePath + oldSuffix
+	if err := os.RemoveAll(vacuumPath); err != nil {
+		return nil, err
+	}
+	packed, err := engineFactories[name](s, table, vacuumPath, columns)
+	if err != nil {
+		return nil, err
+	}
+	if err := appendRows(packed, rows, nextPk); err != nil {
+		os.RemoveAll(vacuumPath)
+		return nil, err
+	}
+	if err := packed.Sync(); err != nil {
+		os.RemoveAll(vacuumPath)
+		return nil, err
+	}
+
+	defer s.cache.removePrefix(vacuumPath + "/")
+	defer s.cache.removePrefix(tablePath + "/")
+	if err := os.Rename(tablePath, oldPath); err != nil {
+		os.RemoveAll(vacuumPath)
+		return nil, err
+	}
+	if err := os.Rename(vacuumPath, tablePath); err != nil {
+		os.Rename(oldPath, tablePath)
+		return nil, err
+	}
+	if err := utils.SyncDir(path.Dir(tablePath)); err != nil {
+		return nil, err
+	}
+	if err := os.RemoveAll(oldPath); err != nil {
+		s.log.Warn(
+			"Can't remove old sheets",
+			prettylogger.Err(err),
+			slog.String("path", oldPath),
+		)
+	}
+	return engineFactories[name](s, table, tablePath, columns)
+}
+
+// recoverVacuum restores the directory of the table if VACUUM was interrupted and removes its temporary directories
+func (s *Storage) recoverVacuum(tablePath string) {
+	oldPath := tablePath + oldSuffix
+	if !utils.FileExists(tablePath) && utils.FileExists(oldPath) {
+		s.log.Warn(
+			"Restoring sheets of table after interrupted vacuum",
+			slog.String("path", tablePath),
+		)
+		if err := os.Rename(oldPath, tablePath); err != nil {
+			s.log.Error("Can't restore sheets", prettylogger.Err(err))
+		}
+	}
+	os.RemoveAll(tablePath + vacuumSuffix)
+	os.RemoveAll(oldPath)
+}
+
+// sortedRows reads values of all rows of the table sorted by pks
+func sortedRows(table string, columns []string, engine TableEngine) ([][]string, error) {
+	cursor, err := engine.Scan()
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+
+	rows := make([][]string, 0)
+	for {
+		row, err := cursor.Next()
+		if err != nil {
+			return nil, err
+		}
+		if row == nil {
+			break
+		}
+		rows = append(rows, rowValues(table, columns, row))
+	}
+	slices.SortStableFunc(rows, func(a []string, b []string) int {
+		return compareIndexValue(a[0], b[0])
+	})
+	return rows, nil
+}
+
+// appendRows adds rows to the empty engine and sets its pk sequence
+func appendRows(engine TableEngine, rows [][]string, nextPk int64) error {
+	for _, values := range rows {
+		if _, err := engine.Append(values); err != nil {
+			return err
+		}
+	}
+	return engine.SetPk(nextPk)
+}
+
+// autoVacuum compacts changed tables in the background if VACUUM frees at least the share of sheets from the config
+func (s *Storage) autoVacuum(tables []string) {
+	threshold := s.Schema.Vacuum.Threshold
+	if threshold <= 0 {
+		return
+	}
+	for _, table := range tables {
+		if !s.needsVacuum(table, threshold) {
+			continue
+		}
+		s.vacuumMutex.Lock()
+		if s.vacuuming.Get(table) != nil {
+			s.vacuumMutex.Unlock()
+			continue
+		}
+		s.vacuuming.Add(table, true)
+		s.vacuumWG.Add(1)
+		s.vacuumMutex.Unlock()
+
+		go func() {
+			defer func() {
+				s.vacuumMutex.Lock()
+				s.vacuuming.Delete(table)
+				s.vacuumMutex.Unlock()
+				s.vacuumWG.Done()
+			}()
+			if _, err := s.Vacuum(table); err != nil {
+				s.log.Error(
+					"Auto vacuum failed",
+					prettylogger.Err(err),
+					slog.String("table", table),
+				)
+			}
+		}()
+	}
+}
+
+// needsVacuum reports if packing the table frees at least the share of its sheets
+//
+// A csv sheet holds tuples_limit rows, a page of other engines is assumed to hold as many rows as the fullest page.
+func (s *Storage) needsVacuum(table string, threshold float64) bool {
+	engine, ok := s.tableEngine(table)
+	if !ok {
+		return false
+	}
+	meta, err := engine.Meta()
+	if err != nil || len(meta.Sheets) < 2 {
+		return false
+	}
+	rows, capacity := 0, 0
+	for _, sheet := range meta.Sheets {
+		rows += sheet.Rows
+		capacity = max(capacity, sheet.Rows)
+	}
+	if s.engineName(table) == CSVEngine {
+		capacity = s.Schema.TuplesLimit
+	}
+	if capacity == 0 {
+		return true
+	}
+	needed := max(1, (rows+capacity-1)/capacity)
+	return float64(len(meta.Sheets)-needed)/float64(len(meta.Sheets)) >= threshold
+}
@@ -0,0 +1,558 @@
+package storage
+
+import (
+	"JacuteSQL/internal/data_structures/mymap"
+	"JacuteSQL/internal/data_structures/mysl"
+	"JacuteSQL/internal/lib/csv"
+	"JacuteSQL/internal/lib/utils"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/jacute/prettylogger"
+)
+
+var (
+	createViewRegexp  = regexp.MustCompile(`(?i)^CREATE\s+(MATERIALIZED\s+)?VIEW\s+(\w+)\s*(?:\(([\w\s,]+)\))?\s+AS\s+(SELECT\s+.+?)\s*;?$`)
+	dropViewRegexp    = regexp.MustCompile(`(?i)^DROP\s+(MATERIALIZED\s+)?VIEW\s+(IF\s+EXISTS\s+)?(\w+)\s*;?$`)
+	refreshViewRegexp = regexp.MustCompile(`(?i)^REFRESH\s+MATERIALIZED\s+VIEW\s+(\w+)\s*;?$`)
+	showTablesRegexp  = regexp.MustCompile(`(?i)^SHOW\s+TABLES\s*;?$`)
+	showViewsRegexp   = regexp.MustCompile(`(?i)^SHOW\s+VIEWS\s*;?$`)
+	describeRegexp    = regexp.MustCompile(`(?i)^DESCRIBE\s+(\w+)\s*;?$`)
+)
+
+var (
+	ErrViewExists   = errors.New("view already exists")
+	ErrViewNotFound = errors.New("view not found")
+)
+
+const (
+	viewsFileName = "views.json"
+	// suffixes of directories used while materialized view is refreshed
+	refreshSuffix = ".refresh"
+	oldSuffix     = ".old"
+)
+
+// View is a named SELECT, which is expanded when it appears in FROM
+//
+// Rows of materialized view are stored in sheets like rows of the table and updated by REFRESH
+type View struct {
+	Name         string   `json:"name"`
+	Columns      []string `json:"columns"`
+	Query        string   `json:"query"`
+	Materialized bool     `json:"materialized,omitempty"`
+
+	query *selectQuery
+	// mu blocks materialized view like table
+	mu sync.Mutex
+	// refreshMu doesn't allow to refresh materialized view concurrently
+	refreshMu sync.Mutex
+}
+
+// CreateView adds a new view and saves it to the database directory
+//
+// If columns are empty, column names are taken from the selected fields.
+// Materialized view is filled with rows of the query immediately.
+func (s *Storage) CreateView(name string, columns []string, query string, materialized bool) error {
+	const op = "storage.CreateView"
+	log := s.log.With(
+		slog.String("op", op),
+		slog.String("view", name),
+	)
+
+	if err := checkReservedName(name); err != nil {
+		return err
+	}
+	view, err := s.newView(name, columns, query)
+	if err != nil {
+		return err
+	}
+	if err := s.validateView(view); err != nil {
+		return err
+	}
+	if s.getView(name) != nil {
+		return ErrViewExists
+	}
+
+	view.Materialized = materialized
+	if materialized {
+		if err := s.materialize(view); err != nil {
+			return err
+		}
+	}
+
+	s.viewsMutex.Lock()
+	defer s.viewsMutex.Unlock()
+
+	if s.views.Get(name) != nil {
+		return ErrViewExists
+	}
+	s.views.Add(name, view)
+	if err := s.saveViews(); err != nil {
+		s.views.Delete(name)
+		if materialized {
+			os.RemoveAll(s.viewPath(view))
+		}
+		log.Error(
+			"Error saving views",
+			prettylogger.Err(err),
+		)
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	log.Info("view created", slog.String("query", query), slog.Bool("materialized", materialized))
+	return nil
+}
+
+// DropView removes the view from the database
+func (s *Storage) DropView(name string, ifExists bool, materialized bool) error {
+	const op = "storage.DropView"
+	log := s.log.With(
+		slog.String("op", op),
+		slog.String("view", name),
+	)
+
+	s.viewsMutex.Lock()
+	defer s.viewsMutex.Unlock()
+
+	view, ok := s.views.Get(name).(*View)
+	if !ok {
+		if ifExists {
+			return nil
+		}
+		return ErrViewNotFound
+	}
+	if view.Materialized && !materialized {
+		return fmt.Errorf("%s is a materialized view, use DROP MATERIALIZED VIEW", name)
+	}
+	if !view.Materialized && materialized {
+		return fmt.Errorf("%s is not a materialized view", name)
+	}
+
+	s.views.Delete(name)
+	if err := s.saveViews(); err != nil {
+		s.views.Add(name, view)
+		log.Error(
+			"Error saving views",
+			prettylogger.Err(err),
+		)
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	if view.Materialized {
+		view.mu.Lock()
+		err := os.RemoveAll(s.viewPath(view))
+		view.mu.Unlock()
+		s.cache.removePrefix(s.viewPath(view) + "/")
+		if err != nil {
+			log.Error(
+				"Error removing materialized view",
+				prettylogger.Err(err),
+			)
+		}
+	}
+
+	log.Info("view dropped")
+	return nil
+}
+
+// RefreshMaterializedView rebuilds rows of the materialized view
+//
+// Readers see the old rows until the new ones are written.
+func (s *Storage) RefreshMaterializedView(name string) error {
+	view := s.getView(name)
+	if view == nil {
+		return ErrViewNotFound
+	}
+	if !view.Materialized {
+		return fmt.Errorf("%s is not a materialized view", name)
+	}
+	return s.materialize(view)
+}
+
+// materialize executes the query of the view and replaces its sheets
+//
+// New sheets are written to the temporary directory, which is swapped with the old one under the lock.
+func (s *Storage) materialize(view *View) error {
+	const op = "storage.materialize"
+	log := s.log.With(
+		slog.String("op", op),
+		slog.String("view", view.Name),
+	)
+
+	view.refreshMu.Lock()
+	defer view.refreshMu.Unlock()
+
+	tables := s.baseTables(view.query.Tables)
+	if err := s.blockTables(tables); err != nil {
+		return err
+	}
+	rows, err := s.computeView(view)
+	s.unBlockTables(tables)
+	if err != nil {
+		return err
+	}
+
+	viewPath := s.viewPath(view)
+	refreshPath := viewPath + refreshSuffix
+	oldPath := viewPath + oldSuffix
+	if err := os.RemoveAll(refreshPath); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if err := s.writeSheets(refreshPath, view.Name, view.Columns, rows); err != nil {
+		log.Error(
+			"Error writing sheets",
+			prettylogger.Err(err),
+			slog.String("path", refreshPath),
+		)
+		os.RemoveAll(refreshPath)
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	view.mu.Lock()
+	defer view.mu.Unlock()
+
+	if utils.FileExists(viewPath) {
+		if err := os.Rename(viewPath, oldPath); err != nil {
+			os.RemoveAll(refreshPath)
+			return fmt.Errorf("%s: %w", op, err)
+		}
+	}
+	if err := os.Rename(refreshPath, viewPath); err != nil {
+		os.Rename(oldPath, viewPath)
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	s.cache.removePrefix(viewPath + "/")
+	if err := os.RemoveAll(oldPath); err != nil {
+		log.Warn(
+			"Can't remove old sheets",
+			prettylogger.Err(err),
+			slog.String("path", oldPath),
+		)
+	}
+
+	log.Info("materialized view refreshed", slog.Int("rows", rows.Len()))
+	return nil
+}
+
+// writeSheets writes rows to the new directory, each sheet contains at most tuples_limit rows
+func (s *Storage) writeSheets(dirPath string, table string, columns []string, rows *mysl.MySl[*mymap.CustomMap]) error {
+	if err := os.Mkdir(dirPath, 0755); err != nil {
+		return err
+	}
+
+	sheet := mysl.New[*mymap.CustomMap]()
+	sheetNumber := 1
+	for i := 0; i < rows.Len(); i++ {
+		sheet.Append(rows.Get(i))
+		if sheet.Len() == s.Schema.TuplesLimit {
+			if err := csv.WriteFile(path.Join(dirPath, fmt.Sprintf("%d.csv", sheetNumber)), table, sheet, columns); err != nil {
+				return err
+			}
+			sheet = mysl.New[*mymap.CustomMap]()
+			sheetNumber++
+		}
+	}
+	if sheet.Len() > 0 || sheetNumber == 1 {
+		return csv.WriteFile(path.Join(dirPath, fmt.Sprintf("%d.csv", sheetNumber)), table, sheet, columns)
+	}
+	return nil
+}
+
+// ShowTables returns names of all tables in the database
+func (s *Storage) ShowTables() string {
+	output := "table\n"
+	for _, table := range s.tableNames() {
+		output += table + "\n"
+	}
+	return output
+}
+
+// ShowViews returns all views with their definitions
+//
+// status is "ok" or the reason why the view can't be used, the status and the definition are quoted if they contain ',
+func (s *Storage) ShowViews() string {
+	output := "view,status,definition\n"
+	for _, view := range s.getViews() {
+		status := "ok"
+		if err := s.validateView(view); err != nil {
+			status = err.Error()
+		}
+		output += fmt.Sprintf("%s,%s,%s\n", view.Name, quoteField(status), quoteField(view.definition()))
+	}
+	return output
+}
+
+// quoteField writes the value of the output in double quotes if it contains ',', '"' or a line break
+//
+// Quote inside the value is written as "", like in csv.
+func quoteField(value string) string {
+	if !strings.ContainsAny(value, ",\"\r\n") {
+		return value
+	}
+	return `"` + strings.ReplaceAll(value, `"`, `""`) + `"`
+}
+
+// Describe returns columns of the table or view
+func (s *Storage) Describe(name string) (string, error) {
+	columns, err := s.sourceColumns(name)
+	if err != nil {
+		return "", err
+	}
+	return "column\n" + strings.Join(columns, "\n") + "\n", nil
+}
+
+// loadViews reads views from the database directory
+func (s *Storage) loadViews() error {
+	const op = "storage.loadViews"
+	log := s.log.With(
+		slog.String("op", op),
+	)
+
+	viewsPath := path.Join(s.databasePath(), viewsFileName)
+	data, err := os.ReadFile(viewsPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	var views []*View
+	if err := json.Unmarshal(data, &views); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	s.viewsMutex.Lock()
+	for _, view := range views {
+		query, ok := parseSelect(view.Query)
+		if !ok {
+			log.Warn("Can't parse view query", slog.String("view", view.Name), slog.String("query", view.Query))
+			continue
+		}
+		view.query = query
+		s.views.Add(view.Name, view)
+	}
+	s.viewsMutex.Unlock()
+
+	for _, view := range s.getViews() {
+		if view.Materialized {
+			s.recoverMaterializedView(view)
+		}
+	}
+
+	for _, view := range s.getViews() {
+		if err := s.validateView(view); err != nil {
+			log.Warn(
+				"View is invalid",
+				slog.String("view", view.Name),
+				prettylogger.Err(err),
+			)
+		}
+	}
+	return nil
+}
+
+// recoverMaterializedView restores sheets of the materialized view if refresh was interrupted
+func (s *Storage) recoverMaterializedView(view *View) {
+	const op = "storage.recoverMaterializedView"
+	log := s.log.With(
+		slog.String("op", op),
+		slog.String("view", view.Name),
+	)
+
+	viewPath := s.viewPath(view)
+	oldPath := viewPath + oldSuffix
+	if !utils.FileExists(viewPath) && utils.FileExists(oldPath) {
+		log.Warn("Restoring sheets of materialized view after interrupted refresh")
+		if err := os.Rename(oldPath, viewPath); err != nil {
+			log.Error("Can't restore sheets", prettylogger.Err(err))
+		}
+	}
+	os.RemoveAll(viewPath + refreshSuffix)
+	os.RemoveAll(oldPath)
+
+	if !utils.FileExists(viewPath) {
+		log.Warn("Sheets of materialized view not found, use REFRESH MATERIALIZED VIEW")
+	}
+}
+
+// saveViews writes views to the database directory, viewsMutex must be locked
+func (s *Storage) saveViews() error {
+	data, err := json.MarshalIndent(s.sortedViews(), "", "    ")
+	if err != nil {
+		return err
+	}
+	return utils.WriteFileAtomic(path.Join(s.databasePath(), viewsFileName), data)
+}
+
+// newView parses the query of the view and gets names of its columns
+func (s *Storage) newView(name string, columns []string, query string) (*View, error) {
+	if _, ok := s.tableColumns(name); ok {
+		return nil, fmt.Errorf("table %s already exists", name)
+	}
+	parsed, ok := parseSelect(query)
+	if !ok {
+		return nil, fmt.Errorf("%w: invalid query of view %s", ErrParse, name)
+	}
+
+	if len(columns) == 0 {
+		for _, field := range parsed.Fields {
+			if aggregate, ok := parseAggregate(field); ok {
+				columns = append(columns, aggregate.columnName())
+				continue
+			}
+			fieldSplitted := strings.Split(field, ".")
+			columns = append(columns, fieldSplitted[len(fieldSplitted)-1])
+		}
+	}
+	if len(columns) != len(parsed.Fields) {
+		return nil, fmt.Errorf("view %s has %d columns, but query returns %d", name, len(columns), len(parsed.Fields))
+	}
+	for i, column := range columns {
+		if slices.Contains(columns[i+1:], column) {
+			return nil, fmt.Errorf("duplicate column %s in view %s, specify column names", column, name)
+		}
+	}
+
+	return &View{
+		Name:    name,
+		Columns: columns,
+		Query:   query,
+		query:   parsed,
+	}, nil
+}
+
+// validateView checks that all tables and columns used by the view exist
+func (s *Storage) validateView(view *View) error {
+	if s.viewReferences(view, view.Name) {
+		return fmt.Errorf("view %s references itself", view.Name)
+	}
+	for _, table := range view.query.Tables {
+		if _, err := s.sourceColumns(table); err != nil {
+			return fmt.Errorf("view %s references missing table %s", view.Name, table)
+		}
+	}
+	fields := slices.Clone(view.query.GroupBy)
+	for _, field := range view.query.Fields {
+		if aggregate, ok := parseAggregate(field); ok {
+			if aggregate.Field == "*" {
+				continue
+			}
+			field = aggregate.Field
+		}
+		fields = append(fields, field)
+	}
+	for _, field := range fields {
+		table := tableOfField(field)
+		if !slices.Contains(view.query.Tables, table) {
+			return fmt.Errorf("field %s of view %s not in tables", field, view.Name)
+		}
+		columns, _ := s.sourceColumns(table)
+		if !slices.Contains(columns, strings.TrimPrefix(field, table+".")) {
+			return fmt.Errorf("view %s references missing column %s", view.Name, field)
+		}
+	}
+	return nil
+}
+
+// viewReferences checks if the view uses source with the name directly or through other views
+func (s *Storage) viewReferences(view *View, name string) bool {
+	return s.viewReferencesVisited(view, name, []string{})
+}
+
+func (s *Storage) viewReferencesVisited(view *View, name string, visited []string) bool {
+	if slices.Contains(visited, view.Name) {
+		return true
+	}
+	visited = append(visited, view.Name)
+	for _, table := range view.query.Tables {
+		if table == name {
+			return true
+		}
+		if other := s.getView(table); other != nil && s.viewReferencesVisited(other, name, visited) {
+			return true
+		}
+	}
+	return false
+}
+
+// readView returns rows with view columns
+//
+// Materialized view is read from its sheets, other views execute their queries
+func (s *Storage) readView(view *View) (*mysl.MySl[*mymap.CustomMap], error) {
+	if view.Materialized {
+		return s.readSheets(view.Name, s.viewPath(view))
+	}
+	return s.computeView(view)
+}
+
+// computeView executes the query of the view and returns rows with view columns
+func (s *Storage) computeView(view *View) (*mysl.MySl[*mymap.CustomMap], error) {
+	if err := s.validateView(view); err != nil {
+		return nil, err
+	}
+	rows, err := s.Select(view.query)
+	if err != nil {
+		return nil, fmt.Errorf("view %s: %w", view.Name, err)
+	}
+
+	result := mysl.New[*mymap.CustomMap]()
+	for i := 0; i < rows.Len(); i++ {
+		row := mymap.New()
+		for j, column := range view.Columns {
+			row.Add(view.Name+"."+column, rows.Get(i).Get(j))
+		}
+		result.Append(row)
+	}
+	return result, nil
+}
+
+func (s *Storage) getView(name string) *View {
+	s.viewsMutex.RLock()
+	defer s.viewsMutex.RUnlock()
+
+	view, _ := s.views.Get(name).(*View)
+	return view
+}
+
+// getViews returns all views sorted by name
+func (s *Storage) getViews() []*View {
+	s.viewsMutex.RLock()
+	defer s.viewsMutex.RUnlock()
+
+	return s.sortedViews()
+}
+
+// sortedViews returns all views sorted by name, viewsMutex must be locked
+func (s *Storage) sortedViews() []*View {
+	views := make([]*View, 0)
+	keys := s.views.Keys()
+	for i := 0; i < keys.Len(); i++ {
+		views = append(views, s.views.Get(keys.Get(i)).(*View))
+	}
+	slices.SortFunc(views, func(a, b *View) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	return views
+}
+
+// viewPath returns the directory with sheets of the materialized view
+func (s *Storage) viewPath(view *View) string {
+	return path.Join(s.databasePath(), view.Name)
+}
+
+func (v *View) definition() string {
+	kind := "VIEW"
+	if v.Materialized {
+		kind = "MATERIALIZED VIEW"
+	}
+	return fmt.Sprintf("CREATE %s %s (%s) AS %s", kind, v.Name, strings.Join(v.Columns, ", "), v.Query)
+}
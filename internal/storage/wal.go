@@ -0,0 +1,439 @@
+package storage
+
+import (
+	"JacuteSQL/internal/config"
+	"JacuteSQL/internal/data_structures/mymap"
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"log/slog"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jacute/prettylogger"
+)
+
+const (
+	walFileName = "wal.log"
+
+	WALSyncAlways   = "always"
+	WALSyncInterval = "interval"
+	WALSyncOff      = "off"
+
+	defaultWALSyncInterval   = 100
+	defaultWALCheckpointSize = 4 << 20
+)
+
+// types of operations in the log
+const (
+	walInsert   = "insert"
+	walUpdate   = "update"
+	walDelete   = "delete"
+	walTruncate = "truncate"
+)
+
+// walOp is a change of the table, it can be applied again without changing the result
+//
+// Rows have values in order of columns of the table, the pk is the first value.
+type walOp struct {
+	Type  string     `json:"type"`
+	Table string     `json:"table"`
+	Rows  [][]string `json:"rows,omitempty"`
+	Pks   []string   `json:"pks,omitempty"`
+}
+
+// walEntry is a record of the log with all changes of one statement
+//
+// It's written as a line "<crc32> <json>", a line with a wrong checksum ends the log.
+type walEntry struct {
+	LSN int64   `json:"lsn"`
+	Ops []walOp `json:"ops"`
+}
+
+// wal is the write-ahead log of the database, changes are written to it before sheets are changed
+type wal struct {
+	mu     sync.Mutex
+	file   *os.File
+	config config.WALConfig
+	lsn    int64
+	size   int64
+	// active is the number of logged statements which aren't applied yet
+	active int
+	// dirty are tables changed after the last checkpoint
+	dirty    []string
+	lastSync time.Time
+}
+
+// openWAL opens the log for appending, the log must be replayed before
+func openWAL(walPath string, cfg config.WALConfig) (*wal, error) {
+	if cfg.Sync == "" {
+		cfg.Sync = WALSyncAlways
+	}
+	if cfg.SyncInterval <= 0 {
+		cfg.SyncInterval = defaultWALSyncInterval
+	}
+	if cfg.CheckpointSize <= 0 {
+		cfg.CheckpointSize = defaultWALCheckpointSize
+	}
+	if !slices.Contains([]string{WALSyncAlways, WALSyncInterval, WALSyncOff}, cfg.Sync) {
+		return nil, fmt.Errorf("unknown sync policy %s of wal", cfg.Sync)
+	}
+
+	file, err := os.OpenFile(walPath, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &wal{file: file, config: cfg, size: info.Size(), lastSync: time.Now()}, nil
+}
+
+// readWAL reads entries of the log, a torn or damaged tail is skipped
+func readWAL(walPath string) ([]walEntry, error) {
+	file, err := os.Open(walPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+
+	entries := make([]walEntry, 0)
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			// the last line without the line break wasn't written completely
+			return entries, nil
+		}
+		checksum, data, ok := strings.Cut(strings.TrimSuffix(line, "\n"), " ")
+		if !ok || checksum != strconv.FormatUint(uint64(crc32.ChecksumIEEE([]byte(data))), 16) {
+			return entries, nil
+		}
+		var entry walEntry
+		if err := json.Unmarshal([]byte(data), &entry); err != nil {
+			return entries, nil
+		}
+		entries = append(entries, entry)
+	}
+}
+
+// append writes the entry with operations to the log and syncs it by the policy
+//
+// Every successful append must be followed by done after changes are applied.
+func (w *wal) append(ops []walOp) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	entry := walEntry{LSN: w.lsn + 1, Ops: ops}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	line := strconv.FormatUint(uint64(crc32.ChecksumIEEE(data)), 16) + " " + string(data) + "\n"
+	n, err := w.file.WriteString(line)
+	w.size += int64(n)
+	if err != nil {
+		return err
+	}
+	switch {
+	case w.config.Sync == WALSyncAlways,
+		w.config.Sync == WALSyncInterval && time.Since(w.lastSync) >= time.Duration(w.config.SyncInterval)*time.Millisecond:
+		if err := w.file.Sync(); err != nil {
+			return err
+		}
+		w.lastSync = time.Now()
+	}
+
+	w.lsn = entry.LSN
+	w.active++
+	for _, op := range ops {
+		if !slices.Contains(w.dirty, op.Table) {
+			w.dirty = append(w.dirty, op.Table)
+		}
+	}
+	return nil
+}
+
+// done marks the logged statement as applied, the log is truncated if it's big and nothing is being applied
+func (w *wal) done(s *Storage) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.active--
+	if w.active > 0 || w.size < w.config.CheckpointSize {
+		return
+	}
+	if err := w.checkpoint(s); err != nil {
+		s.log.Error(
+			"WAL checkpoint error",
+			prettylogger.Err(err),
+		)
+	}
+}
+
+// checkpoint syncs changed tables and truncates the log, mu must be locked
+func (w *wal) checkpoint(s *Storage) error {
+	for _, table := range w.dirty {
+		engine, ok := s.tableEngine(table)
+		if !ok {
+			continue
+		}
+		if err := engine.Sync(); err != nil {
+			return err
+		}
+	}
+	if err := w.file.Truncate(0); err != nil {
+		return err
+	}
+	if err := w.file.Sync(); err != nil {
+		return err
+	}
+	w.size = 0
+	w.dirty = nil
+	return nil
+}
+
+// sync flushes the log to the disk regardless of the sync policy
+func (w *wal) sync() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.file.Sync()
+}
+
+// close closes the log file
+func (w *wal) close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.file.Close()
+}
+
+// syncFile flushes the file to the disk
+func syncFile(filePath string) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return file.Sync()
+}
+
+// logChanges writes operations of the statement to the log before they are applied
+//
+// Changes of tables which aren't durable are skipped. The returned function must be called after the changes are applied,
+// it saves catalogs of changed tables.
+func (s *Storage) logChanges(ops ...walOp) (func(), error) {
+	if s.readOnly {
+		return nil, ErrStorageReadOnly
+	}
+	if s.closed {
+		return nil, ErrStorageClosed
+	}
+	durable := make([]walOp, 0, len(ops))
+	for _, op := range ops {
+		if engine, ok := s.tableEngine(op.Table); ok && engine.Durable() {
+			durable = append(durable, op)
+		}
+	}
+	if len(durable) == 0 {
+		return func() {}, nil
+	}
+	tables := make([]string, 0, len(durable))
+	for _, op := range durable {
+		if !slices.Contains(tables, op.Table) {
+			tables = append(tables, op.Table)
+		}
+	}
+	if s.wal == nil {
+		return func() { s.flushTables(tables) }, nil
+	}
+	if err := s.wal.append(durable); err != nil {
+		return nil, fmt.Errorf("can't write wal: %w", err)
+	}
+	return func() {
+		s.flushTables(tables)
+		s.wal.done(s)
+	}, nil
+}
+
+// rowValues returns values of the row in order of columns of the table
+func rowValues(table string, columns []string, row *mymap.CustomMap) []string {
+	values := make([]string, len(columns))
+	for i, column := range columns {
+		values[i], _ = row.Get(table + "." + column).(string)
+	}
+	return values
+}
+
+// recoverWAL replays the log of the database and opens it for new entries
+//
+// Engines of replayed tables drop their cached state before the replay.
+func (s *Storage) recoverWAL() error {
+	const op = "storage.recoverWAL"
+	log := s.log.With(
+		slog.String("op", op),
+	)
+
+	walPath := path.Join(s.databasePath(), walFileName)
+	entries, err := readWAL(walPath)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	replayed := make([]string, 0)
+	for _, entry := range entries {
+		for _, change := range entry.Ops {
+			engine, ok := s.tableEngine(change.Table)
+			if !ok || slices.Contains(replayed, change.Table) {
+				continue
+			}
+			if err := engine.Recover(); err != nil {
+				return fmt.Errorf("%s: %w", op, err)
+			}
+			replayed = append(replayed, change.Table)
+		}
+	}
+	// pks of rows of replayed tables, they are read once per table
+	pks := mymap.New()
+	for _, entry := range entries {
+		for _, change := range entry.Ops {
+			err := s.replayOp(change, pks)
+			if errors.Is(err, ErrRowTooLarge) {
+				// the statement was rejected by the engine after it was logged
+				log.Warn("WAL operation is skipped", prettylogger.Err(err), slog.Int64("lsn", entry.LSN))
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("%s: lsn %d: %w", op, entry.LSN, err)
+			}
+		}
+	}
+	for _, table := range replayed {
+		engine, _ := s.tableEngine(table)
+		if err := engine.Sync(); err != nil {
+			return fmt.Errorf("%s: %w", op, err)
+		}
+		// indexes could be saved before or after the replayed change
+		s.resetIndexes(table)
+	}
+	if len(entries) > 0 {
+		log.Info(
+			"WAL replayed",
+			slog.Int("entries", len(entries)),
+			slog.Any("tables", replayed),
+		)
+	}
+
+	s.wal, err = openWAL(walPath, s.Schema.WAL)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if len(entries) > 0 {
+		s.wal.lsn = entries[len(entries)-1].LSN
+		s.wal.mu.Lock()
+		defer s.wal.mu.Unlock()
+		if err := s.wal.checkpoint(s); err != nil {
+			return fmt.Errorf("%s: %w", op, err)
+		}
+	}
+	return nil
+}
+
+// replayOp applies the operation of the log again by the engine of the table, it's skipped for unknown tables and tables which aren't durable
+//
+// pks keeps a set of pks of rows for each table, it's read from the table at the first insert and changed by the replay,
+// so an inserted row is checked without reading the table again.
+func (s *Storage) replayOp(op walOp, pks *mymap.CustomMap) error {
+	engine, ok := s.tableEngine(op.Table)
+	columns, _ := s.tableColumns(op.Table)
+	if !ok || !engine.Durable() {
+		return nil
+	}
+	for _, values := range op.Rows {
+		if len(values) != len(columns) {
+			return fmt.Errorf("row of table %s has %d values instead of %d", op.Table, len(values), len(columns))
+		}
+	}
+
+	switch op.Type {
+	case walInsert:
+		tablePks, ok := pks.Get(op.Table).(*mymap.CustomMap)
+		if !ok {
+			tablePks = mymap.New()
+			err := s.scanRows(op.Table, func(row *mymap.CustomMap) error {
+				tablePks.Add(rowPk(op.Table, row), true)
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			pks.Add(op.Table, tablePks)
+		}
+		for _, values := range op.Rows {
+			if tablePks.Get(values[0]) == nil {
+				if _, err := engine.Append(values); err != nil {
+					return err
+				}
+				tablePks.Add(values[0], true)
+			}
+			// the pk sequence continues after the replayed row
+			id, err := strconv.ParseInt(values[0], 10, 64)
+			if err != nil {
+				continue
+			}
+			next, err := engine.PeekPk()
+			if err != nil {
+				return err
+			}
+			if next <= id {
+				if err := engine.SetPk(id + 1); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	case walUpdate, walDelete:
+		changes := mymap.New()
+		tablePks, _ := pks.Get(op.Table).(*mymap.CustomMap)
+		for _, pk := range op.Pks {
+			changes.Add(pk, true)
+			if tablePks != nil {
+				tablePks.Delete(pk)
+			}
+		}
+		for _, values := range op.Rows {
+			row := mymap.New()
+			for i, column := range columns {
+				row.Add(op.Table+"."+column, values[i])
+			}
+			changes.Add(values[0], row)
+		}
+		_, err := engine.Rewrite(nil, func(row *mymap.CustomMap) (*mymap.CustomMap, bool) {
+			switch change := changes.Get(rowPk(op.Table, row)).(type) {
+			case *mymap.CustomMap:
+				return change, true
+			case bool:
+				return nil, true
+			}
+			return row, false
+		})
+		return err
+	case walTruncate:
+		if pks.Get(op.Table) != nil {
+			pks.Add(op.Table, mymap.New())
+		}
+		return engine.Truncate()
+	default:
+		return fmt.Errorf("unknown operation %s", op.Type)
+	}
+}
@@ -0,0 +1,189 @@
+package tests
+
+import (
+	"JacuteSQL/internal/config"
+	"JacuteSQL/internal/storage"
+	suite "JacuteSQL/tests/suite/storage"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/jacute/prettylogger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAdminInspect(t *testing.T) {
+	st := suite.New(t)
+
+	for i := 1; i <= 25; i++ {
+		_, err := st.Storage.Exec(fmt.Sprintf("INSERT INTO cars VALUES ('model%d', 'maker', 'type', 'fuel')", i))
+		require.Nil(t, err)
+	}
+	restart := func() *storage.Storage {
+		cfg := config.MustLoadByPath("test_config.yaml")
+		cfg.LoadedSchema.Consistency.Policy = storage.ConsistencyOff
+		restarted := storage.New(cfg.StoragePath, cfg.LoadedSchema, slog.New(prettylogger.NewDiscardHandler()))
+		restarted.Create()
+		return restarted
+	}
+	// the wal is replayed, so changes below aren't undone by the next restart
+	restart()
+
+	// files are changed while the server is stopped, the catalog is removed to accept changes of sheets
+	tablePath := path.Join(st.Cfg.StoragePath, st.Cfg.LoadedSchema.Name, "cars")
+	sheetPath := path.Join(tablePath, "2.csv")
+	data, err := os.ReadFile(sheetPath)
+	require.Nil(t, err)
+	sheet := strings.Replace(string(data), "cars_pk,model,", "cars_pk,name,", 1)
+	sheet = strings.Replace(sheet, "22,model22", "21,model22", 1)
+	require.Nil(t, os.WriteFile(sheetPath, []byte(sheet), 0644))
+	require.Nil(t, os.Remove(path.Join(tablePath, "cars_meta.json")))
+	require.Nil(t, os.WriteFile(path.Join(tablePath, "cars_pk_sequence"), []byte("3"), 0644))
+	require.Nil(t, os.WriteFile(path.Join(tablePath, "notes.txt"), []byte("notes"), 0644))
+
+	restarted := restart()
+	problems, err := restarted.Inspect(false)
+	require.Nil(t, err)
+	kinds := make([]string, 0)
+	for _, problem := range problems {
+		assert.False(t, problem.Repaired)
+		kinds = append(kinds, problem.File+":"+problem.Kind)
+	}
+	// pks aren't checked while the header is wrong
+	assert.Equal(t, []string{"notes.txt:stray_file", "2.csv:header"}, kinds)
+
+	// the header is renamed by position only with rename_columns
+	problems, err = restarted.Inspect(true)
+	require.Nil(t, err)
+	kinds = kinds[:0]
+	for _, problem := range problems {
+		if !problem.Repaired {
+			kinds = append(kinds, problem.File+":"+problem.Kind)
+		}
+	}
+	assert.Equal(t, []string{"2.csv:header"}, kinds)
+
+	restarted.Schema.Consistency.RenameColumns = true
+	problems, err = restarted.Inspect(true)
+	require.Nil(t, err)
+	kinds = kinds[:0]
+	for _, problem := range problems {
+		assert.True(t, problem.Repaired, problem.String())
+		kinds = append(kinds, problem.File+":"+problem.Kind)
+	}
+	// the stray file is moved by the first repair
+	assert.Equal(t, []string{"2.csv:header", ":duplicate_pk", ":pk_sequence"}, kinds)
+	assert.FileExists(t, path.Join(st.Cfg.StoragePath, st.Cfg.LoadedSchema.Name, "lost+found", "cars", "notes.txt"))
+	assert.NoFileExists(t, path.Join(tablePath, "notes.txt"))
+
+	problems, err = restarted.Inspect(false)
+	require.Nil(t, err)
+	assert.Empty(t, problems)
+
+	// the duplicate row gets the pk after the largest one
+	output, err := restarted.Exec("SELECT cars.cars_pk, cars.model FROM cars WHERE cars.cars_pk > 20")
+	require.Nil(t, err)
+	assert.Equal(t, "cars.cars_pk,cars.model\n21,model21\n26,model22\n23,model23\n24,model24\n25,model25\n", output)
+	_, err = restarted.Exec("INSERT INTO cars VALUES ('model27', 'maker', 'type', 'fuel')")
+	require.Nil(t, err)
+	output, err = restarted.Exec("SELECT cars.cars_pk FROM cars WHERE cars.model = 'model27'")
+	require.Nil(t, err)
+	assert.Equal(t, "cars.cars_pk\n27\n", output)
+
+	stats, err := restarted.Stats()
+	require.Nil(t, err)
+	require.Len(t, stats, 2)
+	assert.Equal(t, "cars", stats[1].Table)
+	assert.Equal(t, storage.CSVEngine, stats[1].Engine)
+	assert.Equal(t, 26, stats[1].Rows)
+	assert.Equal(t, 2, stats[1].Sheets)
+	assert.Equal(t, int64(28), stats[1].NextPk)
+	assert.Greater(t, stats[1].Bytes, int64(0))
+}
+
+func TestAdminInspectDamaged(t *testing.T) {
+	st := suite.New(t)
+
+	_, err := st.Storage.Exec("INSERT INTO cars VALUES ('model', 'maker', 'type', 'fuel')")
+	require.Nil(t, err)
+	sheetPath := path.Join(st.Cfg.StoragePath, st.Cfg.LoadedSchema.Name, "cars", "1.csv")
+	require.Nil(t, os.WriteFile(sheetPath, []byte("cars_pk,model,maker,type,fueltype\n1,edited,maker,type,fuel\n"), 0644))
+
+	// damaged sheets are reported and not repaired
+	problems, err := st.Storage.Inspect(true)
+	require.Nil(t, err)
+	require.Len(t, problems, 1)
+	assert.Equal(t, storage.ProblemDamaged, problems[0].Kind)
+	assert.Equal(t, "1.csv", problems[0].File)
+	assert.False(t, problems[0].Repaired)
+}
+
+func TestAdminReadOnly(t *testing.T) {
+	st := suite.New(t)
+
+	_, err := st.Storage.Exec("INSERT INTO cars VALUES ('model', 'maker', 'type', 'fuel')")
+	require.Nil(t, err)
+	databasePath := path.Join(st.Cfg.StoragePath, st.Cfg.LoadedSchema.Name)
+	require.Nil(t, os.RemoveAll(path.Join(databasePath, "beer")))
+	wal, err := os.ReadFile(path.Join(databasePath, "wal.log"))
+	require.Nil(t, err)
+	require.NotEmpty(t, wal)
+	sequence, err := os.ReadFile(path.Join(databasePath, "cars", "cars_pk_sequence"))
+	require.Nil(t, err)
+
+	cfg := config.MustLoadByPath("test_config.yaml")
+	readOnly := storage.New(cfg.StoragePath, cfg.LoadedSchema, slog.New(prettylogger.NewDiscardHandler()))
+	require.Nil(t, readOnly.OpenReadOnly())
+	problems, err := readOnly.Inspect(false)
+	require.Nil(t, err)
+	kinds := make([]string, 0)
+	for _, problem := range problems {
+		kinds = append(kinds, problem.Table+":"+problem.Kind)
+	}
+	assert.Equal(t, []string{":pending_wal", "beer:missing_table"}, kinds)
+	_, err = readOnly.Inspect(true)
+	assert.ErrorIs(t, err, storage.ErrStorageReadOnly)
+	stats, err := readOnly.Stats()
+	require.Nil(t, err)
+	require.Len(t, stats, 2)
+	assert.Equal(t, 0, stats[0].Rows)
+
+	_, err = readOnly.Exec("SELECT cars.model FROM cars")
+	assert.Nil(t, err)
+	_, err = readOnly.Exec("INSERT INTO cars VALUES ('model', 'maker', 'type', 'fuel')")
+	assert.EqualError(t, err, "error: "+storage.ErrStorageReadOnly.Error())
+	_, err = readOnly.Exec("CREATE TABLE orders (item)")
+	assert.EqualError(t, err, "error: "+storage.ErrStorageReadOnly.Error())
+
+	// files aren't changed by the read-only storage
+	assert.NoDirExists(t, path.Join(databasePath, "beer"))
+	assert.NoDirExists(t, path.Join(databasePath, "orders"))
+	data, err := os.ReadFile(path.Join(databasePath, "wal.log"))
+	require.Nil(t, err)
+	assert.Equal(t, wal, data)
+	data, err = os.ReadFile(path.Join(databasePath, "cars", "cars_pk_sequence"))
+	require.Nil(t, err)
+	assert.Equal(t, sequence, data)
+}
+
+func TestAdminLockDatabase(t *testing.T) {
+	dir := t.TempDir()
+
+	lock, err := storage.LockDatabase(dir, "my_db")
+	require.Nil(t, err)
+	_, err = storage.LockDatabase(dir, "my_db")
+	assert.ErrorIs(t, err, storage.ErrDatabaseLocked)
+	// other databases aren't locked
+	other, err := storage.LockDatabase(dir, "other_db")
+	require.Nil(t, err)
+	other.Close()
+
+	require.Nil(t, lock.Close())
+	lock, err = storage.LockDatabase(dir, "my_db")
+	require.Nil(t, err)
+	lock.Close()
+}
@@ -0,0 +1,87 @@
+package tests
+
+import (
+	suite "JacuteSQL/tests/suite/storage"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSheetCache(t *testing.T) {
+	st := suite.New(t)
+
+	for i := 0; i < 25; i++ {
+		_, err := st.Storage.Exec(fmt.Sprintf("INSERT INTO cars VALUES ('model%d', 'maker', 'type', 'fuel')", i))
+		require.Nil(t, err)
+	}
+
+	// the second read of both sheets hits the cache
+	_, err := st.Storage.Exec("SELECT cars.model FROM cars")
+	require.Nil(t, err)
+	before, err := st.Storage.Exec("SHOW CACHE")
+	require.Nil(t, err)
+	_, err = st.Storage.Exec("SELECT cars.model FROM cars")
+	require.Nil(t, err)
+	after, err := st.Storage.Exec("SHOW CACHE")
+	require.Nil(t, err)
+	assert.Equal(t, cacheStat(t, before, 2)+2, cacheStat(t, after, 2))
+	assert.Equal(t, cacheStat(t, before, 3), cacheStat(t, after, 3))
+	assert.Equal(t, "64", strings.Split(strings.Split(after, "\n")[1], ",")[1])
+
+	// changed rows are read from the cache after UPDATE, DELETE and INSERT
+	_, err = st.Storage.Exec("UPDATE cars SET model = 'updated' WHERE cars.model = 'model3'")
+	require.Nil(t, err)
+	_, err = st.Storage.Exec("DELETE FROM cars WHERE cars.model = 'model24'")
+	require.Nil(t, err)
+	_, err = st.Storage.Exec("INSERT INTO cars VALUES ('new', 'maker', 'type', 'fuel')")
+	require.Nil(t, err)
+	output, err := st.Storage.Exec("SELECT cars.model FROM cars WHERE cars.model = 'updated' OR cars.model = 'model24' OR cars.model = 'new' OR cars.model = 'model3'")
+	require.Nil(t, err)
+	assert.Equal(t, "cars.model\nupdated\nnew\n", output)
+
+	// the sheet changed outside of the engine is read again and fails its checksum
+	sheetPath := path.Join(st.Cfg.StoragePath, st.Cfg.LoadedSchema.Name, "cars", "2.csv")
+	original, err := os.ReadFile(sheetPath)
+	require.Nil(t, err)
+	require.Nil(t, os.WriteFile(sheetPath, []byte("cars_pk,model,maker,type,fueltype\n21,edited,maker,type,fuel\n"), 0644))
+	_, err = st.Storage.Exec("SELECT cars.model FROM cars WHERE cars.cars_pk > 20")
+	assert.ErrorContains(t, err, "damaged sheet")
+	require.Nil(t, os.WriteFile(sheetPath, original, 0644))
+	_, err = st.Storage.Exec("CHECK TABLE cars")
+	require.Nil(t, err)
+	output, err = st.Storage.Exec("SELECT cars.model FROM cars WHERE cars.cars_pk > 20")
+	require.Nil(t, err)
+	assert.Equal(t, "cars.model\nmodel20\nmodel21\nmodel22\nmodel23\nnew\n", output)
+
+	// pages of binary tables are cached too
+	_, err = st.Storage.Exec("ALTER TABLE cars SET ENGINE = binary")
+	require.Nil(t, err)
+	_, err = st.Storage.Exec("SELECT cars.model FROM cars")
+	require.Nil(t, err)
+	_, err = st.Storage.Exec("UPDATE cars SET model = 'binary' WHERE cars.model = 'model0'")
+	require.Nil(t, err)
+	before, err = st.Storage.Exec("SHOW CACHE")
+	require.Nil(t, err)
+	output, err = st.Storage.Exec("SELECT cars.model FROM cars WHERE cars.model = 'binary' OR cars.model = 'model0'")
+	require.Nil(t, err)
+	assert.Equal(t, "cars.model\nbinary\n", output)
+	_, err = st.Storage.Exec("SELECT cars.model FROM cars")
+	require.Nil(t, err)
+	after, err = st.Storage.Exec("SHOW CACHE")
+	require.Nil(t, err)
+	assert.Equal(t, cacheStat(t, before, 2)+1, cacheStat(t, after, 2))
+}
+
+// cacheStat returns the column of the output of SHOW CACHE
+func cacheStat(t *testing.T, output string, column int) int {
+	t.Helper()
+	var stat int
+	_, err := fmt.Sscan(strings.Split(strings.Split(output, "\n")[1], ",")[column], &stat)
+	require.Nil(t, err)
+	return stat
+}
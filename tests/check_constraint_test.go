@@ -0,0 +1,66 @@
+package tests
+
+import (
+	"JacuteSQL/internal/storage"
+	suite "JacuteSQL/tests/suite/storage"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckConstraints(t *testing.T) {
+	st := suite.New(t)
+
+	_, err := st.Storage.Exec(`CREATE TABLE item (
+		name NOT NULL,
+		quantity DEFAULT 1 CHECK (quantity >= 0),
+		price DEFAULT '0.5',
+		created DEFAULT CURRENT_TIMESTAMP,
+		CHECK (quantity < 100 OR price = '0')
+	)`)
+	require.Nil(t, err)
+
+	_, err = st.Storage.Exec("CREATE TABLE broken (name DEFAULT word)")
+	assert.Error(t, err)
+	_, err = st.Storage.Exec("CREATE TABLE broken (name, CHECK (color > 1))")
+	assert.Error(t, err)
+
+	// listed columns, defaults for others
+	_, err = st.Storage.Exec("INSERT INTO item (name) VALUES ('apple')")
+	require.Nil(t, err)
+	_, err = st.Storage.Exec("INSERT INTO item (price, name, quantity) VALUES ('2', 'pear', DEFAULT)")
+	require.Nil(t, err)
+	_, err = st.Storage.Exec("INSERT INTO item VALUES ('plum', 5, '1', NULL)")
+	require.Nil(t, err)
+	output, err := st.Storage.Exec("SELECT item.name, item.quantity, item.price FROM item ORDER BY item.name")
+	require.Nil(t, err)
+	assert.Equal(t, "item.name,item.quantity,item.price\napple,1,0.5\npear,1,2\nplum,5,1\n", output)
+	output, err = st.Storage.Exec("SELECT item.created FROM item WHERE item.name = 'apple'")
+	require.Nil(t, err)
+	assert.Regexp(t, regexp.MustCompile(`^item.created\n\d{4}-\d\d-\d\d \d\d:\d\d:\d\d\n$`), output)
+
+	// violations
+	_, err = st.Storage.Exec("INSERT INTO item (quantity) VALUES (3)")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), storage.ErrConstraintViolation.Error())
+	assert.Contains(t, err.Error(), "item_name_not_null")
+	_, err = st.Storage.Exec("INSERT INTO item (name, quantity) VALUES ('fig', -1)")
+	assert.ErrorContains(t, err, "item_quantity_check")
+	_, err = st.Storage.Exec("INSERT INTO item (name, quantity) VALUES ('fig', 150)")
+	assert.ErrorContains(t, err, "item_price_quantity_check")
+	_, err = st.Storage.Exec("INSERT INTO item (name, color) VALUES ('fig', 'red')")
+	assert.Error(t, err)
+	_, err = st.Storage.Exec("UPDATE item SET quantity = 200 WHERE item.name = 'plum'")
+	assert.ErrorContains(t, err, "item_price_quantity_check")
+	_, err = st.Storage.Exec("UPDATE item SET name = NULL")
+	assert.ErrorContains(t, err, "item_name_not_null")
+
+	output, err = st.Storage.Exec("UPDATE item SET quantity = DEFAULT WHERE item.quantity > 2")
+	require.Nil(t, err)
+	assert.Equal(t, "updated 1 rows", output)
+	output, err = st.Storage.Exec("SELECT item.name FROM item WHERE item.quantity <= 1 AND item.price <> '0.5' ORDER BY item.name")
+	require.Nil(t, err)
+	assert.Equal(t, "item.name\npear\nplum\n", output)
+}
@@ -0,0 +1,112 @@
+package tests
+
+import (
+	"JacuteSQL/internal/config"
+	"JacuteSQL/internal/storage"
+	suite "JacuteSQL/tests/suite/storage"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/jacute/prettylogger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// restartWithPolicy opens the storage of the test again with the consistency policy
+func restartWithPolicy(policy string) *storage.Storage {
+	return restartWithConsistency(config.ConsistencyConfig{Policy: policy})
+}
+
+// restartWithConsistency opens the storage of the test again with settings of the consistency check
+func restartWithConsistency(consistency config.ConsistencyConfig) *storage.Storage {
+	cfg := config.MustLoadByPath("test_config.yaml")
+	cfg.LoadedSchema.Consistency = consistency
+	restarted := storage.New(cfg.StoragePath, cfg.LoadedSchema, slog.New(prettylogger.NewDiscardHandler()))
+	restarted.Create()
+	return restarted
+}
+
+func TestStartupRepair(t *testing.T) {
+	st := suite.New(t)
+
+	for i := 1; i <= 25; i++ {
+		_, err := st.Storage.Exec(fmt.Sprintf("INSERT INTO cars VALUES ('model%d', 'maker', 'type', 'fuel')", i))
+		require.Nil(t, err)
+	}
+	restartWithPolicy(storage.ConsistencyRepair)
+
+	// the header drifted from schema.json, the pk sequence is behind, a sheet is lost and a table is orphaned
+	databasePath := path.Join(st.Cfg.StoragePath, st.Cfg.LoadedSchema.Name)
+	tablePath := path.Join(databasePath, "cars")
+	sheetPath := path.Join(tablePath, "1.csv")
+	data, err := os.ReadFile(sheetPath)
+	require.Nil(t, err)
+	require.Nil(t, os.WriteFile(sheetPath, []byte(strings.Replace(string(data), ",fueltype", ",fuel", 1)), 0644))
+	require.Nil(t, os.WriteFile(path.Join(tablePath, "cars_pk_sequence"), []byte("2"), 0644))
+	require.Nil(t, os.Remove(path.Join(tablePath, "2.csv")))
+	require.Nil(t, os.Mkdir(path.Join(databasePath, "trucks"), 0755))
+
+	// problems are only reported by default
+	restarted := restartWithPolicy("")
+	problems, err := restarted.Inspect(false)
+	require.Nil(t, err)
+	kinds := make([]string, 0)
+	for _, problem := range problems {
+		kinds = append(kinds, problem.Table+":"+problem.Kind)
+	}
+	assert.Equal(t, []string{"trucks:orphaned_table", "cars:header", "cars:missing_sheet", "cars:damaged"}, kinds)
+	assert.DirExists(t, path.Join(databasePath, "trucks"))
+
+	// columns with unknown names aren't renamed by position without rename_columns
+	restarted = restartWithPolicy(storage.ConsistencyRepair)
+	problems, err = restarted.Inspect(false)
+	require.Nil(t, err)
+	require.Len(t, problems, 1)
+	assert.Equal(t, storage.ProblemHeader, problems[0].Kind)
+	assert.Contains(t, problems[0].Detail, "rename_columns")
+
+	restarted = restartWithConsistency(config.ConsistencyConfig{Policy: storage.ConsistencyRepair, RenameColumns: true})
+	problems, err = restarted.Inspect(false)
+	require.Nil(t, err)
+	assert.Empty(t, problems)
+
+	output, err := restarted.Exec("SELECT cars.fueltype FROM cars WHERE cars.cars_pk = 1")
+	require.Nil(t, err)
+	assert.Equal(t, "cars.fueltype\nfuel\n", output)
+	_, err = restarted.Exec("INSERT INTO cars VALUES ('new', 'maker', 'type', 'fuel')")
+	require.Nil(t, err)
+	output, err = restarted.Exec("SELECT cars.cars_pk FROM cars WHERE cars.model = 'new'")
+	require.Nil(t, err)
+	assert.Equal(t, "cars.cars_pk\n21\n", output)
+	assert.NoDirExists(t, path.Join(databasePath, "trucks"))
+	assert.DirExists(t, path.Join(databasePath, "lost+found", "trucks"))
+}
+
+func TestStartupRefuse(t *testing.T) {
+	st := suite.New(t)
+
+	_, err := st.Storage.Exec("INSERT INTO cars VALUES ('model', 'maker', 'type', 'fuel')")
+	require.Nil(t, err)
+	restartWithPolicy(storage.ConsistencyRefuse)
+
+	tablePath := path.Join(st.Cfg.StoragePath, st.Cfg.LoadedSchema.Name, "cars")
+	require.Nil(t, os.WriteFile(path.Join(tablePath, "cars_pk_sequence"), []byte("1"), 0644))
+	assert.PanicsWithValue(t, "Storage is inconsistent: storage.checkConsistency: found 1 problems in tables [cars]", func() {
+		restartWithPolicy(storage.ConsistencyRefuse)
+	})
+
+	// the check is skipped if it's off
+	restarted := restartWithPolicy(storage.ConsistencyOff)
+	problems, err := restarted.Inspect(false)
+	require.Nil(t, err)
+	require.Len(t, problems, 1)
+	assert.Equal(t, storage.ProblemPkSequence, problems[0].Kind)
+
+	assert.Panics(t, func() {
+		restartWithPolicy("unknown")
+	})
+}
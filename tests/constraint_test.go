@@ -0,0 +1,142 @@
+package tests
+
+import (
+	"JacuteSQL/internal/config"
+	"JacuteSQL/internal/logger"
+	"JacuteSQL/internal/storage"
+	suite "JacuteSQL/tests/suite/storage"
+	"log/slog"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/jacute/prettylogger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCreateTableUnique(t *testing.T) {
+	st := suite.New(t)
+
+	_, err := st.Storage.Exec("CREATE TABLE account (username UNIQUE, token)")
+	require.Nil(t, err)
+	_, err = st.Storage.Exec("INSERT INTO account VALUES ('alice', 'token1')")
+	require.Nil(t, err)
+	_, err = st.Storage.Exec("INSERT INTO account VALUES ('alice', 'token2')")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), storage.ErrConstraintViolation.Error())
+	assert.Contains(t, err.Error(), "account_username_key")
+
+	_, err = st.Storage.Exec("CREATE TABLE account (username)")
+	assert.Error(t, err)
+	_, err = st.Storage.Exec("CREATE TABLE IF NOT EXISTS account (username)")
+	assert.Nil(t, err)
+	_, err = st.Storage.Exec("CREATE TABLE broken (name, UNIQUE (color))")
+	assert.Error(t, err)
+
+	_, err = st.Storage.Exec("CREATE TABLE holding (user_id, lot_id, quantity, PRIMARY KEY (user_id, lot_id))")
+	require.Nil(t, err)
+	_, err = st.Storage.Exec("INSERT INTO holding VALUES ('1', '1', '10')")
+	require.Nil(t, err)
+	_, err = st.Storage.Exec("INSERT INTO holding VALUES ('1', '2', '5')")
+	require.Nil(t, err)
+	_, err = st.Storage.Exec("INSERT INTO holding VALUES ('1', '1', '3')")
+	assert.ErrorContains(t, err, "holding_pkey")
+	_, err = st.Storage.Exec("INSERT INTO holding VALUES ('', '1', '3')")
+	assert.ErrorContains(t, err, "holding_pkey")
+
+	// update checks constraints before rows are written
+	_, err = st.Storage.Exec("UPDATE holding SET lot_id = '2' WHERE holding.quantity = 10")
+	assert.ErrorContains(t, err, "holding_pkey")
+	_, err = st.Storage.Exec("UPDATE holding SET lot_id = '3'")
+	assert.ErrorContains(t, err, "holding_pkey")
+	output, err := st.Storage.Exec("UPDATE holding SET quantity = 20, holding.lot_id = '3' WHERE holding.lot_id = '1'")
+	require.Nil(t, err)
+	assert.Equal(t, "updated 1 rows", output)
+	output, err = st.Storage.Exec("SELECT holding.lot_id, holding.quantity FROM holding ORDER BY holding.lot_id")
+	require.Nil(t, err)
+	assert.Equal(t, "holding.lot_id,holding.quantity\n2,5\n3,20\n", output)
+
+	// deleted keys can be used again
+	_, err = st.Storage.Exec("DELETE FROM holding WHERE holding.lot_id = '3'")
+	require.Nil(t, err)
+	_, err = st.Storage.Exec("INSERT INTO holding VALUES ('1', '3', '1')")
+	require.Nil(t, err)
+
+	// tables and indexes are restored after restart
+	cfg := config.MustLoadByPath("test_config.yaml")
+	discardLogger := &logger.Logger{
+		Log: slog.New(prettylogger.NewDiscardHandler()),
+	}
+	restarted := storage.New(cfg.StoragePath, cfg.LoadedSchema, discardLogger.Log)
+	restarted.Create()
+	_, err = restarted.Exec("INSERT INTO account VALUES ('alice', 'token3')")
+	assert.ErrorContains(t, err, "account_username_key")
+	_, err = restarted.Exec("INSERT INTO account VALUES ('bob', 'token3')")
+	assert.Nil(t, err)
+}
+
+func TestUniqueFromSchema(t *testing.T) {
+	st := suite.New(t)
+
+	cfg := config.MustLoadByPath("test_config.yaml")
+	cfg.LoadedSchema.Constraints = append(cfg.LoadedSchema.Constraints, config.Constraint{
+		Table:   "beer",
+		Type:    "unique",
+		Columns: []string{"name"},
+	})
+	discardLogger := &logger.Logger{
+		Log: slog.New(prettylogger.NewDiscardHandler()),
+	}
+	restarted := storage.New(cfg.StoragePath, cfg.LoadedSchema, discardLogger.Log)
+	restarted.Create()
+
+	_, err := restarted.Exec("INSERT INTO beer VALUES ('Duvel', 'Ale', '8.5', '32', '17')")
+	require.Nil(t, err)
+	_, err = restarted.Exec("INSERT INTO beer VALUES ('Duvel', 'Stout', '4.2', '45', '10')")
+	assert.ErrorContains(t, err, "beer_name_key")
+	_, err = restarted.Exec("INSERT INTO beer VALUES ('Guinness', 'Stout', '4.2', '45', '10')")
+	require.Nil(t, err)
+	_, err = restarted.Exec("UPDATE beer SET name = 'Duvel' WHERE beer.style = 'Stout'")
+	assert.ErrorContains(t, err, "beer_name_key")
+
+	// pk sequence behind the data
+	tablePath := st.Storage.TablePathes.Get("beer").(string)
+	require.Nil(t, os.WriteFile(path.Join(tablePath, "beer_pk_sequence"), []byte("1"), 0644))
+	_, err = restarted.Exec("INSERT INTO beer VALUES ('Pilsner', 'Lager', '10.5', '40', '12')")
+	assert.ErrorContains(t, err, "beer_pk")
+}
+
+func TestInsertRejectedPk(t *testing.T) {
+	st := suite.New(t)
+
+	_, err := st.Storage.Exec("CREATE TABLE account (username UNIQUE, age CHECK (account.age > '17'))")
+	require.Nil(t, err)
+	_, err = st.Storage.Exec("CREATE TABLE post (author REFERENCES account (username), text)")
+	require.Nil(t, err)
+	id, err := st.Storage.Exec("INSERT INTO account VALUES ('alice', '20')")
+	require.Nil(t, err)
+	assert.Equal(t, "1", id)
+
+	// rejected rows don't use up pks
+	_, err = st.Storage.Exec("INSERT INTO account VALUES ('alice', '30')")
+	assert.ErrorContains(t, err, "account_username_key")
+	_, err = st.Storage.Exec("INSERT INTO account VALUES ('bob', '10')")
+	assert.ErrorContains(t, err, storage.ErrConstraintViolation.Error())
+	id, err = st.Storage.Exec("INSERT INTO account VALUES ('bob', '30')")
+	require.Nil(t, err)
+	assert.Equal(t, "2", id)
+
+	_, err = st.Storage.Exec("INSERT INTO post VALUES ('carol', 'hello')")
+	assert.ErrorContains(t, err, storage.ErrConstraintViolation.Error())
+	id, err = st.Storage.Exec("INSERT INTO post VALUES ('alice', 'hello')")
+	require.Nil(t, err)
+	assert.Equal(t, "1", id)
+
+	// the pk taken by nextval isn't used by the next row
+	_, err = st.Storage.Exec("SELECT nextval('account_pk_sequence')")
+	require.Nil(t, err)
+	id, err = st.Storage.Exec("INSERT INTO account VALUES ('carol', '40')")
+	require.Nil(t, err)
+	assert.Equal(t, "4", id)
+}
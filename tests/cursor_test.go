@@ -0,0 +1,38 @@
+package tests
+
+import (
+	suite "JacuteSQL/tests/suite/storage"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCursorSheetOrder(t *testing.T) {
+	st := suite.New(t)
+
+	_, err := st.Storage.Exec("CREATE TABLE counter (n)")
+	require.Nil(t, err)
+	// 250 rows take 13 sheets with tuples_limit 20
+	for i := 1; i <= 250; i++ {
+		_, err := st.Storage.Exec(fmt.Sprintf("INSERT INTO counter VALUES ('%d')", i))
+		require.Nil(t, err)
+	}
+
+	var expected strings.Builder
+	expected.WriteString("counter.n\n")
+	for i := 1; i <= 250; i++ {
+		fmt.Fprintf(&expected, "%d\n", i)
+	}
+	output, err := st.Storage.Exec("SELECT counter.n FROM counter")
+	require.Nil(t, err)
+	assert.Equal(t, expected.String(), output)
+
+	_, err = st.Storage.Exec("DELETE FROM counter WHERE counter.n > 5")
+	require.Nil(t, err)
+	output, err = st.Storage.Exec("SELECT counter.n FROM counter")
+	require.Nil(t, err)
+	assert.Equal(t, "counter.n\n1\n2\n3\n4\n5\n", output)
+}
@@ -0,0 +1,196 @@
+package tests
+
+import (
+	"JacuteSQL/internal/config"
+	"JacuteSQL/internal/lib/utils"
+	"JacuteSQL/internal/logger"
+	"JacuteSQL/internal/storage"
+	suite "JacuteSQL/tests/suite/storage"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/jacute/prettylogger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryEngine(t *testing.T) {
+	st := suite.New(t)
+
+	session := st.Storage.NewSession()
+	_, err := session.ExecScript(`
+		CREATE TABLE cache (key UNIQUE, value) ENGINE = memory;
+		INSERT INTO cache VALUES ('a', '1');
+		INSERT INTO cache VALUES ('b', '2');
+		INSERT INTO cache VALUES ('c', '3');
+		UPDATE cache SET value = '20' WHERE cache.key = 'b';
+		DELETE FROM cache WHERE cache.key = 'a'`)
+	require.Nil(t, err)
+
+	output, err := st.Storage.Exec("SELECT cache.cache_pk, cache.key, cache.value FROM cache")
+	require.Nil(t, err)
+	assert.Equal(t, "cache.cache_pk,cache.key,cache.value\n2,b,20\n3,c,3\n", output)
+	_, err = st.Storage.Exec("INSERT INTO cache VALUES ('c', '4')")
+	assert.ErrorContains(t, err, "cache_key_key")
+	output, err = st.Storage.Exec("SELECT currval('cache_pk_sequence')")
+	require.Nil(t, err)
+	assert.Equal(t, "currval\n3\n", output)
+
+	// the table doesn't touch the disk and isn't logged
+	databasePath := path.Join(st.Cfg.StoragePath, st.Cfg.LoadedSchema.Name)
+	_, err = os.Stat(path.Join(databasePath, "cache"))
+	assert.True(t, os.IsNotExist(err))
+	wal, err := os.ReadFile(path.Join(databasePath, "wal.log"))
+	require.Nil(t, err)
+	assert.NotContains(t, string(wal), "cache")
+
+	_, err = st.Storage.Exec("CREATE TABLE broken (a) ENGINE = paper")
+	assert.ErrorContains(t, err, storage.ErrUnknownEngine.Error())
+
+	// the table is empty after restart
+	cfg := config.MustLoadByPath("test_config.yaml")
+	discardLogger := &logger.Logger{
+		Log: slog.New(prettylogger.NewDiscardHandler()),
+	}
+	restarted := storage.New(cfg.StoragePath, cfg.LoadedSchema, discardLogger.Log)
+	restarted.Create()
+	output, err = restarted.Exec("SELECT cache.key FROM cache")
+	require.Nil(t, err)
+	assert.Equal(t, "cache.key\n", output)
+}
+
+func TestEngineFromSchema(t *testing.T) {
+	cfg := config.MustLoadByPath("test_config.yaml")
+	cfg.LoadedSchema.Engines = map[string]string{"cars": "memory"}
+	st := storage.New(t.TempDir(), cfg.LoadedSchema, slog.New(prettylogger.NewDiscardHandler()))
+	st.Create()
+
+	_, err := st.Exec("INSERT INTO cars VALUES ('model', 'maker', 'type', 'fuel')")
+	require.Nil(t, err)
+	output, err := st.Exec("EXPLAIN ANALYZE SELECT cars.model FROM cars")
+	require.Nil(t, err)
+	assert.Contains(t, output, "Scan on cars (1 sheets) (rows=1 sheets=1")
+
+	_, err = os.Stat(path.Join(st.StoragePath, cfg.LoadedSchema.Name, "cars"))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(path.Join(st.StoragePath, cfg.LoadedSchema.Name, "beer", "1.csv"))
+	assert.Nil(t, err)
+}
+
+func TestBinaryEngine(t *testing.T) {
+	st := suite.New(t)
+
+	long := strings.Repeat("x", 1500)
+	session := st.Storage.NewSession()
+	_, err := session.ExecScript(`
+		CREATE TABLE metrics (name, value, note) ENGINE = binary;
+		INSERT INTO metrics VALUES ('count', 42, 'it''s quoted');
+		INSERT INTO metrics VALUES ('ratio', 0.25, '');
+		INSERT INTO metrics VALUES ('code', '007', '-1.50');
+		INSERT INTO metrics VALUES ('big', 9223372036854775807, '1e3')`)
+	require.Nil(t, err)
+	for i := 0; i < 5; i++ {
+		_, err = st.Storage.Exec(fmt.Sprintf("INSERT INTO metrics VALUES ('long%d', %d, '%s')", i, i, long))
+		require.Nil(t, err)
+	}
+
+	output, err := st.Storage.Exec("SELECT metrics.metrics_pk, metrics.name, metrics.value, metrics.note FROM metrics WHERE metrics.metrics_pk < 5")
+	require.Nil(t, err)
+	assert.Equal(t, "metrics.metrics_pk,metrics.name,metrics.value,metrics.note\n1,count,42,it's quoted\n2,ratio,0.25,\n3,code,007,-1.50\n4,big,9223372036854775807,1e3\n", output)
+
+	// rows of 1500 bytes take two pages
+	output, err = st.Storage.Exec("EXPLAIN ANALYZE SELECT metrics.name FROM metrics")
+	require.Nil(t, err)
+	assert.Contains(t, output, "Scan on metrics (3 sheets) (rows=9 sheets=3")
+
+	// the grown row doesn't fit into its page and is moved to a new one
+	_, err = st.Storage.Exec(fmt.Sprintf("UPDATE metrics SET note = '%s' WHERE metrics.name = 'count'", long))
+	require.Nil(t, err)
+	_, err = st.Storage.Exec("DELETE FROM metrics WHERE metrics.name = 'long0'")
+	require.Nil(t, err)
+	output, err = st.Storage.Exec("SELECT metrics.name FROM metrics WHERE metrics.note = '" + long + "'")
+	require.Nil(t, err)
+	assert.Equal(t, "metrics.name\ncount\nlong2\nlong3\nlong4\nlong1\n", output)
+
+	_, err = st.Storage.Exec(fmt.Sprintf("INSERT INTO metrics VALUES ('huge', 1, '%s')", strings.Repeat("x", 5000)))
+	assert.ErrorContains(t, err, storage.ErrRowTooLarge.Error())
+
+	tablePath := path.Join(st.Cfg.StoragePath, st.Cfg.LoadedSchema.Name, "metrics")
+	files, err := os.ReadDir(tablePath)
+	require.Nil(t, err)
+	require.Len(t, files, 1)
+	assert.Equal(t, "pages.bin", files[0].Name())
+
+	// rows and the pk sequence are read from pages after restart, the rejected row took pk 10
+	cfg := config.MustLoadByPath("test_config.yaml")
+	restarted := storage.New(cfg.StoragePath, cfg.LoadedSchema, slog.New(prettylogger.NewDiscardHandler()))
+	restarted.Create()
+	output, err = restarted.Exec("SELECT metrics.metrics_pk, metrics.value FROM metrics WHERE metrics.name = 'ratio'")
+	require.Nil(t, err)
+	assert.Equal(t, "metrics.metrics_pk,metrics.value\n2,0.25\n", output)
+	output, err = restarted.Exec("SELECT nextval('metrics_pk_sequence')")
+	require.Nil(t, err)
+	assert.Equal(t, "nextval\n11\n", output)
+}
+
+func TestConvertTable(t *testing.T) {
+	st := suite.New(t)
+
+	for i := 0; i < 45; i++ {
+		_, err := st.Storage.Exec(fmt.Sprintf("INSERT INTO cars VALUES ('model%d', 'maker', 'type', '%d.5')", i, i))
+		require.Nil(t, err)
+	}
+	expected, err := st.Storage.Exec("SELECT cars.cars_pk, cars.model, cars.fueltype FROM cars")
+	require.Nil(t, err)
+
+	_, err = st.Storage.Exec("ALTER TABLE cars SET ENGINE = binary")
+	require.Nil(t, err)
+	tablePath := path.Join(st.Cfg.StoragePath, st.Cfg.LoadedSchema.Name, "cars")
+	assert.FileExists(t, path.Join(tablePath, "pages.bin"))
+	assert.NoFileExists(t, path.Join(tablePath, "1.csv"))
+	assert.NoFileExists(t, path.Join(tablePath, "cars_pk_sequence"))
+	output, err := st.Storage.Exec("SELECT cars.cars_pk, cars.model, cars.fueltype FROM cars")
+	require.Nil(t, err)
+	assert.Equal(t, expected, output)
+	id, err := st.Storage.Exec("INSERT INTO cars VALUES ('model45', 'maker', 'type', '45.5')")
+	require.Nil(t, err)
+	assert.Equal(t, "46", id)
+
+	// the engine of the table from schema.json is kept after restart
+	cfg := config.MustLoadByPath("test_config.yaml")
+	restarted := storage.New(cfg.StoragePath, cfg.LoadedSchema, slog.New(prettylogger.NewDiscardHandler()))
+	restarted.Create()
+	output, err = restarted.Exec("EXPLAIN SELECT cars.model FROM cars")
+	require.Nil(t, err)
+	assert.Contains(t, output, "Scan on cars (1 sheets)")
+
+	_, err = restarted.Exec("ALTER TABLE cars SET ENGINE csv")
+	require.Nil(t, err)
+	assert.NoFileExists(t, path.Join(tablePath, "pages.bin"))
+	sheets, err := utils.GetSheetsFromFiles(tablePath)
+	require.Nil(t, err)
+	assert.Equal(t, []string{"1.csv", "2.csv", "3.csv"}, sheets)
+	output, err = restarted.Exec("SELECT cars.cars_pk, cars.model FROM cars WHERE cars.fueltype = '45.5'")
+	require.Nil(t, err)
+	assert.Equal(t, "cars.cars_pk,cars.model\n46,model45\n", output)
+	data, err := os.ReadFile(path.Join(tablePath, "cars_pk_sequence"))
+	require.Nil(t, err)
+	assert.Equal(t, "47", string(data))
+
+	_, err = restarted.Exec("ALTER TABLE unknown SET ENGINE binary")
+	assert.NotNil(t, err)
+
+	// rows of the durable table aren't moved to memory and files are kept
+	_, err = restarted.Exec("ALTER TABLE cars SET ENGINE memory")
+	assert.EqualError(t, err, "error: engine doesn't keep rows after restart: table cars can't be converted to memory, its rows would be lost")
+	sheets, err = utils.GetSheetsFromFiles(tablePath)
+	require.Nil(t, err)
+	assert.Equal(t, []string{"1.csv", "2.csv", "3.csv"}, sheets)
+	output, err = restarted.Exec("SELECT cars.cars_pk FROM cars WHERE cars.model = 'model45'")
+	require.Nil(t, err)
+	assert.Equal(t, "cars.cars_pk\n46\n", output)
+}
@@ -0,0 +1,72 @@
+package tests
+
+import (
+	suite "JacuteSQL/tests/suite/storage"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSelectOrderBy(t *testing.T) {
+	st := suite.New(t)
+
+	_, err := st.Storage.Exec("INSERT INTO beer VALUES ('Duvel', 'Ale', '8.5', '32', '17')")
+	require.Nil(t, err)
+	_, err = st.Storage.Exec("INSERT INTO beer VALUES ('Guinness', 'Stout', '4.2', '45', '10')")
+	require.Nil(t, err)
+	_, err = st.Storage.Exec("INSERT INTO beer VALUES ('Pilsner', 'Lager', '10.5', '40', '12')")
+	require.Nil(t, err)
+
+	// numbers are compared as numbers
+	output, err := st.Storage.Exec("SELECT beer.name FROM beer ORDER BY beer.alcohol DESC")
+	require.Nil(t, err)
+	assert.Equal(t, "beer.name\nPilsner\nDuvel\nGuinness\n", output)
+
+	output, err = st.Storage.Exec("SELECT beer.name FROM beer WHERE beer.style = 'Ale' OR beer.style = 'Stout' ORDER BY beer.ibu")
+	require.Nil(t, err)
+	assert.Equal(t, "beer.name\nDuvel\nGuinness\n", output)
+
+	output, err = st.Storage.Exec("SELECT beer.style, COUNT(*) FROM beer GROUP BY beer.style ORDER BY beer.style")
+	require.Nil(t, err)
+	assert.Equal(t, "beer.style,COUNT(*)\nAle,1\nLager,1\nStout,1\n", output)
+
+	_, err = st.Storage.Exec("SELECT beer.style, COUNT(*) FROM beer GROUP BY beer.style ORDER BY beer.name")
+	assert.Error(t, err)
+	_, err = st.Storage.Exec("SELECT beer.name FROM beer ORDER BY beer.color")
+	assert.Error(t, err)
+}
+
+func TestExplain(t *testing.T) {
+	st := suite.New(t)
+
+	_, err := st.Storage.Exec("INSERT INTO beer VALUES ('Duvel', 'Ale', '8.5', '32', '17')")
+	require.Nil(t, err)
+	_, err = st.Storage.Exec("INSERT INTO beer VALUES ('Guinness', 'Stout', '4.2', '45', '10')")
+	require.Nil(t, err)
+	_, err = st.Storage.Exec("INSERT INTO cars VALUES ('Golf', 'Volkswagen', 'hatchback', 'petrol')")
+	require.Nil(t, err)
+
+	output, err := st.Storage.Exec("EXPLAIN SELECT beer.name, cars.model FROM beer, cars WHERE beer.style = 'Ale' AND cars.maker = beer.name ORDER BY beer.name")
+	require.Nil(t, err)
+	assert.Equal(t, "QUERY PLAN\n"+
+		"Project (beer.name, cars.model)\n"+
+		"-> Sort (beer.name)\n"+
+		"  -> Filter (beer.style = 'Ale' AND cars.maker = beer.name)\n"+
+		"    -> Nested Loop (cross join)\n"+
+		"      -> Filter (beer.style = 'Ale')\n"+
+		"        -> Scan on beer (1 sheets)\n"+
+		"      -> Scan on cars (1 sheets)\n", output)
+
+	output, err = st.Storage.Exec("EXPLAIN ANALYZE SELECT beer.style, COUNT(*) FROM beer WHERE beer.style = 'Ale' GROUP BY beer.style")
+	require.Nil(t, err)
+	assert.Regexp(t, `^QUERY PLAN
+Project \(beer.style, COUNT\(\*\)\) \(rows=1 time=[\d\.]+ms\)
+-> Aggregate \(beer.style, COUNT\(\*\)\) GROUP BY beer.style \(rows=1 time=[\d\.]+ms\)
+  -> Filter \(beer.style = 'Ale'\) \(rows=1 time=[\d\.]+ms\)
+    -> Scan on beer \(1 sheets\) \(rows=2 sheets=1 time=[\d\.]+ms\)
+$`, output)
+
+	_, err = st.Storage.Exec("EXPLAIN DELETE FROM beer")
+	assert.Error(t, err)
+}
@@ -0,0 +1,73 @@
+package tests
+
+import (
+	"JacuteSQL/internal/storage"
+	suite "JacuteSQL/tests/suite/storage"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestForeignKeys(t *testing.T) {
+	st := suite.New(t)
+
+	session := st.Storage.NewSession()
+	_, err := session.ExecScript(`
+		CREATE TABLE person (username UNIQUE);
+		CREATE TABLE orders (person_id REFERENCES person ON DELETE CASCADE, quantity);
+		CREATE TABLE note (person_name REFERENCES person (username) ON DELETE SET NULL, text);
+		CREATE TABLE payment (order_id, FOREIGN KEY (order_id) REFERENCES orders);
+		INSERT INTO person VALUES ('alice');
+		INSERT INTO person VALUES ('bob');
+		INSERT INTO orders VALUES ('1', 10);
+		INSERT INTO orders VALUES ('2', 20);
+		INSERT INTO note VALUES ('alice', 'hi');
+		INSERT INTO note VALUES ('bob', 'hello');
+		INSERT INTO payment VALUES ('1')`)
+	require.Nil(t, err)
+
+	_, err = st.Storage.Exec("CREATE TABLE broken (name REFERENCES note (text))")
+	assert.ErrorContains(t, err, "not unique")
+
+	// referenced rows must exist, empty values aren't checked
+	_, err = st.Storage.Exec("INSERT INTO orders VALUES ('3', 5)")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), storage.ErrConstraintViolation.Error())
+	assert.Contains(t, err.Error(), "orders_person_id_fkey")
+	_, err = st.Storage.Exec("INSERT INTO note VALUES ('carol', 'x')")
+	assert.ErrorContains(t, err, "note_person_name_fkey")
+	_, err = st.Storage.Exec("INSERT INTO orders VALUES ('', 1)")
+	assert.Nil(t, err)
+	_, err = st.Storage.Exec("UPDATE orders SET person_id = '7' WHERE orders.quantity = 10")
+	assert.ErrorContains(t, err, "orders_person_id_fkey")
+	_, err = st.Storage.Exec("UPDATE person SET username = 'robert' WHERE person.username = 'bob'")
+	assert.ErrorContains(t, err, "note_person_name_fkey")
+
+	// cascade to orders is restricted by payment, nothing is deleted
+	_, err = st.Storage.Exec("DELETE FROM person WHERE person.username = 'alice'")
+	assert.ErrorContains(t, err, "payment_order_id_fkey")
+	output, err := st.Storage.Exec("SELECT COUNT(*) FROM person, orders, note WHERE person.person_pk = orders.person_id AND note.person_name = person.username")
+	require.Nil(t, err)
+	assert.Equal(t, "COUNT(*)\n2\n", output)
+
+	_, err = st.Storage.Exec("DELETE FROM payment")
+	require.Nil(t, err)
+	output, err = st.Storage.Exec("DELETE FROM person WHERE person.username = 'alice'")
+	require.Nil(t, err)
+	assert.Equal(t, "deleted 1 rows", output)
+
+	output, err = st.Storage.Exec("SELECT orders.person_id, orders.quantity FROM orders ORDER BY orders.quantity")
+	require.Nil(t, err)
+	assert.Equal(t, "orders.person_id,orders.quantity\n,1\n2,20\n", output)
+	output, err = st.Storage.Exec("SELECT note.person_name, note.text FROM note ORDER BY note.text")
+	require.Nil(t, err)
+	assert.Equal(t, "note.person_name,note.text\nbob,hello\n,hi\n", output)
+
+	// delete of all rows applies actions too
+	_, err = st.Storage.Exec("DELETE FROM person")
+	require.Nil(t, err)
+	output, err = st.Storage.Exec("SELECT COUNT(*) FROM orders")
+	require.Nil(t, err)
+	assert.Equal(t, "COUNT(*)\n1\n", output)
+}
@@ -0,0 +1,90 @@
+package tests
+
+import (
+	suite "JacuteSQL/tests/suite/storage"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGeneratedColumns(t *testing.T) {
+	st := suite.New(t)
+
+	session := st.Storage.NewSession()
+	_, err := session.ExecScript(`
+		CREATE TABLE deal (
+			quantity,
+			price,
+			notional GENERATED ALWAYS AS (quantity * price) STORED CHECK (notional < 1000),
+			fee GENERATED ALWAYS AS ((quantity * price) / 100 + 1) STORED
+		);
+		INSERT INTO deal VALUES (2, 10.5);
+		INSERT INTO deal (price, quantity) VALUES (3, 4);
+		INSERT INTO deal (quantity, price, notional) VALUES (1, 7, DEFAULT);
+		INSERT INTO deal (quantity) VALUES (5)`)
+	require.Nil(t, err)
+
+	_, err = st.Storage.Exec("CREATE TABLE broken (a, b GENERATED ALWAYS AS (a + b) STORED)")
+	assert.Error(t, err)
+	_, err = st.Storage.Exec("CREATE TABLE broken (a, b GENERATED ALWAYS AS (a * 2) STORED, c GENERATED ALWAYS AS (b + 1) STORED)")
+	assert.Error(t, err)
+	_, err = st.Storage.Exec("CREATE TABLE broken (a, b GENERATED ALWAYS AS (a * 2))")
+	assert.Error(t, err)
+
+	// generated columns are stored and used like normal columns
+	output, err := st.Storage.Exec("SELECT deal.quantity, deal.notional, deal.fee FROM deal WHERE deal.notional > 10 ORDER BY deal.notional DESC")
+	require.Nil(t, err)
+	assert.Equal(t, "deal.quantity,deal.notional,deal.fee\n2,21,1.21\n4,12,1.12\n", output)
+	output, err = st.Storage.Exec("SELECT deal.notional FROM deal WHERE deal.quantity = 5")
+	require.Nil(t, err)
+	assert.Equal(t, "deal.notional\n\n", output)
+
+	_, err = st.Storage.Exec("INSERT INTO deal (quantity, price, notional) VALUES (1, 2, 2)")
+	assert.ErrorContains(t, err, "generated column notional")
+	_, err = st.Storage.Exec("INSERT INTO deal VALUES (1, 2, 2, 1)")
+	assert.Error(t, err)
+	_, err = st.Storage.Exec("INSERT INTO deal VALUES ('one', 2)")
+	assert.ErrorContains(t, err, "not a number")
+	_, err = st.Storage.Exec("INSERT INTO deal VALUES (100, 20)")
+	assert.ErrorContains(t, err, "deal_notional_check")
+	_, err = st.Storage.Exec("UPDATE deal SET notional = 5")
+	assert.ErrorContains(t, err, "can't be updated")
+
+	// update recomputes generated columns
+	_, err = st.Storage.Exec("UPDATE deal SET price = 2 WHERE deal.quantity = 5")
+	require.Nil(t, err)
+	output, err = st.Storage.Exec("SELECT deal.notional, deal.fee FROM deal WHERE deal.quantity = 5")
+	require.Nil(t, err)
+	assert.Equal(t, "deal.notional,deal.fee\n10,1.1\n", output)
+}
+
+func TestGeneratedDecimals(t *testing.T) {
+	st := suite.New(t)
+
+	session := st.Storage.NewSession()
+	_, err := session.ExecScript(`
+		CREATE TABLE rate (
+			a,
+			b,
+			product GENERATED ALWAYS AS (a * b) STORED,
+			total GENERATED ALWAYS AS (a + b) STORED,
+			diff GENERATED ALWAYS AS (a - b) STORED,
+			ratio GENERATED ALWAYS AS (a / b) STORED
+		);
+		INSERT INTO rate VALUES (0.1, 0.2);
+		INSERT INTO rate VALUES (1.1, 3);
+		INSERT INTO rate VALUES (0.3, 0.1)`)
+	require.Nil(t, err)
+
+	// results are decimal, not binary fractions like 0.020000000000000004
+	output, err := st.Storage.Exec("SELECT rate.product, rate.total, rate.diff, rate.ratio FROM rate")
+	require.Nil(t, err)
+	assert.Equal(t, "rate.product,rate.total,rate.diff,rate.ratio\n"+
+		"0.02,0.3,-0.1,0.5\n"+
+		"3.3,4.1,-1.9,0.36666666666666667\n"+
+		"0.03,0.4,0.2,3\n", output)
+
+	_, err = st.Storage.Exec("INSERT INTO rate VALUES (1, 0.0)")
+	assert.ErrorContains(t, err, "division by zero")
+}
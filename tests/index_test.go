@@ -0,0 +1,161 @@
+package tests
+
+import (
+	"JacuteSQL/internal/config"
+	"JacuteSQL/internal/storage"
+	suite "JacuteSQL/tests/suite/storage"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/jacute/prettylogger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIndex(t *testing.T) {
+	st := suite.New(t)
+
+	for i := 0; i < 45; i++ {
+		_, err := st.Storage.Exec(fmt.Sprintf("INSERT INTO cars VALUES ('model%d', 'maker%d', 'type', '%d.5')", i, i%3, i))
+		require.Nil(t, err)
+	}
+	_, err := st.Storage.Exec("CREATE INDEX cars_maker_idx ON cars USING hash (maker)")
+	require.Nil(t, err)
+	_, err = st.Storage.Exec("CREATE INDEX ON cars (fueltype)")
+	require.Nil(t, err)
+	_, err = st.Storage.Exec("CREATE INDEX ON cars (fueltype)")
+	assert.ErrorContains(t, err, "already exists")
+	_, err = st.Storage.Exec("CREATE INDEX IF NOT EXISTS ON cars (fueltype)")
+	assert.Nil(t, err)
+	_, err = st.Storage.Exec("CREATE INDEX ON cars USING tree (model)")
+	assert.ErrorContains(t, err, "unknown index type")
+	output, err := st.Storage.Exec("SHOW INDEXES")
+	require.Nil(t, err)
+	assert.Equal(t, "index,table,columns,type,unique\ncars_fueltype_idx,cars,fueltype,ordered,false\ncars_maker_idx,cars,maker,hash,false\n", output)
+
+	// only the sheet with found rows is read
+	output, err = st.Storage.Exec("EXPLAIN ANALYZE SELECT cars.model FROM cars WHERE cars.fueltype >= 40 AND cars.fueltype < 42")
+	require.Nil(t, err)
+	assert.Contains(t, output, "Index Scan on cars using cars_fueltype_idx (cars.fueltype >= 40 AND cars.fueltype < 42) (1 sheets) (rows=2 sheets=1")
+	output, err = st.Storage.Exec("SELECT cars.model FROM cars WHERE cars.fueltype >= 40 AND cars.fueltype < 42")
+	require.Nil(t, err)
+	assert.Equal(t, "cars.model\nmodel40\nmodel41\n", output)
+	output, err = st.Storage.Exec("SELECT cars.model FROM cars WHERE cars.maker = 'maker1' AND cars.model = 'model4'")
+	require.Nil(t, err)
+	assert.Equal(t, "cars.model\nmodel4\n", output)
+	output, err = st.Storage.Exec("EXPLAIN SELECT cars.model FROM cars WHERE cars.maker = 'maker1' OR cars.model = 'model4'")
+	require.Nil(t, err)
+	assert.Contains(t, output, "-> Scan on cars (3 sheets)")
+
+	// indexes follow changed rows
+	_, err = st.Storage.Exec("UPDATE cars SET fueltype = '100' WHERE cars.model = 'model0'")
+	require.Nil(t, err)
+	_, err = st.Storage.Exec("DELETE FROM cars WHERE cars.fueltype < 2")
+	require.Nil(t, err)
+	output, err = st.Storage.Exec("SELECT cars.model FROM cars WHERE cars.fueltype > 99 OR cars.fueltype < 3")
+	require.Nil(t, err)
+	assert.Equal(t, "cars.model\nmodel0\nmodel2\n", output)
+	output, err = st.Storage.Exec("SELECT cars.model FROM cars WHERE cars.fueltype > 99")
+	require.Nil(t, err)
+	assert.Equal(t, "cars.model\nmodel0\n", output)
+	output, err = st.Storage.Exec("SELECT cars.model FROM cars WHERE cars.fueltype < 3")
+	require.Nil(t, err)
+	assert.Equal(t, "cars.model\nmodel2\n", output)
+
+	_, err = st.Storage.Exec("CREATE UNIQUE INDEX cars_maker_key ON cars (maker)")
+	assert.ErrorContains(t, err, storage.ErrConstraintViolation.Error())
+	_, err = st.Storage.Exec("CREATE UNIQUE INDEX cars_model_key ON cars (model)")
+	require.Nil(t, err)
+	_, err = st.Storage.Exec("INSERT INTO cars VALUES ('model5', 'maker', 'type', 'fuel')")
+	assert.ErrorContains(t, err, "cars_model_key")
+	_, err = st.Storage.Exec("UPDATE cars SET model = 'model6' WHERE cars.model = 'model5'")
+	assert.ErrorContains(t, err, "cars_model_key")
+	_, err = st.Storage.Exec("UPDATE cars SET model = 'model5' WHERE cars.model = 'model5'")
+	assert.Nil(t, err)
+
+	// indexes are kept after restart and rebuilt after conversion
+	databasePath := path.Join(st.Cfg.StoragePath, st.Cfg.LoadedSchema.Name)
+	assert.FileExists(t, path.Join(databasePath, "indexes.json"))
+	assert.FileExists(t, path.Join(databasePath, "indexes", "cars_fueltype_idx.json"))
+	cfg := config.MustLoadByPath("test_config.yaml")
+	restarted := storage.New(cfg.StoragePath, cfg.LoadedSchema, slog.New(prettylogger.NewDiscardHandler()))
+	restarted.Create()
+	output, err = restarted.Exec("EXPLAIN SELECT cars.model FROM cars WHERE cars.maker = 'maker2'")
+	require.Nil(t, err)
+	assert.Contains(t, output, "Index Scan on cars using cars_maker_idx (cars.maker = 'maker2')")
+	_, err = restarted.Exec("ALTER TABLE cars SET ENGINE = binary")
+	require.Nil(t, err)
+	output, err = restarted.Exec("SELECT cars.model FROM cars WHERE cars.fueltype > 43")
+	require.Nil(t, err)
+	assert.Equal(t, "cars.model\nmodel0\nmodel43\nmodel44\n", output)
+
+	_, err = restarted.Exec("DROP INDEX cars_fueltype_idx")
+	require.Nil(t, err)
+	assert.NoFileExists(t, path.Join(databasePath, "indexes", "cars_fueltype_idx.json"))
+	output, err = restarted.Exec("EXPLAIN SELECT cars.model FROM cars WHERE cars.fueltype > 43")
+	require.Nil(t, err)
+	assert.Contains(t, output, "-> Scan on cars")
+	_, err = restarted.Exec("DROP INDEX cars_fueltype_idx")
+	assert.ErrorContains(t, err, storage.ErrIndexNotFound.Error())
+	_, err = restarted.Exec("DROP INDEX IF EXISTS cars_fueltype_idx")
+	assert.Nil(t, err)
+}
+
+func TestPkLookup(t *testing.T) {
+	st := suite.New(t)
+
+	for i := 1; i <= 45; i++ {
+		_, err := st.Storage.Exec(fmt.Sprintf("INSERT INTO cars VALUES ('model%d', 'maker', 'type', 'fuel')", i))
+		require.Nil(t, err)
+	}
+
+	output, err := st.Storage.Exec("EXPLAIN ANALYZE SELECT cars.model FROM cars WHERE cars.cars_pk = 42")
+	require.Nil(t, err)
+	assert.Contains(t, output, "Index Scan on cars using cars_pk (cars.cars_pk = 42) (1 sheets) (rows=5 sheets=1")
+	assert.Contains(t, output, "-> Filter (cars.cars_pk = 42) (rows=1")
+	output, err = st.Storage.Exec("EXPLAIN ANALYZE SELECT cars.model FROM cars WHERE cars.cars_pk >= 15 AND cars.cars_pk <= 25")
+	require.Nil(t, err)
+	assert.Contains(t, output, "(2 sheets) (rows=40 sheets=2")
+	output, err = st.Storage.Exec("SELECT cars.model FROM cars WHERE cars.cars_pk > 19 AND cars.cars_pk < 22")
+	require.Nil(t, err)
+	assert.Equal(t, "cars.model\nmodel20\nmodel21\n", output)
+
+	// UPDATE and DELETE by pk rewrite only sheets with the pk
+	tablePath := path.Join(st.Cfg.StoragePath, st.Cfg.LoadedSchema.Name, "cars")
+	first, err := os.Stat(path.Join(tablePath, "1.csv"))
+	require.Nil(t, err)
+	_, err = st.Storage.Exec("UPDATE cars SET model = 'updated' WHERE cars.cars_pk = 30")
+	require.Nil(t, err)
+	_, err = st.Storage.Exec("DELETE FROM cars WHERE cars.cars_pk > 43")
+	require.Nil(t, err)
+	unchanged, err := os.Stat(path.Join(tablePath, "1.csv"))
+	require.Nil(t, err)
+	assert.Equal(t, first.ModTime(), unchanged.ModTime())
+
+	output, err = st.Storage.Exec("SELECT cars.cars_pk, cars.model FROM cars WHERE cars.cars_pk = 30 OR cars.cars_pk > 42")
+	require.Nil(t, err)
+	assert.Equal(t, "cars.cars_pk,cars.model\n30,updated\n43,model43\n", output)
+}
+
+func TestIndexReservedNames(t *testing.T) {
+	st := suite.New(t)
+
+	// files of tables and views can't share directories with files of the storage
+	_, err := st.Storage.Exec("CREATE TABLE indexes (name)")
+	assert.EqualError(t, err, "error: name indexes is reserved by the storage")
+	_, err = st.Storage.Exec("CREATE VIEW indexes AS SELECT cars.model FROM cars")
+	assert.EqualError(t, err, "error: name indexes is reserved by the storage")
+	_, err = st.Storage.Exec("CREATE MATERIALIZED VIEW indexes AS SELECT cars.model FROM cars")
+	assert.EqualError(t, err, "error: name indexes is reserved by the storage")
+
+	// repair doesn't move files of indexes
+	_, err = st.Storage.Exec("CREATE INDEX cars_model_idx ON cars (model)")
+	require.Nil(t, err)
+	problems, err := st.Storage.Inspect(true)
+	require.Nil(t, err)
+	assert.Empty(t, problems)
+	assert.FileExists(t, path.Join(st.Cfg.StoragePath, st.Cfg.LoadedSchema.Name, "indexes", "cars_model_idx.json"))
+}
@@ -0,0 +1,109 @@
+package tests
+
+import (
+	"JacuteSQL/internal/config"
+	"JacuteSQL/internal/storage"
+	suite "JacuteSQL/tests/suite/storage"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/jacute/prettylogger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIntegrity(t *testing.T) {
+	st := suite.New(t)
+
+	for i := 1; i <= 25; i++ {
+		_, err := st.Storage.Exec(fmt.Sprintf("INSERT INTO cars VALUES ('model%d', 'maker', 'type', 'fuel')", i))
+		require.Nil(t, err)
+	}
+	output, err := st.Storage.Exec("CHECK TABLE cars")
+	require.Nil(t, err)
+	assert.Equal(t, "sheet,rows,status\n1.csv,20,ok\n2.csv,5,ok\n", output)
+
+	// checksums of the catalog are kept after restart
+	cfg := config.MustLoadByPath("test_config.yaml")
+	restarted := storage.New(cfg.StoragePath, cfg.LoadedSchema, slog.New(prettylogger.NewDiscardHandler()))
+	restarted.Create()
+
+	// the sheet edited by hand is reported by name and the table becomes read-only
+	sheetPath := path.Join(st.Cfg.StoragePath, st.Cfg.LoadedSchema.Name, "cars", "2.csv")
+	original, err := os.ReadFile(sheetPath)
+	require.Nil(t, err)
+	edited := strings.Replace(string(original), "model22", "model99", 1)
+	require.Nil(t, os.WriteFile(sheetPath, []byte(edited), 0644))
+
+	_, err = restarted.Exec("SELECT cars.model FROM cars")
+	assert.ErrorContains(t, err, "damaged sheet")
+	assert.ErrorContains(t, err, "2.csv")
+	_, err = restarted.Exec("INSERT INTO cars VALUES ('model26', 'maker', 'type', 'fuel')")
+	assert.ErrorContains(t, err, "table is read-only")
+	_, err = restarted.Exec("DELETE FROM cars WHERE cars.cars_pk = 1")
+	assert.ErrorContains(t, err, "table is read-only")
+	// other tables are writable
+	_, err = restarted.Exec("INSERT INTO beer VALUES ('Duvel', 'Ale', '8.5', '32', '17')")
+	require.Nil(t, err)
+
+	output, err = restarted.Exec("CHECK TABLE cars")
+	require.Nil(t, err)
+	lines := strings.Split(output, "\n")
+	assert.Equal(t, "1.csv,20,ok", lines[1])
+	assert.True(t, strings.HasPrefix(lines[2], "2.csv,5,damaged sheet 2.csv of table cars: checksum is"), lines[2])
+
+	// CHECK TABLE lifts the quarantine after the sheet is restored
+	require.Nil(t, os.WriteFile(sheetPath, original, 0644))
+	output, err = restarted.Exec("CHECK TABLE cars")
+	require.Nil(t, err)
+	assert.Equal(t, "sheet,rows,status\n1.csv,20,ok\n2.csv,5,ok\n", output)
+	_, err = restarted.Exec("INSERT INTO cars VALUES ('model26', 'maker', 'type', 'fuel')")
+	require.Nil(t, err)
+	output, err = restarted.Exec("SELECT cars.model FROM cars WHERE cars.cars_pk > 24")
+	require.Nil(t, err)
+	assert.Equal(t, "cars.model\nmodel25\nmodel26\n", output)
+
+	_, err = restarted.Exec("CHECK TABLE unknown")
+	assert.ErrorContains(t, err, "table unknown not found")
+}
+
+func TestIntegrityBinary(t *testing.T) {
+	st := suite.New(t)
+
+	for i := 1; i <= 5; i++ {
+		_, err := st.Storage.Exec(fmt.Sprintf("INSERT INTO cars VALUES ('model%d', 'maker', 'type', 'fuel')", i))
+		require.Nil(t, err)
+	}
+	_, err := st.Storage.Exec("ALTER TABLE cars SET ENGINE = binary")
+	require.Nil(t, err)
+	output, err := st.Storage.Exec("CHECK TABLE cars")
+	require.Nil(t, err)
+	assert.Equal(t, "sheet,rows,status\n1,5,ok\n", output)
+
+	// a flipped byte of the page fails the checksum in its header
+	filePath := path.Join(st.Cfg.StoragePath, st.Cfg.LoadedSchema.Name, "cars", "pages.bin")
+	data, err := os.ReadFile(filePath)
+	require.Nil(t, err)
+	data[2*4096-1] ^= 0xff
+	require.Nil(t, os.WriteFile(filePath, data, 0644))
+
+	_, err = st.Storage.Exec("SELECT cars.model FROM cars")
+	assert.ErrorContains(t, err, "damaged page 1 of table cars")
+	_, err = st.Storage.Exec("INSERT INTO cars VALUES ('model6', 'maker', 'type', 'fuel')")
+	assert.ErrorContains(t, err, "table is read-only")
+	output, err = st.Storage.Exec("CHECK TABLE cars")
+	require.Nil(t, err)
+	assert.True(t, strings.HasPrefix(output, "sheet,rows,status\n1,0,damaged page 1 of table cars"), output)
+
+	data[2*4096-1] ^= 0xff
+	require.Nil(t, os.WriteFile(filePath, data, 0644))
+	output, err = st.Storage.Exec("CHECK TABLE cars")
+	require.Nil(t, err)
+	assert.Equal(t, "sheet,rows,status\n1,5,ok\n", output)
+	_, err = st.Storage.Exec("UPDATE cars SET model = 'new' WHERE cars.cars_pk = 1")
+	require.Nil(t, err)
+}
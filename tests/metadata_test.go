@@ -0,0 +1,79 @@
+package tests
+
+import (
+	"JacuteSQL/internal/storage"
+	suite "JacuteSQL/tests/suite/storage"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTableMetadata(t *testing.T) {
+	st := suite.New(t)
+
+	tablePath := st.Storage.TablePathes.Get("cars").(string)
+	readMeta := func() storage.TableMeta {
+		data, err := os.ReadFile(path.Join(tablePath, "cars_meta.json"))
+		require.Nil(t, err)
+		var meta storage.TableMeta
+		require.Nil(t, json.Unmarshal(data, &meta))
+		return meta
+	}
+	// checksum of the sheet file as it's kept in the catalog
+	checksum := func(sheet string) string {
+		data, err := os.ReadFile(path.Join(tablePath, sheet))
+		require.Nil(t, err)
+		return fmt.Sprintf("%08x", crc32.ChecksumIEEE(data))
+	}
+
+	for i := 1; i <= 45; i++ {
+		_, err := st.Storage.Exec(fmt.Sprintf("INSERT INTO cars VALUES ('model%d', 'maker', 'type', 'fuel')", i))
+		require.Nil(t, err)
+	}
+	meta := readMeta()
+	assert.Equal(t, []storage.SheetMeta{
+		{Name: "1.csv", Rows: 20, Pks: &storage.PkRange{Min: 1, Max: 20}, Checksum: checksum("1.csv")},
+		{Name: "2.csv", Rows: 20, Pks: &storage.PkRange{Min: 21, Max: 40}, Checksum: checksum("2.csv")},
+		{Name: "3.csv", Rows: 5, Pks: &storage.PkRange{Min: 41, Max: 45}, Checksum: checksum("3.csv")},
+	}, meta.Sheets)
+	assert.Equal(t, 2, meta.FreeSheet)
+	assert.Equal(t, int64(46), meta.NextPk)
+	// the pk sequence file is replaced through a temporary file
+	data, err := os.ReadFile(path.Join(tablePath, "cars_pk_sequence"))
+	require.Nil(t, err)
+	assert.Equal(t, "46", string(data))
+	assert.NoFileExists(t, path.Join(tablePath, "cars_pk_sequence.tmp"))
+
+	// free space in the first sheet is used by the next insert
+	_, err = st.Storage.Exec("DELETE FROM cars WHERE cars.model = 'model3'")
+	require.Nil(t, err)
+	meta = readMeta()
+	assert.Equal(t, 19, meta.Sheets[0].Rows)
+	assert.Equal(t, 0, meta.FreeSheet)
+	_, err = st.Storage.Exec("INSERT INTO cars VALUES ('model46', 'maker', 'type', 'fuel')")
+	require.Nil(t, err)
+	meta = readMeta()
+	assert.Equal(t, 20, meta.Sheets[0].Rows)
+	assert.Equal(t, &storage.PkRange{Min: 1, Max: 46}, meta.Sheets[0].Pks)
+	assert.Equal(t, 2, meta.FreeSheet)
+	assert.Equal(t, checksum("1.csv"), meta.Sheets[0].Checksum)
+
+	output, err := st.Storage.Exec("SELECT cars.model FROM cars WHERE cars.cars_pk = '46'")
+	require.Nil(t, err)
+	assert.Equal(t, "cars.model\nmodel46\n", output)
+
+	// DELETE without condition resets the catalog
+	_, err = st.Storage.Exec("DELETE FROM cars")
+	require.Nil(t, err)
+	_, err = st.Storage.Exec("INSERT INTO cars VALUES ('model1', 'maker', 'type', 'fuel')")
+	require.Nil(t, err)
+	meta = readMeta()
+	assert.Equal(t, []storage.SheetMeta{{Name: "1.csv", Rows: 1, Pks: &storage.PkRange{Min: 1, Max: 1}, Checksum: checksum("1.csv")}}, meta.Sheets)
+	assert.Equal(t, int64(2), meta.NextPk)
+}
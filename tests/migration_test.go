@@ -0,0 +1,215 @@
+package tests
+
+import (
+	"JacuteSQL/internal/config"
+	"JacuteSQL/internal/lib/utils"
+	"JacuteSQL/internal/storage"
+	suite "JacuteSQL/tests/suite/storage"
+	"log/slog"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/jacute/prettylogger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeMigrations writes scripts to a new migrations directory
+func writeMigrations(t *testing.T, scripts map[string]string) string {
+	dir := t.TempDir()
+	for name, script := range scripts {
+		require.Nil(t, os.WriteFile(path.Join(dir, name), []byte(script), 0644))
+	}
+	return dir
+}
+
+// restartWithMigrations opens the storage of the test again with the migrations directory
+func restartWithMigrations(dir string, auto bool) *storage.Storage {
+	cfg := config.MustLoadByPath("test_config.yaml")
+	cfg.LoadedSchema.Migrations.Path = dir
+	cfg.LoadedSchema.Migrations.Auto = auto
+	restarted := storage.New(cfg.StoragePath, cfg.LoadedSchema, slog.New(prettylogger.NewDiscardHandler()))
+	restarted.Create()
+	return restarted
+}
+
+func TestMigration(t *testing.T) {
+	st := suite.New(t)
+	dir := writeMigrations(t, map[string]string{
+		"1_create_orders.up.sql":   "-- orders of cars\nCREATE TABLE orders (item, quantity);\nINSERT INTO orders VALUES ('tea', '2');\n",
+		"1_create_orders.down.sql": "DROP TABLE orders;\n",
+		"2_add_car.up.sql":         "INSERT INTO cars VALUES ('migrated', 'maker', 'type', 'fuel');",
+		"2_add_car.down.sql":       "DELETE FROM cars WHERE cars.model = 'migrated';",
+		"notes.txt":                "not a migration",
+	})
+	st.Storage.Schema.Migrations.Path = dir
+
+	output, err := st.Storage.Migrate(storage.MigrationUp, 1)
+	require.Nil(t, err)
+	assert.Equal(t, "version,name,direction\n1,create_orders,up\n", output)
+	output, err = st.Storage.Migrate(storage.MigrationUp, 2)
+	require.Nil(t, err)
+	assert.Equal(t, "version,name,direction\n2,add_car,up\n", output)
+
+	// applied migrations are skipped
+	output, err = st.Storage.Migrate(storage.MigrationUp, 2)
+	require.Nil(t, err)
+	assert.Equal(t, "version,name,direction\n", output)
+
+	restarted := restartWithMigrations(dir, false)
+	migrations, err := restarted.LoadMigrations()
+	require.Nil(t, err)
+	require.Len(t, migrations, 2)
+	assert.True(t, migrations[0].Applied)
+	assert.True(t, migrations[1].Applied)
+	output, err = restarted.Exec("SELECT schema_migrations.version, schema_migrations.name FROM schema_migrations")
+	require.Nil(t, err)
+	assert.Equal(t, "schema_migrations.version,schema_migrations.name\n1,create_orders\n2,add_car\n", output)
+	output, err = restarted.Exec("SELECT orders.item, orders.quantity FROM orders")
+	require.Nil(t, err)
+	assert.Equal(t, "orders.item,orders.quantity\ntea,2\n", output)
+
+	output, err = restarted.Migrate(storage.MigrationDown, 0)
+	require.Nil(t, err)
+	assert.Equal(t, "version,name,direction\n2,add_car,down\n1,create_orders,down\n", output)
+	_, err = restarted.Exec("SELECT orders.item FROM orders")
+	assert.NotNil(t, err)
+	output, err = restarted.Exec("SELECT cars.model FROM cars")
+	require.Nil(t, err)
+	assert.Equal(t, "cars.model\n", output)
+	output, err = restarted.Exec("SELECT schema_migrations.version FROM schema_migrations")
+	require.Nil(t, err)
+	assert.Equal(t, "schema_migrations.version\n", output)
+	assert.NoDirExists(t, path.Join(st.Cfg.StoragePath, st.Cfg.LoadedSchema.Name, "orders"))
+}
+
+func TestMigrationFailed(t *testing.T) {
+	st := suite.New(t)
+	dir := writeMigrations(t, map[string]string{
+		"1_add_car.up.sql":    "INSERT INTO cars VALUES ('first', 'maker', 'type', 'fuel');",
+		"2_add_cars.up.sql":   "INSERT INTO cars VALUES ('second', 'maker', 'type', 'fuel');\nINSERT INTO trucks VALUES ('third');",
+		"2_add_cars.down.sql": "DELETE FROM cars WHERE cars.model = 'second';",
+	})
+	st.Storage.Schema.Migrations.Path = dir
+
+	_, err := st.Storage.Migrate(storage.MigrationUp, 2)
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "migration 2_add_cars up failed")
+	assert.NoDirExists(t, path.Join(st.Cfg.StoragePath, st.Cfg.LoadedSchema.Name+".migration"))
+
+	// the storage doesn't match the restored files and must be opened again
+	_, err = st.Storage.Exec("SELECT cars.model FROM cars")
+	assert.EqualError(t, err, "error: "+storage.ErrStorageClosed.Error())
+	_, err = st.Storage.NewSession().Exec("INSERT INTO cars VALUES ('lost', 'maker', 'type', 'fuel')")
+	assert.EqualError(t, err, "error: "+storage.ErrStorageClosed.Error())
+	_, err = st.Storage.Migrate(storage.MigrationUp, 1)
+	assert.ErrorIs(t, err, storage.ErrStorageClosed)
+
+	// migrations of one command are rolled back together
+	restarted := restartWithMigrations(dir, false)
+	output, err := restarted.Exec("SELECT cars.model FROM cars")
+	require.Nil(t, err)
+	assert.Equal(t, "cars.model\n", output)
+	migrations, err := restarted.LoadMigrations()
+	require.Nil(t, err)
+	require.Len(t, migrations, 2)
+	assert.False(t, migrations[0].Applied)
+	assert.False(t, migrations[1].Applied)
+
+	output, err = restarted.Migrate(storage.MigrationUp, 1)
+	require.Nil(t, err)
+	assert.Equal(t, "version,name,direction\n1,add_car,up\n", output)
+	// the first migration has no down script
+	_, err = restarted.Migrate(storage.MigrationDown, 0)
+	assert.EqualError(t, err, "migration 1_add_car has no down script")
+}
+
+func TestMigrationExclusive(t *testing.T) {
+	st := suite.New(t)
+	dir := writeMigrations(t, map[string]string{
+		"1_add_cars.up.sql": strings.Repeat("INSERT INTO cars VALUES ('migrated', 'maker', 'type', 'fuel');\n", 30),
+	})
+	st.Storage.Schema.Migrations.Path = dir
+
+	// the command started during the migration sees all its rows
+	migrated := make(chan error)
+	go func() {
+		_, err := st.Storage.Migrate(storage.MigrationUp, 1)
+		migrated <- err
+	}()
+	var output string
+	var err error
+	for output == "" || output == "cars.model\n" {
+		output, err = st.Storage.Exec("SELECT cars.model FROM cars")
+		require.Nil(t, err)
+	}
+	assert.Equal(t, "cars.model\n"+strings.Repeat("migrated\n", 30), output)
+	require.Nil(t, <-migrated)
+}
+
+func TestMigrationOnStartup(t *testing.T) {
+	st := suite.New(t)
+	dir := writeMigrations(t, map[string]string{
+		"1_add_car.up.sql": "INSERT INTO cars VALUES ('migrated', 'maker', 'type', 'fuel');",
+	})
+
+	restarted := restartWithMigrations(dir, true)
+	output, err := restarted.Exec("SELECT cars.model FROM cars")
+	require.Nil(t, err)
+	assert.Equal(t, "cars.model\nmigrated\n", output)
+
+	// a migration interrupted by a crash is rolled back at startup
+	databasePath := path.Join(st.Cfg.StoragePath, st.Cfg.LoadedSchema.Name)
+	require.Nil(t, utils.CopyDir(databasePath, databasePath+".migration"))
+	_, err = restarted.Exec("INSERT INTO cars VALUES ('interrupted', 'maker', 'type', 'fuel')")
+	require.Nil(t, err)
+
+	restarted = restartWithMigrations(dir, true)
+	output, err = restarted.Exec("SELECT cars.model FROM cars")
+	require.Nil(t, err)
+	assert.Equal(t, "cars.model\nmigrated\n", output)
+	assert.NoDirExists(t, databasePath+".migration")
+
+	assert.Panics(t, func() {
+		restartWithMigrations(path.Join(dir, "missing"), true)
+	})
+}
+
+func TestDropTable(t *testing.T) {
+	st := suite.New(t)
+
+	_, err := st.Storage.Exec("CREATE TABLE orders (item UNIQUE, quantity)")
+	require.Nil(t, err)
+	_, err = st.Storage.Exec("CREATE TABLE lines (order_item REFERENCES orders (item), price)")
+	require.Nil(t, err)
+	_, err = st.Storage.Exec("CREATE INDEX lines_price ON lines (price)")
+	require.Nil(t, err)
+
+	_, err = st.Storage.Exec("DROP TABLE cars")
+	assert.EqualError(t, err, "error: table cars is declared in schema.json and can't be dropped")
+	_, err = st.Storage.Exec("DROP TABLE orders")
+	assert.NotNil(t, err)
+	_, err = st.Storage.Exec("DROP TABLE missing")
+	assert.EqualError(t, err, "error: table missing not found")
+	_, err = st.Storage.Exec("DROP TABLE IF EXISTS missing")
+	assert.Nil(t, err)
+
+	_, err = st.Storage.Exec("DROP TABLE lines")
+	require.Nil(t, err)
+	_, err = st.Storage.Exec("DROP TABLE orders;")
+	require.Nil(t, err)
+	_, err = st.Storage.Exec("SELECT orders.item FROM orders")
+	assert.NotNil(t, err)
+
+	// the table is dropped after restart and can be created again
+	restarted := restartWithMigrations("", false)
+	_, err = restarted.Exec("SELECT lines.price FROM lines")
+	assert.NotNil(t, err)
+	_, err = restarted.Exec("CREATE TABLE orders (item, quantity)")
+	require.Nil(t, err)
+	output, err := restarted.Exec("SELECT orders.item FROM orders")
+	require.Nil(t, err)
+	assert.Equal(t, "orders.item\n", output)
+}
@@ -0,0 +1,77 @@
+package tests
+
+import (
+	"JacuteSQL/internal/config"
+	"JacuteSQL/internal/logger"
+	"JacuteSQL/internal/storage"
+	suite "JacuteSQL/tests/suite/storage"
+	"log/slog"
+	"testing"
+
+	"github.com/jacute/prettylogger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSequences(t *testing.T) {
+	st := suite.New(t)
+
+	session := st.Storage.NewSession()
+	_, err := session.ExecScript(`
+		CREATE SEQUENCE ticket_seq START WITH 100 INCREMENT BY 10;
+		CREATE TABLE ticket (number DEFAULT nextval('ticket_seq'), title);
+		INSERT INTO ticket (title) VALUES ('first');
+		INSERT INTO ticket VALUES (nextval('ticket_seq'), 'second');
+		INSERT INTO ticket (number, title) VALUES (currval('ticket_seq'), 'same')`)
+	require.Nil(t, err)
+
+	output, err := st.Storage.Exec("SELECT ticket.number, ticket.title FROM ticket ORDER BY ticket.ticket_pk")
+	require.Nil(t, err)
+	assert.Equal(t, "ticket.number,ticket.title\n100,first\n110,second\n110,same\n", output)
+
+	output, err = st.Storage.Exec("SELECT setval('ticket_seq', 500)")
+	require.Nil(t, err)
+	assert.Equal(t, "setval\n500\n", output)
+	output, err = st.Storage.Exec("SELECT nextval('ticket_seq')")
+	require.Nil(t, err)
+	assert.Equal(t, "nextval\n510\n", output)
+
+	_, err = st.Storage.Exec("CREATE SEQUENCE ticket_seq")
+	assert.ErrorContains(t, err, storage.ErrSequenceExists.Error())
+	_, err = st.Storage.Exec("CREATE SEQUENCE IF NOT EXISTS ticket_seq")
+	assert.Nil(t, err)
+	_, err = st.Storage.Exec("CREATE SEQUENCE empty_seq")
+	require.Nil(t, err)
+	_, err = st.Storage.Exec("SELECT currval('empty_seq')")
+	assert.ErrorContains(t, err, "not yet defined")
+	_, err = st.Storage.Exec("SELECT nextval('missing_seq')")
+	assert.ErrorContains(t, err, storage.ErrSequenceNotFound.Error())
+
+	// pk sequence of the table after import with explicit ids
+	output, err = st.Storage.Exec("SELECT currval('ticket_pk_sequence')")
+	require.Nil(t, err)
+	assert.Equal(t, "currval\n3\n", output)
+	_, err = st.Storage.Exec("SELECT setval('ticket_pk_sequence', 1000)")
+	require.Nil(t, err)
+	output, err = st.Storage.Exec("INSERT INTO ticket (title) VALUES ('after import')")
+	require.Nil(t, err)
+	assert.Equal(t, "1001", output)
+
+	// sequences are restored after restart
+	cfg := config.MustLoadByPath("test_config.yaml")
+	discardLogger := &logger.Logger{
+		Log: slog.New(prettylogger.NewDiscardHandler()),
+	}
+	restarted := storage.New(cfg.StoragePath, cfg.LoadedSchema, discardLogger.Log)
+	restarted.Create()
+	output, err = restarted.Exec("SELECT nextval('ticket_seq')")
+	require.Nil(t, err)
+	assert.Equal(t, "nextval\n530\n", output)
+
+	_, err = restarted.Exec("DROP SEQUENCE ticket_seq")
+	require.Nil(t, err)
+	_, err = restarted.Exec("INSERT INTO ticket (title) VALUES ('no sequence')")
+	assert.ErrorContains(t, err, storage.ErrSequenceNotFound.Error())
+	_, err = restarted.Exec("DROP SEQUENCE IF EXISTS ticket_seq")
+	assert.Nil(t, err)
+}
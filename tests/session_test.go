@@ -0,0 +1,151 @@
+package tests
+
+import (
+	suite "JacuteSQL/tests/suite/storage"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPreparedStatements(t *testing.T) {
+	st := suite.New(t)
+	session := st.Storage.NewSession()
+
+	_, err := session.Exec("PREPARE add_beer (text, text, float, int, text) AS INSERT INTO beer VALUES ($1, $2, $3, $4, $5)")
+	require.Nil(t, err)
+	// output rows are separated by ',', so values with ',' are rejected
+	_, err = session.Exec("EXECUTE add_beer('O''Hara''s', 'Stout, Irish', 4.3, '30', '11')")
+	assert.EqualError(t, err, "error: Values can't contain ',' symbol")
+	id, err := session.Exec("EXECUTE add_beer('O''Hara''s', 'Irish Stout', 4.3, '30', '11')")
+	require.Nil(t, err)
+	assert.Equal(t, "1", id)
+	_, err = session.Exec("EXECUTE add_beer('Duvel', 'Ale', 8.5, 32, '17')")
+	require.Nil(t, err)
+	_, err = session.Exec("UPDATE beer SET style = 'Ale, Belgian' WHERE beer.name = 'Duvel'")
+	assert.EqualError(t, err, "error: Values can't contain ',' symbol")
+
+	_, err = session.Exec("PREPARE by_name AS SELECT beer.name, beer.style, beer.alcohol FROM beer WHERE beer.name = ?")
+	require.Nil(t, err)
+	output, err := session.Exec("EXECUTE by_name('O''Hara''s')")
+	require.Nil(t, err)
+	assert.Equal(t, "beer.name,beer.style,beer.alcohol\nO'Hara's,Irish Stout,4.3\n", output)
+
+	// value is compared as is and isn't parsed as a part of the condition
+	output, err = session.Exec("EXECUTE by_name('x'' OR beer.beer_pk = ''2')")
+	require.Nil(t, err)
+	assert.Equal(t, "beer.name,beer.style,beer.alcohol\n", output)
+
+	_, err = session.Exec("EXECUTE add_beer('Leffe', 'Ale', 'strong', 20, '15')")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "parameter $3")
+	_, err = session.Exec("EXECUTE by_name('a', 'b')")
+	assert.Error(t, err)
+	_, err = session.Exec("PREPARE by_name AS SELECT beer.name FROM beer")
+	assert.Error(t, err)
+
+	// prepared statements are stored only in the session
+	_, err = st.Storage.NewSession().Exec("EXECUTE by_name('Duvel')")
+	assert.Error(t, err)
+	_, err = st.Storage.Exec("SELECT beer.name FROM beer WHERE beer.name = $1")
+	assert.Error(t, err)
+
+	_, err = session.Exec("DEALLOCATE by_name")
+	require.Nil(t, err)
+	_, err = session.Exec("EXECUTE by_name('Duvel')")
+	assert.Error(t, err)
+
+	_, err = session.Exec("PREPARE delete_beer (int) AS DELETE FROM beer WHERE beer.beer_pk = $1")
+	require.Nil(t, err)
+	output, err = session.Exec("EXECUTE delete_beer(2)")
+	require.Nil(t, err)
+	assert.Equal(t, "deleted 1 rows", output)
+	_, err = session.Exec("PREPARE set_style AS UPDATE beer SET style = $1 WHERE beer.beer_pk = $2")
+	require.Nil(t, err)
+	_, err = session.Exec("PREPARE drop_beer AS DROP TABLE beer")
+	assert.ErrorContains(t, err, "only SELECT, INSERT, UPDATE, DELETE and EXPLAIN can be prepared")
+	_, err = session.Exec("DEALLOCATE ALL")
+	require.Nil(t, err)
+}
+
+func TestExecScript(t *testing.T) {
+	st := suite.New(t)
+	session := st.Storage.NewSession()
+
+	outputs, err := session.ExecScript(`
+		INSERT INTO beer VALUES ('Duvel', 'Ale; Belgian', '8.5', '32', '17');
+		INSERT INTO beer VALUES ('Leffe', 'Ale', '6.6', '20', '15');
+		SELECT beer.name FROM beer WHERE beer.style = 'Ale; Belgian';
+	`)
+	require.Nil(t, err)
+	assert.Equal(t, []string{"1", "2", "beer.name\nDuvel\n"}, outputs)
+
+	// execution stops at the first error
+	outputs, err = session.ExecScript("INSERT INTO cars VALUES ('Golf', 'Volkswagen', 'hatchback', 'petrol'); SELECT beer.color FROM beer; INSERT INTO cars VALUES ('Polo', 'Volkswagen', 'hatchback', 'petrol')")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "statement 2 failed (SELECT beer.color FROM beer)")
+	assert.Equal(t, []string{"1"}, outputs)
+
+	output, err := session.Exec("SELECT cars.model FROM cars")
+	require.Nil(t, err)
+	assert.Equal(t, "cars.model\nGolf\n", output)
+}
+
+// limitedWriter fails after limit writes, writes are counted to check that rows are streamed
+type limitedWriter struct {
+	data   strings.Builder
+	writes int
+	limit  int
+}
+
+func (w *limitedWriter) Write(p []byte) (int, error) {
+	w.writes++
+	if w.limit > 0 && w.writes > w.limit {
+		return 0, errors.New("connection closed")
+	}
+	return w.data.Write(p)
+}
+
+func (w *limitedWriter) String() string {
+	return w.data.String()
+}
+
+func TestExecTo(t *testing.T) {
+	st := suite.New(t)
+	session := st.Storage.NewSession()
+
+	for i := 1; i <= 30; i++ {
+		_, err := session.Exec(fmt.Sprintf("INSERT INTO cars VALUES ('model%d', 'maker', 'type', 'fuel')", i))
+		require.Nil(t, err)
+	}
+	expected, err := session.Exec("SELECT cars.model FROM cars")
+	require.Nil(t, err)
+
+	// rows are written one by one after the header
+	output := &limitedWriter{}
+	require.Nil(t, session.ExecTo(output, "SELECT cars.model FROM cars"))
+	assert.Equal(t, expected, output.String())
+	assert.Equal(t, 31, output.writes)
+
+	_, err = session.Exec("PREPARE by_maker AS SELECT cars.model FROM cars WHERE cars.maker = $1")
+	require.Nil(t, err)
+	output = &limitedWriter{}
+	require.Nil(t, session.ExecTo(output, "EXECUTE by_maker('maker')"))
+	assert.Equal(t, expected, output.String())
+
+	// nothing is written if the query is invalid
+	output = &limitedWriter{}
+	assert.Error(t, session.ExecTo(output, "SELECT cars.color FROM cars"))
+	assert.Equal(t, 0, output.writes)
+
+	// reading stops when the output fails and tables are unlocked
+	output = &limitedWriter{limit: 3}
+	err = session.ExecTo(output, "SELECT cars.model FROM cars")
+	assert.EqualError(t, err, "error: connection closed")
+	assert.Equal(t, "cars.model\nmodel1\nmodel2\n", output.String())
+	_, err = session.Exec("INSERT INTO cars VALUES ('new', 'maker', 'type', 'fuel')")
+	require.Nil(t, err)
+}
@@ -135,6 +135,32 @@ func TestDeleteWhereHappyPath(t *testing.T) {
 	assert.Equal(t, 0, rowsCount)
 }
 
+func TestDeleteTruncatesSheets(t *testing.T) {
+	st := suite.New(t)
+	table := "cars"
+	tablepath := st.Storage.TablePathes.Get(table).(string)
+	FillTableCars(t, st.Storage, 45)
+
+	_, err := st.Storage.Exec("DELETE FROM cars")
+	require.Nil(t, err)
+
+	// only the empty first sheet is left, temporary files are renamed or removed
+	files, err := os.ReadDir(tablepath)
+	require.Nil(t, err)
+	names := make([]string, 0)
+	for _, file := range files {
+		names = append(names, file.Name())
+	}
+	assert.Equal(t, []string{"1.csv", "cars_meta.json", "cars_pk_sequence"}, names)
+	data, err := os.ReadFile(path.Join(tablepath, "1.csv"))
+	require.Nil(t, err)
+	assert.Equal(t, "cars_pk,model,maker,type,fueltype\n", string(data))
+
+	id, err := st.Storage.Exec("INSERT INTO cars VALUES ('model', 'maker', 'type', 'fuel')")
+	require.Nil(t, err)
+	assert.Equal(t, "1", id)
+}
+
 func TestBlock(t *testing.T) {
 	st := suite.New(t)
 	var wg sync.WaitGroup
@@ -35,7 +35,7 @@ func New(t *testing.T) *ApplicationSuite {
 	st := storage.New(cfg.StoragePath, cfg.LoadedSchema, discardLogger.Log)
 	st.Destroy()
 	st.Create()
-	application := app.New(discardLogger.Log, st, cfg.ConnTL, cfg.Port)
+	application := app.New(discardLogger.Log, st, cfg.ConnTL, cfg.WriteTL, cfg.Port)
 	return &ApplicationSuite{
 		T:       t,
 		Cfg:     cfg,
@@ -0,0 +1,114 @@
+package tests
+
+import (
+	"JacuteSQL/internal/config"
+	"JacuteSQL/internal/storage"
+	suite "JacuteSQL/tests/suite/storage"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/jacute/prettylogger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVacuum(t *testing.T) {
+	st := suite.New(t)
+
+	for i := 1; i <= 60; i++ {
+		_, err := st.Storage.Exec(fmt.Sprintf("INSERT INTO cars VALUES ('model%d', 'maker%d', 'type', 'fuel')", i, i%2))
+		require.Nil(t, err)
+	}
+	_, err := st.Storage.Exec("CREATE INDEX ON cars USING hash (maker)")
+	require.Nil(t, err)
+	_, err = st.Storage.Exec("DELETE FROM cars WHERE cars.cars_pk < 55 AND cars.model <> 'model7' AND cars.model <> 'model33'")
+	require.Nil(t, err)
+	tablePath := path.Join(st.Cfg.StoragePath, st.Cfg.LoadedSchema.Name, "cars")
+	assert.FileExists(t, path.Join(tablePath, "2.csv"))
+
+	output, err := st.Storage.Exec("VACUUM cars")
+	require.Nil(t, err)
+	assert.Equal(t, "table,rows,sheets_before,sheets_after\ncars,8,3,1\n", output)
+	assert.NoFileExists(t, path.Join(tablePath, "2.csv"))
+	assert.NoDirExists(t, tablePath+".vacuum")
+	assert.NoDirExists(t, tablePath+".old")
+
+	// rows keep pk order, the pk sequence and indexes
+	output, err = st.Storage.Exec("SELECT cars.cars_pk FROM cars")
+	require.Nil(t, err)
+	assert.Equal(t, "cars.cars_pk\n7\n33\n55\n56\n57\n58\n59\n60\n", output)
+	_, err = st.Storage.Exec("INSERT INTO cars VALUES ('new', 'maker1', 'type', 'fuel')")
+	require.Nil(t, err)
+	output, err = st.Storage.Exec("SELECT cars.cars_pk FROM cars WHERE cars.maker = 'maker1'")
+	require.Nil(t, err)
+	assert.Equal(t, "cars.cars_pk\n7\n33\n55\n57\n59\n61\n", output)
+
+	output, err = st.Storage.Exec("VACUUM")
+	require.Nil(t, err)
+	assert.Equal(t, "table,rows,sheets_before,sheets_after\nbeer,0,1,1\ncars,9,1,1\n", output)
+	_, err = st.Storage.Exec("VACUUM unknown")
+	assert.ErrorContains(t, err, "table unknown not found")
+
+	// pages of binary tables are packed too
+	_, err = st.Storage.Exec("ALTER TABLE cars SET ENGINE = binary")
+	require.Nil(t, err)
+	_, err = st.Storage.Exec("DELETE FROM cars WHERE cars.cars_pk > 50")
+	require.Nil(t, err)
+	output, err = st.Storage.Exec("VACUUM cars")
+	require.Nil(t, err)
+	assert.Equal(t, "table,rows,sheets_before,sheets_after\ncars,2,1,1\n", output)
+	output, err = st.Storage.Exec("SELECT cars.model FROM cars")
+	require.Nil(t, err)
+	assert.Equal(t, "cars.model\nmodel7\nmodel33\n", output)
+}
+
+func TestVacuumRecovery(t *testing.T) {
+	st := suite.New(t)
+
+	_, err := st.Storage.Exec("INSERT INTO cars VALUES ('model', 'maker', 'type', 'fuel')")
+	require.Nil(t, err)
+
+	// the table directory was moved away before the packed one replaced it
+	tablePath := path.Join(st.Cfg.StoragePath, st.Cfg.LoadedSchema.Name, "cars")
+	require.Nil(t, os.Rename(tablePath, tablePath+".old"))
+	require.Nil(t, os.Mkdir(tablePath+".vacuum", 0755))
+
+	cfg := config.MustLoadByPath("test_config.yaml")
+	restarted := storage.New(cfg.StoragePath, cfg.LoadedSchema, slog.New(prettylogger.NewDiscardHandler()))
+	restarted.Create()
+	output, err := restarted.Exec("SELECT cars.model FROM cars")
+	require.Nil(t, err)
+	assert.Equal(t, "cars.model\nmodel\n", output)
+	assert.NoDirExists(t, tablePath+".vacuum")
+	assert.NoDirExists(t, tablePath+".old")
+}
+
+func TestAutoVacuum(t *testing.T) {
+	st := suite.New(t)
+	st.Storage.Schema.Vacuum.Threshold = 0.5
+
+	for i := 1; i <= 60; i++ {
+		_, err := st.Storage.Exec(fmt.Sprintf("INSERT INTO cars VALUES ('model%d', 'maker', 'type', 'fuel')", i))
+		require.Nil(t, err)
+	}
+	// one sheet of three is freed, it's less than the threshold
+	_, err := st.Storage.Exec("DELETE FROM cars WHERE cars.cars_pk > 50")
+	require.Nil(t, err)
+	tablePath := path.Join(st.Cfg.StoragePath, st.Cfg.LoadedSchema.Name, "cars")
+	time.Sleep(100 * time.Millisecond)
+	assert.FileExists(t, path.Join(tablePath, "3.csv"))
+
+	_, err = st.Storage.Exec("DELETE FROM cars WHERE cars.cars_pk > 15")
+	require.Nil(t, err)
+	assert.Eventually(t, func() bool {
+		_, err := os.Stat(path.Join(tablePath, "2.csv"))
+		return os.IsNotExist(err)
+	}, 5*time.Second, 20*time.Millisecond)
+	output, err := st.Storage.Exec("VACUUM cars")
+	require.Nil(t, err)
+	assert.Equal(t, "table,rows,sheets_before,sheets_after\ncars,15,1,1\n", output)
+}
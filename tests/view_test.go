@@ -0,0 +1,156 @@
+package tests
+
+import (
+	"JacuteSQL/internal/config"
+	"JacuteSQL/internal/logger"
+	"JacuteSQL/internal/storage"
+	suite "JacuteSQL/tests/suite/storage"
+	"encoding/csv"
+	"log/slog"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/jacute/prettylogger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestViewHappyPath(t *testing.T) {
+	st := suite.New(t)
+
+	_, err := st.Storage.Exec("INSERT INTO beer VALUES ('Duvel', 'Ale', '8.5', '32', '17')")
+	require.Nil(t, err)
+	_, err = st.Storage.Exec("INSERT INTO beer VALUES ('Guinness', 'Stout', '4.2', '45', '10')")
+	require.Nil(t, err)
+	_, err = st.Storage.Exec("INSERT INTO cars VALUES ('Golf', 'Volkswagen', 'hatchback', 'petrol')")
+	require.Nil(t, err)
+
+	_, err = st.Storage.Exec("CREATE VIEW ales AS SELECT beer.name, beer.alcohol FROM beer WHERE beer.style = 'Ale'")
+	require.Nil(t, err)
+
+	output, err := st.Storage.Exec("SELECT ales.name, ales.alcohol FROM ales")
+	require.Nil(t, err)
+	assert.Equal(t, "ales.name,ales.alcohol\nDuvel,8.5\n", output)
+
+	// view in cross join with condition between tables
+	_, err = st.Storage.Exec("CREATE VIEW pairs (beer, car) AS SELECT beer.name, cars.model FROM beer, cars")
+	require.Nil(t, err)
+	output, err = st.Storage.Exec("SELECT pairs.car FROM pairs, ales WHERE pairs.beer = ales.name")
+	require.Nil(t, err)
+	assert.Equal(t, "pairs.car\nGolf\n", output)
+
+	_, err = st.Storage.Exec("CREATE VIEW ales AS SELECT beer.name FROM beer")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), storage.ErrViewExists.Error())
+	_, err = st.Storage.Exec("CREATE VIEW bad AS SELECT beer.name, beer.name FROM beer")
+	assert.Error(t, err)
+	_, err = st.Storage.Exec("CREATE VIEW bad AS SELECT beer.color FROM beer")
+	assert.Error(t, err)
+
+	output, err = st.Storage.Exec("SHOW VIEWS")
+	require.Nil(t, err)
+	assert.Contains(t, output, "ales,ok,\"CREATE VIEW ales (name, alcohol) AS")
+	assert.Contains(t, output, "pairs,ok,\"")
+	// each row has as many fields as the header
+	records, err := csv.NewReader(strings.NewReader(output)).ReadAll()
+	require.Nil(t, err)
+	assert.Len(t, records, 3)
+
+	output, err = st.Storage.Exec("DESCRIBE pairs")
+	require.Nil(t, err)
+	assert.Equal(t, "column\nbeer\ncar\n", output)
+
+	_, err = st.Storage.Exec("DROP VIEW ales")
+	require.Nil(t, err)
+	_, err = st.Storage.Exec("SELECT ales.name FROM ales")
+	assert.Error(t, err)
+	_, err = st.Storage.Exec("DROP VIEW IF EXISTS ales")
+	assert.Nil(t, err)
+}
+
+func TestViewMissingColumn(t *testing.T) {
+	st := suite.New(t)
+
+	_, err := st.Storage.Exec("CREATE VIEW strength AS SELECT beer.name, beer.alcohol FROM beer")
+	require.Nil(t, err)
+
+	// restart with schema where the column was dropped
+	cfg := config.MustLoadByPath("test_config.yaml")
+	cfg.LoadedSchema.Tables.Add("beer", []string{"name", "style"})
+	discardLogger := &logger.Logger{
+		Log: slog.New(prettylogger.NewDiscardHandler()),
+	}
+	restarted := storage.New(cfg.StoragePath, cfg.LoadedSchema, discardLogger.Log)
+	restarted.Create()
+
+	_, err = restarted.Exec("SELECT strength.name FROM strength")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "view strength references missing column beer.alcohol")
+
+	output, err := restarted.Exec("SHOW VIEWS")
+	require.Nil(t, err)
+	assert.True(t, strings.HasPrefix(output, "view,status,definition\nstrength,view strength references missing column"))
+}
+
+func TestMaterializedViewRefresh(t *testing.T) {
+	st := suite.New(t)
+
+	_, err := st.Storage.Exec("INSERT INTO beer VALUES ('Duvel', 'Ale', '8.5', '32', '17')")
+	require.Nil(t, err)
+	_, err = st.Storage.Exec("INSERT INTO beer VALUES ('Leffe', 'Ale', '6.6', '20', '15')")
+	require.Nil(t, err)
+	_, err = st.Storage.Exec("INSERT INTO beer VALUES ('Guinness', 'Stout', '4.2', '45', '10')")
+	require.Nil(t, err)
+
+	_, err = st.Storage.Exec("CREATE MATERIALIZED VIEW styles (style, beers, ibu) AS SELECT beer.style, COUNT(*), SUM(beer.ibu) FROM beer GROUP BY beer.style")
+	require.Nil(t, err)
+
+	viewPath := path.Join(st.Cfg.StoragePath, st.Cfg.LoadedSchema.Name, "styles")
+	assert.FileExists(t, path.Join(viewPath, "1.csv"))
+
+	output, err := st.Storage.Exec("SELECT styles.style, styles.beers, styles.ibu FROM styles")
+	require.Nil(t, err)
+	assert.Equal(t, "styles.style,styles.beers,styles.ibu\nAle,2,52\nStout,1,45\n", output)
+
+	// materialized view isn't changed until refresh
+	_, err = st.Storage.Exec("INSERT INTO beer VALUES ('Porter', 'Stout', '5.0', '30', '12')")
+	require.Nil(t, err)
+	output, err = st.Storage.Exec("SELECT styles.beers FROM styles WHERE styles.style = 'Stout'")
+	require.Nil(t, err)
+	assert.Equal(t, "styles.beers\n1\n", output)
+
+	_, err = st.Storage.Exec("REFRESH MATERIALIZED VIEW styles")
+	require.Nil(t, err)
+	output, err = st.Storage.Exec("SELECT styles.beers, styles.ibu FROM styles WHERE styles.style = 'Stout'")
+	require.Nil(t, err)
+	assert.Equal(t, "styles.beers,styles.ibu\n2,75\n", output)
+
+	_, err = st.Storage.Exec("DROP VIEW styles")
+	assert.Error(t, err)
+	_, err = st.Storage.Exec("DROP MATERIALIZED VIEW styles")
+	require.Nil(t, err)
+	assert.NoDirExists(t, viewPath)
+}
+
+func TestSelectAggregate(t *testing.T) {
+	st := suite.New(t)
+
+	_, err := st.Storage.Exec("INSERT INTO beer VALUES ('Duvel', 'Ale', '8.5', '32', '17')")
+	require.Nil(t, err)
+	_, err = st.Storage.Exec("INSERT INTO beer VALUES ('Leffe', 'Ale', '6.5', '20', '15')")
+	require.Nil(t, err)
+
+	output, err := st.Storage.Exec("SELECT COUNT(*), SUM(beer.alcohol), AVG(beer.ibu), MIN(beer.name), MAX(beer.blg) FROM beer")
+	require.Nil(t, err)
+	assert.Equal(t, "COUNT(*),SUM(beer.alcohol),AVG(beer.ibu),MIN(beer.name),MAX(beer.blg)\n2,15,26,Duvel,17\n", output)
+
+	output, err = st.Storage.Exec("SELECT COUNT(*) FROM beer WHERE beer.style = 'Stout'")
+	require.Nil(t, err)
+	assert.Equal(t, "COUNT(*)\n0\n", output)
+
+	_, err = st.Storage.Exec("SELECT beer.name, COUNT(*) FROM beer")
+	assert.Error(t, err)
+	_, err = st.Storage.Exec("SELECT SUM(beer.name) FROM beer")
+	assert.Error(t, err)
+}
@@ -0,0 +1,140 @@
+package tests
+
+import (
+	"JacuteSQL/internal/config"
+	"JacuteSQL/internal/logger"
+	"JacuteSQL/internal/storage"
+	suite "JacuteSQL/tests/suite/storage"
+	"fmt"
+	"hash/crc32"
+	"log/slog"
+	"os"
+	"path"
+	"strconv"
+	"testing"
+
+	"github.com/jacute/prettylogger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func walLine(data string) string {
+	return strconv.FormatUint(uint64(crc32.ChecksumIEEE([]byte(data))), 16) + " " + data + "\n"
+}
+
+func TestWALReplay(t *testing.T) {
+	st := suite.New(t)
+
+	for i := 1; i <= 3; i++ {
+		_, err := st.Storage.Exec(fmt.Sprintf("INSERT INTO cars VALUES ('model%d', 'maker', 'type', 'fuel')", i))
+		require.Nil(t, err)
+	}
+
+	// the server was killed after changes were logged but before sheets were written
+	walPath := path.Join(st.Cfg.StoragePath, st.Cfg.LoadedSchema.Name, "wal.log")
+	wal := walLine(`{"lsn":1,"ops":[{"type":"insert","table":"cars","rows":[["4","model4","maker","type","fuel"]]}]}`) +
+		walLine(`{"lsn":2,"ops":[{"type":"delete","table":"cars","pks":["1"]},{"type":"update","table":"cars","rows":[["2","model2","other","type","fuel"]]}]}`) +
+		// the last entry wasn't written completely
+		`12345 {"lsn":3,"ops":[{"type":"truncate","table":"cars"}`
+	require.Nil(t, os.WriteFile(walPath, []byte(wal), 0644))
+
+	cfg := config.MustLoadByPath("test_config.yaml")
+	discardLogger := &logger.Logger{
+		Log: slog.New(prettylogger.NewDiscardHandler()),
+	}
+	restarted := storage.New(cfg.StoragePath, cfg.LoadedSchema, discardLogger.Log)
+	restarted.Create()
+
+	output, err := restarted.Exec("SELECT cars.cars_pk, cars.model, cars.maker FROM cars")
+	require.Nil(t, err)
+	assert.Equal(t, "cars.cars_pk,cars.model,cars.maker\n2,model2,other\n3,model3,maker\n4,model4,maker\n", output)
+
+	// the log is truncated after replay and the pk sequence continues after replayed rows
+	info, err := os.Stat(walPath)
+	require.Nil(t, err)
+	assert.Equal(t, int64(0), info.Size())
+	id, err := restarted.Exec("INSERT INTO cars VALUES ('model5', 'maker', 'type', 'fuel')")
+	require.Nil(t, err)
+	assert.Equal(t, "5", id)
+
+	// replay of applied changes doesn't change the table
+	require.Nil(t, os.WriteFile(walPath, []byte(wal), 0644))
+	cfg = config.MustLoadByPath("test_config.yaml")
+	again := storage.New(cfg.StoragePath, cfg.LoadedSchema, discardLogger.Log)
+	again.Create()
+	output, err = again.Exec("SELECT cars.cars_pk FROM cars")
+	require.Nil(t, err)
+	assert.Equal(t, "cars.cars_pk\n2\n3\n4\n5\n", output)
+
+	// pks of rows are read once, deleted and truncated rows are inserted by later entries again
+	wal = walLine(`{"lsn":1,"ops":[{"type":"insert","table":"cars","rows":[["6","model6","maker","type","fuel"],["7","model7","maker","type","fuel"]]}]}`) +
+		walLine(`{"lsn":2,"ops":[{"type":"delete","table":"cars","pks":["6"]}]}`) +
+		walLine(`{"lsn":3,"ops":[{"type":"insert","table":"cars","rows":[["6","model6","again","type","fuel"]]}]}`) +
+		walLine(`{"lsn":4,"ops":[{"type":"truncate","table":"cars"}]}`) +
+		walLine(`{"lsn":5,"ops":[{"type":"insert","table":"cars","rows":[["2","model2","last","type","fuel"],["2","model2","last","type","fuel"]]}]}`)
+	require.Nil(t, os.WriteFile(walPath, []byte(wal), 0644))
+	cfg = config.MustLoadByPath("test_config.yaml")
+	again = storage.New(cfg.StoragePath, cfg.LoadedSchema, discardLogger.Log)
+	again.Create()
+	output, err = again.Exec("SELECT cars.cars_pk, cars.maker FROM cars")
+	require.Nil(t, err)
+	assert.Equal(t, "cars.cars_pk,cars.maker\n2,last\n", output)
+}
+
+func TestWALLogsStatements(t *testing.T) {
+	st := suite.New(t)
+
+	walPath := path.Join(st.Cfg.StoragePath, st.Cfg.LoadedSchema.Name, "wal.log")
+	_, err := st.Storage.Exec("INSERT INTO cars VALUES ('model1', 'maker', 'type', 'fuel')")
+	require.Nil(t, err)
+	_, err = st.Storage.Exec("UPDATE cars SET maker = 'other'")
+	require.Nil(t, err)
+	_, err = st.Storage.Exec("DELETE FROM cars WHERE cars.model = 'model1'")
+	require.Nil(t, err)
+
+	data, err := os.ReadFile(walPath)
+	require.Nil(t, err)
+	assert.Equal(t,
+		walLine(`{"lsn":1,"ops":[{"type":"insert","table":"cars","rows":[["1","model1","maker","type","fuel"]]}]}`)+
+			walLine(`{"lsn":2,"ops":[{"type":"update","table":"cars","rows":[["1","model1","other","type","fuel"]]}]}`)+
+			walLine(`{"lsn":3,"ops":[{"type":"delete","table":"cars","pks":["1"]}]}`),
+		string(data),
+	)
+}
+
+func TestWALUnsavedCatalog(t *testing.T) {
+	st := suite.New(t)
+
+	for i := 1; i <= 25; i++ {
+		_, err := st.Storage.Exec(fmt.Sprintf("INSERT INTO cars VALUES ('model%d', 'maker', 'type', 'fuel')", i))
+		require.Nil(t, err)
+	}
+	tablePath := path.Join(st.Cfg.StoragePath, st.Cfg.LoadedSchema.Name, "cars")
+	saved := make(map[string][]byte)
+	for _, file := range []string{"cars_meta.json", "cars_pk_sequence"} {
+		data, err := os.ReadFile(path.Join(tablePath, file))
+		require.Nil(t, err)
+		saved[file] = data
+	}
+	_, err := st.Storage.Exec("INSERT INTO cars VALUES ('model26', 'maker', 'type', 'fuel')")
+	require.Nil(t, err)
+	_, err = st.Storage.Exec("DELETE FROM cars WHERE cars.model = 'model2'")
+	require.Nil(t, err)
+
+	// the server stopped after rows are written and before the catalog is saved
+	for file, data := range saved {
+		require.Nil(t, os.WriteFile(path.Join(tablePath, file), data, 0644))
+	}
+	cfg := config.MustLoadByPath("test_config.yaml")
+	restarted := storage.New(cfg.StoragePath, cfg.LoadedSchema, slog.New(prettylogger.NewDiscardHandler()))
+	restarted.Create()
+	problems, err := restarted.Inspect(false)
+	require.Nil(t, err)
+	assert.Empty(t, problems)
+	output, err := restarted.Exec("SELECT cars.cars_pk FROM cars WHERE cars.cars_pk > 24")
+	require.Nil(t, err)
+	assert.Equal(t, "cars.cars_pk\n25\n26\n", output)
+	id, err := restarted.Exec("INSERT INTO cars VALUES ('model27', 'maker', 'type', 'fuel')")
+	require.Nil(t, err)
+	assert.Equal(t, "27", id)
+}